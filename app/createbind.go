@@ -6,6 +6,7 @@ import (
 	"github.com/martini-contrib/render"
 	"github.com/nu7hatch/gouuid"
 	"net/http"
+	service "region-api/service"
 	structs "region-api/structs"
 	utils "region-api/utils"
 )
@@ -32,7 +33,18 @@ func Createbind(db *sql.DB, spec structs.Bindspec, berr binding.Errors, r render
 		utils.ReportInvalidRequest("Bind Name can not be blank", r)
 		return
 	}
-	_, inserterr := db.Exec("INSERT INTO appbindings(appname,space,bindtype,bindname) VALUES($1,$2,$3,$4)", spec.App, spec.Space, spec.Bindtype, spec.Bindname)
+	role, err := service.AuthorizeInstanceBinding(db, spec.Bindname, spec.Space, spec.Role)
+	if err == service.ErrInvalidRole {
+		utils.ReportInvalidRequest(err.Error(), r)
+		return
+	} else if err == service.ErrInstanceNotShared || err == service.ErrReadOnlyShare {
+		r.JSON(http.StatusForbidden, structs.Messagespec{Status: http.StatusForbidden, Message: err.Error()})
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	_, inserterr := db.Exec("INSERT INTO appbindings(appname,space,bindtype,bindname,role) VALUES($1,$2,$3,$4,$5)", spec.App, spec.Space, spec.Bindtype, spec.Bindname, sql.NullString{String: role, Valid: role != ""})
 	if inserterr != nil {
 		utils.ReportError(inserterr, r)
 		return
@@ -0,0 +1,318 @@
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	runtime "region-api/runtime"
+	service "region-api/service"
+	structs "region-api/structs"
+	utils "region-api/utils"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+const (
+	RotationInProgress = "in progress"
+	RotationSucceeded  = "succeeded"
+	RotationFailed     = "failed"
+
+	defaultRotationTimeout = 10 * time.Minute
+	minimumRotationEvery   = time.Hour
+)
+
+// How long a rotation waits for the app to roll out with its new credentials, set with BINDING_ROTATION_TIMEOUT.
+func rotationTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(os.Getenv("BINDING_ROTATION_TIMEOUT")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultRotationTimeout
+}
+
+// Rotations still in progress after this long were interrupted (e.g. by a restart), besides the rollout a rotation
+// waits on the broker for the new binding so twice the rollout timeout is allowed.
+func rotationExpiry() time.Duration {
+	return 2 * rotationTimeout()
+}
+
+// The config vars to set and remove to move an app from one set of service config vars to another.
+func rotatedConfigVars(before []structs.EnvVar, after []structs.EnvVar) (set []structs.EnvVar, remove []string) {
+	for _, b := range before {
+		found := false
+		for _, a := range after {
+			if a.Name == b.Name {
+				found = true
+			}
+		}
+		if !found {
+			remove = append(remove, b.Name)
+		}
+	}
+	return after, remove
+}
+
+func waitForRollout(rt runtime.Runtime, space string, app string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		// give the deployment a moment to pick up the change before checking it.
+		time.Sleep(10 * time.Second)
+		done, err := rt.DeploymentRolledOut(space, app)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s-%s did not become healthy with its new credentials within %s", app, space, timeout)
+		}
+	}
+}
+
+// Issues new credentials, rolls the app out with them and then retires the old credentials. If the app does not
+// become healthy it is returned to its old credentials where the broker kept them.
+func rotateBindingCredentials(db *sql.DB, bind structs.Bindspec) error {
+	rt, err := runtime.GetRuntimeFor(db, bind.Space)
+	if err != nil {
+		return err
+	}
+	err, before := service.GetServiceConfigVars(db, bind.App, bind.Space, []structs.Bindspec{bind})
+	if err != nil {
+		return err
+	}
+	rotation, err := service.StartCredentialRotation(db, bind)
+	if err != nil {
+		return err
+	}
+	err, after := service.GetServiceConfigVars(db, bind.App, bind.Space, []structs.Bindspec{bind})
+	if err != nil {
+		if aerr := rotation.Abandon(); aerr != nil {
+			log.Printf("WARNING: Unable to abandon the rotation of %s:%s for %s-%s: %s\n", bind.Bindtype, bind.Bindname, bind.App, bind.Space, aerr.Error())
+		}
+		return err
+	}
+	deployed, err := rt.DeploymentExists(bind.Space, bind.App)
+	if err != nil {
+		return err
+	}
+	if deployed {
+		set, remove := rotatedConfigVars(before, after)
+		if err = rt.UpdateConfigVars(bind.Space, bind.App, set, remove); err == nil {
+			err = waitForRollout(rt, bind.Space, bind.App, rotationTimeout())
+		}
+		if err != nil {
+			// the old credentials no longer work once the broker has replaced them, the app keeps the new ones.
+			if !rotation.Reversible() {
+				return err
+			}
+			set, remove = rotatedConfigVars(after, before)
+			if rerr := rt.UpdateConfigVars(bind.Space, bind.App, set, remove); rerr != nil {
+				log.Printf("WARNING: Unable to restore the config vars of %s-%s: %s\n", bind.App, bind.Space, rerr.Error())
+			}
+			if aerr := rotation.Abandon(); aerr != nil {
+				log.Printf("WARNING: Unable to abandon the rotation of %s:%s for %s-%s: %s\n", bind.Bindtype, bind.Bindname, bind.App, bind.Space, aerr.Error())
+			}
+			return err
+		}
+	}
+	return rotation.Finish()
+}
+
+func rotateBinding(db *sql.DB, bind structs.Bindspec, rotationId string) {
+	status := RotationSucceeded
+	message := ""
+	if err := rotateBindingCredentials(db, bind); err != nil {
+		log.Printf("ERROR: Unable to rotate the credentials of %s:%s for %s-%s: %s\n", bind.Bindtype, bind.Bindname, bind.App, bind.Space, err.Error())
+		status = RotationFailed
+		message = err.Error()
+	}
+	if _, err := db.Exec("update binding_rotations set status=$2, message=$3, finished=now() where rotation_id=$1", rotationId, status, message); err != nil {
+		log.Printf("ERROR: Unable to record the rotation %s: %s\n", rotationId, err.Error())
+	}
+}
+
+// Records and starts a rotation, nil is returned if a rotation of the binding is already in progress. The
+// binding_rotations_in_progress_key index allows only one rotation in progress per binding.
+func startRotation(db *sql.DB, bind structs.Bindspec) (*structs.BindingRotation, error) {
+	if _, err := db.Exec("update binding_rotations set status=$5, message=$6, finished=now() where appname=$1 and space=$2 and bindtype=$3 and bindname=$4 and status=$7 and started < $8",
+		bind.App, bind.Space, bind.Bindtype, bind.Bindname, RotationFailed, "The rotation did not finish within "+rotationExpiry().String()+".", RotationInProgress, time.Now().Add(-rotationExpiry())); err != nil {
+		return nil, err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	rotation := structs.BindingRotation{Id: id.String(), App: bind.App, Space: bind.Space, Bindtype: bind.Bindtype, Bindname: bind.Bindname, Status: RotationInProgress}
+	err = db.QueryRow("insert into binding_rotations (rotation_id, appname, space, bindtype, bindname, status) values ($1, $2, $3, $4, $5, $6) on conflict (appname, space, bindtype, bindname) where status='in progress' do nothing returning started",
+		rotation.Id, bind.App, bind.Space, bind.Bindtype, bind.Bindname, rotation.Status).Scan(&rotation.Started)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	go rotateBinding(db, bind, rotation.Id)
+	return &rotation, nil
+}
+
+func getBinding(db *sql.DB, params martini.Params) (*structs.Bindspec, error) {
+	var role sql.NullString
+	bind := structs.Bindspec{App: params["appname"], Space: params["space"], Bindtype: params["bindtype"], Bindname: params["bindname"]}
+	if err := db.QueryRow("select role from appbindings where appname=$1 and space=$2 and bindtype=$3 and bindname=$4", bind.App, bind.Space, bind.Bindtype, bind.Bindname).Scan(&role); err != nil {
+		return nil, err
+	}
+	bind.Role = role.String
+	return &bind, nil
+}
+
+func RotateBinding(db *sql.DB, params martini.Params, r render.Render) {
+	bind, err := getBinding(db, params)
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if !service.CanRotateCredentials(bind.Bindtype) {
+		utils.ReportInvalidRequest(service.ErrRotationNotSupported.Error(), r)
+		return
+	}
+	rotation, err := startRotation(db, *bind)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if rotation == nil {
+		r.JSON(http.StatusConflict, structs.Messagespec{Status: http.StatusConflict, Message: "The credentials of " + bind.Bindtype + ":" + bind.Bindname + " are already being rotated."})
+		return
+	}
+	r.JSON(http.StatusAccepted, rotation)
+}
+
+func GetBindingRotations(db *sql.DB, params martini.Params, r render.Render) {
+	bind, err := getBinding(db, params)
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	rows, err := db.Query("select rotation_id, status, coalesce(message, ''), started, finished from binding_rotations where appname=$1 and space=$2 and bindtype=$3 and bindname=$4 order by started desc", bind.App, bind.Space, bind.Bindtype, bind.Bindname)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	defer rows.Close()
+	rotations := []structs.BindingRotation{}
+	for rows.Next() {
+		rotation := structs.BindingRotation{App: bind.App, Space: bind.Space, Bindtype: bind.Bindtype, Bindname: bind.Bindname}
+		if err = rows.Scan(&rotation.Id, &rotation.Status, &rotation.Message, &rotation.Started, &rotation.Finished); err != nil {
+			utils.ReportError(err, r)
+			return
+		}
+		rotations = append(rotations, rotation)
+	}
+	r.JSON(http.StatusOK, rotations)
+}
+
+func GetBindingRotationSchedule(db *sql.DB, params martini.Params, r render.Render) {
+	var schedule structs.BindingRotationSchedule
+	var every sql.NullString
+	err := db.QueryRow("select rotate_every, next_rotation from appbindings where appname=$1 and space=$2 and bindtype=$3 and bindname=$4", params["appname"], params["space"], params["bindtype"], params["bindname"]).Scan(&every, &schedule.NextRotation)
+	if err == sql.ErrNoRows || (err == nil && every.String == "") {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	schedule.Every = every.String
+	r.JSON(http.StatusOK, schedule)
+}
+
+func SetBindingRotationSchedule(db *sql.DB, params martini.Params, spec structs.BindingRotationSchedule, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	every, err := time.ParseDuration(spec.Every)
+	if err != nil || every < minimumRotationEvery {
+		utils.ReportInvalidRequest("Every must be a duration of at least "+minimumRotationEvery.String()+", e.g. 720h", r)
+		return
+	}
+	bind, err := getBinding(db, params)
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if !service.CanRotateCredentials(bind.Bindtype) {
+		utils.ReportInvalidRequest(service.ErrRotationNotSupported.Error(), r)
+		return
+	}
+	next := time.Now().Add(every)
+	if _, err = db.Exec("update appbindings set rotate_every=$5, next_rotation=$6 where appname=$1 and space=$2 and bindtype=$3 and bindname=$4", bind.App, bind.Space, bind.Bindtype, bind.Bindname, spec.Every, next); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, structs.BindingRotationSchedule{Every: spec.Every, NextRotation: &next})
+}
+
+func DeleteBindingRotationSchedule(db *sql.DB, params martini.Params, r render.Render) {
+	res, err := db.Exec("update appbindings set rotate_every=null, next_rotation=null where appname=$1 and space=$2 and bindtype=$3 and bindname=$4", params["appname"], params["space"], params["bindtype"], params["bindname"])
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		utils.ReportNotFoundError(r)
+		return
+	}
+	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Rotation schedule removed"})
+}
+
+// Starts the rotations that are due, run periodically.
+func RotateScheduledBindings(db *sql.DB) {
+	rows, err := db.Query("select appname, space, bindtype, bindname, coalesce(role, ''), rotate_every from appbindings where rotate_every is not null and next_rotation <= now()")
+	if err != nil {
+		log.Printf("ERROR: Unable to get the bindings due for rotation: %s\n", err.Error())
+		return
+	}
+	due := make([]structs.Bindspec, 0)
+	everys := make([]string, 0)
+	for rows.Next() {
+		var bind structs.Bindspec
+		var every string
+		if err = rows.Scan(&bind.App, &bind.Space, &bind.Bindtype, &bind.Bindname, &bind.Role, &every); err != nil {
+			log.Printf("ERROR: Unable to read a binding due for rotation: %s\n", err.Error())
+			rows.Close()
+			return
+		}
+		due = append(due, bind)
+		everys = append(everys, every)
+	}
+	rows.Close()
+	for i, bind := range due {
+		every, err := time.ParseDuration(everys[i])
+		if err != nil || every < minimumRotationEvery {
+			every = minimumRotationEvery
+		}
+		// a failed rotation is tried again at the next interval rather than immediately.
+		if _, err = db.Exec("update appbindings set next_rotation=$5 where appname=$1 and space=$2 and bindtype=$3 and bindname=$4", bind.App, bind.Space, bind.Bindtype, bind.Bindname, time.Now().Add(every)); err != nil {
+			log.Printf("ERROR: Unable to schedule the next rotation of %s:%s for %s-%s: %s\n", bind.Bindtype, bind.Bindname, bind.App, bind.Space, err.Error())
+			continue
+		}
+		if _, err = startRotation(db, bind); err != nil {
+			log.Printf("ERROR: Unable to rotate the credentials of %s:%s for %s-%s: %s\n", bind.Bindtype, bind.Bindname, bind.App, bind.Space, err.Error())
+		}
+	}
+}
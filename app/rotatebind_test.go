@@ -0,0 +1,37 @@
+package app
+
+import (
+	"os"
+	"region-api/structs"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBindingRotation(t *testing.T) {
+	Convey("Test rotating the credentials of a binding", t, func() {
+		Convey("Config vars from the old credentials should be replaced or removed", func() {
+			before := []structs.EnvVar{{Name: "DATABASE_URL", Value: "postgres://old"}, {Name: "DATABASE_READONLY_URL", Value: "postgres://old-ro"}}
+			after := []structs.EnvVar{{Name: "DATABASE_URL", Value: "postgres://new"}}
+			set, remove := rotatedConfigVars(before, after)
+			So(set, ShouldResemble, after)
+			So(remove, ShouldResemble, []string{"DATABASE_READONLY_URL"})
+			set, remove = rotatedConfigVars(after, before)
+			So(set, ShouldResemble, before)
+			So(remove, ShouldBeEmpty)
+		})
+
+		Convey("The rollout timeout should default when not set or invalid", func() {
+			timeout := os.Getenv("BINDING_ROTATION_TIMEOUT")
+			defer os.Setenv("BINDING_ROTATION_TIMEOUT", timeout)
+			os.Setenv("BINDING_ROTATION_TIMEOUT", "")
+			So(rotationTimeout(), ShouldEqual, defaultRotationTimeout)
+			os.Setenv("BINDING_ROTATION_TIMEOUT", "-1m")
+			So(rotationTimeout(), ShouldEqual, defaultRotationTimeout)
+			os.Setenv("BINDING_ROTATION_TIMEOUT", "30m")
+			So(rotationTimeout(), ShouldEqual, 30*time.Minute)
+			So(rotationExpiry(), ShouldEqual, 60*time.Minute)
+		})
+	})
+}
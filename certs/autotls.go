@@ -0,0 +1,45 @@
+package certs
+
+import (
+	"database/sql"
+	"region-api/router"
+)
+
+// Orders certificates for routers created with auto_tls from the default issuer.
+type AutoTLS struct{}
+
+func (provisioner AutoTLS) OrderCertificate(db *sql.DB, domain string) (string, error) {
+	issuerName, requestedIssuer := defaultIssuer("")
+	issuer, err := GetIssuer(db, issuerName)
+	if err != nil {
+		return "", err
+	}
+	return issuer.CreateOrder(domain, []string{}, "Ordered automatically for the router "+domain, "region-api", requestedIssuer)
+}
+
+func (provisioner AutoTLS) CheckCertificateOrder(db *sql.DB, id string) (string, error) {
+	issuer, err := GetIssuerForOrder(db, id)
+	if err != nil {
+		return "", err
+	}
+	order, err := issuer.GetOrderStatus(id)
+	if err == ErrOrderNotFound {
+		return router.CertificateFailed, nil
+	} else if err != nil {
+		return "", err
+	}
+	if order.Status == "rejected" || order.Status == "revoked" {
+		return router.CertificateFailed, nil
+	}
+	ready, err := issuer.IsOrderReady(id)
+	if err != nil {
+		return "", err
+	}
+	if !ready {
+		return router.CertificatePending, nil
+	}
+	if err = installOrder(db, issuer, order); err != nil {
+		return "", err
+	}
+	return router.CertificateIssued, nil
+}
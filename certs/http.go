@@ -12,21 +12,57 @@ import (
 	"os"
 )
 
+// Returns the issuer to order from and the issuer on the order, the requested issuer is one of
+// cert-manager's cluster issuers unless it's our own acme issuer.
+func defaultIssuer(requested string) (string, string) {
+	if requested == "" && os.Getenv("DEFAULT_ISSUER") != "" {
+		requested = os.Getenv("DEFAULT_ISSUER")
+	} else if requested == "" && os.Getenv("DEFAULT_ISSUER") == "" {
+		requested = "letsencrypt"
+	}
+	if requested == "acme" {
+		return "acme", requested
+	}
+	return "cert-manager", requested
+}
+
+// Installs an issued certificate on the site ingresses, unless the issuer already has.
+func installOrder(db *sql.DB, issuer Issuer, order *CertificateOrder) error {
+	for _, internal := range []bool{false, true} {
+		ingress, err := router.GetSiteIngress(db, internal)
+		if err != nil {
+			return err
+		}
+		auto, err := issuer.IsOrderAutoInstalled(ingress)
+		if err != nil {
+			return err
+		}
+		if auto {
+			continue
+		}
+		pem_cert, pem_key, err := issuer.GetCertificate(order.Id, order.CommonName)
+		if err != nil {
+			return err
+		}
+		if err = ingress.InstallCertificate(order.CommonName, pem_cert, pem_key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func HttpCreateCertificateOrder(db *sql.DB, request CertificateOrder, berr binding.Errors, r render.Render) {
 	if berr != nil {
 		utils.ReportInvalidRequest(berr[0].Message, r)
 		return
 	}
-	issuer, err := GetIssuer(db, "cert-manager") // we only support cert-manager as an issuer system at the moment.
+	issuerName, requestedIssuer := defaultIssuer(request.Issuer)
+	request.Issuer = requestedIssuer
+	issuer, err := GetIssuer(db, issuerName)
 	if err != nil {
 		utils.ReportError(err, r)
 		return
 	}
-	if request.Issuer == "" && os.Getenv("DEFAULT_ISSUER") != "" {
-		request.Issuer = os.Getenv("DEFAULT_ISSUER")
-	} else if request.Issuer == "" && os.Getenv("DEFAULT_ISSUER") == "" {
-		request.Issuer = "letsencrypt"
-	}
 	id, err := issuer.CreateOrder(request.CommonName, request.SubjectAlternativeNames, request.Comment, request.Requestor, request.Issuer)
 	if err != nil {
 		utils.ReportError(err, r)
@@ -37,35 +73,39 @@ func HttpCreateCertificateOrder(db *sql.DB, request CertificateOrder, berr bindi
 }
 
 func HttpGetCertificateOrderStatus(db *sql.DB, params martini.Params, r render.Render) {
-	issuer, err := GetIssuer(db, "cert-manager") // we only support cert-manager as an issuer system at the moment.
+	issuer, err := GetIssuerForOrder(db, params["id"])
 	if err != nil {
 		utils.ReportError(err, r)
 		return
 	}
 	order, err := issuer.GetOrderStatus(params["id"])
 	if err != nil {
-		utils.ReportError(err, r)
+		reportOrderError(err, r)
 		return
 	}
 	r.JSON(http.StatusOK, order)
 }
 
 func HttpGetCertificateOrders(db *sql.DB, params martini.Params, r render.Render) {
-	issuer, err := GetIssuer(db, "cert-manager") // we only support cert-manager as an issuer system at the moment.
+	issuers, err := GetIssuers(db)
 	if err != nil {
 		utils.ReportError(err, r)
 		return
 	}
-	orders, err := issuer.GetOrders()
-	if err != nil {
-		utils.ReportError(err, r)
-		return
+	orders := make([]CertificateOrder, 0)
+	for _, issuer := range issuers {
+		o, err := issuer.GetOrders()
+		if err != nil {
+			utils.ReportError(err, r)
+			return
+		}
+		orders = append(orders, o...)
 	}
 	r.JSON(http.StatusOK, orders)
 }
 
 func HttpInstallCertificate(db *sql.DB, params martini.Params, r render.Render) {
-	issuer, err := GetIssuer(db, "cert-manager") // we only support cert-manager as an issuer system at the moment.
+	issuer, err := GetIssuerForOrder(db, params["id"])
 	if err != nil {
 		utils.ReportError(err, r)
 		return
@@ -84,44 +124,129 @@ func HttpInstallCertificate(db *sql.DB, params martini.Params, r render.Render)
 		utils.ReportError(err, r)
 		return
 	}
-	private, err := router.GetSiteIngress(db, false)
-	if err != nil {
+	if err = installOrder(db, issuer, order); err != nil {
 		utils.ReportError(err, r)
 		return
 	}
-	public, err := router.GetSiteIngress(db, true)
-	if err != nil {
+	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Certificate Installed"})
+}
+
+type RevokeRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// The CRL reason codes (RFC 5280) that may be given when revoking a certificate.
+var revocationReasons = map[string]int{
+	"":                     0,
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+}
+
+func reportOrderError(err error, r render.Render) {
+	switch err {
+	case ErrOrderNotFound:
+		utils.ReportNotFoundError(r)
+	case ErrOrderPending, ErrOrderNotIssued:
+		r.JSON(http.StatusConflict, structs.Messagespec{Status: http.StatusConflict, Message: err.Error()})
+	case ErrRevokeNotSupported:
+		r.JSON(http.StatusUnprocessableEntity, structs.Messagespec{Status: http.StatusUnprocessableEntity, Message: err.Error()})
+	default:
 		utils.ReportError(err, r)
-		return
 	}
+}
 
-	// Get Certificate
-	pem_cert, pem_key, err := issuer.GetCertificate(params["id"], order.CommonName)
-	auto, err := issuer.IsOrderAutoInstalled(private)
+// Deletes the order (cancelling it if it's pending), if the certificate was issued it's
+// removed from the ingresses and the sites using it fall back to another certificate.
+func HttpDeleteCertificateOrder(db *sql.DB, params martini.Params, r render.Render) {
+	issuer, err := GetIssuerForOrder(db, params["id"])
 	if err != nil {
 		utils.ReportError(err, r)
 		return
 	}
-	if !auto {
-		err = private.InstallCertificate(order.CommonName, pem_cert, pem_key)
-		if err != nil {
+	order, err := issuer.GetOrderStatus(params["id"])
+	if err != nil {
+		reportOrderError(err, r)
+		return
+	}
+	// the certificate is uninstalled first so the order remains to retry if it cannot be removed.
+	if order.Status == "issued" {
+		if err = router.UninstallCertificate(db, order.CommonName); err != nil {
 			utils.ReportError(err, r)
 			return
 		}
 	}
-	auto, err = issuer.IsOrderAutoInstalled(public)
+	if err = issuer.DeleteOrder(params["id"]); err != nil {
+		reportOrderError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Certificate Order Deleted"})
+}
+
+func HttpReissueCertificateOrder(db *sql.DB, params martini.Params, r render.Render) {
+	issuer, err := GetIssuerForOrder(db, params["id"])
 	if err != nil {
 		utils.ReportError(err, r)
 		return
 	}
-	if !auto {
-		err = public.InstallCertificate(order.CommonName, pem_cert, []byte(pem_key))
-		if err != nil {
-			utils.ReportError(err, r)
+	if err = issuer.ReissueOrder(params["id"]); err != nil {
+		reportOrderError(err, r)
+		return
+	}
+	order, err := issuer.GetOrderStatus(params["id"])
+	if err != nil {
+		reportOrderError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, order)
+}
+
+func HttpRevokeCertificateOrder(db *sql.DB, params martini.Params, request RevokeRequest, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	reason, ok := revocationReasons[request.Reason]
+	if !ok {
+		utils.ReportInvalidRequest("The reason must be one of unspecified, keyCompromise, affiliationChanged, superseded or cessationOfOperation.", r)
+		return
+	}
+	issuer, err := GetIssuerForOrder(db, params["id"])
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	order, err := issuer.GetOrderStatus(params["id"])
+	if err != nil {
+		reportOrderError(err, r)
+		return
+	}
+	if err = issuer.RevokeOrder(params["id"], reason); err != nil {
+		reportOrderError(err, r)
+		return
+	}
+	if err = router.UninstallCertificate(db, order.CommonName); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Certificate Revoked"})
+}
+
+// Serves the key authorization for pending http-01 challenges, while an acme order is pending
+// the ingress routes /.well-known/acme-challenge/ for the domain to region-api.
+func HttpGetAcmeChallenge(db *sql.DB, params martini.Params, r render.Render) {
+	var keyAuth string
+	if err := db.QueryRow("select value from acme_challenges where token=$1 and type='http-01'", params["token"]).Scan(&keyAuth); err != nil {
+		if err == sql.ErrNoRows {
+			utils.ReportNotFoundError(r)
 			return
 		}
+		utils.ReportError(err, r)
+		return
 	}
-	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Certificate Installed"})
+	r.Text(http.StatusOK, keyAuth)
 }
 
 func AddToMartini(m *martini.ClassicMartini) {
@@ -129,5 +254,9 @@ func AddToMartini(m *martini.ClassicMartini) {
 	m.Get("/v1/certs", HttpGetCertificateOrders)
 	m.Get("/v1/certs/:id", HttpGetCertificateOrderStatus)
 	m.Post("/v1/certs/:id/install", HttpInstallCertificate)
+	m.Delete("/v1/certs/:id", HttpDeleteCertificateOrder)
+	m.Post("/v1/certs/:id/reissue", HttpReissueCertificateOrder)
+	m.Post("/v1/certs/:id/revoke", binding.Json(RevokeRequest{}), HttpRevokeCertificateOrder)
+	m.Get("/.well-known/acme-challenge/:token", HttpGetAcmeChallenge)
 }
 
@@ -0,0 +1,760 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"region-api/router"
+	"region-api/runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	uuid "github.com/nu7hatch/gouuid"
+	"golang.org/x/crypto/acme"
+	kube "k8s.io/api/core/v1"
+)
+
+const acmeAccountSecretName = "acme-account-key"
+
+// Orders certificates directly from an ACME server (e.g., Let's Encrypt) without cert-manager,
+// orders are kept in the certs table and the issued certificate is installed on the site ingresses.
+type AcmeIssuer struct {
+	db                   *sql.DB
+	runtime              runtime.Runtime
+	client               *acme.Client
+	certificateNamespace string
+	challenge            string
+	solverHost           string
+	solverPort           int32
+	dns                  router.DNSProvider
+	install              func(common_name string, pem_cert []byte, pem_key []byte) error
+	resolveTXT           func(ctx context.Context, name string) ([]string, error)
+}
+
+var acmeIssuer *AcmeIssuer
+var acmeIssuerMutex sync.Mutex
+
+// How often a dns-01 challenge record is checked while waiting for it to propagate.
+var acmeDNSPollInterval = time.Second * 5
+
+// Orders being worked on by this process, so only one go routine advances an order at a time.
+var acmeOrdersProcessing = make(map[string]bool)
+var acmeOrdersMutex sync.Mutex
+
+func getAcmeAccountKey(runtime runtime.Runtime, namespace string) (*ecdsa.PrivateKey, error) {
+	body, code, err := runtime.GenericRequest("get", "/api/v1/namespaces/"+namespace+"/secrets/"+acmeAccountSecretName, nil)
+	if err != nil {
+		return nil, err
+	}
+	if code == http.StatusOK {
+		var secret kube.Secret
+		if err = json.Unmarshal(body, &secret); err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(secret.Data["tls.key"])
+		if block == nil {
+			return nil, errors.New("Unable to decode the acme account key in " + acmeAccountSecretName)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if code != http.StatusNotFound {
+		return nil, errors.New("Unable to get the acme account key: " + string(body))
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var secret kube.Secret
+	secret.APIVersion = "v1"
+	secret.Kind = "Secret"
+	secret.SetName(acmeAccountSecretName)
+	secret.SetNamespace(namespace)
+	secret.Type = kube.SecretTypeOpaque
+	secret.Data = map[string][]byte{"tls.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})}
+	body, code, err = runtime.GenericRequest("post", "/api/v1/namespaces/"+namespace+"/secrets", secret)
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusOK && code != http.StatusCreated {
+		return nil, errors.New("Unable to store the acme account key: " + string(body))
+	}
+	return key, nil
+}
+
+func NewAcmeIssuer(db *sql.DB, runtime runtime.Runtime, dns router.DNSProvider, directory string, key *ecdsa.PrivateKey, email string) (*AcmeIssuer, error) {
+	client := &acme.Client{Key: key, DirectoryURL: directory}
+	if os.Getenv("ACME_INSECURE_SKIP_VERIFY") == "true" {
+		client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
+	account := &acme.Account{}
+	if email != "" {
+		account.Contact = []string{"mailto:" + email}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, err
+	}
+	namespace := os.Getenv("CERT_NAMESPACE")
+	if namespace == "" {
+		namespace = "istio-system"
+	}
+	challenge := strings.ToLower(os.Getenv("ACME_CHALLENGE"))
+	if challenge == "" {
+		challenge = "http-01"
+	}
+	if challenge != "http-01" && challenge != "dns-01" {
+		return nil, errors.New("The ACME_CHALLENGE must be http-01 or dns-01.")
+	}
+	var solverPort int32 = 80
+	if os.Getenv("ACME_HTTP01_SOLVER_PORT") != "" {
+		port, err := strconv.ParseInt(os.Getenv("ACME_HTTP01_SOLVER_PORT"), 10, 32)
+		if err != nil {
+			return nil, errors.New("The ACME_HTTP01_SOLVER_PORT was not a valid port.")
+		}
+		solverPort = int32(port)
+	}
+	issuer := &AcmeIssuer{
+		db:                   db,
+		runtime:              runtime,
+		client:               client,
+		certificateNamespace: namespace,
+		challenge:            challenge,
+		solverHost:           os.Getenv("ACME_HTTP01_SOLVER_HOST"),
+		solverPort:           solverPort,
+		dns:                  dns,
+	}
+	issuer.install = issuer.installOnSiteIngresses
+	issuer.resolveTXT = router.ResolveTXT
+	return issuer, nil
+}
+
+// Returns the acme issuer if ACME_DIRECTORY_URL is set, the account key is created (and
+// registered) the first time this is called.
+func GetAcmeIssuers(db *sql.DB, runtime runtime.Runtime) ([]Issuer, error) {
+	directory := os.Getenv("ACME_DIRECTORY_URL")
+	if directory == "" {
+		return []Issuer{}, nil
+	}
+	acmeIssuerMutex.Lock()
+	defer acmeIssuerMutex.Unlock()
+	if acmeIssuer != nil {
+		return []Issuer{acmeIssuer}, nil
+	}
+	namespace := os.Getenv("CERT_NAMESPACE")
+	if namespace == "" {
+		namespace = "istio-system"
+	}
+	key, err := getAcmeAccountKey(runtime, namespace)
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := NewAcmeIssuer(db, runtime, router.GetDnsProvider(), directory, key, os.Getenv("ACME_EMAIL"))
+	if err != nil {
+		return nil, err
+	}
+	acmeIssuer = issuer
+	return []Issuer{acmeIssuer}, nil
+}
+
+func (issuer *AcmeIssuer) installOnSiteIngresses(common_name string, pem_cert []byte, pem_key []byte) error {
+	for _, internal := range []bool{false, true} {
+		ingress, err := router.GetSiteIngress(issuer.db, internal)
+		if err != nil {
+			return err
+		}
+		if err = ingress.InstallCertificate(common_name, pem_cert, pem_key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (issuer *AcmeIssuer) GetName() string {
+	return "acme"
+}
+
+func (issuer *AcmeIssuer) CreateOrder(domain string, sans []string, comment string, requestor string, issuerName string) (id string, err error) {
+	if domain == "" {
+		return "", errors.New("The common name of the certificate cannot be blank.")
+	}
+	names := append([]string{domain}, sans...)
+	if issuer.challenge == "http-01" && issuer.solverHost == "" {
+		return "", errors.New("The ACME_HTTP01_SOLVER_HOST must be set to use the http-01 challenge.")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	order, err := issuer.client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return "", err
+	}
+	u, _ := uuid.NewV4()
+	if _, err = issuer.db.Exec("insert into certs (id, request, ordernumber, cn, san, comment, status, issuer, created) values ($1, $2, $3, $4, $5, $6, 'pending', $7, now())", u.String(), requestor, order.URI, domain, strings.Join(sans, ","), comment, issuer.GetName()); err != nil {
+		return "", err
+	}
+	go issuer.completeOrder(u.String())
+	return u.String(), nil
+}
+
+func (issuer *AcmeIssuer) getOrder(id string) (*CertificateOrder, string, error) {
+	var order CertificateOrder
+	var orderUrl, san, errorMessage sql.NullString
+	var issued, expires pq.NullTime
+	err := issuer.db.QueryRow("select id, coalesce(request, ''), ordernumber, cn, san, coalesce(comment, ''), status, error, issued, expires from certs where id=$1 and issuer=$2", id, issuer.GetName()).Scan(&order.Id, &order.Requestor, &orderUrl, &order.CommonName, &san, &order.Comment, &order.Status, &errorMessage, &issued, &expires)
+	if err == sql.ErrNoRows {
+		return nil, "", ErrOrderNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+	order.SubjectAlternativeNames = make([]string, 0)
+	if san.String != "" {
+		order.SubjectAlternativeNames = strings.Split(san.String, ",")
+	}
+	if errorMessage.String != "" {
+		order.Comment = strings.TrimSpace(order.Comment + " " + errorMessage.String)
+	}
+	if issued.Valid {
+		order.Issued = issued.Time.UTC().String()
+	}
+	if expires.Valid {
+		order.Expires = expires.Time.UTC().String()
+	}
+	order.Issuer = issuer.GetName()
+	return &order, orderUrl.String, nil
+}
+
+// Advances the order until it's issued or rejected, if region-api restarted while the order was
+// pending checking its status will resume it.
+func (issuer *AcmeIssuer) completeOrder(id string) {
+	acmeOrdersMutex.Lock()
+	if acmeOrdersProcessing[id] {
+		acmeOrdersMutex.Unlock()
+		return
+	}
+	acmeOrdersProcessing[id] = true
+	acmeOrdersMutex.Unlock()
+	defer func() {
+		acmeOrdersMutex.Lock()
+		delete(acmeOrdersProcessing, id)
+		acmeOrdersMutex.Unlock()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*15)
+	defer cancel()
+	for {
+		status, err := issuer.advanceOrder(ctx, id)
+		if err != nil {
+			fmt.Printf("WARNING: Unable to advance acme order %s: %s\n", id, err.Error())
+		}
+		if status != "pending" {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			fmt.Printf("WARNING: The acme order %s did not complete in time, it will be resumed when checked.\n", id)
+			return
+		case <-time.After(time.Second * 5):
+		}
+	}
+}
+
+func (issuer *AcmeIssuer) rejectOrder(id string, message string) (string, error) {
+	if err := issuer.cleanUpChallenges(id); err != nil {
+		fmt.Printf("WARNING: Unable to clean up acme challenges for %s: %s\n", id, err.Error())
+	}
+	_, err := issuer.db.Exec("update certs set status='rejected', error=$2 where id=$1", id, message)
+	return "rejected", err
+}
+
+func (issuer *AcmeIssuer) advanceOrder(ctx context.Context, id string) (string, error) {
+	order, orderUrl, err := issuer.getOrder(id)
+	if err != nil {
+		return "", err
+	}
+	if order.Status != "pending" {
+		return order.Status, nil
+	}
+	o, err := issuer.client.GetOrder(ctx, orderUrl)
+	if err != nil {
+		return order.Status, err
+	}
+	switch o.Status {
+	case acme.StatusPending:
+		for _, url := range o.AuthzURLs {
+			authz, err := issuer.client.GetAuthorization(ctx, url)
+			if err != nil {
+				return order.Status, err
+			}
+			if authz.Status != acme.StatusPending {
+				continue
+			}
+			challenge := AcmeChallengeFor(authz, issuer.challenge)
+			if challenge == nil {
+				return issuer.rejectOrder(id, "The acme server did not offer a "+issuer.challenge+" challenge for "+authz.Identifier.Value+".")
+			}
+			if challenge.Status != acme.StatusPending {
+				continue
+			}
+			if err = issuer.presentChallenge(ctx, id, authz.Identifier.Value, challenge); err != nil {
+				return order.Status, err
+			}
+			if _, err = issuer.client.Accept(ctx, challenge); err != nil {
+				return order.Status, err
+			}
+		}
+	case acme.StatusReady:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return order.Status, err
+		}
+		csr, err := CreateCertificateRequest(key, order.CommonName, order.SubjectAlternativeNames)
+		if err != nil {
+			return order.Status, err
+		}
+		der, _, err := issuer.client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+		if err != nil {
+			return order.Status, err
+		}
+		pem_cert := make([]byte, 0)
+		for _, b := range der {
+			pem_cert = append(pem_cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+		}
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return order.Status, err
+		}
+		leaf, err := x509.ParseCertificate(der[0])
+		if err != nil {
+			return order.Status, err
+		}
+		if err = issuer.install(order.CommonName, pem_cert, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})); err != nil {
+			return issuer.rejectOrder(id, "The certificate was issued but could not be installed: "+err.Error())
+		}
+		if err = issuer.cleanUpChallenges(id); err != nil {
+			fmt.Printf("WARNING: Unable to clean up acme challenges for %s: %s\n", id, err.Error())
+		}
+		if _, err = issuer.db.Exec("update certs set status='issued', error=null, issued=now(), expires=$2 where id=$1", id, leaf.NotAfter); err != nil {
+			return order.Status, err
+		}
+		return "issued", nil
+	case acme.StatusValid:
+		// The order was finalized but the process stopped before the certificate (and its
+		// key) could be installed, the key cannot be recovered so the order must be placed again.
+		return issuer.rejectOrder(id, "The certificate was issued but was never installed, order it again.")
+	case acme.StatusInvalid:
+		message := "The acme server marked the order as invalid."
+		if o.Error != nil {
+			message = o.Error.Error()
+		}
+		for _, url := range o.AuthzURLs {
+			if authz, err := issuer.client.GetAuthorization(ctx, url); err == nil && authz.Status == acme.StatusInvalid {
+				for _, c := range authz.Challenges {
+					if c.Error != nil {
+						message = authz.Identifier.Value + ": " + c.Error.Error()
+					}
+				}
+			}
+		}
+		return issuer.rejectOrder(id, message)
+	}
+	return order.Status, nil
+}
+
+// Finds the challenge of the preferred type in the authorization, wildcard names can only be
+// validated with dns-01.
+func AcmeChallengeFor(authz *acme.Authorization, preferred string) *acme.Challenge {
+	if authz.Wildcard || strings.HasPrefix(authz.Identifier.Value, "*.") {
+		preferred = "dns-01"
+	}
+	for _, challenge := range authz.Challenges {
+		if challenge.Type == preferred {
+			return challenge
+		}
+	}
+	return nil
+}
+
+func AcmeChallengeRecordName(domain string) string {
+	return "_acme-challenge." + strings.TrimPrefix(domain, "*.")
+}
+
+func CreateCertificateRequest(key *ecdsa.PrivateKey, common_name string, sans []string) ([]byte, error) {
+	names := []string{common_name}
+	for _, san := range sans {
+		if san != common_name {
+			names = append(names, san)
+		}
+	}
+	return x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: common_name},
+		DNSNames: names,
+	}, key)
+}
+
+func (issuer *AcmeIssuer) publicZones(domain string) ([]router.Domain, error) {
+	domains, err := issuer.dns.Domain(strings.TrimPrefix(domain, "*."))
+	if err != nil {
+		return nil, err
+	}
+	zones := make([]router.Domain, 0)
+	for _, d := range domains {
+		if d.Public {
+			zones = append(zones, d)
+		}
+	}
+	if len(zones) == 0 {
+		return nil, errors.New("No public dns zone was found for " + domain + ".")
+	}
+	return zones, nil
+}
+
+// The values of all pending dns-01 challenges for a record, a certificate for example.com and
+// *.example.com needs two values on the same record.
+func (issuer *AcmeIssuer) challengeRecordValues(record string) ([]string, error) {
+	rows, err := issuer.db.Query("select value from acme_challenges where type='dns-01' and domain=$1", record)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make([]string, 0)
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, "\""+value+"\"")
+	}
+	return values, nil
+}
+
+// How long to wait for a dns-01 challenge record to be visible, ACME_DNS_PROPAGATION_TIMEOUT is in seconds.
+func acmeDNSPropagationTimeout() time.Duration {
+	if val := os.Getenv("ACME_DNS_PROPAGATION_TIMEOUT"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err == nil && seconds > 0 {
+			return time.Second * time.Duration(seconds)
+		}
+		fmt.Printf("WARNING: Invalid ACME_DNS_PROPAGATION_TIMEOUT %s, it will be ignored.\n", val)
+	}
+	return time.Minute * 5
+}
+
+// The acme server checks the challenge as soon as it's accepted, so the record must be applied by the
+// dns provider and resolvable publicly first, otherwise the authorization fails and can't be retried.
+func (issuer *AcmeIssuer) waitForChallengeRecord(ctx context.Context, zones []router.Domain, record string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, acmeDNSPropagationTimeout())
+	defer cancel()
+	if waiter, ok := issuer.dns.(router.DNSChangeWaiter); ok {
+		for _, zone := range zones {
+			if err := waiter.WaitForDomainRecords(ctx, zone); err != nil {
+				return err
+			}
+		}
+	}
+	for {
+		values, err := issuer.resolveTXT(ctx, record)
+		if err == nil {
+			for _, v := range values {
+				if v == value {
+					return nil
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("The acme challenge record " + record + " did not resolve in time.")
+		case <-time.After(acmeDNSPollInterval):
+		}
+	}
+}
+
+// The values left on a challenge record once the given values are removed from it.
+func remainingChallengeValues(values []string, removed []string) []string {
+	remaining := make([]string, 0)
+	for _, value := range values {
+		found := false
+		for _, r := range removed {
+			if value == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			remaining = append(remaining, value)
+		}
+	}
+	return remaining
+}
+
+func (issuer *AcmeIssuer) presentChallenge(ctx context.Context, id string, domain string, challenge *acme.Challenge) error {
+	if challenge.Type == "dns-01" {
+		value, err := issuer.client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return err
+		}
+		record := AcmeChallengeRecordName(domain)
+		zones, err := issuer.publicZones(domain)
+		if err != nil {
+			return err
+		}
+		if _, err = issuer.db.Exec("insert into acme_challenges (token, cert, type, domain, value, created) values ($1, $2, $3, $4, $5, now()) on conflict (token) do nothing", challenge.Token, id, challenge.Type, record, value); err != nil {
+			return err
+		}
+		values, err := issuer.challengeRecordValues(record)
+		if err != nil {
+			return err
+		}
+		for _, zone := range zones {
+			if err = issuer.dns.CreateDomainRecord(zone, "TXT", record, values); err != nil {
+				return err
+			}
+		}
+		return issuer.waitForChallengeRecord(ctx, zones, record, value)
+	}
+	keyAuth, err := issuer.client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+	internal, err := router.IsInternalRouter(issuer.db, domain)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errors.New("The site " + domain + " must exist to use the http-01 challenge.")
+		}
+		return err
+	}
+	if _, err = issuer.db.Exec("insert into acme_challenges (token, cert, type, domain, value, created) values ($1, $2, $3, $4, $5, now()) on conflict (token) do nothing", challenge.Token, id, challenge.Type, domain, keyAuth); err != nil {
+		return err
+	}
+	ingress, err := router.GetSiteIngress(issuer.db, internal)
+	if err != nil {
+		return err
+	}
+	return ingress.InstallAcmeChallengeRoute(domain, internal, issuer.solverHost, issuer.solverPort)
+}
+
+func (issuer *AcmeIssuer) cleanUpChallenges(id string) error {
+	rows, err := issuer.db.Query("select token, type, domain, value from acme_challenges where cert=$1", id)
+	if err != nil {
+		return err
+	}
+	type challenge struct {
+		token  string
+		kind   string
+		domain string
+		value  string
+	}
+	challenges := make([]challenge, 0)
+	// the values of this order's challenges on each dns-01 record
+	records := make(map[string][]string)
+	for rows.Next() {
+		var c challenge
+		if err = rows.Scan(&c.token, &c.kind, &c.domain, &c.value); err != nil {
+			rows.Close()
+			return err
+		}
+		if c.kind == "dns-01" {
+			records[c.domain] = append(records[c.domain], "\""+c.value+"\"")
+		}
+		challenges = append(challenges, c)
+	}
+	rows.Close()
+	// a record can also hold the challenges of other orders for the same domain, only this order's
+	// values are removed and the record is deleted once nothing is left on it.
+	for record, mine := range records {
+		values, err := issuer.challengeRecordValues(record)
+		if err != nil {
+			return err
+		}
+		zones, err := issuer.publicZones(strings.TrimPrefix(record, "_acme-challenge."))
+		if err != nil {
+			return err
+		}
+		remaining := remainingChallengeValues(values, mine)
+		for _, zone := range zones {
+			if len(remaining) == 0 {
+				err = issuer.dns.RemoveDomainRecord(zone, "TXT", record, values)
+			} else {
+				err = issuer.dns.CreateDomainRecord(zone, "TXT", record, remaining)
+			}
+			if err != nil {
+				fmt.Printf("WARNING: Unable to remove acme challenge record %s: %s\n", record, err.Error())
+			}
+		}
+	}
+	for _, c := range challenges {
+		if c.kind != "dns-01" {
+			internal, err := router.IsInternalRouter(issuer.db, c.domain)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			ingress, err := router.GetSiteIngress(issuer.db, internal)
+			if err != nil {
+				return err
+			}
+			if err = ingress.DeleteAcmeChallengeRoute(c.domain); err != nil {
+				return err
+			}
+		}
+		if _, err = issuer.db.Exec("delete from acme_challenges where token=$1", c.token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (issuer *AcmeIssuer) GetOrderStatus(id string) (*CertificateOrder, error) {
+	order, _, err := issuer.getOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status == "pending" {
+		go issuer.completeOrder(id)
+	}
+	return order, nil
+}
+
+func (issuer *AcmeIssuer) GetOrders() (orders []CertificateOrder, err error) {
+	rows, err := issuer.db.Query("select id from certs where issuer=$1 order by created", issuer.GetName())
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	orders = make([]CertificateOrder, 0)
+	for _, id := range ids {
+		order, _, err := issuer.getOrder(id)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, nil
+}
+
+// The certificate is installed on the site ingresses as soon as it's issued.
+func (issuer *AcmeIssuer) IsOrderAutoInstalled(ingress router.Ingress) (bool, error) {
+	return true, nil
+}
+
+func (issuer *AcmeIssuer) IsOrderReady(id string) (bool, error) {
+	order, err := issuer.GetOrderStatus(id)
+	if err != nil {
+		return false, err
+	}
+	return order.Status == "issued", nil
+}
+
+func (issuer *AcmeIssuer) GetCertificate(id string, domain string) (pem_cert []byte, pem_key []byte, err error) {
+	return getCertificateSecret(issuer.runtime, issuer.certificateNamespace, domain)
+}
+
+// ACME has no way to cancel an order, a pending order is abandoned (and its challenges removed)
+// and expires on the acme server.
+func (issuer *AcmeIssuer) DeleteOrder(id string) error {
+	if _, _, err := issuer.getOrder(id); err != nil {
+		return err
+	}
+	if err := issuer.cleanUpChallenges(id); err != nil {
+		return err
+	}
+	_, err := issuer.db.Exec("delete from certs where id=$1", id)
+	return err
+}
+
+// Places a new order for the same names, the certificate is replaced once it's issued.
+func (issuer *AcmeIssuer) ReissueOrder(id string) error {
+	order, _, err := issuer.getOrder(id)
+	if err != nil {
+		return err
+	}
+	if order.Status == "pending" {
+		return ErrOrderPending
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	o, err := issuer.client.AuthorizeOrder(ctx, acme.DomainIDs(append([]string{order.CommonName}, order.SubjectAlternativeNames...)...))
+	if err != nil {
+		return err
+	}
+	if _, err = issuer.db.Exec("update certs set ordernumber=$2, status='pending', error=null where id=$1", id, o.URI); err != nil {
+		return err
+	}
+	go issuer.completeOrder(id)
+	return nil
+}
+
+func (issuer *AcmeIssuer) RevokeOrder(id string, reason int) error {
+	order, _, err := issuer.getOrder(id)
+	if err != nil {
+		return err
+	}
+	if order.Status != "issued" {
+		return ErrOrderNotIssued
+	}
+	pem_cert, _, err := issuer.GetCertificate(id, order.CommonName)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(pem_cert)
+	if block == nil {
+		return errors.New("Unable to decode the installed certificate for " + order.CommonName)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err = issuer.client.RevokeCert(ctx, nil, block.Bytes, acme.CRLReasonCode(reason)); err != nil {
+		return err
+	}
+	_, err = issuer.db.Exec("update certs set status='revoked' where id=$1", id)
+	return err
+}
+
+// Used by unit tests, shoudn't be used outside of that.
+func (issuer *AcmeIssuer) DeleteCertificate(name string) error {
+	rows, err := issuer.db.Query("select id from certs where cn=$1 and issuer=$2", name, issuer.GetName())
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err = issuer.cleanUpChallenges(id); err != nil {
+			return err
+		}
+		if _, err = issuer.db.Exec("delete from certs where id=$1", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"region-api/router"
+	"region-api/utils"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/acme"
+)
+
+// Records dns-01 challenges instead of creating them, pebble is expected to run with
+// PEBBLE_VA_ALWAYS_VALID=1 so the records do not need to resolve.
+type fakeDNSProvider struct {
+	mutex   sync.Mutex
+	records map[string][]string
+	waits   int
+}
+
+func (dns *fakeDNSProvider) Type() string { return "fake" }
+func (dns *fakeDNSProvider) Domains() ([]router.Domain, error) {
+	return []router.Domain{router.Domain{ProviderId: "fake", Name: "example.com", Public: true}}, nil
+}
+func (dns *fakeDNSProvider) Domain(domain string) ([]router.Domain, error) { return dns.Domains() }
+func (dns *fakeDNSProvider) DomainRecord(domain router.Domain, recordType string, name string) (*router.DomainRecord, error) {
+	return nil, nil
+}
+func (dns *fakeDNSProvider) DomainRecords(domain router.Domain) ([]router.DomainRecord, error) {
+	return []router.DomainRecord{}, nil
+}
+func (dns *fakeDNSProvider) CreateDomainRecord(domain router.Domain, recordType string, name string, values []string) error {
+	dns.mutex.Lock()
+	defer dns.mutex.Unlock()
+	dns.records[name] = values
+	return nil
+}
+func (dns *fakeDNSProvider) RemoveDomainRecord(domain router.Domain, recordType string, name string, values []string) error {
+	dns.mutex.Lock()
+	defer dns.mutex.Unlock()
+	delete(dns.records, name)
+	return nil
+}
+
+func (dns *fakeDNSProvider) WaitForDomainRecords(ctx context.Context, domain router.Domain) error {
+	dns.mutex.Lock()
+	defer dns.mutex.Unlock()
+	dns.waits++
+	return nil
+}
+
+// Resolves the records as a public resolver would, without the quotes.
+func (dns *fakeDNSProvider) ResolveTXT(ctx context.Context, name string) ([]string, error) {
+	dns.mutex.Lock()
+	defer dns.mutex.Unlock()
+	values := make([]string, 0)
+	for _, value := range dns.records[name] {
+		values = append(values, strings.Trim(value, "\""))
+	}
+	return values, nil
+}
+
+func (dns *fakeDNSProvider) ChangeDomainRecords(domain router.Domain, changes []router.DomainRecordChange) error {
+	for _, change := range changes {
+		if change.Action == "delete" {
+			dns.RemoveDomainRecord(domain, change.Record.Type, change.Record.Name, change.Record.Values)
+		} else {
+			dns.CreateDomainRecord(domain, change.Record.Type, change.Record.Name, change.Record.Values)
+		}
+	}
+	return nil
+}
+
+func TestAcmeChallenges(t *testing.T) {
+	Convey("Test choosing acme challenges", t, func() {
+		authz := &acme.Authorization{
+			Identifier: acme.AuthzID{Type: "dns", Value: "www.example.com"},
+			Challenges: []*acme.Challenge{&acme.Challenge{Type: "http-01", Token: "a"}, &acme.Challenge{Type: "dns-01", Token: "b"}},
+		}
+		So(AcmeChallengeFor(authz, "http-01").Token, ShouldEqual, "a")
+		So(AcmeChallengeFor(authz, "dns-01").Token, ShouldEqual, "b")
+		So(AcmeChallengeFor(authz, "tls-alpn-01"), ShouldBeNil)
+
+		wildcard := &acme.Authorization{
+			Identifier: acme.AuthzID{Type: "dns", Value: "example.com"},
+			Wildcard:   true,
+			Challenges: []*acme.Challenge{&acme.Challenge{Type: "dns-01", Token: "c"}},
+		}
+		So(AcmeChallengeFor(wildcard, "http-01").Token, ShouldEqual, "c")
+		So(AcmeChallengeRecordName("*.example.com"), ShouldEqual, "_acme-challenge.example.com")
+		So(AcmeChallengeRecordName("www.example.com"), ShouldEqual, "_acme-challenge.www.example.com")
+	})
+
+	Convey("Test creating the certificate request", t, func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		der, err := CreateCertificateRequest(key, "www.example.com", []string{"www.example.com", "example.com"})
+		So(err, ShouldBeNil)
+		csr, err := x509.ParseCertificateRequest(der)
+		So(err, ShouldBeNil)
+		So(csr.Subject.CommonName, ShouldEqual, "www.example.com")
+		So(csr.DNSNames, ShouldResemble, []string{"www.example.com", "example.com"})
+	})
+}
+
+func TestAcmeChallengeRecords(t *testing.T) {
+	Convey("Test waiting for dns-01 challenge records", t, func() {
+		interval := acmeDNSPollInterval
+		acmeDNSPollInterval = time.Millisecond * 10
+		defer func() { acmeDNSPollInterval = interval }()
+		dns := &fakeDNSProvider{records: make(map[string][]string)}
+		issuer := &AcmeIssuer{dns: dns, resolveTXT: dns.ResolveTXT}
+		zones, _ := dns.Domains()
+
+		Convey("The wait should end once the change is applied and the value resolves", func() {
+			go func() {
+				time.Sleep(time.Millisecond * 50)
+				dns.CreateDomainRecord(zones[0], "TXT", "_acme-challenge.example.com", []string{"\"other\"", "\"token\""})
+			}()
+			So(issuer.waitForChallengeRecord(context.Background(), zones, "_acme-challenge.example.com", "token"), ShouldBeNil)
+			So(dns.waits, ShouldEqual, 1)
+		})
+
+		Convey("The wait should fail if the value never resolves", func() {
+			os.Setenv("ACME_DNS_PROPAGATION_TIMEOUT", "1")
+			defer os.Unsetenv("ACME_DNS_PROPAGATION_TIMEOUT")
+			So(issuer.waitForChallengeRecord(context.Background(), zones, "_acme-challenge.example.com", "token"), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Test removing an order's values from a challenge record", t, func() {
+		So(remainingChallengeValues([]string{"\"a\"", "\"b\"", "\"c\""}, []string{"\"a\"", "\"c\""}), ShouldResemble, []string{"\"b\""})
+		So(remainingChallengeValues([]string{"\"a\""}, []string{"\"a\""}), ShouldBeEmpty)
+	})
+}
+
+func TestAcmeIssuer(t *testing.T) {
+	if os.Getenv("PEBBLE_DIRECTORY_URL") == "" || os.Getenv("PITDB") == "" {
+		t.Skip("PEBBLE_DIRECTORY_URL or PITDB is not set, skipping TestAcmeIssuer")
+	}
+	Convey("Given an acme issuer using pebble", t, func() {
+		os.Setenv("ACME_CHALLENGE", "dns-01")
+		os.Setenv("ACME_INSECURE_SKIP_VERIFY", "true")
+		db := utils.GetDB(os.Getenv("PITDB"))
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		dns := &fakeDNSProvider{records: make(map[string][]string)}
+		issuer, err := NewAcmeIssuer(db, nil, dns, os.Getenv("PEBBLE_DIRECTORY_URL"), key, "")
+		So(err, ShouldBeNil)
+		installed := make(chan []byte, 1)
+		issuer.install = func(common_name string, pem_cert []byte, pem_key []byte) error {
+			installed <- pem_cert
+			return nil
+		}
+		issuer.resolveTXT = dns.ResolveTXT
+		Reset(func() {
+			issuer.DeleteCertificate("acmetest.example.com")
+		})
+
+		Convey("An order should be issued and installed", func() {
+			id, err := issuer.CreateOrder("acmetest.example.com", []string{"*.acmetest.example.com"}, "test", "test", "acme")
+			So(err, ShouldBeNil)
+			order, err := issuer.GetOrderStatus(id)
+			for deadline := time.Now().Add(time.Minute * 2); err == nil && order.Status == "pending" && time.Now().Before(deadline); {
+				time.Sleep(time.Second)
+				order, err = issuer.GetOrderStatus(id)
+			}
+			So(err, ShouldBeNil)
+			So(order.Status, ShouldEqual, "issued")
+			pem_cert := <-installed
+			block, _ := pem.Decode(pem_cert)
+			cert, err := x509.ParseCertificate(block.Bytes)
+			So(err, ShouldBeNil)
+			So(cert.DNSNames, ShouldContain, "*.acmetest.example.com")
+			So(len(dns.records), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestOrderErrors(t *testing.T) {
+	Convey("Test order errors are reported with the right status", t, func() {
+		m := martini.Classic()
+		m.Use(render.Renderer())
+		m.Get("/:error", func(params martini.Params, r render.Render) {
+			errs := map[string]error{"notfound": ErrOrderNotFound, "pending": ErrOrderPending, "notissued": ErrOrderNotIssued, "revoke": ErrRevokeNotSupported}
+			reportOrderError(errs[params["error"]], r)
+		})
+		for path, code := range map[string]int{"/notfound": http.StatusNotFound, "/pending": http.StatusConflict, "/notissued": http.StatusConflict, "/revoke": http.StatusUnprocessableEntity} {
+			r, _ := http.NewRequest("GET", path, nil)
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, code)
+		}
+		So(revocationReasons["keyCompromise"], ShouldEqual, 1)
+		So(revocationReasons[""], ShouldEqual, 0)
+	})
+}
@@ -11,8 +11,8 @@ import (
 	"strings"
 
 	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1alpha2"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
 	uuid "github.com/nu7hatch/gouuid"
-	kube "k8s.io/api/core/v1"
 	kubemetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -151,6 +151,9 @@ func (issuer *CertManagerIssuer) GetOrderStatus(id string) (*CertificateOrder, e
 	if err = json.Unmarshal(body, &certStatusList); err != nil {
 		return nil, err
 	}
+	if len(certStatusList.Items) == 0 {
+		return nil, ErrOrderNotFound
+	}
 	if len(certStatusList.Items) != 1 {
 		return nil, errors.New("More than one (or none) certificates were returned.")
 	}
@@ -212,26 +215,77 @@ func (issuer *CertManagerIssuer) IsOrderReady(id string) (bool, error) {
 }
 
 func (issuer *CertManagerIssuer) GetCertificate(id string, domain string) (pem_cert []byte, pem_key []byte, err error) {
-	name := strings.Replace(domain, "*.", "star.", -1)
-	name = strings.Replace(name, ".", "-", -1) + "-tls"
-	body, code, err := issuer.runtime.GenericRequest("get", "/api/v1/namespaces/"+issuer.certificateNamespace+"/secrets/"+name, nil)
+	return getCertificateSecret(issuer.runtime, issuer.certificateNamespace, domain)
+}
+
+func (issuer *CertManagerIssuer) getCertificateById(id string) (*certmanager.Certificate, error) {
+	body, code, err := issuer.runtime.GenericRequest("get", "/apis/"+certmanager.SchemeGroupVersion.Group+"/"+certmanager.SchemeGroupVersion.Version+"/namespaces/"+issuer.certificateNamespace+"/certificates?labelSelector=akkeris-cert-id%3D"+id, nil)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	if code != http.StatusOK {
-		return nil, nil, errors.New("Certificate not found.")
+		return nil, errors.New("Unable to find certificate: " + string(body))
+	}
+	var certStatusList certmanager.CertificateList
+	if err = json.Unmarshal(body, &certStatusList); err != nil {
+		return nil, err
+	}
+	if len(certStatusList.Items) == 0 {
+		return nil, ErrOrderNotFound
+	}
+	if len(certStatusList.Items) != 1 {
+		return nil, errors.New("More than one certificate was returned.")
+	}
+	return &certStatusList.Items[0], nil
+}
+
+func (issuer *CertManagerIssuer) DeleteOrder(id string) error {
+	cert, err := issuer.getCertificateById(id)
+	if err != nil {
+		return err
+	}
+	return issuer.DeleteCertificate(cert.GetName())
+}
+
+// Marks the certificate as issuing, the same as cert-manager's renew command, which causes
+// cert-manager to issue it again with a new key.
+func (issuer *CertManagerIssuer) ReissueOrder(id string) error {
+	cert, err := issuer.getCertificateById(id)
+	if err != nil {
+		return err
+	}
+	for _, condition := range cert.Status.Conditions {
+		if condition.Type == certmanager.CertificateConditionIssuing && condition.Status == cmmeta.ConditionTrue {
+			return ErrOrderPending
+		}
 	}
-	var secret kube.Secret
-	if err = json.Unmarshal(body, &secret); err != nil {
-		return nil, nil, err
+	now := kubemetav1.Now()
+	conditions := make([]certmanager.CertificateCondition, 0)
+	for _, condition := range cert.Status.Conditions {
+		if condition.Type != certmanager.CertificateConditionIssuing {
+			conditions = append(conditions, condition)
+		}
 	}
-	if secret.Data["tls.crt"] == nil {
-		return nil, nil, errors.New("Unable to decode or get certificate, the tls.crt field was null")
+	cert.Status.Conditions = append(conditions, certmanager.CertificateCondition{
+		Type:               certmanager.CertificateConditionIssuing,
+		Status:             cmmeta.ConditionTrue,
+		LastTransitionTime: &now,
+		Reason:             "ManuallyTriggered",
+		Message:            "Certificate re-issuance was requested",
+	})
+	body, code, err := issuer.runtime.GenericRequest("put", "/apis/"+certmanager.SchemeGroupVersion.Group+"/"+certmanager.SchemeGroupVersion.Version+"/namespaces/"+issuer.certificateNamespace+"/certificates/"+cert.GetName()+"/status", cert)
+	if err != nil {
+		return err
 	}
-	if secret.Data["tls.key"] == nil {
-		return nil, nil, errors.New("Unable to decode or get certificate, the tls.key field was null")
+	if code != http.StatusOK {
+		return errors.New("Unable to re-issue certificate. (" + string(body) + " [" + strconv.Itoa(code) + "])")
 	}
-	return secret.Data["tls.crt"], secret.Data["tls.key"], nil
+	return nil
+}
+
+// cert-manager has no way of revoking a certificate it has issued.
+func (issuer *CertManagerIssuer) RevokeOrder(id string, reason int) error {
+	return ErrRevokeNotSupported
 }
 
 // Used by unit tests, shoudn't be used outside of that.
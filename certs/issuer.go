@@ -2,16 +2,21 @@ package certs
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
 	"region-api/router"
 	"region-api/runtime"
-	"errors"
+	"strings"
+
+	kube "k8s.io/api/core/v1"
 )
 
 type CertificateOrder struct {
 	Id                      string   `json:"id,omitempty"`
 	CommonName              string   `json:"common_name"`
 	SubjectAlternativeNames []string `json:"subject_alternative_names"`
-	Status                  string   `json:"status,omitempty"` // can be pending, approved, issued, rejected
+	Status                  string   `json:"status,omitempty"` // can be pending, approved, issued, rejected, revoked
 	Comment                 string   `json:"comment,omitempty"`
 	Requestor               string   `json:"requestor,omitempty"`
 	Issued                  string   `json:"issued,omitempty"`
@@ -27,9 +32,17 @@ type Issuer interface {
 	IsOrderAutoInstalled(ingress router.Ingress) (bool, error)
 	IsOrderReady(id string) (bool, error)
 	GetCertificate(id string, domain string) (pem_cert []byte, pem_key []byte, err error)
+	DeleteOrder(id string) error
+	ReissueOrder(id string) error
+	RevokeOrder(id string, reason int) error
 	DeleteCertificate(name string) (error)
 }
 
+var ErrOrderNotFound = errors.New("The certificate order was not found.")
+var ErrOrderPending = errors.New("The certificate order is still pending.")
+var ErrOrderNotIssued = errors.New("The certificate has not been issued.")
+var ErrRevokeNotSupported = errors.New("The issuer does not support revoking certificates.")
+
 func GetIssuers(db *sql.DB) ([]Issuer, error) {
 	runtimes, err := runtime.GetAllRuntimes(db)
 	// TODO: This is obvious we don't yet support multi-cluster regions.
@@ -41,12 +54,21 @@ func GetIssuers(db *sql.DB) ([]Issuer, error) {
 	if len(runtimes) == 0 {
 		return nil, errors.New("No runtime was found.")
 	}
-	// For now we only support cert-manager Issuer types, we could support others outside of
-	// what cert manager/acme supports but its not yet implemented.
-	return GetCertManagerIssuers(runtimes[0]);
+	acmeIssuers, err := GetAcmeIssuers(db, runtimes[0])
+	if err != nil {
+		return nil, err
+	}
+	certManagerIssuers, err := GetCertManagerIssuers(runtimes[0])
+	if err != nil {
+		// cert-manager does not need to be installed if certificates are ordered over acme.
+		if len(acmeIssuers) == 0 {
+			return nil, err
+		}
+		return acmeIssuers, nil
+	}
+	return append(certManagerIssuers, acmeIssuers...), nil
 }
 
-
 func GetIssuer(db *sql.DB, name string) (Issuer, error) {
 	issuers, err := GetIssuers(db)
 	if err != nil {
@@ -59,3 +81,40 @@ func GetIssuer(db *sql.DB, name string) (Issuer, error) {
 	}
 	return nil, errors.New("Unable to find issuer by name " + name)
 }
+
+// Finds the issuer that placed an order, orders from the acme issuer are recorded in
+// the certs table while cert-manager keeps track of its own.
+func GetIssuerForOrder(db *sql.DB, id string) (Issuer, error) {
+	var name sql.NullString
+	if err := db.QueryRow("select issuer from certs where id=$1", id).Scan(&name); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if name.String == "" {
+		return GetIssuer(db, "cert-manager")
+	}
+	return GetIssuer(db, name.String)
+}
+
+// Reads the certificate and key installed for the domain from its secret in the certificate namespace.
+func getCertificateSecret(runtime runtime.Runtime, namespace string, domain string) (pem_cert []byte, pem_key []byte, err error) {
+	name := strings.Replace(domain, "*.", "star.", -1)
+	name = strings.Replace(name, ".", "-", -1) + "-tls"
+	body, code, err := runtime.GenericRequest("get", "/api/v1/namespaces/"+namespace+"/secrets/"+name, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if code != http.StatusOK {
+		return nil, nil, errors.New("Certificate not found.")
+	}
+	var secret kube.Secret
+	if err = json.Unmarshal(body, &secret); err != nil {
+		return nil, nil, err
+	}
+	if secret.Data["tls.crt"] == nil {
+		return nil, nil, errors.New("Unable to decode or get certificate, the tls.crt field was null")
+	}
+	if secret.Data["tls.key"] == nil {
+		return nil, nil, errors.New("Unable to decode or get certificate, the tls.key field was null")
+	}
+	return secret.Data["tls.crt"], secret.Data["tls.key"], nil
+}
@@ -22,6 +22,57 @@ begin
 
     create unique index if not exists appbindings_appname_bindtype_bindname_space_key ON appbindings (appname, bindtype, bindname, space);
 
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'appbindings'
+              AND column_name = 'role'
+              and table_schema = 'public') then
+        alter table appbindings add column role varchar(128) null;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'appbindings'
+              AND column_name = 'binding_id'
+              and table_schema = 'public') then
+        alter table appbindings add column binding_id varchar(1024) null;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'appbindings'
+              AND column_name = 'rotate_every'
+              and table_schema = 'public') then
+        alter table appbindings add column rotate_every varchar(128) null;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'appbindings'
+              AND column_name = 'next_rotation'
+              and table_schema = 'public') then
+        alter table appbindings add column next_rotation timestamp with time zone null;
+    end if; 
+
+    create table if not exists binding_rotations
+    (
+        rotation_id UUID primary key not null,
+        appname TEXT NOT NULL,
+        space TEXT NOT NULL,
+        bindtype TEXT NOT NULL,
+        bindname TEXT NOT NULL,
+        status varchar(128) not null default 'in progress',
+        message text null,
+        started timestamp with time zone default now(),
+        finished timestamp with time zone null
+    );
+
+    -- only one rotation of a binding may be in progress, older duplicates are from before this was enforced.
+    update binding_rotations br set status='failed', message='Superseded by a later rotation.', finished=now()
+        where br.status='in progress' and exists (select 1 from binding_rotations newer where newer.appname=br.appname and newer.space=br.space
+        and newer.bindtype=br.bindtype and newer.bindname=br.bindname and newer.status='in progress' and newer.started > br.started);
+    create unique index if not exists binding_rotations_in_progress_key ON binding_rotations (appname, space, bindtype, bindname) where status='in progress';
+
     create table if not exists appfeature
     (
         space TEXT NOT NULL,
@@ -41,6 +92,149 @@ begin
         metadata text default ''
     );
 
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'service_instances'
+              AND column_name = 'operation'
+              and table_schema = 'public') then
+        alter table service_instances add column operation varchar(128) null;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'service_instances'
+              AND column_name = 'operation_started'
+              and table_schema = 'public') then
+        alter table service_instances add column operation_started timestamp with time zone null;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'service_instances'
+              AND column_name = 'next_poll'
+              and table_schema = 'public') then
+        alter table service_instances add column next_poll timestamp with time zone null;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'service_instances'
+              AND column_name = 'poll_attempts'
+              and table_schema = 'public') then
+        alter table service_instances add column poll_attempts integer not null default 0;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'service_instances'
+              AND column_name = 'status_description'
+              and table_schema = 'public') then
+        alter table service_instances add column status_description text null;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'service_instances'
+              AND column_name = 'owner_space'
+              and table_schema = 'public') then
+        alter table service_instances add column owner_space varchar(128) null;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'service_instances'
+              AND column_name = 'owner_app'
+              and table_schema = 'public') then
+        alter table service_instances add column owner_app varchar(128) null;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'service_instances'
+              AND column_name = 'billing_code'
+              and table_schema = 'public') then
+        alter table service_instances add column billing_code varchar(1024) null;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'service_instances'
+              AND column_name = 'created'
+              and table_schema = 'public') then
+        alter table service_instances add column created timestamp with time zone null;
+    end if; 
+
+    create table if not exists service_instance_shares
+    (
+        instance_id varchar(1024) not null,
+        space varchar(128) not null,
+        role varchar(128) not null default 'read-only',
+        created timestamp with time zone default now(),
+        primary key (instance_id, space)
+    );
+
+    create table if not exists brokers
+    (
+        name varchar(128) not null primary key,
+        url varchar(1024) not null,
+        credentials text null,
+        status varchar(128) not null default 'unknown',
+        status_message text null,
+        checked timestamp with time zone null,
+        created timestamp with time zone default now(),
+        service_ids text[] null
+    );
+
+    create table if not exists service_bindings
+    (
+        instance_id varchar(1024) not null,
+        binding_id varchar(1024) not null,
+        service_id varchar(1024) not null,
+        plan_id varchar(1024) not null,
+        operation_key varchar(1024) null,
+        status varchar(1024) not null default '',
+        status_description text null,
+        operation_started timestamp with time zone default now(),
+        next_poll timestamp with time zone default now(),
+        poll_attempts integer not null default 0,
+        primary key (instance_id, binding_id)
+    );
+
+    create table if not exists legacy_service_instances
+    (
+        instance_id varchar(1024) not null primary key,
+        service varchar(128) not null,
+        name varchar(1024) not null,
+        plan varchar(128) null,
+        billing_code varchar(1024) null,
+        created timestamp with time zone default now()
+    );
+
+    create table if not exists osb_binding_credentials
+    (
+        instance_id varchar(1024) not null,
+        binding_id varchar(1024) not null,
+        service_id varchar(1024) not null,
+        service_name varchar(1024) not null,
+        credentials text not null,
+        fetched timestamp with time zone not null default now(),
+        last_error text null,
+        last_error_at timestamp with time zone null,
+        primary key (instance_id, binding_id)
+    );
+
+    create table if not exists kafka_topic_changes
+    (
+        change_id UUID primary key not null,
+        cluster varchar(128) not null,
+        topic varchar(1024) not null,
+        setting varchar(128) not null,
+        old_value text null,
+        new_value text not null,
+        created timestamp with time zone default now(),
+        status varchar(128) not null default 'applied'
+    );
+
     create table if not exists appopsgenie
     (
         space TEXT NOT NULL,
@@ -80,6 +274,16 @@ begin
 
     create unique index if not exists certs_request_ordernumber_cn_key ON certs (request, ordernumber, cn);
 
+    create table if not exists acme_challenges
+    (
+        token TEXT PRIMARY KEY NOT NULL,
+        cert UUID NOT NULL,
+        type TEXT NOT NULL,
+        domain TEXT NOT NULL,
+        value TEXT NOT NULL,
+        created TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
     create table if not exists configvars
     (
         setname TEXT NOT NULL,
@@ -165,6 +369,38 @@ begin
 
     create unique index if not exists routers_domain_key ON routers (domain);
 
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'routers'
+              AND column_name = 'hsts'
+              and table_schema = 'public') then
+        alter table routers add column hsts text;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'routers'
+              AND column_name = 'auto_tls'
+              and table_schema = 'public') then
+        alter table routers add column auto_tls boolean;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'routers'
+              AND column_name = 'certificate_order'
+              and table_schema = 'public') then
+        alter table routers add column certificate_order text;
+    end if; 
+
+    if not exists (SELECT NULL 
+              FROM INFORMATION_SCHEMA.COLUMNS
+             WHERE table_name = 'routers'
+              AND column_name = 'certificate_status'
+              and table_schema = 'public') then
+        alter table routers add column certificate_status text;
+    end if; 
+
     create table if not exists sets
     (
         setid UUID PRIMARY KEY NOT NULL,
@@ -221,6 +457,37 @@ begin
         CONSTRAINT subscribers_pkey PRIMARY KEY (space, app, email)
     );
 
+    create table if not exists certificate_expiry_notifications
+    (
+        name TEXT NOT NULL,
+        ingress TEXT NOT NULL,
+        expires BIGINT NOT NULL,
+        threshold INTEGER NOT NULL,
+        notified TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        CONSTRAINT certificate_expiry_notifications_pkey PRIMARY KEY (name, ingress, expires, threshold)
+    );
+
+    create table if not exists dns_records
+    (
+        zone TEXT NOT NULL,
+        type TEXT NOT NULL,
+        name TEXT NOT NULL,
+        value TEXT NOT NULL,
+        owner_type TEXT NOT NULL,
+        owner TEXT NOT NULL,
+        created TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        CONSTRAINT dns_records_pkey PRIMARY KEY (zone, type, name, value)
+    );
+
+    create table if not exists app_domains
+    (
+        domain TEXT PRIMARY KEY NOT NULL,
+        app TEXT NOT NULL,
+        space TEXT NOT NULL,
+        internal BOOLEAN NOT NULL DEFAULT false,
+        created TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
     if (select count(*) from plans) = 0 then
         INSERT INTO public.plans (name, memrequest, memlimit, price, "description") 
             VALUES ('gp1', '256Mi', '256Mi', 10, '256MB RAM, 3.1 Intel Xeon Platinum 8000 CPU, 10 Gbps Networking');
@@ -342,5 +609,82 @@ begin
     ) then
         alter table spacesapps add column port integer;
     end if;
+
+    -- Add "comment" column to certs table
+    if not exists 
+    (
+        SELECT NULL FROM INFORMATION_SCHEMA.COLUMNS
+            WHERE table_name = 'certs'
+            AND column_name = 'comment'
+            and table_schema = 'public'
+    ) then
+        alter table certs add column comment text;
+    end if;
+
+    -- Add "status" column to certs table
+    if not exists 
+    (
+        SELECT NULL FROM INFORMATION_SCHEMA.COLUMNS
+            WHERE table_name = 'certs'
+            AND column_name = 'status'
+            and table_schema = 'public'
+    ) then
+        alter table certs add column status text;
+    end if;
+
+    -- Add "error" column to certs table
+    if not exists 
+    (
+        SELECT NULL FROM INFORMATION_SCHEMA.COLUMNS
+            WHERE table_name = 'certs'
+            AND column_name = 'error'
+            and table_schema = 'public'
+    ) then
+        alter table certs add column error text;
+    end if;
+
+    -- Add "issuer" column to certs table
+    if not exists 
+    (
+        SELECT NULL FROM INFORMATION_SCHEMA.COLUMNS
+            WHERE table_name = 'certs'
+            AND column_name = 'issuer'
+            and table_schema = 'public'
+    ) then
+        alter table certs add column issuer text;
+    end if;
+
+    -- Add "created" column to certs table
+    if not exists 
+    (
+        SELECT NULL FROM INFORMATION_SCHEMA.COLUMNS
+            WHERE table_name = 'certs'
+            AND column_name = 'created'
+            and table_schema = 'public'
+    ) then
+        alter table certs add column created timestamp with time zone default now();
+    end if;
+
+    -- Add "issued" column to certs table
+    if not exists 
+    (
+        SELECT NULL FROM INFORMATION_SCHEMA.COLUMNS
+            WHERE table_name = 'certs'
+            AND column_name = 'issued'
+            and table_schema = 'public'
+    ) then
+        alter table certs add column issued timestamp with time zone;
+    end if;
+
+    -- Add "expires" column to certs table
+    if not exists 
+    (
+        SELECT NULL FROM INFORMATION_SCHEMA.COLUMNS
+            WHERE table_name = 'certs'
+            AND column_name = 'expires'
+            and table_schema = 'public'
+    ) then
+        alter table certs add column expires timestamp with time zone;
+    end if;
 end
 $$;
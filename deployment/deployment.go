@@ -205,6 +205,10 @@ func createOrUpdateService(db *sql.DB, rt runtime.Runtime, payload structs.Deplo
 	foundJwtFilter := false
 	foundCorsFilter := false
 	foundCspFilter := false
+	foundIpFilter := false
+	foundBasicAuthFilter := false
+	foundOAuth2Filter := false
+	trafficPolicyFilters := make([]structs.HttpFilters, 0)
 	for _, filter := range payload.Filters {
 		if filter.Type == "jwt" {
 			issuer := ""
@@ -326,11 +330,78 @@ func createOrUpdateService(db *sql.DB, rt runtime.Runtime, payload structs.Deplo
 					fmt.Printf("WARNING: There was an error trying to pull the routes for an app to install the CSP filters on: %s\n", err.Error())
 				}
 			}
+		} else if ingress.IsTrafficPolicyFilter(filter.Type) {
+			trafficPolicyFilters = append(trafficPolicyFilters, filter)
+		} else if filter.Type == "basic_auth" {
+			// never remove existing protection because of a bad filter
+			foundBasicAuthFilter = true
+			if os.Getenv("INGRESS_DEBUG") == "true" {
+				fmt.Printf("[ingress] Adding basic auth filter for user %s\n", filter.Data["username"])
+			}
+			auth, err := ingress.BasicAuthFromFilter(filter)
+			if err != nil {
+				fmt.Printf("WARNING: The basic auth filter was invalid: %s\n", err.Error())
+			} else if err := appIngress.InstallOrUpdateBasicAuthFilter(payload.Name+"-"+payload.Space, "/", auth.Username, auth.Password); err != nil {
+				fmt.Printf("WARNING: There was an error installing or updating the basic auth filter: %s\n", err.Error())
+			}
+		} else if filter.Type == "oauth2" {
+			// never remove existing protection because of a bad filter
+			foundOAuth2Filter = true
+			if os.Getenv("INGRESS_DEBUG") == "true" {
+				fmt.Printf("[ingress] Adding oauth2 filter %#+v\n", filter)
+			}
+			oauth2, err := ingress.OAuth2FromFilter(filter)
+			if err != nil {
+				fmt.Printf("WARNING: The oauth2 filter was invalid: %s\n", err.Error())
+			} else if err := appIngress.InstallOrUpdateOAuth2Filter(payload.Name+"-"+payload.Space, "/", oauth2.Provider, oauth2.Excludes); err != nil {
+				fmt.Printf("WARNING: There was an error installing or updating the oauth2 filter: %s\n", err.Error())
+			}
+		} else if filter.Type == "ipfilter" {
+			// never remove existing protection because of a bad filter
+			foundIpFilter = true
+			if os.Getenv("INGRESS_DEBUG") == "true" {
+				fmt.Printf("[ingress] Adding ip filter %#+v\n", filter)
+			}
+			ipfilter, err := ingress.IPFilterFromFilter(filter)
+			if err != nil {
+				fmt.Printf("WARNING: The ip filter was invalid: %s\n", err.Error())
+			} else if err := appIngress.InstallOrUpdateIPFilter(payload.Name+"-"+payload.Space, "/", ipfilter.Allow, ipfilter.Deny); err != nil {
+				return err
+			}
 		} else {
 			fmt.Printf("WARNING: Unknown filter type: %s\n", filter.Type)
 		}
 	}
 
+	// Timeouts, retries and fault injection are applied to the app's own virtual service as its defaults.
+	if len(trafficPolicyFilters) > 0 {
+		if err := appIngress.InstallOrUpdateTrafficPolicyFilter(payload.Name+"-"+payload.Space, "/", trafficPolicyFilters); err != nil {
+			fmt.Printf("WARNING: There was an error installing or updating the traffic policy filters: %s\n", err.Error())
+		}
+	} else {
+		if err := appIngress.DeleteTrafficPolicyFilter(payload.Name+"-"+payload.Space, "/"); err != nil {
+			fmt.Printf("WARNING: There was an error removing the traffic policy filters from the app: %s\n", err.Error())
+		}
+	}
+
+	if !foundBasicAuthFilter {
+		if err := appIngress.DeleteBasicAuthFilter(payload.Name+"-"+payload.Space, "/"); err != nil {
+			fmt.Printf("WARNING: There was an error removing the basic auth filter from the app: %s\n", err.Error())
+		}
+	}
+	if !foundOAuth2Filter {
+		if err := appIngress.DeleteOAuth2Filter(payload.Name+"-"+payload.Space, "/"); err != nil {
+			fmt.Printf("WARNING: There was an error removing the oauth2 filter from the app: %s\n", err.Error())
+		}
+	}
+
+	// The ip filter is only applied to the app's own virtual service, sites use their path filters.
+	if !foundIpFilter {
+		if err := appIngress.DeleteIPFilter(payload.Name+"-"+payload.Space, "/"); err != nil {
+			fmt.Printf("WARNING: There was an error removing the ip filter from the app: %s\n", err.Error())
+		}
+	}
+
 	// If we don't have a CORS filter remove it from the app and any sites it may be associated with.
 	// this is effectively a no-op if there is no CORS auth filter in the first place
 	if !foundCorsFilter {
@@ -19,6 +19,7 @@ require (
 	github.com/robfig/cron v1.2.0
 	github.com/smartystreets/goconvey v0.0.0-20190330032615-68dc04aab96a
 	github.com/stackimpact/stackimpact-go v2.3.10+incompatible
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	gopkg.in/guregu/null.v3 v3.5.0
 	k8s.io/api v0.18.5
 	k8s.io/apimachinery v0.18.5
@@ -0,0 +1,199 @@
+package router
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	structs "region-api/structs"
+	utils "region-api/utils"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+)
+
+// A hostname served directly by an app (through the sites gateway) rather than a router.
+type AppDomain struct {
+	Domain   string     `json:"domain"`
+	App      string     `json:"app"`
+	Space    string     `json:"space"`
+	Internal bool       `json:"internal"`
+	Created  *time.Time `json:"created,omitempty"`
+}
+
+func GetAppDomains(db *sql.DB, app string, space string) ([]AppDomain, error) {
+	rows, err := db.Query("select domain, app, space, internal, created from app_domains where app=$1 and space=$2 order by domain", app, space)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	domains := make([]AppDomain, 0)
+	for rows.Next() {
+		var domain AppDomain
+		var created time.Time
+		if err = rows.Scan(&domain.Domain, &domain.App, &domain.Space, &domain.Internal, &created); err != nil {
+			return nil, err
+		}
+		domain.Created = &created
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+// Checks the domain is not already a site or attached to an app.
+func appDomainInUse(db *sql.DB, domain string) (string, error) {
+	var count int
+	if err := db.QueryRow("select count(*) from routers where domain=$1", domain).Scan(&count); err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return "The domain " + domain + " is already used by a site.", nil
+	}
+	var app, space string
+	err := db.QueryRow("select app, space from app_domains where domain=$1", domain).Scan(&app, &space)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return "The domain " + domain + " is already used by the app " + app + "-" + space + ".", nil
+}
+
+func HttpAddAppDomain(db *sql.DB, params martini.Params, spec AppDomain, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	app := params["app"]
+	space := params["space"]
+	domain := strings.ToLower(strings.Trim(strings.TrimSpace(spec.Domain), "."))
+	if !isHostname(domain) || strings.Contains(domain, "*") || !strings.Contains(domain, ".") {
+		utils.ReportInvalidRequest("The domain must be a fully qualified hostname, wildcards are not supported.", r)
+		return
+	}
+	var count int
+	if err := db.QueryRow("select count(*) from spacesapps where appname=$1 and space=$2", app, space).Scan(&count); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if count == 0 {
+		utils.ReportNotFoundError(r)
+		return
+	}
+	inUse, err := appDomainInUse(db, domain)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if inUse != "" {
+		r.JSON(http.StatusConflict, structs.Messagespec{Status: http.StatusConflict, Message: inUse})
+		return
+	}
+	internal, err := utils.IsInternalSpace(db, space)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	ingress, err := GetSiteIngress(db, internal)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	// the domain is claimed before it is installed so it is never served without a record,
+	// the claim is released if the domain cannot be installed.
+	tx, err := db.Begin()
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	var created time.Time
+	if err = tx.QueryRow("insert into app_domains (domain, app, space, internal) values ($1, $2, $3, $4) returning created", domain, app, space, internal).Scan(&created); err != nil {
+		tx.Rollback()
+		utils.ReportError(err, r)
+		return
+	}
+	if err = ingress.InstallAppDomain(app, space, domain, internal); err != nil {
+		tx.Rollback()
+		if err.Error() == "virtual service was not found" {
+			utils.ReportInvalidRequest("The app "+app+"-"+space+" must be deployed before domains can be added.", r)
+			return
+		}
+		utils.ReportError(err, r)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		if e := ingress.DeleteAppDomain(app, space, domain, internal); e != nil {
+			fmt.Printf("WARNING: Unable to uninstall the domain %s from %s-%s: %s\n", domain, app, space, e.Error())
+		}
+		utils.ReportError(err, r)
+		return
+	}
+	config, err := GetDefaultIngressSiteAddresses()
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if err := SetDomainName(db, config, domain, internal, AppDNSRecordOwner(app, space)); err != nil {
+		fmt.Printf("WARNING: %s\n", err.Error())
+	}
+	r.JSON(http.StatusCreated, AppDomain{Domain: domain, App: app, Space: space, Internal: internal, Created: &created})
+}
+
+func HttpGetAppDomains(db *sql.DB, params martini.Params, r render.Render) {
+	domains, err := GetAppDomains(db, params["app"], params["space"])
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, domains)
+}
+
+func removeAppDomain(db *sql.DB, domain AppDomain) error {
+	ingress, err := GetSiteIngress(db, domain.Internal)
+	if err != nil {
+		return err
+	}
+	if err = ingress.DeleteAppDomain(domain.App, domain.Space, domain.Domain, domain.Internal); err != nil {
+		return err
+	}
+	if _, err = RemoveOwnedDomainRecordsFor(db, GetDnsProvider(), AppDNSRecordOwner(domain.App, domain.Space), domain.Domain); err != nil {
+		fmt.Printf("WARNING: Unable to remove the dns records for %s: %s\n", domain.Domain, err.Error())
+	}
+	_, err = db.Exec("delete from app_domains where domain=$1", domain.Domain)
+	return err
+}
+
+func HttpRemoveAppDomain(db *sql.DB, params martini.Params, r render.Render) {
+	domains, err := GetAppDomains(db, params["app"], params["space"])
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	for _, domain := range domains {
+		if domain.Domain == strings.ToLower(params["domain"]) {
+			if err = removeAppDomain(db, domain); err != nil {
+				utils.ReportError(err, r)
+				return
+			}
+			r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Domain " + domain.Domain + " removed"})
+			return
+		}
+	}
+	utils.ReportNotFoundError(r)
+}
+
+// Removes the custom domains of an app, this is called when an app is removed from a space.
+func RemoveAppDomains(db *sql.DB, app string, space string) {
+	domains, err := GetAppDomains(db, app, space)
+	if err != nil {
+		fmt.Printf("WARNING: Unable to get the domains for %s-%s: %s\n", app, space, err.Error())
+		return
+	}
+	for _, domain := range domains {
+		if err = removeAppDomain(db, domain); err != nil {
+			fmt.Printf("WARNING: Unable to remove the domain %s from %s-%s: %s\n", domain.Domain, app, space, err.Error())
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package router
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAppDomains(t *testing.T) {
+	Convey("Test adding custom domains to an app's virtual service", t, func() {
+		vs := VirtualService{}
+		vs.Spec.Hosts = []string{"web-default.example.com"}
+		vs.Spec.Gateways = []string{"apps-public"}
+
+		So(AddHostToVirtualService(&vs, "api.customer.com", "sites-public"), ShouldBeTrue)
+		So(vs.Spec.Hosts, ShouldResemble, []string{"web-default.example.com", "api.customer.com"})
+		So(vs.Spec.Gateways, ShouldResemble, []string{"apps-public", "sites-public"})
+		So(AddHostToVirtualService(&vs, "api.customer.com", "sites-public"), ShouldBeFalse)
+
+		So(AddHostToVirtualService(&vs, "www.customer.com", "sites-public"), ShouldBeTrue)
+		So(vs.Spec.Gateways, ShouldResemble, []string{"apps-public", "sites-public"})
+
+		So(RemoveHostFromVirtualService(&vs, "api.customer.com"), ShouldBeTrue)
+		So(vs.Spec.Hosts, ShouldResemble, []string{"web-default.example.com", "www.customer.com"})
+		So(RemoveHostFromVirtualService(&vs, "api.customer.com"), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,154 @@
+package router
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	CertificatePending = "pending"
+	CertificateIssued  = "issued"
+	CertificateFailed  = "failed"
+)
+
+// Orders and checks certificates for routers created with auto_tls, the certs package
+// provides this as it depends on the router package.
+type CertificateProvisioner interface {
+	OrderCertificate(db *sql.DB, domain string) (id string, err error)
+	// Returns pending, issued (and installed) or failed.
+	CheckCertificateOrder(db *sql.DB, id string) (status string, err error)
+}
+
+var certificateProvisioner CertificateProvisioner
+
+var ErrRouterPendingCertificate = errors.New("The router is waiting on its certificate, it will be pushed once the certificate is issued.")
+
+func SetCertificateProvisioner(provisioner CertificateProvisioner) {
+	certificateProvisioner = provisioner
+}
+
+func GetRouterAutoTLS(db *sql.DB, domain string) (autoTLS bool, status string, err error) {
+	err = db.QueryRow("select coalesce(auto_tls, false), coalesce(certificate_status, '') from routers where domain=$1", domain).Scan(&autoTLS, &status)
+	return autoTLS, status, err
+}
+
+// Whether a certificate (either for the domain or a wildcard covering it) is installed.
+func hasCertificate(db *sql.DB, domain string, internal bool) (bool, error) {
+	ingress, err := GetSiteIngress(db, internal)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range []string{domain, "*." + strings.Join(strings.Split(domain, ".")[1:], ".")} {
+		certs, err := ingress.GetInstalledCertificates(name)
+		if err != nil {
+			return false, err
+		}
+		if len(certs) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Orders a certificate for the router unless one is already installed, the router is held
+// as pending (and not pushed) until the certificate is issued.
+func OrderRouterCertificate(db *sql.DB, domain string, internal bool) (string, error) {
+	if certificateProvisioner == nil {
+		return "", errors.New("Automatic certificates are not available.")
+	}
+	exists, err := hasCertificate(db, domain, internal)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		_, err = db.Exec("update routers set certificate_status=$2, certificate_order=null where domain=$1", domain, CertificateIssued)
+		return CertificateIssued, err
+	}
+	id, err := certificateProvisioner.OrderCertificate(db, domain)
+	if err != nil {
+		if _, e := db.Exec("update routers set certificate_status=$2, certificate_order=null where domain=$1", domain, CertificateFailed); e != nil {
+			fmt.Printf("WARNING: Unable to mark the certificate for %s as failed: %s\n", domain, e.Error())
+		}
+		return CertificateFailed, err
+	}
+	_, err = db.Exec("update routers set certificate_status=$2, certificate_order=$3 where domain=$1", domain, CertificatePending, id)
+	return CertificatePending, err
+}
+
+// Whether a router with auto_tls must be held until its certificate is issued, a failed order is placed again.
+func holdForCertificate(db *sql.DB, domain string, internal bool) (bool, error) {
+	autoTLS, status, err := GetRouterAutoTLS(db, domain)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if autoTLS && status == CertificateFailed {
+		if status, err = OrderRouterCertificate(db, domain, internal); err != nil {
+			return false, err
+		}
+	}
+	return autoTLS && status == CertificatePending, nil
+}
+
+// Checks the certificate orders of routers that are pending, once issued the router is pushed.
+func PushPendingRouters(db *sql.DB) {
+	if certificateProvisioner == nil {
+		return
+	}
+	rows, err := db.Query("select domain, coalesce(internal, false), certificate_order from routers where certificate_status=$1", CertificatePending)
+	if err != nil {
+		fmt.Printf("WARNING: Unable to find routers pending certificates: %s\n", err.Error())
+		return
+	}
+	pending := make(map[string]Router)
+	orders := make(map[string]string)
+	for rows.Next() {
+		var router Router
+		var order sql.NullString
+		if err = rows.Scan(&router.Domain, &router.Internal, &order); err != nil {
+			rows.Close()
+			fmt.Printf("WARNING: Unable to find routers pending certificates: %s\n", err.Error())
+			return
+		}
+		pending[router.Domain] = router
+		orders[router.Domain] = order.String
+	}
+	rows.Close()
+	for domain, router := range pending {
+		status, err := certificateProvisioner.CheckCertificateOrder(db, orders[domain])
+		if err != nil {
+			fmt.Printf("WARNING: Unable to check the certificate order for %s: %s\n", domain, err.Error())
+			continue
+		}
+		if status == CertificatePending {
+			continue
+		}
+		if _, err = db.Exec("update routers set certificate_status=$2 where domain=$1", domain, status); err != nil {
+			fmt.Printf("WARNING: Unable to update the certificate status for %s: %s\n", domain, err.Error())
+			continue
+		}
+		if status != CertificateIssued {
+			fmt.Printf("WARNING: The certificate order for %s failed, push the router to order it again.\n", domain)
+			continue
+		}
+		paths, err := GetPaths(db, domain)
+		if err != nil {
+			fmt.Printf("WARNING: Unable to get paths for %s: %s\n", domain, err.Error())
+			continue
+		}
+		if len(paths) == 0 {
+			continue
+		}
+		ingress, err := GetSiteIngress(db, router.Internal)
+		if err != nil {
+			fmt.Printf("WARNING: Unable to get the ingress for %s: %s\n", domain, err.Error())
+			continue
+		}
+		if err = ingress.CreateOrUpdateRouter(domain, router.Internal, paths); err != nil {
+			fmt.Printf("WARNING: Unable to push %s after its certificate was issued: %s\n", domain, err.Error())
+		}
+	}
+}
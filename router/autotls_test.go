@@ -0,0 +1,21 @@
+package router
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAutoTLS(t *testing.T) {
+	Convey("Ordering a router certificate without a provisioner should fail", t, func() {
+		provisioner := certificateProvisioner
+		SetCertificateProvisioner(nil)
+		Reset(func() {
+			SetCertificateProvisioner(provisioner)
+		})
+		status, err := OrderRouterCertificate(nil, "www.example.com", false)
+		So(err, ShouldNotBeNil)
+		So(status, ShouldEqual, "")
+		PushPendingRouters(nil)
+	})
+}
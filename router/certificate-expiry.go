@@ -0,0 +1,235 @@
+package router
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/martini-contrib/render"
+	"math"
+	"net/http"
+	"os"
+	utils "region-api/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ExpiringCertificate struct {
+	Certificate
+	Ingress       string `json:"ingress"`
+	DaysRemaining int    `json:"days_remaining"`
+}
+
+type CertificateExpiryNotification struct {
+	Action      string              `json:"action"`
+	Threshold   int                 `json:"threshold"`
+	Certificate ExpiringCertificate `json:"certificate"`
+}
+
+// The results of the last scan of certificates, served by the expiring endpoint and metrics
+// so neither has to query every ingress on each request.
+var certificateScan struct {
+	sync.Mutex
+	scanned      time.Time
+	certificates []ExpiringCertificate
+}
+
+var certificateScanMaxAge = time.Hour
+
+func GetCertificateExpiryThresholds() []int {
+	thresholds := make([]int, 0)
+	val := os.Getenv("CERTIFICATE_EXPIRY_THRESHOLDS")
+	if val == "" {
+		val = "30,14,7,1"
+	}
+	for _, t := range strings.Split(val, ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(t))
+		if err != nil || days < 0 {
+			fmt.Printf("WARNING: Invalid certificate expiry threshold %s, it will be ignored.\n", t)
+			continue
+		}
+		thresholds = append(thresholds, days)
+	}
+	sort.Ints(thresholds)
+	return thresholds
+}
+
+func daysRemaining(expires int64, now time.Time) int {
+	return int(math.Floor(time.Unix(expires, 0).Sub(now).Hours() / 24))
+}
+
+// Returns the smallest threshold the certificate has crossed, or -1 if it has not crossed any.
+func crossedThreshold(days int, thresholds []int) int {
+	for _, threshold := range thresholds {
+		if days <= threshold {
+			return threshold
+		}
+	}
+	return -1
+}
+
+func ScanInstalledCertificates(db *sql.DB) ([]ExpiringCertificate, error) {
+	now := time.Now()
+	certificates := make([]ExpiringCertificate, 0)
+	for _, internal := range []bool{false, true} {
+		ingress, err := GetSiteIngress(db, internal)
+		if err != nil {
+			return nil, err
+		}
+		installed, err := ingress.GetInstalledCertificates("*")
+		if err != nil {
+			return nil, err
+		}
+		name := "public"
+		if internal {
+			name = "private"
+		}
+		for _, cert := range installed {
+			certificates = append(certificates, ExpiringCertificate{Certificate: cert, Ingress: name, DaysRemaining: daysRemaining(cert.Expires, now)})
+		}
+	}
+	sort.Slice(certificates, func(i, j int) bool {
+		return certificates[i].Expires < certificates[j].Expires
+	})
+	certificateScan.Lock()
+	certificateScan.scanned = now
+	certificateScan.certificates = certificates
+	certificateScan.Unlock()
+	return certificates, nil
+}
+
+func getScannedCertificates(db *sql.DB) ([]ExpiringCertificate, time.Time, error) {
+	certificateScan.Lock()
+	scanned := certificateScan.scanned
+	certificates := certificateScan.certificates
+	certificateScan.Unlock()
+	if scanned.IsZero() || time.Since(scanned) > certificateScanMaxAge {
+		certificates, err := ScanInstalledCertificates(db)
+		return certificates, time.Now(), err
+	}
+	return certificates, scanned, nil
+}
+
+func sendCertificateExpiryNotification(webhook string, notification CertificateExpiryNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: time.Second * 10}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("The webhook %s responded with %d", webhook, resp.StatusCode)
+	}
+	return nil
+}
+
+// Scans the installed certificates on all site ingresses and notifies the webhook once for each
+// threshold a certificate crosses, a renewed certificate (with a new expiration) is notified again.
+func CheckCertificateExpiry(db *sql.DB) {
+	certificates, err := ScanInstalledCertificates(db)
+	if err != nil {
+		fmt.Printf("WARNING: Unable to scan installed certificates for expiry: %s\n", err.Error())
+		return
+	}
+	webhook := os.Getenv("CERTIFICATE_EXPIRY_WEBHOOK")
+	if webhook == "" {
+		return
+	}
+	thresholds := GetCertificateExpiryThresholds()
+	for _, cert := range certificates {
+		threshold := crossedThreshold(cert.DaysRemaining, thresholds)
+		if threshold == -1 && !cert.Expired {
+			continue
+		}
+		action := "certificate_expiring"
+		if cert.Expired {
+			action = "certificate_expired"
+			threshold = 0
+		}
+		var notified bool
+		if err := db.QueryRow("select exists(select 1 from certificate_expiry_notifications where name=$1 and ingress=$2 and expires=$3 and threshold=$4)", cert.Name, cert.Ingress, cert.Expires, threshold).Scan(&notified); err != nil {
+			fmt.Printf("WARNING: Unable to check certificate expiry notifications for %s: %s\n", cert.Name, err.Error())
+			continue
+		}
+		if notified {
+			continue
+		}
+		if err := sendCertificateExpiryNotification(webhook, CertificateExpiryNotification{Action: action, Threshold: threshold, Certificate: cert}); err != nil {
+			fmt.Printf("WARNING: Unable to send certificate expiry notification for %s: %s\n", cert.Name, err.Error())
+			continue
+		}
+		if _, err := db.Exec("insert into certificate_expiry_notifications (name, ingress, expires, threshold, notified) values ($1, $2, $3, $4, now())", cert.Name, cert.Ingress, cert.Expires, threshold); err != nil {
+			fmt.Printf("WARNING: Unable to record certificate expiry notification for %s: %s\n", cert.Name, err.Error())
+		}
+	}
+}
+
+func HttpGetExpiringCertificates(db *sql.DB, req *http.Request, r render.Render) {
+	days := 30
+	if val := req.URL.Query().Get("days"); val != "" {
+		d, err := strconv.Atoi(val)
+		if err != nil || d < 0 {
+			utils.ReportInvalidRequest("The days parameter must be a positive whole number.", r)
+			return
+		}
+		days = d
+	}
+	certificates, _, err := getScannedCertificates(db)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	expiring := make([]ExpiringCertificate, 0)
+	for _, cert := range certificates {
+		if cert.DaysRemaining <= days {
+			expiring = append(expiring, cert)
+		}
+	}
+	r.JSON(http.StatusOK, expiring)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.Replace(strings.Replace(strings.Replace(value, "\\", "\\\\", -1), "\"", "\\\"", -1), "\n", "\\n", -1)
+}
+
+// Renders the certificate expiry in the prometheus text exposition format.
+func CertificateExpiryMetrics(certificates []ExpiringCertificate, scanned time.Time) string {
+	var out strings.Builder
+	now := time.Now()
+	out.WriteString("# HELP region_api_certificate_expiry_days Days until the installed certificate expires.\n")
+	out.WriteString("# TYPE region_api_certificate_expiry_days gauge\n")
+	for _, cert := range certificates {
+		days := time.Unix(cert.Expires, 0).Sub(now).Hours() / 24
+		out.WriteString(fmt.Sprintf("region_api_certificate_expiry_days{name=\"%s\",ingress=\"%s\",type=\"%s\"} %s\n", escapeLabelValue(cert.Name), cert.Ingress, cert.Type, strconv.FormatFloat(days, 'f', 2, 64)))
+	}
+	out.WriteString("# HELP region_api_certificate_expired Whether the installed certificate has expired.\n")
+	out.WriteString("# TYPE region_api_certificate_expired gauge\n")
+	for _, cert := range certificates {
+		expired := 0
+		if cert.Expired {
+			expired = 1
+		}
+		out.WriteString(fmt.Sprintf("region_api_certificate_expired{name=\"%s\",ingress=\"%s\",type=\"%s\"} %d\n", escapeLabelValue(cert.Name), cert.Ingress, cert.Type, expired))
+	}
+	out.WriteString("# HELP region_api_certificate_scan_timestamp_seconds When the installed certificates were last scanned.\n")
+	out.WriteString("# TYPE region_api_certificate_scan_timestamp_seconds gauge\n")
+	out.WriteString(fmt.Sprintf("region_api_certificate_scan_timestamp_seconds %d\n", scanned.Unix()))
+	return out.String()
+}
+
+func HttpGetCertificateMetrics(db *sql.DB, r render.Render) {
+	certificates, scanned, err := getScannedCertificates(db)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Text(http.StatusOK, CertificateExpiryMetrics(certificates, scanned))
+}
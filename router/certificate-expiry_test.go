@@ -0,0 +1,50 @@
+package router
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCertificateExpiry(t *testing.T) {
+	Convey("Test certificate expiry monitoring", t, func() {
+		now := time.Now()
+
+		Convey("Days remaining should round down and be negative once expired", func() {
+			So(daysRemaining(now.Add(time.Hour*24*30+time.Hour).Unix(), now), ShouldEqual, 30)
+			So(daysRemaining(now.Add(time.Hour*23).Unix(), now), ShouldEqual, 0)
+			So(daysRemaining(now.Add(-time.Hour).Unix(), now), ShouldEqual, -1)
+		})
+
+		Convey("Thresholds should default, be sorted and ignore invalid values", func() {
+			os.Setenv("CERTIFICATE_EXPIRY_THRESHOLDS", "")
+			So(GetCertificateExpiryThresholds(), ShouldResemble, []int{1, 7, 14, 30})
+			os.Setenv("CERTIFICATE_EXPIRY_THRESHOLDS", "10, 3,abc,-2")
+			So(GetCertificateExpiryThresholds(), ShouldResemble, []int{3, 10})
+			os.Unsetenv("CERTIFICATE_EXPIRY_THRESHOLDS")
+		})
+
+		Convey("Only the smallest threshold crossed should be used", func() {
+			thresholds := []int{1, 7, 14, 30}
+			So(crossedThreshold(45, thresholds), ShouldEqual, -1)
+			So(crossedThreshold(30, thresholds), ShouldEqual, 30)
+			So(crossedThreshold(10, thresholds), ShouldEqual, 14)
+			So(crossedThreshold(0, thresholds), ShouldEqual, 1)
+		})
+
+		Convey("Metrics should be rendered in the prometheus text format", func() {
+			certificates := []ExpiringCertificate{
+				{Certificate: Certificate{Name: "www-example-com-tls", Type: "normal", Expires: now.Add(time.Hour * 24 * 10).Unix()}, Ingress: "public", DaysRemaining: 10},
+				{Certificate: Certificate{Name: "old-example-com-tls", Type: "normal", Expires: now.Add(-time.Hour * 24).Unix(), Expired: true}, Ingress: "private", DaysRemaining: -1},
+			}
+			metrics := CertificateExpiryMetrics(certificates, now)
+			So(metrics, ShouldContainSubstring, "# TYPE region_api_certificate_expiry_days gauge\n")
+			So(metrics, ShouldContainSubstring, "region_api_certificate_expiry_days{name=\"www-example-com-tls\",ingress=\"public\",type=\"normal\"} 10.00\n")
+			So(metrics, ShouldContainSubstring, "region_api_certificate_expired{name=\"old-example-com-tls\",ingress=\"private\",type=\"normal\"} 1\n")
+			So(metrics, ShouldContainSubstring, "region_api_certificate_expired{name=\"www-example-com-tls\",ingress=\"public\",type=\"normal\"} 0\n")
+			So(escapeLabelValue("a\"b\\c"), ShouldEqual, "a\\\"b\\\\c")
+		})
+	})
+}
@@ -0,0 +1,390 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+	"net/http"
+	structs "region-api/structs"
+	utils "region-api/utils"
+	"strings"
+	"time"
+)
+
+// A certificate issued outside of region-api (e.g., an EV or partner issued certificate)
+// uploaded as PEM, the chain is optional if the certificate field contains the full bundle.
+type CertificateUpload struct {
+	Certificate    string `json:"certificate"`
+	Chain          string `json:"chain,omitempty"`
+	Key            string `json:"key"`
+	Domain         string `json:"domain,omitempty"`
+	AllowPrivateCA bool   `json:"allow_private_ca,omitempty"`
+}
+
+type InstalledCertificate struct {
+	Name         string   `json:"name"`
+	CommonName   string   `json:"common_name"`
+	Alternatives []string `json:"alternatives"`
+	Expires      int64    `json:"expires"`
+	Issuer       string   `json:"issuer"`
+	Sites        []string `json:"sites"`
+}
+
+// The secret name a certificate is installed as, see CertificateToSecret
+func certificateSecretName(common_name string) string {
+	return strings.Replace(strings.Replace(common_name, "*.", "star.", -1), ".", "-", -1) + "-tls"
+}
+
+// Ensures the uploaded certificate is usable before it's installed: the key must match the
+// certificate, the chain must verify, it must cover the requested domain and be currently valid.
+// Returns the decoded certificate, the certificate with its chain and the key.
+func ValidateCertificateUpload(upload CertificateUpload, now time.Time) (*x509.Certificate, []byte, []byte, error) {
+	if strings.TrimSpace(upload.Certificate) == "" {
+		return nil, nil, nil, errors.New("The certificate cannot be blank.")
+	}
+	if strings.TrimSpace(upload.Key) == "" {
+		return nil, nil, nil, errors.New("The private key cannot be blank.")
+	}
+	bundle := strings.TrimSpace(upload.Certificate) + "\n"
+	if strings.TrimSpace(upload.Chain) != "" {
+		bundle = bundle + strings.TrimSpace(upload.Chain) + "\n"
+	}
+	x509_decoded_cert, pem_cert, pem_chain, err := DecodeCertificateBundle(upload.Domain, []byte(bundle))
+	if err != nil {
+		return nil, nil, nil, errors.New("The certificate or chain could not be decoded: " + err.Error())
+	}
+	if _, err := tls.X509KeyPair(pem_cert, []byte(upload.Key)); err != nil {
+		return nil, nil, nil, errors.New("The private key does not match the certificate: " + err.Error())
+	}
+	if x509_decoded_cert.Subject.CommonName == "" {
+		return nil, nil, nil, errors.New("The certificate must have a common name.")
+	}
+	if now.Before(x509_decoded_cert.NotBefore) {
+		return nil, nil, nil, errors.New("The certificate is not valid until " + x509_decoded_cert.NotBefore.Format(time.RFC3339) + ".")
+	}
+	if now.After(x509_decoded_cert.NotAfter) {
+		return nil, nil, nil, errors.New("The certificate expired on " + x509_decoded_cert.NotAfter.Format(time.RFC3339) + ".")
+	}
+	if upload.Domain != "" {
+		if err := x509_decoded_cert.VerifyHostname(upload.Domain); err != nil {
+			return nil, nil, nil, errors.New("The certificate is not valid for " + upload.Domain + ": " + err.Error())
+		}
+	}
+
+	intermediates := x509.NewCertPool()
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+	for rest := pem_chain; len(rest) > 0; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, nil, errors.New("The certificate chain could not be decoded: " + err.Error())
+		}
+		if upload.AllowPrivateCA && cert.IsCA && cert.CheckSignatureFrom(cert) == nil {
+			roots.AddCert(cert)
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if _, err := x509_decoded_cert.Verify(x509.VerifyOptions{Intermediates: intermediates, Roots: roots, CurrentTime: now}); err != nil {
+		return nil, nil, nil, errors.New("The certificate chain could not be verified: " + err.Error())
+	}
+	return x509_decoded_cert, append(pem_cert, pem_chain...), []byte(upload.Key), nil
+}
+
+// Whether a domain is one of the names or matches a wildcard name, a wildcard only covers one label.
+func certificateCoversDomain(names []string, domain string) bool {
+	for _, name := range names {
+		if name == domain || (strings.HasPrefix(name, "*.") && "*."+strings.Join(strings.Split(domain, ".")[1:], ".") == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// The name of the unexpired certificate (with the latest expiry) whose alternative names cover the
+// domain, or an empty string if there is none.
+func alternativeCertificateName(certificates []Certificate, domain string) string {
+	var found *Certificate
+	for i, c := range certificates {
+		if !c.Expired && certificateCoversDomain(c.Alternatives, domain) && (found == nil || c.Expires > found.Expires) {
+			found = &certificates[i]
+		}
+	}
+	if found == nil {
+		return ""
+	}
+	return found.Name
+}
+
+// The common name and alternative names of an installed certificate, only the common name is
+// returned if the certificate is not installed on either site ingress.
+func installedCertificateNames(db *sql.DB, common_name string) ([]string, error) {
+	names := []string{common_name}
+	for _, internal := range []bool{false, true} {
+		ingress, err := GetSiteIngress(db, internal)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := ingress.GetInstalledCertificates(common_name)
+		if err != nil {
+			return nil, err
+		}
+		for _, cert := range certs {
+			names = append(names, cert.Alternatives...)
+		}
+	}
+	return names, nil
+}
+
+// Finds the sites a certificate covers, either an exact or a wildcard match on the certificate's
+// common name or any of its alternative names.
+func sitesForCertificate(db *sql.DB, names []string) ([]Router, error) {
+	rows, err := db.Query("select domain, coalesce(internal, false) from routers")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sites := make([]Router, 0)
+	for rows.Next() {
+		var site Router
+		if err := rows.Scan(&site.Domain, &site.Internal); err != nil {
+			return nil, err
+		}
+		if certificateCoversDomain(names, site.Domain) {
+			sites = append(sites, site)
+		}
+	}
+	return sites, nil
+}
+
+// Installs the certificate on the ingresses of the sites that use it (or all site ingresses if no
+// site uses it yet) and pushes those sites so their gateways pick up the certificate.
+func installUploadedCertificate(db *sql.DB, x509_decoded_cert *x509.Certificate, pem_bundle []byte, pem_key []byte) (*InstalledCertificate, error) {
+	sites, err := sitesForCertificate(db, append([]string{x509_decoded_cert.Subject.CommonName}, x509_decoded_cert.DNSNames...))
+	if err != nil {
+		return nil, err
+	}
+	ingresses := make(map[bool]bool)
+	if len(sites) == 0 {
+		ingresses[false] = true
+		ingresses[true] = true
+	}
+	for _, site := range sites {
+		ingresses[site.Internal] = true
+	}
+	for internal := range ingresses {
+		ingress, err := GetSiteIngress(db, internal)
+		if err != nil {
+			return nil, err
+		}
+		if err = ingress.InstallCertificate(x509_decoded_cert.Subject.CommonName, pem_bundle, pem_key); err != nil {
+			return nil, err
+		}
+	}
+	installed := InstalledCertificate{
+		Name:         certificateSecretName(x509_decoded_cert.Subject.CommonName),
+		CommonName:   x509_decoded_cert.Subject.CommonName,
+		Alternatives: x509_decoded_cert.DNSNames,
+		Expires:      x509_decoded_cert.NotAfter.Unix(),
+		Issuer:       x509_decoded_cert.Issuer.CommonName,
+		Sites:        make([]string, 0),
+	}
+	for _, site := range sites {
+		installed.Sites = append(installed.Sites, site.Domain)
+		paths, err := GetPaths(db, site.Domain)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			continue
+		}
+		ingress, err := GetSiteIngress(db, site.Internal)
+		if err != nil {
+			return nil, err
+		}
+		if err = ingress.CreateOrUpdateRouter(site.Domain, site.Internal, paths); err != nil {
+			fmt.Printf("WARNING: Unable to push site %s after installing certificate %s: %s\n", site.Domain, installed.Name, err.Error())
+		}
+	}
+	return &installed, nil
+}
+
+// Removes a certificate that is being deleted or was revoked, the sites using it are taken off
+// of its gateway servers and pushed again so they fall back to a wildcard or the default certificate.
+func UninstallCertificate(db *sql.DB, common_name string) error {
+	names, err := installedCertificateNames(db, common_name)
+	if err != nil {
+		return err
+	}
+	sites, err := sitesForCertificate(db, names)
+	if err != nil {
+		return err
+	}
+	for _, site := range sites {
+		ingress, err := GetSiteIngress(db, site.Internal)
+		if err != nil {
+			return err
+		}
+		if err = ingress.DeleteUberSiteGateway(site.Domain, certificateSecretName(common_name), site.Internal, 0); err != nil {
+			return err
+		}
+	}
+	for _, internal := range []bool{false, true} {
+		ingress, err := GetSiteIngress(db, internal)
+		if err != nil {
+			return err
+		}
+		if err = ingress.DeleteCertificate(common_name); err != nil {
+			return err
+		}
+	}
+	for _, site := range sites {
+		paths, err := GetPaths(db, site.Domain)
+		if err != nil {
+			return err
+		}
+		if len(paths) == 0 {
+			continue
+		}
+		ingress, err := GetSiteIngress(db, site.Internal)
+		if err != nil {
+			return err
+		}
+		if err = ingress.CreateOrUpdateRouter(site.Domain, site.Internal, paths); err != nil {
+			fmt.Printf("WARNING: Unable to push site %s after removing certificate %s: %s\n", site.Domain, common_name, err.Error())
+		}
+	}
+	return nil
+}
+
+func certificateInstalled(db *sql.DB, common_name string) (bool, error) {
+	for _, internal := range []bool{false, true} {
+		ingress, err := GetSiteIngress(db, internal)
+		if err != nil {
+			return false, err
+		}
+		certs, err := ingress.GetInstalledCertificates(common_name)
+		if err != nil {
+			return false, err
+		}
+		if len(certs) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func HttpUploadCertificate(db *sql.DB, spec CertificateUpload, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	x509_decoded_cert, pem_bundle, pem_key, err := ValidateCertificateUpload(spec, time.Now())
+	if err != nil {
+		utils.ReportInvalidRequest(err.Error(), r)
+		return
+	}
+	exists, err := certificateInstalled(db, x509_decoded_cert.Subject.CommonName)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if exists {
+		r.JSON(http.StatusConflict, structs.Messagespec{Status: http.StatusConflict, Message: "A certificate for " + x509_decoded_cert.Subject.CommonName + " is already installed, replace it instead."})
+		return
+	}
+	installed, err := installUploadedCertificate(db, x509_decoded_cert, pem_bundle, pem_key)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusCreated, installed)
+}
+
+func HttpReplaceCertificate(db *sql.DB, params martini.Params, spec CertificateUpload, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	common_name := strings.Replace(params["domain"], "star.", "*.", 1)
+	x509_decoded_cert, pem_bundle, pem_key, err := ValidateCertificateUpload(spec, time.Now())
+	if err != nil {
+		utils.ReportInvalidRequest(err.Error(), r)
+		return
+	}
+	if x509_decoded_cert.Subject.CommonName != common_name {
+		utils.ReportInvalidRequest("The certificate's common name "+x509_decoded_cert.Subject.CommonName+" does not match "+common_name+".", r)
+		return
+	}
+	exists, err := certificateInstalled(db, common_name)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if !exists {
+		utils.ReportNotFoundError(r)
+		return
+	}
+	installed, err := installUploadedCertificate(db, x509_decoded_cert, pem_bundle, pem_key)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, installed)
+}
+
+func HttpDeleteCertificate(db *sql.DB, params martini.Params, r render.Render) {
+	common_name := strings.Replace(params["domain"], "star.", "*.", 1)
+	exists, err := certificateInstalled(db, common_name)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if !exists {
+		utils.ReportNotFoundError(r)
+		return
+	}
+	names, err := installedCertificateNames(db, common_name)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	sites, err := sitesForCertificate(db, names)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if len(sites) > 0 {
+		names := make([]string, 0)
+		for _, site := range sites {
+			names = append(names, site.Domain)
+		}
+		r.JSON(http.StatusConflict, structs.Messagespec{Status: http.StatusConflict, Message: "The certificate is in use by " + strings.Join(names, ", ") + ", remove or replace it instead."})
+		return
+	}
+	for _, internal := range []bool{false, true} {
+		ingress, err := GetSiteIngress(db, internal)
+		if err != nil {
+			utils.ReportError(err, r)
+			return
+		}
+		if err = ingress.DeleteCertificate(common_name); err != nil {
+			utils.ReportError(err, r)
+			return
+		}
+	}
+	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Certificate Deleted"})
+}
@@ -0,0 +1,120 @@
+package router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func createTestCertificate(cn string, names []string, isCA bool, notBefore time.Time, notAfter time.Time, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              names,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	So(err, ShouldBeNil)
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	So(err, ShouldBeNil)
+	return cert, key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+func TestCertificateUpload(t *testing.T) {
+	Convey("Test validating uploaded certificates", t, func() {
+		now := time.Now()
+		ca, caKey, caPem, _ := createTestCertificate("Test Root CA", nil, true, now.Add(-time.Hour), now.Add(time.Hour*24*365), nil, nil)
+		_, _, leafPem, leafKey := createTestCertificate("www.example.com", []string{"www.example.com", "example.com"}, false, now.Add(-time.Hour), now.Add(time.Hour*24*90), ca, caKey)
+		_, _, _, otherKey := createTestCertificate("www.example.com", []string{"www.example.com"}, false, now.Add(-time.Hour), now.Add(time.Hour*24*90), ca, caKey)
+		_, _, expiredPem, expiredKey := createTestCertificate("www.example.com", []string{"www.example.com"}, false, now.Add(-time.Hour*48), now.Add(-time.Hour*24), ca, caKey)
+
+		Convey("A certificate with a matching key, valid chain and SAN should be accepted", func() {
+			cert, bundle, key, err := ValidateCertificateUpload(CertificateUpload{Certificate: leafPem, Chain: caPem, Key: leafKey, Domain: "example.com", AllowPrivateCA: true}, now)
+			So(err, ShouldBeNil)
+			So(cert.Subject.CommonName, ShouldEqual, "www.example.com")
+			So(string(key), ShouldEqual, leafKey)
+			So(string(bundle), ShouldContainSubstring, "BEGIN CERTIFICATE")
+			So(certificateSecretName(cert.Subject.CommonName), ShouldEqual, "www-example-com-tls")
+			So(certificateSecretName("*.example.com"), ShouldEqual, "star-example-com-tls")
+		})
+
+		Convey("A certificate with a key that does not match should be rejected", func() {
+			_, _, _, err := ValidateCertificateUpload(CertificateUpload{Certificate: leafPem, Chain: caPem, Key: otherKey, AllowPrivateCA: true}, now)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A certificate that does not cover the domain should be rejected", func() {
+			_, _, _, err := ValidateCertificateUpload(CertificateUpload{Certificate: leafPem, Chain: caPem, Key: leafKey, Domain: "api.example.com", AllowPrivateCA: true}, now)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("An expired certificate should be rejected", func() {
+			_, _, _, err := ValidateCertificateUpload(CertificateUpload{Certificate: expiredPem, Chain: caPem, Key: expiredKey, AllowPrivateCA: true}, now)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A certificate from an untrusted authority should be rejected", func() {
+			_, _, _, err := ValidateCertificateUpload(CertificateUpload{Certificate: leafPem, Chain: caPem, Key: leafKey}, now)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A blank certificate or key should be rejected", func() {
+			_, _, _, err := ValidateCertificateUpload(CertificateUpload{Key: leafKey}, now)
+			So(err, ShouldNotBeNil)
+			_, _, _, err = ValidateCertificateUpload(CertificateUpload{Certificate: leafPem}, now)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCertificateSites(t *testing.T) {
+	Convey("Test finding the sites a certificate covers", t, func() {
+		Convey("The common name should match exactly or as a wildcard", func() {
+			So(certificateCoversDomain([]string{"www.example.com"}, "www.example.com"), ShouldBeTrue)
+			So(certificateCoversDomain([]string{"*.example.com"}, "api.example.com"), ShouldBeTrue)
+			So(certificateCoversDomain([]string{"*.example.com"}, "a.api.example.com"), ShouldBeFalse)
+			So(certificateCoversDomain([]string{"*.example.com"}, "example.com"), ShouldBeFalse)
+		})
+
+		Convey("Sites covered only by an alternative name should match", func() {
+			names := []string{"www.example.com", "www.example.com", "example.com", "*.apps.example.com"}
+			So(certificateCoversDomain(names, "example.com"), ShouldBeTrue)
+			So(certificateCoversDomain(names, "api.apps.example.com"), ShouldBeTrue)
+			So(certificateCoversDomain(names, "api.example.com"), ShouldBeFalse)
+			So(certificateCoversDomain([]string{}, "example.com"), ShouldBeFalse)
+		})
+
+		Convey("The gateway should use the unexpired certificate with an alternative name that expires last", func() {
+			now := time.Now()
+			certificates := []Certificate{
+				Certificate{Name: "www-example-com-tls", Alternatives: []string{"www.example.com", "example.com"}, Expires: now.Add(time.Hour * 24).Unix()},
+				Certificate{Name: "example-net-tls", Alternatives: []string{"example.net", "example.com"}, Expires: now.Add(time.Hour * 48).Unix()},
+				Certificate{Name: "old-example-com-tls", Alternatives: []string{"example.com"}, Expires: now.Add(time.Hour * 96).Unix(), Expired: true},
+			}
+			So(alternativeCertificateName(certificates, "example.com"), ShouldEqual, "example-net-tls")
+			So(alternativeCertificateName(certificates, "www.example.com"), ShouldEqual, "www-example-com-tls")
+			So(alternativeCertificateName(certificates, "api.example.com"), ShouldEqual, "")
+		})
+	})
+}
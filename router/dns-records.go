@@ -0,0 +1,396 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	utils "region-api/utils"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+)
+
+const DefaultDomainRecordTTL int64 = 300
+const MaxDomainRecordTTL int64 = 604800
+
+// The record types that may be managed through the domains api.
+var ManagedDomainRecordTypes = []string{"A", "AAAA", "CNAME", "MX", "TXT", "CAA", "SRV"}
+
+// Record types that may be set on the root of the domain, the others would replace the records
+// the domain itself relies on.
+var rootDomainRecordTypes = map[string]bool{"MX": true, "TXT": true, "CAA": true}
+
+type DomainRecordChanges struct {
+	Changes []DomainRecordChange `json:"changes"`
+}
+
+type DomainRecordChangeResult struct {
+	Action string       `json:"action"`
+	Record DomainRecord `json:"record"`
+	// applied, invalid, failed or skipped (another change in the batch was invalid).
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type DomainRecordChangesResult struct {
+	Applied bool                       `json:"applied"`
+	Results []DomainRecordChangeResult `json:"results"`
+}
+
+func IsManagedDomainRecordType(recordType string) bool {
+	for _, t := range ManagedDomainRecordTypes {
+		if strings.ToUpper(recordType) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a record can be removed, optionally only records of one type. The root of the domain only
+// allows removing the record types that can be created on it, and only when the type is given so
+// one request can't remove all of the domain's mail, verification and CAA records.
+func IsRemovableDomainRecord(recordType string, root bool, only string) bool {
+	recordType = strings.ToUpper(recordType)
+	if !IsManagedDomainRecordType(recordType) || (only != "" && strings.ToUpper(only) != recordType) {
+		return false
+	}
+	return !root || (only != "" && rootDomainRecordTypes[recordType])
+}
+
+// Returns the change that removes a value from a record, the record is deleted when it was its last
+// value and otherwise updated with the values that remain. Returns false if the record doesn't have
+// the value.
+func RemoveDomainRecordValue(record DomainRecord, value string) (DomainRecordChange, bool) {
+	remaining := make([]string, 0)
+	found := false
+	for _, v := range record.Values {
+		if v == value {
+			found = true
+		} else {
+			remaining = append(remaining, v)
+		}
+	}
+	if !found {
+		return DomainRecordChange{}, false
+	}
+	if len(remaining) == 0 {
+		return DomainRecordChange{Action: "delete", Record: record}, true
+	}
+	record.Values = remaining
+	return DomainRecordChange{Action: "upsert", Record: record}, true
+}
+
+func parseUint16(value string, field string) error {
+	if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+		return errors.New("The " + field + " " + value + " must be a number between 0 and 65535.")
+	}
+	return nil
+}
+
+func isHostname(value string) bool {
+	value = strings.TrimSuffix(value, ".")
+	if value == "" || len(value) > 253 || strings.ContainsAny(value, " \t\"") {
+		return false
+	}
+	for _, label := range strings.Split(value, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// Quotes a txt value (if it isn't already), values longer than 255 characters are split
+// into multiple strings.
+func quoteTXT(value string) string {
+	if strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") && len(value) > 1 {
+		return value
+	}
+	value = strings.Replace(strings.Replace(value, "\\", "\\\\", -1), "\"", "\\\"", -1)
+	quoted := make([]string, 0)
+	for len(value) > 255 {
+		split := 255
+		// do not split an escape sequence
+		for split > 0 && value[split-1] == '\\' {
+			split--
+		}
+		quoted = append(quoted, "\""+value[:split]+"\"")
+		value = value[split:]
+	}
+	return strings.Join(append(quoted, "\""+value+"\""), " ")
+}
+
+func normalizeDomainRecordValue(recordType string, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch recordType {
+	case "A":
+		if ip := net.ParseIP(value); ip == nil || ip.To4() == nil {
+			return "", errors.New("The value " + value + " is not an IPv4 address.")
+		}
+	case "AAAA":
+		if ip := net.ParseIP(value); ip == nil || ip.To4() != nil {
+			return "", errors.New("The value " + value + " is not an IPv6 address.")
+		}
+	case "CNAME":
+		if !isHostname(value) {
+			return "", errors.New("The value " + value + " is not a hostname.")
+		}
+	case "MX":
+		// <priority> <host>
+		fields := strings.Fields(value)
+		if len(fields) != 2 || !isHostname(fields[1]) {
+			return "", errors.New("The MX value " + value + " must be in the format '<priority> <host>'.")
+		}
+		if err := parseUint16(fields[0], "priority"); err != nil {
+			return "", err
+		}
+		value = strings.Join(fields, " ")
+	case "SRV":
+		// <priority> <weight> <port> <target>
+		fields := strings.Fields(value)
+		if len(fields) != 4 || !isHostname(fields[3]) {
+			return "", errors.New("The SRV value " + value + " must be in the format '<priority> <weight> <port> <target>'.")
+		}
+		for i, field := range []string{"priority", "weight", "port"} {
+			if err := parseUint16(fields[i], field); err != nil {
+				return "", err
+			}
+		}
+		value = strings.Join(fields, " ")
+	case "CAA":
+		// <flags> <tag> "<value>"
+		fields := strings.SplitN(value, " ", 3)
+		if len(fields) != 3 {
+			return "", errors.New("The CAA value " + value + " must be in the format '<flags> <tag> \"<value>\"'.")
+		}
+		if flags, err := strconv.ParseUint(fields[0], 10, 8); err != nil || (flags != 0 && flags != 128) {
+			return "", errors.New("The CAA flags " + fields[0] + " must be 0 or 128.")
+		}
+		if fields[1] != "issue" && fields[1] != "issuewild" && fields[1] != "iodef" {
+			return "", errors.New("The CAA tag " + fields[1] + " must be issue, issuewild or iodef.")
+		}
+		caa := strings.TrimSpace(fields[2])
+		if !strings.HasPrefix(caa, "\"") {
+			caa = "\"" + strings.Replace(caa, "\"", "\\\"", -1) + "\""
+		}
+		value = fields[0] + " " + fields[1] + " " + caa
+	case "TXT":
+		value = quoteTXT(value)
+	}
+	return value, nil
+}
+
+// Validates the type and name of a record are ones that can be managed in the domain (zone).
+func NormalizeDomainRecordName(domain string, record DomainRecord) (DomainRecord, error) {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	record.Type = strings.ToUpper(strings.TrimSpace(record.Type))
+	record.Name = strings.ToLower(strings.Trim(strings.TrimSpace(record.Name), "."))
+	record.Domain = nil
+	if !IsManagedDomainRecordType(record.Type) {
+		return record, errors.New("Only " + strings.Join(ManagedDomainRecordTypes, ", ") + " records may be managed in a domain.")
+	}
+	if record.Name == "" {
+		return record, errors.New("Entries cannot be changed for the root domain.")
+	}
+	if record.Name == domain && !rootDomainRecordTypes[record.Type] {
+		return record, errors.New("Only MX, TXT and CAA entries can be changed for the root domain.")
+	}
+	if record.Name != domain && !strings.HasSuffix(record.Name, "."+domain) {
+		return record, errors.New("The entry " + record.Name + " is not in the domain " + domain + ".")
+	}
+	return record, nil
+}
+
+// Validates a record for the domain (zone) and returns it in the form the provider expects,
+// e.g., with its type upper cased and txt values quoted.
+func NormalizeDomainRecord(domain string, record DomainRecord) (DomainRecord, error) {
+	record, err := NormalizeDomainRecordName(domain, record)
+	if err != nil {
+		return record, err
+	}
+	if record.TTL < 0 || record.TTL > MaxDomainRecordTTL {
+		return record, fmt.Errorf("The ttl must be between 0 (the default of %d) and %d seconds.", DefaultDomainRecordTTL, MaxDomainRecordTTL)
+	}
+	if record.Weight != nil || record.SetIdentifier != "" {
+		if record.Weight == nil || record.SetIdentifier == "" {
+			return record, errors.New("Weighted entries must have both a weight and a set_identifier.")
+		}
+		if *record.Weight < 0 || *record.Weight > 255 {
+			return record, errors.New("The weight must be between 0 and 255.")
+		}
+	}
+	if record.Alias != nil {
+		if record.Type != "A" && record.Type != "AAAA" && record.Type != "CNAME" {
+			return record, errors.New("Only A, AAAA and CNAME entries can be an alias.")
+		}
+		if len(record.Values) > 0 || record.TTL != 0 {
+			return record, errors.New("An alias cannot have values or a ttl, they come from its target.")
+		}
+		if !isHostname(record.Alias.Target) {
+			return record, errors.New("The alias target " + record.Alias.Target + " is not a hostname.")
+		}
+		return record, nil
+	}
+	if len(record.Values) == 0 {
+		return record, errors.New("The entry " + record.Name + " must have at least one value.")
+	}
+	if record.Type == "CNAME" && len(record.Values) != 1 {
+		return record, errors.New("A CNAME entry must have exactly one value.")
+	}
+	values := make([]string, 0)
+	for _, value := range record.Values {
+		normalized, err := normalizeDomainRecordValue(record.Type, value)
+		if err != nil {
+			return record, err
+		}
+		values = append(values, normalized)
+	}
+	record.Values = values
+	if record.TTL == 0 {
+		record.TTL = DefaultDomainRecordTTL
+	}
+	return record, nil
+}
+
+func sameDomainRecord(a DomainRecord, b DomainRecord) bool {
+	return strings.ToLower(a.Name) == strings.ToLower(b.Name) && strings.ToUpper(a.Type) == strings.ToUpper(b.Type) && a.SetIdentifier == b.SetIdentifier
+}
+
+// Returns the records after the change is applied, used to keep cached records up to date.
+func ApplyDomainRecordChange(records []DomainRecord, domain Domain, change DomainRecordChange) []DomainRecord {
+	updated := make([]DomainRecord, 0)
+	for _, record := range records {
+		if !sameDomainRecord(record, change.Record) {
+			updated = append(updated, record)
+		}
+	}
+	if strings.ToLower(change.Action) != "delete" {
+		record := change.Record
+		record.Name = strings.ToLower(record.Name)
+		record.Type = strings.ToUpper(record.Type)
+		if record.TTL == 0 && record.Alias == nil {
+			record.TTL = DefaultDomainRecordTTL
+		}
+		record.Domain = &domain
+		updated = append(updated, record)
+	}
+	return updated
+}
+
+// Deletes must match the existing record exactly (including its ttl and values), so they're
+// replaced with the record as it is in the zone.
+func resolveDomainRecordDeletes(dns DNSProvider, domain Domain, changes []DomainRecordChange) ([]DomainRecordChange, int, error) {
+	var records []DomainRecord
+	resolved := make([]DomainRecordChange, 0)
+	for i, change := range changes {
+		if change.Action != "delete" {
+			resolved = append(resolved, change)
+			continue
+		}
+		if records == nil {
+			var err error
+			if records, err = dns.DomainRecords(domain); err != nil {
+				return nil, -1, err
+			}
+		}
+		found := false
+		for _, record := range records {
+			if sameDomainRecord(record, change.Record) {
+				record.Domain = nil
+				resolved = append(resolved, DomainRecordChange{Action: change.Action, Record: record})
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, i, errors.New("The " + change.Record.Type + " entry " + change.Record.Name + " was not found in " + domain.Name + ".")
+		}
+	}
+	return resolved, -1, nil
+}
+
+func HttpChangeDomainRecords(params martini.Params, spec DomainRecordChanges, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	if len(spec.Changes) == 0 {
+		utils.ReportInvalidRequest("At least one change must be provided.", r)
+		return
+	}
+
+	result := DomainRecordChangesResult{Applied: false, Results: make([]DomainRecordChangeResult, 0)}
+	changes := make([]DomainRecordChange, 0)
+	invalid := false
+	for _, change := range spec.Changes {
+		change.Action = strings.ToLower(change.Action)
+		var record DomainRecord
+		var err error
+		if change.Action == "create" || change.Action == "upsert" {
+			record, err = NormalizeDomainRecord(params["domain"], change.Record)
+		} else if change.Action == "delete" {
+			record, err = NormalizeDomainRecordName(params["domain"], change.Record)
+		} else {
+			err = errors.New("The action " + change.Action + " must be create, upsert or delete.")
+		}
+		if err != nil {
+			invalid = true
+			result.Results = append(result.Results, DomainRecordChangeResult{Action: change.Action, Record: change.Record, Status: "invalid", Error: err.Error()})
+		} else {
+			result.Results = append(result.Results, DomainRecordChangeResult{Action: change.Action, Record: record, Status: "skipped"})
+		}
+		changes = append(changes, DomainRecordChange{Action: change.Action, Record: record})
+	}
+	if invalid {
+		r.JSON(http.StatusUnprocessableEntity, result)
+		return
+	}
+
+	dns := GetDnsProvider()
+	domains, err := dns.Domain(params["domain"])
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if len(domains) == 0 {
+		r.JSON(http.StatusNotFound, map[string]interface{}{"error": "NOT_FOUND", "error_description": "The domain " + params["domain"] + " was not found."})
+		return
+	}
+	// Each zone is changed atomically, if the domain has more than one zone (e.g., public and private)
+	// a failure in a later zone does not undo the earlier ones.
+	applied := make([]string, 0)
+	for _, domain := range domains {
+		zoneChanges, failed, err := resolveDomainRecordDeletes(dns, domain, changes)
+		if err != nil && failed != -1 {
+			result.Results[failed].Status = "invalid"
+			result.Results[failed].Error = err.Error()
+			r.JSON(http.StatusUnprocessableEntity, result)
+			return
+		} else if err != nil {
+			utils.ReportError(err, r)
+			return
+		}
+		if err = dns.ChangeDomainRecords(domain, zoneChanges); err != nil {
+			message := err.Error()
+			if len(applied) > 0 {
+				message = "The changes were applied to " + strings.Join(applied, ", ") + " but failed on " + domain.ProviderId + ": " + message
+			}
+			for i := range result.Results {
+				result.Results[i].Status = "failed"
+				result.Results[i].Error = message
+			}
+			r.JSON(http.StatusInternalServerError, result)
+			return
+		}
+		applied = append(applied, domain.ProviderId)
+	}
+	for i := range result.Results {
+		result.Results[i].Status = "applied"
+	}
+	result.Applied = true
+	r.JSON(http.StatusOK, result)
+}
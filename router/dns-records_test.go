@@ -0,0 +1,118 @@
+package router
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDomainRecords(t *testing.T) {
+	Convey("Test validating and normalizing domain records", t, func() {
+		Convey("Address records should be validated and get the default ttl", func() {
+			record, err := NormalizeDomainRecord("example.com", DomainRecord{Type: "a", Name: "WWW.example.com.", Values: []string{"10.0.0.1"}})
+			So(err, ShouldBeNil)
+			So(record.Type, ShouldEqual, "A")
+			So(record.Name, ShouldEqual, "www.example.com")
+			So(record.TTL, ShouldEqual, DefaultDomainRecordTTL)
+			_, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "A", Name: "www.example.com", Values: []string{"::1"}})
+			So(err, ShouldNotBeNil)
+			_, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "AAAA", Name: "www.example.com", Values: []string{"::1"}})
+			So(err, ShouldBeNil)
+			_, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "CNAME", Name: "www.example.com", Values: []string{"a.example.com", "b.example.com"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Records must be in the domain and only some types may be on the root", func() {
+			_, err := NormalizeDomainRecord("example.com", DomainRecord{Type: "A", Name: "example.com", Values: []string{"10.0.0.1"}})
+			So(err, ShouldNotBeNil)
+			_, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "A", Name: "www.other.com", Values: []string{"10.0.0.1"}})
+			So(err, ShouldNotBeNil)
+			_, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "NS", Name: "sub.example.com", Values: []string{"ns.example.com"}})
+			So(err, ShouldNotBeNil)
+			record, err := NormalizeDomainRecord("example.com", DomainRecord{Type: "MX", Name: "example.com", Values: []string{"10   mail.example.com"}, TTL: 3600})
+			So(err, ShouldBeNil)
+			So(record.Values, ShouldResemble, []string{"10 mail.example.com"})
+			So(record.TTL, ShouldEqual, 3600)
+		})
+
+		Convey("Only the types that can be created on the root should be removed from it", func() {
+			So(IsRemovableDomainRecord("MX", true, ""), ShouldBeFalse)
+			So(IsRemovableDomainRecord("MX", true, "MX"), ShouldBeTrue)
+			So(IsRemovableDomainRecord("txt", true, "TXT"), ShouldBeTrue)
+			So(IsRemovableDomainRecord("CAA", true, "mx"), ShouldBeFalse)
+			So(IsRemovableDomainRecord("A", true, ""), ShouldBeFalse)
+			So(IsRemovableDomainRecord("A", false, ""), ShouldBeTrue)
+			So(IsRemovableDomainRecord("NS", false, ""), ShouldBeFalse)
+		})
+
+		Convey("Removing a value should only remove the record with its last value", func() {
+			record := DomainRecord{Type: "MX", Name: "example.com", TTL: 300, Values: []string{"10 mx1.example.com", "20 mx2.example.com"}}
+			change, ok := RemoveDomainRecordValue(record, "20 mx2.example.com")
+			So(ok, ShouldBeTrue)
+			So(change.Action, ShouldEqual, "upsert")
+			So(change.Record.Values, ShouldResemble, []string{"10 mx1.example.com"})
+			So(change.Record.TTL, ShouldEqual, 300)
+			So(record.Values, ShouldResemble, []string{"10 mx1.example.com", "20 mx2.example.com"})
+			change, ok = RemoveDomainRecordValue(change.Record, "10 mx1.example.com")
+			So(ok, ShouldBeTrue)
+			So(change.Action, ShouldEqual, "delete")
+			_, ok = RemoveDomainRecordValue(record, "30 mx3.example.com")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("TXT, CAA and SRV values should be checked and quoted", func() {
+			record, err := NormalizeDomainRecord("example.com", DomainRecord{Type: "TXT", Name: "example.com", Values: []string{"v=spf1 include:example.net ~all", "\"already quoted\""}})
+			So(err, ShouldBeNil)
+			So(record.Values, ShouldResemble, []string{"\"v=spf1 include:example.net ~all\"", "\"already quoted\""})
+			record, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "TXT", Name: "example.com", Values: []string{strings.Repeat("a", 300)}})
+			So(err, ShouldBeNil)
+			So(record.Values[0], ShouldEqual, "\""+strings.Repeat("a", 255)+"\" \""+strings.Repeat("a", 45)+"\"")
+			record, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "CAA", Name: "example.com", Values: []string{"0 issue letsencrypt.org"}})
+			So(err, ShouldBeNil)
+			So(record.Values, ShouldResemble, []string{"0 issue \"letsencrypt.org\""})
+			_, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "CAA", Name: "example.com", Values: []string{"0 allow \"letsencrypt.org\""}})
+			So(err, ShouldNotBeNil)
+			_, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "SRV", Name: "_sip._tcp.example.com", Values: []string{"10 5 5060 sip.example.com"}})
+			So(err, ShouldBeNil)
+			_, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "SRV", Name: "_sip._tcp.example.com", Values: []string{"10 5 99999 sip.example.com"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Weighted and alias records should be validated", func() {
+			weight := int64(10)
+			_, err := NormalizeDomainRecord("example.com", DomainRecord{Type: "A", Name: "www.example.com", Values: []string{"10.0.0.1"}, Weight: &weight})
+			So(err, ShouldNotBeNil)
+			_, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "A", Name: "www.example.com", Values: []string{"10.0.0.1"}, Weight: &weight, SetIdentifier: "blue"})
+			So(err, ShouldBeNil)
+			alias := &DomainRecordAlias{Target: "lb-123.us-east-1.elb.amazonaws.com", HostedZoneId: "Z35SXDOTRQ7X7K"}
+			record, err := NormalizeDomainRecord("example.com", DomainRecord{Type: "A", Name: "www.example.com", Alias: alias})
+			So(err, ShouldBeNil)
+			So(record.TTL, ShouldEqual, 0)
+			_, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "A", Name: "www.example.com", Alias: alias, Values: []string{"10.0.0.1"}})
+			So(err, ShouldNotBeNil)
+			_, err = NormalizeDomainRecord("example.com", DomainRecord{Type: "MX", Name: "www.example.com", Alias: alias})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Changes should only replace the matching record", func() {
+			domain := Domain{ProviderId: "/hostedzone/Z1", Name: "example.com"}
+			records := []DomainRecord{
+				DomainRecord{Type: "A", Name: "www.example.com", Values: []string{"10.0.0.1"}},
+				DomainRecord{Type: "TXT", Name: "www.example.com", Values: []string{"\"a\""}},
+				DomainRecord{Type: "A", Name: "api.example.com", Values: []string{"10.0.0.2"}},
+			}
+			updated := ApplyDomainRecordChange(records, domain, DomainRecordChange{Action: "upsert", Record: DomainRecord{Type: "A", Name: "www.example.com", Values: []string{"10.0.0.3"}}})
+			So(len(updated), ShouldEqual, 3)
+			So(updated[2].Values, ShouldResemble, []string{"10.0.0.3"})
+			So(updated[2].TTL, ShouldEqual, DefaultDomainRecordTTL)
+			updated = ApplyDomainRecordChange(updated, domain, DomainRecordChange{Action: "delete", Record: DomainRecord{Type: "TXT", Name: "www.example.com"}})
+			So(len(updated), ShouldEqual, 2)
+
+			set := MapDomainRecordToAwsResourceRecordSet(domain, DomainRecord{Type: "A", Name: "WWW.example.com", Alias: &DomainRecordAlias{Target: "api.example.com"}})
+			So(*set.Name, ShouldEqual, "www.example.com")
+			So(*set.AliasTarget.HostedZoneId, ShouldEqual, "Z1")
+			So(set.TTL, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,267 @@
+package router
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	utils "region-api/utils"
+	"strings"
+
+	"github.com/martini-contrib/render"
+)
+
+const (
+	DNSRecordOwnerSite = "site"
+	DNSRecordOwnerApp  = "app"
+)
+
+// What a dns record region-api created is for, a site's domain or an app (as app-space).
+type DNSRecordOwner struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+func SiteDNSRecordOwner(domain string) DNSRecordOwner {
+	return DNSRecordOwner{Type: DNSRecordOwnerSite, Name: domain}
+}
+
+func AppDNSRecordOwner(app string, space string) DNSRecordOwner {
+	return DNSRecordOwner{Type: DNSRecordOwnerApp, Name: app + "-" + space}
+}
+
+type TrackedDomainRecord struct {
+	Zone  string         `json:"zone"`
+	Type  string         `json:"type"`
+	Name  string         `json:"name"`
+	Value string         `json:"value"`
+	Owner DNSRecordOwner `json:"owner"`
+}
+
+type OrphanedDomainRecord struct {
+	Record DomainRecord `json:"record"`
+	// The owner region-api recorded for the record (if any) which no longer exists.
+	Owner *DNSRecordOwner `json:"owner,omitempty"`
+}
+
+func TrackDomainRecord(db *sql.DB, zone Domain, recordType string, name string, value string, owner DNSRecordOwner) error {
+	_, err := db.Exec(`insert into dns_records (zone, type, name, value, owner_type, owner) values ($1, $2, $3, $4, $5, $6)
+		on conflict (zone, type, name, value) do update set owner_type=$5, owner=$6`,
+		zone.ProviderId, strings.ToUpper(recordType), strings.ToLower(name), value, owner.Type, owner.Name)
+	return err
+}
+
+func GetTrackedDomainRecords(db *sql.DB, owner *DNSRecordOwner) ([]TrackedDomainRecord, error) {
+	var rows *sql.Rows
+	var err error
+	if owner == nil {
+		rows, err = db.Query("select zone, type, name, value, owner_type, owner from dns_records")
+	} else {
+		rows, err = db.Query("select zone, type, name, value, owner_type, owner from dns_records where owner_type=$1 and owner=$2", owner.Type, owner.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]TrackedDomainRecord, 0)
+	for rows.Next() {
+		var record TrackedDomainRecord
+		if err = rows.Scan(&record.Zone, &record.Type, &record.Name, &record.Value, &record.Owner.Type, &record.Owner.Name); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Returns the change that removes the tracked value from the record, the record is deleted
+// if that was its only value.
+func RemoveTrackedValue(record DomainRecord, tracked TrackedDomainRecord) (DomainRecordChange, bool) {
+	if record.Name != tracked.Name || strings.ToUpper(record.Type) != tracked.Type || record.SetIdentifier != "" || record.Alias != nil {
+		return DomainRecordChange{}, false
+	}
+	values := make([]string, 0)
+	for _, value := range record.Values {
+		if value != tracked.Value {
+			values = append(values, value)
+		}
+	}
+	if len(values) == len(record.Values) {
+		return DomainRecordChange{}, false
+	}
+	record.Domain = nil
+	if len(values) > 0 {
+		record.Values = values
+		return DomainRecordChange{Action: "upsert", Record: record}, true
+	}
+	return DomainRecordChange{Action: "delete", Record: record}, true
+}
+
+// Removes the records created for the owner, a value is only removed from a record if
+// other values were added to it since.
+func RemoveOwnedDomainRecords(db *sql.DB, dns DNSProvider, owner DNSRecordOwner) (int, error) {
+	return RemoveOwnedDomainRecordsFor(db, dns, owner, "")
+}
+
+// Removes the records created for the owner with the name, or all of them if the name is empty.
+func RemoveOwnedDomainRecordsFor(db *sql.DB, dns DNSProvider, owner DNSRecordOwner, name string) (int, error) {
+	owned, err := GetTrackedDomainRecords(db, &owner)
+	if err != nil {
+		return 0, err
+	}
+	tracked := make([]TrackedDomainRecord, 0)
+	for _, t := range owned {
+		if name == "" || t.Name == strings.ToLower(name) {
+			tracked = append(tracked, t)
+		}
+	}
+	if len(tracked) == 0 {
+		return 0, nil
+	}
+	domains, err := dns.Domains()
+	if err != nil {
+		return 0, err
+	}
+	zones := make(map[string]Domain)
+	for _, domain := range domains {
+		zones[domain.ProviderId] = domain
+	}
+	removed := 0
+	for _, t := range tracked {
+		if zone, ok := zones[t.Zone]; ok {
+			records, err := dns.DomainRecords(zone)
+			if err != nil {
+				return removed, err
+			}
+			for _, record := range records {
+				change, ok := RemoveTrackedValue(record, t)
+				if !ok {
+					continue
+				}
+				if err = dns.ChangeDomainRecords(zone, []DomainRecordChange{change}); err != nil {
+					return removed, err
+				}
+				removed++
+			}
+		}
+		if _, err = db.Exec("delete from dns_records where zone=$1 and type=$2 and name=$3 and value=$4", t.Zone, t.Type, t.Name, t.Value); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func dnsRecordOwnerExists(db *sql.DB, owner DNSRecordOwner) (bool, error) {
+	var count int
+	var err error
+	if owner.Type == DNSRecordOwnerApp {
+		// apps in the default space are published as app.domain rather than app-space.domain.
+		err = db.QueryRow("select count(*) from spacesapps where appname || '-' || space = $1 or (space = 'default' and appname = $1)", owner.Name).Scan(&count)
+	} else {
+		err = db.QueryRow("select count(*) from routers where domain=$1", owner.Name).Scan(&count)
+	}
+	return count > 0, err
+}
+
+// The addresses of all of the configured app and site ingresses.
+func getIngressAddresses() map[string]bool {
+	addresses := make(map[string]bool)
+	getters := []func() ([]*IngressConfig, error){
+		getAppsIngressPublicInternal, getAppsIngressPublicExternal, getAppsIngressPrivateInternal,
+		getSitesIngressPublicInternal, getSitesIngressPublicExternal, getSitesIngressPrivateInternal,
+	}
+	for _, get := range getters {
+		configs, err := get()
+		if err != nil {
+			continue
+		}
+		for _, config := range configs {
+			addresses[config.Address] = true
+		}
+	}
+	return addresses
+}
+
+// Finds the records in the managed zones that point to an ingress but are not for a router
+// or app (or were created for one that no longer exists). Wildcard records are not reported
+// as they serve all of the apps in a space.
+func FindOrphanedDomainRecords(db *sql.DB, dns DNSProvider, addresses map[string]bool) ([]OrphanedDomainRecord, error) {
+	tracked, err := GetTrackedDomainRecords(db, nil)
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]DNSRecordOwner)
+	for _, t := range tracked {
+		owners[t.Zone+"/"+t.Type+"/"+t.Name] = t.Owner
+	}
+	exists := make(map[DNSRecordOwner]bool)
+	domains, err := dns.Domains()
+	if err != nil {
+		return nil, err
+	}
+	orphans := make([]OrphanedDomainRecord, 0)
+	for _, domain := range domains {
+		records, err := dns.DomainRecords(domain)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if strings.HasPrefix(record.Name, "*") {
+				continue
+			}
+			pointsToIngress := false
+			for _, value := range record.Values {
+				if addresses[strings.TrimSuffix(value, ".")] {
+					pointsToIngress = true
+				}
+			}
+			if record.Alias != nil && addresses[record.Alias.Target] {
+				pointsToIngress = true
+			}
+			if !pointsToIngress {
+				continue
+			}
+			owner, isTracked := owners[domain.ProviderId+"/"+strings.ToUpper(record.Type)+"/"+record.Name]
+			candidates := []DNSRecordOwner{owner}
+			if !isTracked {
+				// records created before they were tracked are owned by a router with the same name,
+				// or the app an app-space.domain (or app.domain in the default space) name is for.
+				candidates = []DNSRecordOwner{SiteDNSRecordOwner(record.Name), DNSRecordOwner{Type: DNSRecordOwnerApp, Name: strings.Split(record.Name, ".")[0]}}
+			}
+			owned := false
+			for _, candidate := range candidates {
+				if _, checked := exists[candidate]; !checked {
+					if exists[candidate], err = dnsRecordOwnerExists(db, candidate); err != nil {
+						return nil, err
+					}
+				}
+				owned = owned || exists[candidate]
+			}
+			if owned {
+				continue
+			}
+			record.Domain = &Domain{ProviderId: domain.ProviderId, Name: domain.Name, Public: domain.Public}
+			orphan := OrphanedDomainRecord{Record: record}
+			if isTracked {
+				orphan.Owner = &owner
+			}
+			orphans = append(orphans, orphan)
+		}
+	}
+	return orphans, nil
+}
+
+func HttpGetOrphanedDomainRecords(db *sql.DB, r render.Render) {
+	orphans, err := FindOrphanedDomainRecords(db, GetDnsProvider(), getIngressAddresses())
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, orphans)
+}
+
+// Removes the dns records created for the app, this is called when an app is removed from a space.
+func RemoveAppDomainRecords(db *sql.DB, app string, space string) {
+	if _, err := RemoveOwnedDomainRecords(db, GetDnsProvider(), AppDNSRecordOwner(app, space)); err != nil {
+		fmt.Printf("WARNING: Unable to remove the dns records for %s-%s: %s\n", app, space, err.Error())
+	}
+}
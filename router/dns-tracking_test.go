@@ -0,0 +1,40 @@
+package router
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDNSTracking(t *testing.T) {
+	Convey("Test removing tracked dns records", t, func() {
+		tracked := TrackedDomainRecord{Zone: "/hostedzone/Z1", Type: "A", Name: "www.example.com", Value: "10.0.0.1", Owner: SiteDNSRecordOwner("www.example.com")}
+
+		Convey("A record with only the tracked value should be deleted", func() {
+			change, ok := RemoveTrackedValue(DomainRecord{Type: "A", Name: "www.example.com", Values: []string{"10.0.0.1"}, TTL: 60}, tracked)
+			So(ok, ShouldBeTrue)
+			So(change.Action, ShouldEqual, "delete")
+			So(change.Record.TTL, ShouldEqual, 60)
+		})
+
+		Convey("Other values should be kept", func() {
+			change, ok := RemoveTrackedValue(DomainRecord{Type: "A", Name: "www.example.com", Values: []string{"10.0.0.1", "10.0.0.2"}}, tracked)
+			So(ok, ShouldBeTrue)
+			So(change.Action, ShouldEqual, "upsert")
+			So(change.Record.Values, ShouldResemble, []string{"10.0.0.2"})
+		})
+
+		Convey("Records that do not match should be left alone", func() {
+			_, ok := RemoveTrackedValue(DomainRecord{Type: "A", Name: "www.example.com", Values: []string{"10.0.0.2"}}, tracked)
+			So(ok, ShouldBeFalse)
+			_, ok = RemoveTrackedValue(DomainRecord{Type: "CNAME", Name: "www.example.com", Values: []string{"10.0.0.1"}}, tracked)
+			So(ok, ShouldBeFalse)
+			_, ok = RemoveTrackedValue(DomainRecord{Type: "A", Name: "www.example.com", Values: []string{"10.0.0.1"}, SetIdentifier: "blue"}, tracked)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("App owners should be named app-space", func() {
+			So(AppDNSRecordOwner("web", "default"), ShouldResemble, DNSRecordOwner{Type: DNSRecordOwnerApp, Name: "web-default"})
+		})
+	})
+}
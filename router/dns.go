@@ -1,6 +1,7 @@
 package router
 
 import (
+	"database/sql"
 	"fmt"
 	"context"
 	"errors"
@@ -25,10 +26,28 @@ type Domain struct {
 }
 
 type DomainRecord struct {
-	Type   string   `json:"type"`
-	Name   string   `json:"name"`
-	Values []string `json:"values"`
-	Domain *Domain  `json:"domain",omitempty`
+	Type          string             `json:"type"`
+	Name          string             `json:"name"`
+	Values        []string           `json:"values"`
+	TTL           int64              `json:"ttl,omitempty"`
+	Weight        *int64             `json:"weight,omitempty"`
+	SetIdentifier string             `json:"set_identifier,omitempty"`
+	Alias         *DomainRecordAlias `json:"alias,omitempty"`
+	Domain        *Domain            `json:"domain",omitempty`
+}
+
+// Points the record at another resource (e.g., a load balancer) rather than values, if the
+// hosted zone is empty the target is in the same zone.
+type DomainRecordAlias struct {
+	Target               string `json:"target"`
+	HostedZoneId         string `json:"hosted_zone_id,omitempty"`
+	EvaluateTargetHealth bool   `json:"evaluate_target_health"`
+}
+
+// Action is one of create (fails if the record exists), upsert or delete
+type DomainRecordChange struct {
+	Action string       `json:"action"`
+	Record DomainRecord `json:"record"`
 }
 
 // Domain.Status = available
@@ -41,6 +60,14 @@ type DNSProvider interface {
 	DomainRecords(domain Domain) ([]DomainRecord, error)
 	CreateDomainRecord(domain Domain, recordType string, name string, values []string) error
 	RemoveDomainRecord(domain Domain, recordType string, name string, values []string) error
+	// Applies all of the changes or none of them.
+	ChangeDomainRecords(domain Domain, changes []DomainRecordChange) error
+}
+
+// Providers that apply record changes asynchronously, waits until the last change made to the
+// zone is live on all of its name servers.
+type DNSChangeWaiter interface {
+	WaitForDomainRecords(ctx context.Context, domain Domain) error
 }
 
 func GetDNSRecordType(address string) string {
@@ -51,20 +78,24 @@ func GetDNSRecordType(address string) string {
 	return recType
 }
 
+func publicResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo:true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+            d := net.Dialer{}
+            nameserver := "8.8.8.8"
+            if os.Getenv("PUBLIC_DNS_RESOLVER") != "" {
+            	nameserver = os.Getenv("PUBLIC_DNS_RESOLVER")
+            }
+            return d.DialContext(ctx, "udp", net.JoinHostPort(nameserver, "53"))
+        },
+	}
+}
+
 func ResolveDNS(address string, private bool) ([]string, error) {
 	resolver := net.DefaultResolver
 	if !private {
-		resolver = &net.Resolver{
-			PreferGo:true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-	            d := net.Dialer{}
-	            nameserver := "8.8.8.8"
-	            if os.Getenv("PUBLIC_DNS_RESOLVER") != "" {
-	            	nameserver = os.Getenv("PUBLIC_DNS_RESOLVER")
-	            }
-	            return d.DialContext(ctx, "udp", net.JoinHostPort(nameserver, "53"))
-	        },
-		}
+		resolver = publicResolver()
 	}
 	result, err := resolver.LookupHost(context.Background(), address)
 	if err != nil {
@@ -77,7 +108,14 @@ func ResolveDNS(address string, private bool) ([]string, error) {
 	return result, nil
 }
 
-func SetDomainName(config *FullIngressConfig, fqdn string, internal bool) (error) {
+// The values of a TXT record as seen by the public resolver.
+func ResolveTXT(ctx context.Context, name string) ([]string, error) {
+	return publicResolver().LookupTXT(ctx, name)
+}
+
+// Points the fqdn at the ingress in its public and private zones, the records are tracked as
+// belonging to the owner so they can be removed with it.
+func SetDomainName(db *sql.DB, config *FullIngressConfig, fqdn string, internal bool, owner DNSRecordOwner) (error) {
 	dns := GetDnsProvider()
 	domains, err := dns.Domain(fqdn)
 	if err != nil {
@@ -89,6 +127,9 @@ func SetDomainName(config *FullIngressConfig, fqdn string, internal bool) (error
 		if domain.Public && !internal {
 			record, err := ResolveDNS(fqdn, false)
 			if err == nil && record[0] == config.PublicExternal.Address {
+				if err := TrackDomainRecord(db, domain, GetDNSRecordType(config.PublicExternal.Address), fqdn, config.PublicExternal.Address, owner); err != nil {
+					fmt.Printf("WARNING: Unable to track the public (external) dns record for %s: %s\n", fqdn, err.Error())
+				}
 				if os.Getenv("INGRESS_DEBUG") == "true" {
 					fmt.Printf("[ingress] Setting public external address was unnecessary, it already is set: %s == %s\n", fqdn, config.PublicExternal.Address)
 				}
@@ -106,10 +147,16 @@ func SetDomainName(config *FullIngressConfig, fqdn string, internal bool) (error
 			if err := dns.CreateDomainRecord(domain, GetDNSRecordType(config.PublicExternal.Address), fqdn, []string{config.PublicExternal.Address}); err != nil {
 				return fmt.Errorf("Error: Failed to create public (external) dns: %s", err.Error())
 			}
+			if err := TrackDomainRecord(db, domain, GetDNSRecordType(config.PublicExternal.Address), fqdn, config.PublicExternal.Address, owner); err != nil {
+				fmt.Printf("WARNING: Unable to track the public (external) dns record for %s: %s\n", fqdn, err.Error())
+			}
 		}
 		if !domain.Public && !internal {
 			record, err := ResolveDNS(fqdn, true)
 			if err == nil && record[0] == config.PublicInternal.Address {
+				if err := TrackDomainRecord(db, domain, GetDNSRecordType(config.PublicInternal.Address), fqdn, config.PublicInternal.Address, owner); err != nil {
+					fmt.Printf("WARNING: Unable to track the private (external) dns record for %s: %s\n", fqdn, err.Error())
+				}
 				if os.Getenv("INGRESS_DEBUG") == "true" {
 					fmt.Printf("[ingress] Setting public internal address was unnecessary, it already is set: %s == %s\n", fqdn, config.PublicInternal.Address)
 				}
@@ -127,10 +174,16 @@ func SetDomainName(config *FullIngressConfig, fqdn string, internal bool) (error
 			if err := dns.CreateDomainRecord(domain, GetDNSRecordType(config.PublicInternal.Address), fqdn, []string{config.PublicInternal.Address}); err != nil {
 				return fmt.Errorf("Error: Failed to create private (external) dns: %s", err.Error())
 			}
+			if err := TrackDomainRecord(db, domain, GetDNSRecordType(config.PublicInternal.Address), fqdn, config.PublicInternal.Address, owner); err != nil {
+				fmt.Printf("WARNING: Unable to track the private (external) dns record for %s: %s\n", fqdn, err.Error())
+			}
 		}
 		if !domain.Public && internal {
 			record, err := ResolveDNS(fqdn, true)
 			if err == nil && record[0] == config.PrivateInternal.Address {
+				if err := TrackDomainRecord(db, domain, GetDNSRecordType(config.PrivateInternal.Address), fqdn, config.PrivateInternal.Address, owner); err != nil {
+					fmt.Printf("WARNING: Unable to track the private (internal) dns record for %s: %s\n", fqdn, err.Error())
+				}
 				if os.Getenv("INGRESS_DEBUG") == "true" {
 					fmt.Printf("[ingress] Setting private internal address was unnecessary, it already is set: %s == %s\n", fqdn, config.PrivateInternal.Address)
 				}
@@ -148,11 +201,45 @@ func SetDomainName(config *FullIngressConfig, fqdn string, internal bool) (error
 			if err := dns.CreateDomainRecord(domain, GetDNSRecordType(config.PrivateInternal.Address), fqdn, []string{config.PrivateInternal.Address}); err != nil {
 				return fmt.Errorf("Error: Failed to create private (internal) dns: %s", err.Error())
 			}
+			if err := TrackDomainRecord(db, domain, GetDNSRecordType(config.PrivateInternal.Address), fqdn, config.PrivateInternal.Address, owner); err != nil {
+				fmt.Printf("WARNING: Unable to track the private (internal) dns record for %s: %s\n", fqdn, err.Error())
+			}
 		}
 	}
 	return nil
 }
 
+// Returns the most specific public and private zones the fqdn belongs to, e.g., www.dev.example.com
+// is in the zone dev.example.com (if it exists) rather than example.com.
+func MostSpecificZones(domains []Domain, fqdn string) []Domain {
+	fqdn = strings.TrimSuffix(strings.ToLower(fqdn), ".")
+	matches := func(domain Domain) (bool, int) {
+		name := strings.TrimSuffix(strings.ToLower(domain.Name), ".")
+		return name != "" && (fqdn == name || strings.HasSuffix(fqdn, "."+name)), len(name)
+	}
+	longest := make(map[bool]int)
+	for _, domain := range domains {
+		if match, length := matches(domain); match && length > longest[domain.Public] {
+			longest[domain.Public] = length
+		}
+	}
+	zones := make([]Domain, 0)
+	for _, domain := range domains {
+		if match, length := matches(domain); match && length == longest[domain.Public] {
+			zones = append(zones, domain)
+		}
+	}
+	return zones
+}
+
+func FindZones(dns DNSProvider, fqdn string) ([]Domain, error) {
+	domains, err := dns.Domains()
+	if err != nil {
+		return nil, err
+	}
+	return MostSpecificZones(domains, fqdn), nil
+}
+
 func GetDnsProvider() DNSProvider {
 	// We could add a switch here for a different dns provider,
 	// but as of now the only dns provider supported is AWS.
@@ -164,6 +251,8 @@ type AwsDNSProvider struct {
 	domainCache        *[]Domain
 	domainRecordsCache *map[string][]DomainRecord
 	mutex              *sync.Mutex
+	// the last change made to each hosted zone
+	changes map[string]string
 }
 
 var provider *AwsDNSProvider = nil
@@ -216,6 +305,7 @@ func NewAwsDNSProvider() *AwsDNSProvider {
 		domainCache:        nil,
 		domainRecordsCache: nil,
 		mutex:              &sync.Mutex{},
+		changes:            make(map[string]string),
 	}
 	AwsRefreshCache()
 	t := time.NewTicker(time.Minute * 60)
@@ -303,16 +393,57 @@ func MapAwsHostedZonesToDomains(awsDomains []*route53.HostedZone) []Domain {
 func MapAwsResourceRecordsToDomainRecords(domain Domain, results []*route53.ResourceRecordSet) []DomainRecord {
 	var domainRecords []DomainRecord = make([]DomainRecord, 0)
 	for _, d := range results {
-		domainRecords = append(domainRecords, DomainRecord{
-			Type:   StringNilToEmpty(d.Type),
-			Name:   FixAwsDomainName(StringNilToEmpty(d.Name)),
-			Values: MapResourceRecordToStringArray(d.ResourceRecords),
-			Domain: &domain,
-		})
+		record := DomainRecord{
+			Type:          StringNilToEmpty(d.Type),
+			Name:          FixAwsDomainName(StringNilToEmpty(d.Name)),
+			Values:        MapResourceRecordToStringArray(d.ResourceRecords),
+			TTL:           aws.Int64Value(d.TTL),
+			Weight:        d.Weight,
+			SetIdentifier: StringNilToEmpty(d.SetIdentifier),
+			Domain:        &domain,
+		}
+		if d.AliasTarget != nil {
+			record.Alias = &DomainRecordAlias{
+				Target:               FixAwsDomainName(StringNilToEmpty(d.AliasTarget.DNSName)),
+				HostedZoneId:         StringNilToEmpty(d.AliasTarget.HostedZoneId),
+				EvaluateTargetHealth: BoolNilToFalse(d.AliasTarget.EvaluateTargetHealth),
+			}
+		}
+		domainRecords = append(domainRecords, record)
 	}
 	return domainRecords
 }
 
+func MapDomainRecordToAwsResourceRecordSet(domain Domain, record DomainRecord) *route53.ResourceRecordSet {
+	set := &route53.ResourceRecordSet{
+		Name: aws.String(strings.ToLower(record.Name)),
+		Type: aws.String(strings.ToUpper(record.Type)),
+	}
+	if record.Alias != nil {
+		hostedZoneId := record.Alias.HostedZoneId
+		if hostedZoneId == "" {
+			hostedZoneId = domain.ProviderId
+		}
+		set.AliasTarget = &route53.AliasTarget{
+			DNSName:              aws.String(record.Alias.Target),
+			HostedZoneId:         aws.String(strings.TrimPrefix(hostedZoneId, "/hostedzone/")),
+			EvaluateTargetHealth: aws.Bool(record.Alias.EvaluateTargetHealth),
+		}
+	} else {
+		ttl := record.TTL
+		if ttl == 0 {
+			ttl = DefaultDomainRecordTTL
+		}
+		set.TTL = aws.Int64(ttl)
+		set.ResourceRecords = MapValuesToResourceRecord(record.Values)
+	}
+	if record.SetIdentifier != "" {
+		set.SetIdentifier = aws.String(record.SetIdentifier)
+		set.Weight = record.Weight
+	}
+	return set
+}
+
 func (dnsProvider *AwsDNSProvider) Type() string {
 	return "aws"
 }
@@ -430,88 +561,71 @@ func (dnsProvider *AwsDNSProvider) DomainRecords(domain Domain) ([]DomainRecord,
 }
 
 func (dnsProvider *AwsDNSProvider) CreateDomainRecord(domain Domain, recordType string, name string, values []string) error {
-	name = strings.ToLower(name)
-	t := time.NewTicker(time.Millisecond * 500)
-	<-t.C // in order to not exceed our throttle rate
-	_, err := dnsProvider.client.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
-		HostedZoneId: aws.String(domain.ProviderId),
-		ChangeBatch: &route53.ChangeBatch{
-			Changes: []*route53.Change{
-				{
-					Action: aws.String("UPSERT"),
-					ResourceRecordSet: &route53.ResourceRecordSet{
-						Name:            aws.String(name),
-						Type:            aws.String(recordType),
-						TTL:             aws.Int64(300),
-						ResourceRecords: MapValuesToResourceRecord(values),
-					},
-				},
-			},
-		},
-	})
-	if err == nil {
-		dnsProvider.mutex.Lock()
-		if provider.domainRecordsCache == nil {
-			dnsProvider.mutex.Unlock()
-			return nil
-		}
-		// ensure we remove the old record, if it exists
-		domains := make([]DomainRecord, 0)
-		prev := (*provider.domainRecordsCache)[domain.ProviderId]
-		for _, d := range prev {
-			if d.Name != name && d.Type != recordType {
-				domains = append(domains, d)
-			}
-		}
-		(*provider.domainRecordsCache)[domain.ProviderId] = domains
-
-		// now add the new record
-		(*provider.domainRecordsCache)[domain.ProviderId] = append((*provider.domainRecordsCache)[domain.ProviderId], DomainRecord{
-			Type:   recordType,
-			Name:   name,
-			Values: values,
-			Domain: &domain,
-		})
-		dnsProvider.mutex.Unlock()
-	}
-	return err
+	return dnsProvider.ChangeDomainRecords(domain, []DomainRecordChange{DomainRecordChange{
+		Action: "upsert",
+		Record: DomainRecord{Type: recordType, Name: name, Values: values},
+	}})
 }
 
 func (dnsProvider *AwsDNSProvider) RemoveDomainRecord(domain Domain, recordType string, name string, values []string) error {
-	name = strings.ToLower(name)
+	return dnsProvider.ChangeDomainRecords(domain, []DomainRecordChange{DomainRecordChange{
+		Action: "delete",
+		Record: DomainRecord{Type: recordType, Name: name, Values: values},
+	}})
+}
+
+func (dnsProvider *AwsDNSProvider) ChangeDomainRecords(domain Domain, changes []DomainRecordChange) error {
+	awsChanges := make([]*route53.Change, 0)
+	for _, change := range changes {
+		awsChanges = append(awsChanges, &route53.Change{
+			Action:            aws.String(strings.ToUpper(change.Action)),
+			ResourceRecordSet: MapDomainRecordToAwsResourceRecordSet(domain, change.Record),
+		})
+	}
 	t := time.NewTicker(time.Millisecond * 500)
 	<-t.C // in order to not exceed our throttle rate
-	_, err := dnsProvider.client.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+	resp, err := dnsProvider.client.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
 		HostedZoneId: aws.String(domain.ProviderId),
-		ChangeBatch: &route53.ChangeBatch{
-			Changes: []*route53.Change{
-				{
-					Action: aws.String("DELETE"),
-					ResourceRecordSet: &route53.ResourceRecordSet{
-						Name:            aws.String(name),
-						Type:            aws.String(recordType),
-						TTL:             aws.Int64(300),
-						ResourceRecords: MapValuesToResourceRecord(values),
-					},
-				},
-			},
-		},
+		ChangeBatch:  &route53.ChangeBatch{Changes: awsChanges},
 	})
-	if err == nil {
-		dnsProvider.mutex.Lock()
-		if provider.domainRecordsCache == nil {
-			dnsProvider.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	dnsProvider.mutex.Lock()
+	defer dnsProvider.mutex.Unlock()
+	if resp.ChangeInfo != nil && resp.ChangeInfo.Id != nil {
+		dnsProvider.changes[domain.ProviderId] = *resp.ChangeInfo.Id
+	}
+	if provider.domainRecordsCache == nil {
+		return nil
+	}
+	for _, change := range changes {
+		(*provider.domainRecordsCache)[domain.ProviderId] = ApplyDomainRecordChange((*provider.domainRecordsCache)[domain.ProviderId], domain, change)
+	}
+	return nil
+}
+
+// Route53 changes are pending until they're applied to all of the zone's name servers, changes are
+// applied in order so the last change being in sync means the earlier ones are as well.
+func (dnsProvider *AwsDNSProvider) WaitForDomainRecords(ctx context.Context, domain Domain) error {
+	dnsProvider.mutex.Lock()
+	id := dnsProvider.changes[domain.ProviderId]
+	dnsProvider.mutex.Unlock()
+	if id == "" {
+		return nil
+	}
+	for {
+		resp, err := dnsProvider.client.GetChangeWithContext(ctx, &route53.GetChangeInput{Id: aws.String(id)})
+		if err != nil {
+			return err
+		}
+		if resp.ChangeInfo != nil && StringNilToEmpty(resp.ChangeInfo.Status) == route53.ChangeStatusInsync {
 			return nil
 		}
-		domains := make([]DomainRecord, 0)
-		prev := (*provider.domainRecordsCache)[domain.ProviderId]
-		for _, d := range prev {
-			if d.Name != name && d.Type != recordType {
-				domains = append(domains, d)
-			}
+		select {
+		case <-ctx.Done():
+			return errors.New("The dns change " + id + " to " + domain.Name + " was not applied in time.")
+		case <-time.After(time.Second * 5):
 		}
-		(*provider.domainRecordsCache)[domain.ProviderId] = domains
-		dnsProvider.mutex.Unlock()
 	}
-	return err
 }
@@ -0,0 +1,575 @@
+package router
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"region-api/structs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filters are stored on router paths (routerpaths.filters) and on app deployments as
+// a type with a string map of data, the helpers below turn that data into the istio
+// structures and validate it before it is persisted.
+
+var validRetryOnConditions = []string{
+	"5xx",
+	"gateway-error",
+	"reset",
+	"connect-failure",
+	"retriable-4xx",
+	"refused-stream",
+	"retriable-status-codes",
+	"retriable-headers",
+	"envoy-ratelimited",
+	"cancelled",
+	"deadline-exceeded",
+	"internal",
+	"resource-exhausted",
+	"unavailable",
+}
+
+const maxRetryAttempts = 10
+
+// Istio expects protobuf durations which are expressed in seconds, e.g. "1.5s"
+func istioDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+func parseFilterDuration(filter structs.HttpFilters, key string) (time.Duration, bool, error) {
+	val, ok := filter.Data[key]
+	if !ok || val == "" {
+		return 0, false, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		// allow plain numbers to be interpreted as seconds
+		secs, nerr := strconv.ParseFloat(val, 64)
+		if nerr != nil {
+			return 0, false, fmt.Errorf("The %s filter has an invalid duration for %s: %s", filter.Type, key, val)
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, false, fmt.Errorf("The %s filter must have a %s greater than zero.", filter.Type, key)
+	}
+	return d, true, nil
+}
+
+func parseFilterPercentage(filter structs.HttpFilters, key string) (*Percent, error) {
+	val, ok := filter.Data[key]
+	if !ok || val == "" {
+		return &Percent{Value: 100}, nil
+	}
+	p, err := strconv.ParseFloat(strings.TrimSuffix(val, "%"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("The %s filter has an invalid percentage for %s: %s", filter.Type, key, val)
+	}
+	if p < 0 || p > 100 {
+		return nil, fmt.Errorf("The %s filter must have a %s between 0 and 100.", filter.Type, key)
+	}
+	return &Percent{Value: p}, nil
+}
+
+// A rate limit is a token bucket of requests per unit of time, counted per client ip
+// address or per value of a request header. Requests exceeding the limit are rejected by
+// the ingress gateway with a 429 Too Many Requests.
+type RateLimit struct {
+	Requests   int64  `json:"requests"`
+	Unit       string `json:"unit"`
+	Key        string `json:"key"`
+	Header     string `json:"header,omitempty"`
+	StatusCode int    `json:"status_code"`
+	Message    string `json:"message"`
+}
+
+var rateLimitUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+}
+
+func (limit *RateLimit) FillInterval() time.Duration {
+	return rateLimitUnits[limit.Unit]
+}
+
+func RateLimitFromFilter(filter structs.HttpFilters) (*RateLimit, error) {
+	limit := RateLimit{Unit: "minute", Key: "client_ip", StatusCode: http.StatusTooManyRequests}
+	val, ok := filter.Data["requests"]
+	if !ok || val == "" {
+		return nil, errors.New("The ratelimit filter requires the number of requests allowed.")
+	}
+	requests, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || requests < 1 {
+		return nil, errors.New("The ratelimit filter requests must be a whole number greater than zero.")
+	}
+	limit.Requests = requests
+	if val, ok := filter.Data["unit"]; ok && val != "" {
+		if _, ok := rateLimitUnits[strings.ToLower(val)]; !ok {
+			return nil, errors.New("The ratelimit filter unit must be second, minute or hour.")
+		}
+		limit.Unit = strings.ToLower(val)
+	}
+	if val, ok := filter.Data["key"]; ok && val != "" {
+		if val != "client_ip" && val != "header" {
+			return nil, errors.New("The ratelimit filter key must be client_ip or header.")
+		}
+		limit.Key = val
+	}
+	if limit.Key == "header" {
+		if val, ok := filter.Data["header"]; ok && val != "" {
+			limit.Header = strings.ToLower(val)
+		} else {
+			return nil, errors.New("The ratelimit filter requires a header name when the key is header.")
+		}
+	}
+	per := "client ip address"
+	if limit.Key == "header" {
+		per = "value of the " + limit.Header + " header"
+	}
+	limit.Message = fmt.Sprintf("Requests beyond %d per %s for each %s receive a %d Too Many Requests.", limit.Requests, limit.Unit, per, limit.StatusCode)
+	return &limit, nil
+}
+
+// An ip filter restricts a path to clients within the allowed CIDR ranges and/or rejects
+// clients within the denied ranges, single addresses are accepted as /32 (or /128).
+type IPFilter struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+func parseIPRanges(filter structs.HttpFilters, key string) ([]string, error) {
+	ranges := make([]string, 0)
+	val, ok := filter.Data[key]
+	if !ok || strings.TrimSpace(val) == "" {
+		return ranges, nil
+	}
+	for _, cidr := range strings.Split(val, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+			ranges = append(ranges, ipnet.String())
+		} else if ip := net.ParseIP(cidr); ip != nil {
+			ranges = append(ranges, ip.String())
+		} else {
+			return nil, errors.New("The ipfilter filter has an invalid " + key + " address or CIDR range: " + cidr)
+		}
+	}
+	return ranges, nil
+}
+
+func IPFilterFromFilter(filter structs.HttpFilters) (*IPFilter, error) {
+	allow, err := parseIPRanges(filter, "allow")
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseIPRanges(filter, "deny")
+	if err != nil {
+		return nil, err
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, errors.New("The ipfilter filter requires an allow list, a deny list or both.")
+	}
+	return &IPFilter{Allow: allow, Deny: deny}, nil
+}
+
+// Basic auth credentials are only accepted with the password on the way in, the password
+// is hashed into a kubernetes secret and only the username and secret name are persisted.
+type BasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"-"`
+	Secret   string `json:"secret,omitempty"`
+}
+
+func BasicAuthFromFilter(filter structs.HttpFilters) (*BasicAuth, error) {
+	auth := BasicAuth{Username: filter.Data["username"], Password: filter.Data["password"], Secret: filter.Data["secret"]}
+	if auth.Username == "" {
+		return nil, errors.New("The basic_auth filter requires a username.")
+	}
+	if strings.Contains(auth.Username, ":") {
+		return nil, errors.New("The basic_auth filter username cannot contain a colon.")
+	}
+	if auth.Password == "" && auth.Secret == "" {
+		return nil, errors.New("The basic_auth filter requires a password.")
+	}
+	return &auth, nil
+}
+
+// Envoy's basic auth filter accepts htpasswd entries hashed with SHA.
+func (auth *BasicAuth) Htpasswd() string {
+	hash := sha1.Sum([]byte(auth.Password))
+	return auth.Username + ":{SHA}" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Strips basic auth passwords from the filters, returning the filters with only the username
+// and secret name, so credentials are never persisted in routerpaths.filters, along with the
+// credentials to store with StoreBasicAuth once the path has been saved.
+func SecureFilters(domain string, filters []structs.HttpFilters) ([]structs.HttpFilters, *BasicAuth, error) {
+	secured := make([]structs.HttpFilters, 0)
+	var auth *BasicAuth
+	for _, filter := range filters {
+		if filter.Type == "basic_auth" {
+			var err error
+			if auth, err = BasicAuthFromFilter(filter); err != nil {
+				return nil, nil, err
+			}
+			filter = structs.HttpFilters{Type: filter.Type, Data: map[string]string{"username": auth.Username, "secret": BasicAuthSecretName(domain)}}
+		}
+		secured = append(secured, filter)
+	}
+	return secured, auth, nil
+}
+
+// Moves the basic auth password of a path into the site's basic auth secret. When removing,
+// a path without basic auth credentials has its stored credentials deleted.
+func StoreBasicAuth(db *sql.DB, domain string, path string, auth *BasicAuth, removing bool) error {
+	if !(removing && auth == nil) && (auth == nil || auth.Password == "") {
+		return nil
+	}
+	internal, err := IsInternalRouter(db, domain)
+	if err != nil {
+		return err
+	}
+	ingress, err := GetSiteIngress(db, internal)
+	if err != nil {
+		return err
+	}
+	if auth == nil {
+		return ingress.DeleteBasicAuthFilter(domain, path)
+	}
+	return ingress.InstallOrUpdateBasicAuthFilter(domain, path, auth.Username, auth.Password)
+}
+
+// The oauth2 filter delegates the login to an external authorization service (such as
+// oauth2-proxy) registered as an extension provider in the istio mesh config.
+type OAuth2 struct {
+	Provider string   `json:"provider"`
+	Excludes []string `json:"excludes,omitempty"`
+}
+
+func OAuth2FromFilter(filter structs.HttpFilters) (*OAuth2, error) {
+	auth := OAuth2{Provider: filter.Data["provider"], Excludes: make([]string, 0)}
+	if auth.Provider == "" {
+		return nil, errors.New("The oauth2 filter requires the name of the external authorization provider.")
+	}
+	if val, ok := filter.Data["excludes"]; ok && val != "" {
+		for _, exclude := range strings.Split(val, ",") {
+			exclude = strings.TrimSpace(exclude)
+			if exclude == "" {
+				continue
+			}
+			if !strings.HasPrefix(exclude, "/") {
+				return nil, errors.New("The oauth2 filter excludes must be paths starting with a slash: " + exclude)
+			}
+			auth.Excludes = append(auth.Excludes, exclude)
+		}
+	}
+	return &auth, nil
+}
+
+// Headers set by the router on every request which the backend relies on, these cannot be
+// changed by a headers filter.
+var protectedRequestHeaders = []string{"x-forwarded-path", "x-request-start"}
+
+func isProtectedHeader(direction string, header string) bool {
+	header = strings.ToLower(header)
+	if direction == "response" {
+		return header == "strict-transport-security"
+	}
+	if strings.HasPrefix(header, "x-orig-") {
+		return true
+	}
+	for _, protected := range protectedRequestHeaders {
+		if header == protected {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidHeaderName(header string) bool {
+	if header == "" {
+		return false
+	}
+	for _, c := range header {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// The headers filter data uses keys of the form request.set.<header>, request.add.<header>,
+// response.set.<header> and response.add.<header> with the header value, and request.remove
+// or response.remove with a comma separated list of headers.
+func HeadersFromFilter(filter structs.HttpFilters) (*Headers, error) {
+	headers := Headers{}
+	if len(filter.Data) == 0 {
+		return nil, errors.New("The headers filter requires at least one header to add, set or remove.")
+	}
+	for key, value := range filter.Data {
+		parts := strings.SplitN(key, ".", 3)
+		if len(parts) < 2 || (parts[0] != "request" && parts[0] != "response") {
+			return nil, errors.New("The headers filter has an invalid key, it must start with request. or response.: " + key)
+		}
+		ops := &headers.Request
+		if parts[0] == "response" {
+			ops = &headers.Response
+		}
+		var names []string
+		if parts[1] == "remove" && len(parts) == 2 {
+			names = strings.Split(value, ",")
+		} else if (parts[1] == "set" || parts[1] == "add") && len(parts) == 3 {
+			names = []string{parts[2]}
+		} else {
+			return nil, errors.New("The headers filter has an invalid operation, it must be set, add or remove: " + key)
+		}
+		for _, name := range names {
+			name = strings.TrimSpace(name)
+			if !isValidHeaderName(name) {
+				return nil, errors.New("The headers filter has an invalid header name: " + name)
+			}
+			if isProtectedHeader(parts[0], name) {
+				if parts[0] == "response" {
+					return nil, errors.New("The " + name + " header cannot be changed with a headers filter, use the router's hsts setting.")
+				}
+				return nil, errors.New("The " + name + " header is set by the router and cannot be changed.")
+			}
+			if parts[1] == "remove" {
+				ops.Remove = append(ops.Remove, name)
+			} else if parts[1] == "set" {
+				if ops.Set == nil {
+					ops.Set = make(map[string]string)
+				}
+				ops.Set[name] = value
+			} else {
+				if ops.Add == nil {
+					ops.Add = make(map[string]string)
+				}
+				ops.Add[name] = value
+			}
+		}
+	}
+	sort.Strings(headers.Request.Remove)
+	sort.Strings(headers.Response.Remove)
+	return &headers, nil
+}
+
+// Merges the user's header operations into the route's, never replacing the headers the router sets.
+func ApplyHeadersFilter(http *HTTP, headers *Headers) {
+	if http.Headers == nil {
+		http.Headers = &Headers{}
+	}
+	merge := func(into *HeaderOperations, from HeaderOperations) {
+		for name, value := range from.Set {
+			if into.Set == nil {
+				into.Set = make(map[string]string)
+			}
+			into.Set[name] = value
+		}
+		for name, value := range from.Add {
+			if into.Add == nil {
+				into.Add = make(map[string]string)
+			}
+			into.Add[name] = value
+		}
+		into.Remove = append(into.Remove, from.Remove...)
+	}
+	merge(&http.Headers.Request, headers.Request)
+	merge(&http.Headers.Response, headers.Response)
+}
+
+// Adds the effective rate limit (and the 429 response clients receive) to each path
+// with a ratelimit filter so it's visible when describing a router.
+func DescribeRateLimits(paths []Route) []Route {
+	for i, path := range paths {
+		for _, filter := range path.Filters {
+			if filter.Type == "ratelimit" {
+				if limit, err := RateLimitFromFilter(filter); err == nil {
+					paths[i].RateLimit = limit
+				}
+			}
+		}
+	}
+	return paths
+}
+
+func IsTrafficPolicyFilter(filterType string) bool {
+	return filterType == "timeout" || filterType == "retries" || filterType == "fault"
+}
+
+func TimeoutFromFilter(filter structs.HttpFilters) (string, error) {
+	timeout, found, err := parseFilterDuration(filter, "timeout")
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", errors.New("The timeout filter requires a timeout value (e.g., 30s).")
+	}
+	return istioDuration(timeout), nil
+}
+
+func RetriesFromFilter(filter structs.HttpFilters) (*HTTPRetry, error) {
+	retry := HTTPRetry{}
+	val, ok := filter.Data["attempts"]
+	if !ok || val == "" {
+		return nil, errors.New("The retries filter requires the number of attempts.")
+	}
+	attempts, err := strconv.ParseInt(val, 10, 32)
+	if err != nil {
+		return nil, errors.New("The retries filter has an invalid number of attempts: " + val)
+	}
+	if attempts < 0 || attempts > maxRetryAttempts {
+		return nil, fmt.Errorf("The retries filter attempts must be between 0 and %d.", maxRetryAttempts)
+	}
+	retry.Attempts = int32(attempts)
+	perTryTimeout, found, err := parseFilterDuration(filter, "per_try_timeout")
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		retry.PerTryTimeout = istioDuration(perTryTimeout)
+	}
+	if val, ok := filter.Data["retry_on"]; ok && val != "" {
+		conditions := make([]string, 0)
+		for _, condition := range strings.Split(val, ",") {
+			condition = strings.TrimSpace(condition)
+			if _, err := strconv.ParseInt(condition, 10, 32); err != nil {
+				var valid = false
+				for _, c := range validRetryOnConditions {
+					if c == condition {
+						valid = true
+					}
+				}
+				if !valid {
+					return nil, errors.New("The retries filter has an invalid retry_on condition: " + condition)
+				}
+			}
+			conditions = append(conditions, condition)
+		}
+		retry.RetryOn = strings.Join(conditions, ",")
+	}
+	return &retry, nil
+}
+
+func FaultFromFilter(filter structs.HttpFilters) (*HTTPFaultInjection, error) {
+	fault := HTTPFaultInjection{}
+	delay, found, err := parseFilterDuration(filter, "delay")
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		percentage, err := parseFilterPercentage(filter, "delay_percentage")
+		if err != nil {
+			return nil, err
+		}
+		fault.Delay = &FaultDelay{FixedDelay: istioDuration(delay), Percentage: percentage}
+	}
+	if val, ok := filter.Data["abort_status"]; ok && val != "" {
+		status, err := strconv.ParseInt(val, 10, 32)
+		if err != nil || status < 400 || status > 599 {
+			return nil, errors.New("The fault filter abort_status must be an http error status between 400 and 599.")
+		}
+		percentage, err := parseFilterPercentage(filter, "abort_percentage")
+		if err != nil {
+			return nil, err
+		}
+		fault.Abort = &FaultAbort{HttpStatus: int32(status), Percentage: percentage}
+	}
+	if fault.Delay == nil && fault.Abort == nil {
+		return nil, errors.New("The fault filter requires a delay, an abort_status or both.")
+	}
+	return &fault, nil
+}
+
+// Applies a timeout, retries or fault filter to the http route, returns false if the
+// filter was not a traffic policy filter.
+func ApplyTrafficPolicyFilter(http *HTTP, filter structs.HttpFilters) (bool, error) {
+	if filter.Type == "timeout" {
+		timeout, err := TimeoutFromFilter(filter)
+		if err != nil {
+			return true, err
+		}
+		http.Timeout = timeout
+	} else if filter.Type == "retries" {
+		retries, err := RetriesFromFilter(filter)
+		if err != nil {
+			return true, err
+		}
+		http.Retries = retries
+	} else if filter.Type == "fault" {
+		fault, err := FaultFromFilter(filter)
+		if err != nil {
+			return true, err
+		}
+		http.Fault = fault
+	} else {
+		return false, nil
+	}
+	return true, nil
+}
+
+func ValidateFilters(filters []structs.HttpFilters) error {
+	seen := make(map[string]bool)
+	for _, filter := range filters {
+		if filter.Type == "" {
+			return errors.New("Filter type cannot be blank.")
+		}
+		if IsTrafficPolicyFilter(filter.Type) {
+			if seen[filter.Type] {
+				return errors.New("Only one " + filter.Type + " filter may be specified.")
+			}
+			var http HTTP
+			if _, err := ApplyTrafficPolicyFilter(&http, filter); err != nil {
+				return err
+			}
+		} else if filter.Type == "ratelimit" {
+			if seen[filter.Type] {
+				return errors.New("Only one ratelimit filter may be specified.")
+			}
+			if _, err := RateLimitFromFilter(filter); err != nil {
+				return err
+			}
+		} else if filter.Type == "ipfilter" {
+			if seen[filter.Type] {
+				return errors.New("Only one ipfilter filter may be specified.")
+			}
+			if _, err := IPFilterFromFilter(filter); err != nil {
+				return err
+			}
+		} else if filter.Type == "headers" {
+			if seen[filter.Type] {
+				return errors.New("Only one headers filter may be specified.")
+			}
+			if _, err := HeadersFromFilter(filter); err != nil {
+				return err
+			}
+		} else if filter.Type == "basic_auth" || filter.Type == "oauth2" {
+			if seen["basic_auth"] || seen["oauth2"] {
+				return errors.New("Only one basic_auth or oauth2 filter may be specified.")
+			}
+			if filter.Type == "basic_auth" {
+				if _, err := BasicAuthFromFilter(filter); err != nil {
+					return err
+				}
+			} else {
+				if _, err := OAuth2FromFilter(filter); err != nil {
+					return err
+				}
+			}
+		} else if filter.Type != "cors" && filter.Type != "csp" && filter.Type != "jwt" {
+			return errors.New("Unknown filter type: " + filter.Type)
+		}
+		seen[filter.Type] = true
+	}
+	return nil
+}
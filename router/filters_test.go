@@ -0,0 +1,311 @@
+package router
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"region-api/structs"
+	"testing"
+	"time"
+)
+
+func TestFilters(t *testing.T) {
+	Convey("Test router path filters", t, func() {
+
+		Convey("Timeout filters should render istio durations", func() {
+			timeout, err := TimeoutFromFilter(structs.HttpFilters{Type: "timeout", Data: map[string]string{"timeout": "1m30s"}})
+			So(err, ShouldBeNil)
+			So(timeout, ShouldEqual, "90s")
+			timeout, err = TimeoutFromFilter(structs.HttpFilters{Type: "timeout", Data: map[string]string{"timeout": "2.5"}})
+			So(err, ShouldBeNil)
+			So(timeout, ShouldEqual, "2.5s")
+			_, err = TimeoutFromFilter(structs.HttpFilters{Type: "timeout", Data: map[string]string{}})
+			So(err, ShouldNotBeNil)
+			_, err = TimeoutFromFilter(structs.HttpFilters{Type: "timeout", Data: map[string]string{"timeout": "-1s"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Retry filters should validate attempts and conditions", func() {
+			retries, err := RetriesFromFilter(structs.HttpFilters{Type: "retries", Data: map[string]string{"attempts": "3", "per_try_timeout": "500ms", "retry_on": "5xx, connect-failure,503"}})
+			So(err, ShouldBeNil)
+			So(retries.Attempts, ShouldEqual, 3)
+			So(retries.PerTryTimeout, ShouldEqual, "0.5s")
+			So(retries.RetryOn, ShouldEqual, "5xx,connect-failure,503")
+			_, err = RetriesFromFilter(structs.HttpFilters{Type: "retries", Data: map[string]string{"attempts": "50"}})
+			So(err, ShouldNotBeNil)
+			_, err = RetriesFromFilter(structs.HttpFilters{Type: "retries", Data: map[string]string{"attempts": "2", "retry_on": "sometimes"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Fault filters should require a delay or abort", func() {
+			fault, err := FaultFromFilter(structs.HttpFilters{Type: "fault", Data: map[string]string{"delay": "5s", "delay_percentage": "10", "abort_status": "503"}})
+			So(err, ShouldBeNil)
+			So(fault.Delay.FixedDelay, ShouldEqual, "5s")
+			So(fault.Delay.Percentage.Value, ShouldEqual, 10)
+			So(fault.Abort.HttpStatus, ShouldEqual, 503)
+			So(fault.Abort.Percentage.Value, ShouldEqual, 100)
+			_, err = FaultFromFilter(structs.HttpFilters{Type: "fault", Data: map[string]string{}})
+			So(err, ShouldNotBeNil)
+			_, err = FaultFromFilter(structs.HttpFilters{Type: "fault", Data: map[string]string{"abort_status": "200"}})
+			So(err, ShouldNotBeNil)
+			_, err = FaultFromFilter(structs.HttpFilters{Type: "fault", Data: map[string]string{"delay": "1s", "delay_percentage": "150"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Validating filters should reject unknown or duplicate filters", func() {
+			So(ValidateFilters(nil), ShouldBeNil)
+			So(ValidateFilters([]structs.HttpFilters{structs.HttpFilters{Type: "cors", Data: map[string]string{}}, structs.HttpFilters{Type: "timeout", Data: map[string]string{"timeout": "10s"}}}), ShouldBeNil)
+			So(ValidateFilters([]structs.HttpFilters{structs.HttpFilters{Type: "nope", Data: map[string]string{}}}), ShouldNotBeNil)
+			So(ValidateFilters([]structs.HttpFilters{structs.HttpFilters{Type: "timeout", Data: map[string]string{"timeout": "10s"}}, structs.HttpFilters{Type: "timeout", Data: map[string]string{"timeout": "20s"}}}), ShouldNotBeNil)
+		})
+
+		Convey("Traffic policy filters should be added to the site virtual service", func() {
+			filters := []structs.HttpFilters{
+				structs.HttpFilters{Type: "timeout", Data: map[string]string{"timeout": "10s"}},
+				structs.HttpFilters{Type: "retries", Data: map[string]string{"attempts": "2"}},
+			}
+			vs, err := PrepareVirtualServiceForCreateorUpdate("www.example.com", false, []Route{Route{Domain: "www.example.com", Path: "/", Space: "default", App: "test", ReplacePath: "/", Port: "80", Filters: filters}})
+			So(err, ShouldBeNil)
+			So(len(vs.Spec.HTTP), ShouldEqual, 1)
+			So(vs.Spec.HTTP[0].Timeout, ShouldEqual, "10s")
+			So(vs.Spec.HTTP[0].Retries.Attempts, ShouldEqual, 2)
+			So(vs.Spec.HTTP[0].Fault, ShouldBeNil)
+		})
+
+		Convey("Rate limit filters should validate requests, units and keys", func() {
+			limit, err := RateLimitFromFilter(structs.HttpFilters{Type: "ratelimit", Data: map[string]string{"requests": "100"}})
+			So(err, ShouldBeNil)
+			So(limit.Requests, ShouldEqual, 100)
+			So(limit.Unit, ShouldEqual, "minute")
+			So(limit.Key, ShouldEqual, "client_ip")
+			So(limit.StatusCode, ShouldEqual, 429)
+			So(limit.FillInterval(), ShouldEqual, time.Minute)
+			limit, err = RateLimitFromFilter(structs.HttpFilters{Type: "ratelimit", Data: map[string]string{"requests": "5", "unit": "Second", "key": "header", "header": "X-Api-Key"}})
+			So(err, ShouldBeNil)
+			So(limit.Unit, ShouldEqual, "second")
+			So(limit.Header, ShouldEqual, "x-api-key")
+			_, err = RateLimitFromFilter(structs.HttpFilters{Type: "ratelimit", Data: map[string]string{"requests": "0"}})
+			So(err, ShouldNotBeNil)
+			_, err = RateLimitFromFilter(structs.HttpFilters{Type: "ratelimit", Data: map[string]string{"requests": "10", "unit": "day"}})
+			So(err, ShouldNotBeNil)
+			_, err = RateLimitFromFilter(structs.HttpFilters{Type: "ratelimit", Data: map[string]string{"requests": "10", "key": "header"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Rate limit filters should render an envoy filter for the routes they apply to", func() {
+			filters := []structs.HttpFilters{structs.HttpFilters{Type: "ratelimit", Data: map[string]string{"requests": "10", "unit": "second"}}}
+			vs, err := PrepareVirtualServiceForCreateorUpdate("www.example.com", false, []Route{
+				Route{Domain: "www.example.com", Path: "/api", Space: "default", App: "api", ReplacePath: "/", Port: "80", Filters: filters},
+				Route{Domain: "www.example.com", Path: "/", Space: "default", App: "test", ReplacePath: "/", Port: "80"},
+			})
+			So(err, ShouldBeNil)
+			limited := 0
+			for _, http := range vs.Spec.HTTP {
+				if http.RateLimit != nil {
+					limited++
+					So(http.Name, ShouldNotEqual, "")
+				}
+			}
+			So(limited, ShouldBeGreaterThan, 0)
+			filter := PrepareRateLimitEnvoyFilter("www.example.com", "sites-system", "sites-public", vs)
+			So(filter, ShouldNotBeNil)
+			So(filter.GetName(), ShouldEqual, "www-example-com-ratelimit")
+			So(filter.Spec.WorkloadSelector.Labels["istio"], ShouldEqual, "sites-public")
+			So(len(filter.Spec.ConfigPatches), ShouldEqual, 1+limited)
+
+			vs, err = PrepareVirtualServiceForCreateorUpdate("www.example.com", false, []Route{Route{Domain: "www.example.com", Path: "/", Space: "default", App: "test", ReplacePath: "/", Port: "80"}})
+			So(err, ShouldBeNil)
+			So(PrepareRateLimitEnvoyFilter("www.example.com", "sites-system", "sites-public", vs), ShouldBeNil)
+			So(PrepareRateLimitServiceConfig("www.example.com", vs), ShouldBeNil)
+		})
+
+		Convey("Each client ip address or header value should get its own bucket", func() {
+			vs, err := PrepareVirtualServiceForCreateorUpdate("www.example.com", false, []Route{
+				Route{Domain: "www.example.com", Path: "/api", Space: "default", App: "api", ReplacePath: "/", Port: "80",
+					Filters: []structs.HttpFilters{structs.HttpFilters{Type: "ratelimit", Data: map[string]string{"requests": "10", "unit": "second"}}}},
+				Route{Domain: "www.example.com", Path: "/keys", Space: "default", App: "keys", ReplacePath: "/", Port: "80",
+					Filters: []structs.HttpFilters{structs.HttpFilters{Type: "ratelimit", Data: map[string]string{"requests": "50", "key": "header", "header": "X-Api-Key"}}}},
+			})
+			So(err, ShouldBeNil)
+			routes := make(map[string]*RateLimit)
+			for _, http := range vs.Spec.HTTP {
+				if http.RateLimit != nil {
+					routes[http.Name] = http.RateLimit
+				}
+			}
+			So(len(routes), ShouldBeGreaterThanOrEqualTo, 2)
+
+			filter := PrepareRateLimitEnvoyFilter("www.example.com", "sites-system", "sites-public", vs)
+			So(filter, ShouldNotBeNil)
+			So(filter.Spec.ConfigPatches[0].Patch.Value["name"], ShouldEqual, "envoy.filters.http.ratelimit")
+			for _, patch := range filter.Spec.ConfigPatches[1:] {
+				So(patch.Patch.Value["typed_per_filter_config"], ShouldBeNil)
+				name := patch.Match["routeConfiguration"].(map[string]interface{})["vhost"].(map[string]interface{})["route"].(map[string]interface{})["name"].(string)
+				actions := patch.Patch.Value["route"].(map[string]interface{})["rate_limits"].([]interface{})[0].(map[string]interface{})["actions"].([]interface{})
+				So(len(actions), ShouldEqual, 2)
+				So(actions[0].(map[string]interface{})["generic_key"].(map[string]interface{})["descriptor_value"], ShouldEqual, name)
+				if routes[name].Key == "header" {
+					So(actions[1].(map[string]interface{})["request_headers"].(map[string]interface{})["header_name"], ShouldEqual, "x-api-key")
+				} else {
+					So(actions[1].(map[string]interface{})["remote_address"], ShouldNotBeNil)
+				}
+			}
+
+			config := PrepareRateLimitServiceConfig("www.example.com", vs)
+			So(config, ShouldNotBeNil)
+			So(config.Domain, ShouldEqual, "www.example.com")
+			So(len(config.Descriptors), ShouldEqual, len(routes))
+			for _, route := range config.Descriptors {
+				So(route.Key, ShouldEqual, "route")
+				So(route.RateLimit, ShouldBeNil)
+				So(len(route.Descriptors), ShouldEqual, 1)
+				perKey := route.Descriptors[0]
+				// a descriptor without a value counts each value it's sent separately.
+				So(perKey.Value, ShouldEqual, "")
+				So(perKey.RateLimit, ShouldNotBeNil)
+				if routes[route.Value].Key == "header" {
+					So(perKey.Key, ShouldEqual, "header-x-api-key")
+					So(*perKey.RateLimit, ShouldResemble, RateLimitPolicy{Unit: "minute", RequestsPerUnit: 50})
+				} else {
+					So(perKey.Key, ShouldEqual, "remote_address")
+					So(*perKey.RateLimit, ShouldResemble, RateLimitPolicy{Unit: "second", RequestsPerUnit: 10})
+				}
+			}
+		})
+
+		Convey("IP filters should validate addresses and CIDR ranges", func() {
+			ipfilter, err := IPFilterFromFilter(structs.HttpFilters{Type: "ipfilter", Data: map[string]string{"allow": "10.0.0.0/8, 192.168.1.7", "deny": "10.1.2.3/16"}})
+			So(err, ShouldBeNil)
+			So(ipfilter.Allow, ShouldResemble, []string{"10.0.0.0/8", "192.168.1.7"})
+			So(ipfilter.Deny, ShouldResemble, []string{"10.1.0.0/16"})
+			_, err = IPFilterFromFilter(structs.HttpFilters{Type: "ipfilter", Data: map[string]string{}})
+			So(err, ShouldNotBeNil)
+			_, err = IPFilterFromFilter(structs.HttpFilters{Type: "ipfilter", Data: map[string]string{"allow": "10.0.0.0/33"}})
+			So(err, ShouldNotBeNil)
+			So(ValidateFilters([]structs.HttpFilters{structs.HttpFilters{Type: "ipfilter", Data: map[string]string{"deny": "not-an-ip"}}}), ShouldNotBeNil)
+		})
+
+		Convey("IP filters should render a deny authorization policy for the site paths", func() {
+			filters := []structs.HttpFilters{structs.HttpFilters{Type: "ipfilter", Data: map[string]string{"allow": "10.0.0.0/8", "deny": "10.1.0.0/16"}}}
+			policy := PrepareIPFilterAuthorizationPolicy("www.example.com", "istio-system", "sites-public", []Route{
+				Route{Domain: "www.example.com", Path: "/admin", Filters: filters},
+				Route{Domain: "www.example.com", Path: "/"},
+			})
+			So(policy, ShouldNotBeNil)
+			So(policy.GetName(), ShouldEqual, "www-example-com-ipfilter")
+			So(policy.Spec.Action, ShouldEqual, "DENY")
+			So(policy.Spec.Selector.Labels["istio"], ShouldEqual, "sites-public")
+			So(len(policy.Spec.Rules), ShouldEqual, 2)
+			So(policy.Spec.Rules[0].From[0].Source.NotRemoteIpBlocks, ShouldResemble, []string{"10.0.0.0/8"})
+			So(policy.Spec.Rules[1].From[0].Source.RemoteIpBlocks, ShouldResemble, []string{"10.1.0.0/16"})
+			So(policy.Spec.Rules[0].To[0].Operation.Paths, ShouldResemble, []string{"/admin", "/admin/*"})
+			So(policy.Spec.Rules[0].To[0].Operation.Hosts, ShouldResemble, []string{"www.example.com", "www.example.com:*"})
+			So(isIPFilterRuleForPath(policy.Spec.Rules[0], "/admin/"), ShouldBeTrue)
+			So(isIPFilterRuleForPath(policy.Spec.Rules[0], "/"), ShouldBeFalse)
+			So(PrepareIPFilterAuthorizationPolicy("www.example.com", "istio-system", "sites-public", []Route{Route{Domain: "www.example.com", Path: "/"}}), ShouldBeNil)
+		})
+
+		Convey("Basic auth filters should hash passwords and never persist them", func() {
+			auth, err := BasicAuthFromFilter(structs.HttpFilters{Type: "basic_auth", Data: map[string]string{"username": "admin", "password": "password"}})
+			So(err, ShouldBeNil)
+			So(auth.Htpasswd(), ShouldEqual, "admin:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=")
+			_, err = BasicAuthFromFilter(structs.HttpFilters{Type: "basic_auth", Data: map[string]string{"username": "admin"}})
+			So(err, ShouldNotBeNil)
+			_, err = BasicAuthFromFilter(structs.HttpFilters{Type: "basic_auth", Data: map[string]string{"username": "ad:min", "password": "password"}})
+			So(err, ShouldNotBeNil)
+			So(ValidateFilters([]structs.HttpFilters{
+				structs.HttpFilters{Type: "basic_auth", Data: map[string]string{"username": "admin", "password": "password"}},
+				structs.HttpFilters{Type: "oauth2", Data: map[string]string{"provider": "oauth2-proxy"}},
+			}), ShouldNotBeNil)
+			filters, auth, err := SecureFilters("www.example.com", []structs.HttpFilters{structs.HttpFilters{Type: "basic_auth", Data: map[string]string{"username": "admin", "secret": "other"}}})
+			So(err, ShouldBeNil)
+			So(auth.Password, ShouldEqual, "")
+			So(StoreBasicAuth(nil, "www.example.com", "/", auth, true), ShouldBeNil)
+			So(filters[0].Data, ShouldResemble, map[string]string{"username": "admin", "secret": "www-example-com-basic-auth"})
+		})
+
+		Convey("Basic auth filters should render an envoy filter for the protected routes", func() {
+			filters := []structs.HttpFilters{structs.HttpFilters{Type: "basic_auth", Data: map[string]string{"username": "admin", "secret": "www-example-com-basic-auth"}}}
+			vs, err := PrepareVirtualServiceForCreateorUpdate("www.example.com", false, []Route{
+				Route{Domain: "www.example.com", Path: "/admin", Space: "default", App: "admin", ReplacePath: "/", Port: "80", Filters: filters},
+				Route{Domain: "www.example.com", Path: "/", Space: "default", App: "test", ReplacePath: "/", Port: "80"},
+			})
+			So(err, ShouldBeNil)
+			routes, dirty := basicAuthRoutes("www.example.com", vs, map[string]string{"/admin": "admin:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="})
+			So(dirty, ShouldBeFalse)
+			So(len(routes), ShouldEqual, 2)
+			So(routes["www.example.com/admin/"], ShouldEqual, "admin:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=")
+			filter := PrepareBasicAuthEnvoyFilter("www.example.com", "sites-system", "sites-public", routes)
+			So(filter, ShouldNotBeNil)
+			So(filter.GetName(), ShouldEqual, "www-example-com-basic-auth")
+			So(len(filter.Spec.ConfigPatches), ShouldEqual, 3)
+			So(PrepareBasicAuthEnvoyFilter("www.example.com", "sites-system", "sites-public", map[string]string{}), ShouldBeNil)
+
+			app := &VirtualService{}
+			app.Spec.HTTP = []HTTP{HTTP{Match: []Match{Match{URI: StringMatch{Prefix: "/"}}}}}
+			routes, dirty = basicAuthRoutes("test-default", app, map[string]string{"": "admin:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="})
+			So(dirty, ShouldBeTrue)
+			So(app.Spec.HTTP[0].Name, ShouldEqual, "test-default/")
+			So(len(routes), ShouldEqual, 1)
+		})
+
+		Convey("OAuth2 filters should render custom authorization policies", func() {
+			oauth2, err := OAuth2FromFilter(structs.HttpFilters{Type: "oauth2", Data: map[string]string{"provider": "oauth2-proxy", "excludes": "/healthz, /public"}})
+			So(err, ShouldBeNil)
+			So(oauth2.Excludes, ShouldResemble, []string{"/healthz", "/public"})
+			_, err = OAuth2FromFilter(structs.HttpFilters{Type: "oauth2", Data: map[string]string{}})
+			So(err, ShouldNotBeNil)
+			_, err = OAuth2FromFilter(structs.HttpFilters{Type: "oauth2", Data: map[string]string{"provider": "oauth2-proxy", "excludes": "healthz"}})
+			So(err, ShouldNotBeNil)
+
+			policies := PrepareOAuth2AuthorizationPolicies("www.example.com", "sites-system", "sites-public", []Route{
+				Route{Domain: "www.example.com", Path: "/", Filters: []structs.HttpFilters{structs.HttpFilters{Type: "oauth2", Data: map[string]string{"provider": "oauth2-proxy"}}}},
+				Route{Domain: "www.example.com", Path: "/public"},
+			})
+			So(len(policies), ShouldEqual, 1)
+			So(policies[0].GetName(), ShouldEqual, "www-example-com-root-oauth2")
+			So(policies[0].Spec.Action, ShouldEqual, "CUSTOM")
+			So(policies[0].Spec.Provider.Name, ShouldEqual, "oauth2-proxy")
+			So(policies[0].Spec.Rules[0].To[0].Operation.Paths, ShouldBeNil)
+			So(policies[0].Spec.Rules[0].To[0].Operation.NotPaths, ShouldResemble, []string{"/public", "/public/*"})
+			So(oauth2PolicyName("test-default", "/api/v1"), ShouldEqual, "test-default-api-v1-oauth2")
+		})
+
+		Convey("Headers filters should add, set and remove headers but not the router's", func() {
+			headers, err := HeadersFromFilter(structs.HttpFilters{Type: "headers", Data: map[string]string{
+				"request.set.X-Tenant":       "acme",
+				"request.remove":             "Cookie, X-Debug",
+				"response.add.Cache-Control": "no-store",
+				"response.remove":            "Server",
+			}})
+			So(err, ShouldBeNil)
+			So(headers.Request.Set["X-Tenant"], ShouldEqual, "acme")
+			So(headers.Request.Remove, ShouldResemble, []string{"Cookie", "X-Debug"})
+			So(headers.Response.Add["Cache-Control"], ShouldEqual, "no-store")
+			So(headers.Response.Remove, ShouldResemble, []string{"Server"})
+			_, err = HeadersFromFilter(structs.HttpFilters{Type: "headers", Data: map[string]string{"request.set.X-Orig-Host": "evil.example.com"}})
+			So(err, ShouldNotBeNil)
+			_, err = HeadersFromFilter(structs.HttpFilters{Type: "headers", Data: map[string]string{"request.remove": "x-forwarded-path"}})
+			So(err, ShouldNotBeNil)
+			_, err = HeadersFromFilter(structs.HttpFilters{Type: "headers", Data: map[string]string{"response.set.Strict-Transport-Security": "max-age=0"}})
+			So(err, ShouldNotBeNil)
+			_, err = HeadersFromFilter(structs.HttpFilters{Type: "headers", Data: map[string]string{"request.replace.X-Foo": "bar"}})
+			So(err, ShouldNotBeNil)
+			_, err = HeadersFromFilter(structs.HttpFilters{Type: "headers", Data: map[string]string{"request.set.Bad Header": "bar"}})
+			So(err, ShouldNotBeNil)
+
+			vs, err := PrepareVirtualServiceForCreateorUpdate("www.example.com", false, []Route{Route{Domain: "www.example.com", Path: "/", Space: "default", App: "test", ReplacePath: "/", Port: "80", Filters: []structs.HttpFilters{
+				structs.HttpFilters{Type: "headers", Data: map[string]string{"request.set.X-Tenant": "acme", "response.remove": "Server"}},
+			}}})
+			So(err, ShouldBeNil)
+			So(vs.Spec.HTTP[0].Headers.Request.Set["X-Tenant"], ShouldEqual, "acme")
+			So(vs.Spec.HTTP[0].Headers.Request.Set["X-Orig-Host"], ShouldEqual, "www.example.com")
+			So(vs.Spec.HTTP[0].Headers.Response.Remove, ShouldResemble, []string{"Server"})
+		})
+
+		Convey("Describing paths should include the rate limit", func() {
+			paths := DescribeRateLimits([]Route{Route{Path: "/", Filters: []structs.HttpFilters{structs.HttpFilters{Type: "ratelimit", Data: map[string]string{"requests": "10"}}}}, Route{Path: "/other"}})
+			So(paths[0].RateLimit, ShouldNotBeNil)
+			So(paths[0].RateLimit.StatusCode, ShouldEqual, 429)
+			So(paths[1].RateLimit, ShouldBeNil)
+		})
+	})
+}
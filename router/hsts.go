@@ -0,0 +1,171 @@
+package router
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+	"net/http"
+	structs "region-api/structs"
+	utils "region-api/utils"
+	"strconv"
+)
+
+// The Strict-Transport-Security policy for a site, when a site has no policy the
+// default of one year including sub domains is sent on every response.
+type HSTS struct {
+	Disabled          bool  `json:"disabled"`
+	MaxAge            int64 `json:"max_age"`
+	IncludeSubdomains bool  `json:"include_subdomains"`
+	Preload           bool  `json:"preload"`
+}
+
+// Changes to a site's policy, only the fields given are changed.
+type HSTSUpdate struct {
+	Disabled          *bool  `json:"disabled"`
+	MaxAge            *int64 `json:"max_age"`
+	IncludeSubdomains *bool  `json:"include_subdomains"`
+	Preload           *bool  `json:"preload"`
+}
+
+const hstsDefaultMaxAge = 31536000
+
+var DefaultHSTS = HSTS{MaxAge: hstsDefaultMaxAge, IncludeSubdomains: true}
+
+func (hsts *HSTS) Validate() error {
+	if hsts.Disabled {
+		return nil
+	}
+	if hsts.MaxAge < 0 {
+		return errors.New("The HSTS max_age cannot be negative.")
+	}
+	if hsts.Preload && (hsts.MaxAge < hstsDefaultMaxAge || !hsts.IncludeSubdomains) {
+		return errors.New("The HSTS preload option requires a max_age of at least one year and include_subdomains.")
+	}
+	return nil
+}
+
+// The policy with the update applied, a site without a policy starts from the default.
+func (update *HSTSUpdate) Merge(hsts *HSTS) HSTS {
+	merged := DefaultHSTS
+	if hsts != nil {
+		merged = *hsts
+	}
+	if update.Disabled != nil {
+		merged.Disabled = *update.Disabled
+	}
+	if update.MaxAge != nil {
+		merged.MaxAge = *update.MaxAge
+	}
+	if update.IncludeSubdomains != nil {
+		merged.IncludeSubdomains = *update.IncludeSubdomains
+	}
+	if update.Preload != nil {
+		merged.Preload = *update.Preload
+	}
+	return merged
+}
+
+func (hsts *HSTS) Header() string {
+	header := "max-age=" + strconv.FormatInt(hsts.MaxAge, 10)
+	if hsts.IncludeSubdomains {
+		header = header + "; includeSubDomains"
+	}
+	if hsts.Preload {
+		header = header + "; preload"
+	}
+	return header
+}
+
+// Sets (or removes if disabled) the Strict-Transport-Security header on every route of the
+// site, a nil policy uses the default.
+func ApplyHSTS(vs *VirtualService, hsts *HSTS) {
+	if hsts == nil {
+		hsts = &DefaultHSTS
+	}
+	for i := range vs.Spec.HTTP {
+		if vs.Spec.HTTP[i].Headers == nil {
+			vs.Spec.HTTP[i].Headers = &Headers{}
+		}
+		if hsts.Disabled {
+			delete(vs.Spec.HTTP[i].Headers.Response.Set, "Strict-Transport-Security")
+			continue
+		}
+		if vs.Spec.HTTP[i].Headers.Response.Set == nil {
+			vs.Spec.HTTP[i].Headers.Response.Set = make(map[string]string)
+		}
+		vs.Spec.HTTP[i].Headers.Response.Set["Strict-Transport-Security"] = hsts.Header()
+	}
+}
+
+func GetRouterHSTS(db *sql.DB, domain string) (*HSTS, error) {
+	var hstsJson sql.NullString
+	if err := db.QueryRow("select hsts from routers where domain=$1", domain).Scan(&hstsJson); err != nil {
+		return nil, err
+	}
+	if !hstsJson.Valid || hstsJson.String == "" {
+		return nil, nil
+	}
+	var hsts HSTS
+	if err := json.Unmarshal([]byte(hstsJson.String), &hsts); err != nil {
+		return nil, err
+	}
+	return &hsts, nil
+}
+
+func SetRouterHSTS(db *sql.DB, domain string, hsts *HSTS) error {
+	if hsts == nil {
+		_, err := db.Exec("update routers set hsts=null where domain=$1", domain)
+		return err
+	}
+	hstsJson, err := json.Marshal(hsts)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("update routers set hsts=$1 where domain=$2", string(hstsJson), domain)
+	return err
+}
+
+func HttpUpdateRouterHSTS(db *sql.DB, params martini.Params, spec HSTSUpdate, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	current, err := GetRouterHSTS(db, params["router"])
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	hsts := spec.Merge(current)
+	if err := hsts.Validate(); err != nil {
+		utils.ReportInvalidRequest(err.Error(), r)
+		return
+	}
+	if err := SetRouterHSTS(db, params["router"], &hsts); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "HSTS Updated, push the router to apply"})
+}
+
+// Returns the site to the default policy.
+func HttpDeleteRouterHSTS(db *sql.DB, params martini.Params, r render.Render) {
+	if _, err := IsInternalRouter(db, params["router"]); err != nil {
+		if err == sql.ErrNoRows {
+			utils.ReportNotFoundError(r)
+			return
+		}
+		utils.ReportError(err, r)
+		return
+	}
+	if err := SetRouterHSTS(db, params["router"], nil); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "HSTS reset to the default, push the router to apply"})
+}
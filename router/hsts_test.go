@@ -0,0 +1,49 @@
+package router
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestHSTS(t *testing.T) {
+	Convey("Test the HSTS policy for sites", t, func() {
+		vs, err := PrepareVirtualServiceForCreateorUpdate("www.example.com", false, []Route{Route{Domain: "www.example.com", Path: "/", Space: "default", App: "test", ReplacePath: "/", Port: "80"}})
+		So(err, ShouldBeNil)
+
+		Convey("The default policy should be one year including sub domains", func() {
+			ApplyHSTS(vs, nil)
+			So(vs.Spec.HTTP[0].Headers.Response.Set["Strict-Transport-Security"], ShouldEqual, "max-age=31536000; includeSubDomains")
+		})
+
+		Convey("The policy should be tunable", func() {
+			ApplyHSTS(vs, &HSTS{MaxAge: 63072000, IncludeSubdomains: true, Preload: true})
+			So(vs.Spec.HTTP[0].Headers.Response.Set["Strict-Transport-Security"], ShouldEqual, "max-age=63072000; includeSubDomains; preload")
+			ApplyHSTS(vs, &HSTS{MaxAge: 300})
+			So(vs.Spec.HTTP[0].Headers.Response.Set["Strict-Transport-Security"], ShouldEqual, "max-age=300")
+		})
+
+		Convey("The policy can be turned off", func() {
+			ApplyHSTS(vs, &HSTS{Disabled: true})
+			_, ok := vs.Spec.HTTP[0].Headers.Response.Set["Strict-Transport-Security"]
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Invalid policies should be rejected", func() {
+			So((&HSTS{MaxAge: -1}).Validate(), ShouldNotBeNil)
+			So((&HSTS{MaxAge: 300, Preload: true, IncludeSubdomains: true}).Validate(), ShouldNotBeNil)
+			So((&HSTS{MaxAge: 31536000, Preload: true}).Validate(), ShouldNotBeNil)
+			So((&HSTS{Disabled: true}).Validate(), ShouldBeNil)
+			So(DefaultHSTS.Validate(), ShouldBeNil)
+		})
+
+		Convey("Updates should only change the fields given", func() {
+			maxAge := int64(300)
+			preload := false
+			stored := &HSTS{MaxAge: 63072000, IncludeSubdomains: true, Preload: true}
+			So((&HSTSUpdate{Preload: &preload}).Merge(stored), ShouldResemble, HSTS{MaxAge: 63072000, IncludeSubdomains: true})
+			So(stored.Preload, ShouldBeTrue)
+			So((&HSTSUpdate{MaxAge: &maxAge}).Merge(nil), ShouldResemble, HSTS{MaxAge: 300, IncludeSubdomains: true})
+			So((&HSTSUpdate{}).Merge(nil), ShouldResemble, DefaultHSTS)
+		})
+	})
+}
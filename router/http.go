@@ -118,12 +118,20 @@ func HttpDescribeRouters(db *sql.DB, params martini.Params, r render.Render) {
 			return
 		}
 		spec.Internal = internal
+		if spec.HSTS, err = GetRouterHSTS(db, element); err != nil {
+			utils.ReportError(err, r)
+			return
+		}
+		if spec.AutoTLS, spec.CertificateStatus, err = GetRouterAutoTLS(db, element); err != nil {
+			utils.ReportError(err, r)
+			return
+		}
 		pathspecs, err := GetPaths(db, element)
 		if err != nil {
 			utils.ReportError(err, r)
 			return
 		}
-		spec.Paths = pathspecs
+		spec.Paths = DescribeRateLimits(pathspecs)
 		routers = append(routers, spec)
 	}
 
@@ -138,12 +146,20 @@ func HttpDescribeRouter(db *sql.DB, params martini.Params, r render.Render) {
 		return
 	}
 	spec.Internal = internal
+	if spec.HSTS, err = GetRouterHSTS(db, params["router"]); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if spec.AutoTLS, spec.CertificateStatus, err = GetRouterAutoTLS(db, params["router"]); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
 	pathspecs, err := GetPaths(db, params["router"])
 	if err != nil {
 		utils.ReportError(err, r)
 		return
 	}
-	spec.Paths = pathspecs
+	spec.Paths = DescribeRateLimits(pathspecs)
 	r.JSON(http.StatusOK, spec)
 }
 
@@ -187,9 +203,20 @@ func HttpAddPath(db *sql.DB, spec Route, berr binding.Errors, r render.Render) {
 		return
 	}
 
+	if err := ValidateFilters(spec.Filters); err != nil {
+		utils.ReportInvalidRequest(err.Error(), r)
+		return
+	}
+
 	spec.App = strings.Replace(spec.App, "-"+spec.Space, "", -1)
 	filtersJson := make([]byte, 0)
 
+	var auth *BasicAuth
+	if spec.Filters, auth, err = SecureFilters(spec.Domain, spec.Filters); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+
 	if spec.Filters != nil {
 		filtersJson, err = json.Marshal(spec.Filters);
 		if err != nil {
@@ -204,6 +231,16 @@ func HttpAddPath(db *sql.DB, spec Route, berr binding.Errors, r render.Render) {
 		return
 	}
 
+	// the credentials are only stored once the path exists, the path is removed again if they
+	// cannot be stored so it never points at missing credentials.
+	if err = StoreBasicAuth(db, spec.Domain, spec.Path, auth, false); err != nil {
+		if _, e := db.Exec("DELETE from routerpaths where domain=$1 and path=$2", spec.Domain, spec.Path); e != nil {
+			fmt.Printf("WARNING: Unable to remove the path %s%s after its credentials failed to store: %s\n", spec.Domain, spec.Path, e.Error())
+		}
+		utils.ReportError(err, r)
+		return
+	}
+
 	r.JSON(http.StatusCreated, structs.Messagespec{Status: http.StatusCreated, Message: "Path Added"})
 }
 
@@ -241,23 +278,83 @@ func HttpCreateRouter(db *sql.DB, spec Router, berr binding.Errors, r render.Ren
 	} else {
 		spec.Internal = false
 	}
+	if spec.HSTS != nil {
+		if err := spec.HSTS.Validate(); err != nil {
+			utils.ReportInvalidRequest(err.Error(), r)
+			return
+		}
+	}
+	if spec.AutoTLS && certificateProvisioner == nil {
+		utils.ReportInvalidRequest("Automatic certificates (auto_tls) are not available.", r)
+		return
+	}
+	var appDomains int
+	if err := db.QueryRow("select count(*) from app_domains where domain=$1", spec.Domain).Scan(&appDomains); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if appDomains > 0 {
+		r.JSON(http.StatusConflict, structs.Messagespec{Status: http.StatusConflict, Message: "The domain " + spec.Domain + " is already used by an app."})
+		return
+	}
 
-	config, err := GetDefaultIngressSiteAddresses()
+	routerid, status, err := createRouter(db, spec, nil)
 	if err != nil {
 		utils.ReportError(err, r)
 		return
 	}
-	if err := SetDomainName(config, spec.Domain, spec.Internal); err != nil {
-		fmt.Printf("WARNING: %s\n", err.Error())
+	if spec.AutoTLS && status == CertificatePending {
+		r.JSON(http.StatusCreated, structs.Messagespec{Status: http.StatusCreated, Message: "Router created with ID " + routerid + ", it will be pushed once its certificate is issued"})
+		return
+	}
+	r.JSON(http.StatusCreated, structs.Messagespec{Status: http.StatusCreated, Message: "Router created with ID " + routerid})
+}
+
+// Adds the router and its paths with its dns name, hsts policy and (for auto_tls) certificate
+// order, returning the new router's id and the status of its certificate. The router and its
+// paths are inserted in a single transaction.
+func createRouter(db *sql.DB, spec Router, routes []Route) (string, string, error) {
+	config, err := GetDefaultIngressSiteAddresses()
+	if err != nil {
+		return "", "", err
+	}
+	var hsts sql.NullString
+	if spec.HSTS != nil {
+		hstsJson, err := json.Marshal(spec.HSTS)
+		if err != nil {
+			return "", "", err
+		}
+		hsts = sql.NullString{String: string(hstsJson), Valid: true}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", err
 	}
 	var routerid string
 	newrouteriduuid, _ := uuid.NewV4()
 	newrouterid := newrouteriduuid.String()
-	if err := db.QueryRow("INSERT INTO routers(routerid,domain,internal) VALUES($1,$2,$3) returning routerid;", newrouterid, spec.Domain, spec.Internal).Scan(&routerid); err != nil {
-		utils.ReportError(err, r)
-		return
+	if err := tx.QueryRow("INSERT INTO routers(routerid,domain,internal,hsts,auto_tls) VALUES($1,$2,$3,$4,$5) returning routerid;", newrouterid, spec.Domain, spec.Internal, hsts, spec.AutoTLS).Scan(&routerid); err != nil {
+		tx.Rollback()
+		return "", "", err
 	}
-	r.JSON(http.StatusCreated, structs.Messagespec{Status: http.StatusCreated, Message: "Router created with ID " + routerid})
+	if err := insertRouterPaths(tx, spec.Domain, routes); err != nil {
+		tx.Rollback()
+		return "", "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", "", err
+	}
+	if err := SetDomainName(db, config, spec.Domain, spec.Internal, SiteDNSRecordOwner(spec.Domain)); err != nil {
+		fmt.Printf("WARNING: %s\n", err.Error())
+	}
+	if !spec.AutoTLS {
+		return routerid, "", nil
+	}
+	status, err := OrderRouterCertificate(db, spec.Domain, spec.Internal)
+	if err != nil {
+		return "", "", err
+	}
+	return routerid, status, nil
 }
 
 func HttpPushRouter(db *sql.DB, params martini.Params, r render.Render) {
@@ -273,26 +370,32 @@ func HttpPushRouter(db *sql.DB, params martini.Params, r render.Render) {
 		return
 	}
 	router.Internal = IsInternal
-	ingress, err := GetSiteIngress(db, IsInternal)
+	pushed, err := pushRouter(db, router)
 	if err != nil {
 		utils.ReportError(err, r)
 		return
 	}
-	if len(pathspecs) == 0 {
-		if err = ingress.DeleteRouter(router.Domain, router.Internal); err != nil {
-			utils.ReportError(err, r)
-			return
-		}
-		r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Router Updated"})
-		return
-	} else {
-		if err = ingress.CreateOrUpdateRouter(router.Domain, router.Internal, router.Paths); err != nil {
-			utils.ReportError(err, r)
-			return
-		}
-		r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Router Updated"})
+	if !pushed {
+		r.JSON(http.StatusAccepted, structs.Messagespec{Status: http.StatusAccepted, Message: "Router is waiting on its certificate, it will be pushed once the certificate is issued"})
 		return
 	}
+	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Router Updated"})
+}
+
+// Pushes the router's paths to its ingress (or removes it from the ingress if it has no paths),
+// returns false if the router is waiting on its certificate.
+func pushRouter(db *sql.DB, router Router) (bool, error) {
+	ingress, err := GetSiteIngress(db, router.Internal)
+	if err != nil {
+		return false, err
+	}
+	if len(router.Paths) == 0 {
+		return true, ingress.DeleteRouter(router.Domain, router.Internal)
+	}
+	if err = ingress.CreateOrUpdateRouter(router.Domain, router.Internal, router.Paths); err == ErrRouterPendingCertificate {
+		return false, nil
+	}
+	return true, err
 }
 
 func HttpDeleteRouter(db *sql.DB, params martini.Params, r render.Render) {
@@ -327,7 +430,20 @@ func HttpDeleteRouter(db *sql.DB, params martini.Params, r render.Render) {
 	}
 
 	dns := GetDnsProvider()
+	owner := SiteDNSRecordOwner(router.Domain)
+	tracked, err := GetTrackedDomainRecords(db, &owner)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if _, err = RemoveOwnedDomainRecords(db, dns, owner); err != nil {
+		fmt.Println("Error trying to remove the dns records for " + router.Domain + ": " + err.Error())
+	}
+	// routers created before their dns records were tracked use the default ingress addresses.
 	domains, err := dns.Domain(router.Domain)
+	if len(tracked) > 0 {
+		domains = []Domain{}
+	}
 	if err != nil {
 		fmt.Println("Error trying to fetch domain(s) for " + router.Domain + ": " + err.Error())
 	} else {
@@ -382,11 +498,37 @@ func HttpUpdatePath(db *sql.DB, spec Route, berr binding.Errors, r render.Render
 		utils.ReportInvalidRequest("Replace Path Cannot be blank", r)
 		return
 	}
-	_, err := db.Exec("UPDATE routerpaths set space=$1, app=$2, replacepath=$3 where domain=$4 and path=$5", spec.Space, spec.App, spec.ReplacePath, spec.Domain, spec.Path)
+	if err := ValidateFilters(spec.Filters); err != nil {
+		utils.ReportInvalidRequest(err.Error(), r)
+		return
+	}
+	// Filters are only replaced when provided, to remove all filters send an empty list.
+	var auth *BasicAuth
+	var filtersJson sql.NullString
+	if spec.Filters != nil {
+		var err error
+		if spec.Filters, auth, err = SecureFilters(spec.Domain, spec.Filters); err != nil {
+			utils.ReportError(err, r)
+			return
+		}
+		filters, err := json.Marshal(spec.Filters)
+		if err != nil {
+			utils.ReportInvalidRequest("Cannot marshal filters: "+err.Error(), r)
+			return
+		}
+		filtersJson = sql.NullString{String: string(filters), Valid: true}
+	}
+	_, err := db.Exec("UPDATE routerpaths set space=$1, app=$2, replacepath=$3, filters=coalesce($4, filters) where domain=$5 and path=$6", spec.Space, spec.App, spec.ReplacePath, filtersJson, spec.Domain, spec.Path)
 	if err != nil {
 		utils.ReportError(err, r)
 		return
 	}
+	if spec.Filters != nil {
+		if err = StoreBasicAuth(db, spec.Domain, spec.Path, auth, true); err != nil {
+			utils.ReportError(err, r)
+			return
+		}
+	}
 	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Path Updated"})
 }
 
@@ -452,16 +594,9 @@ func HttpCreateDomainRecords(params martini.Params, spec DomainRecord, berr bind
 		utils.ReportInvalidRequest(berr[0].Message, r)
 		return
 	}
-	if strings.ToUpper(spec.Type) != "A" && strings.ToUpper(spec.Type) != "AAAA" && strings.ToUpper(spec.Type) != "CNAME" {
-		utils.ReportInvalidRequest("Only A, AAAA and CNAME records may be added to a domain record.", r)
-		return
-	}
-	if strings.ToUpper(strings.Trim(params["domain"], ".")) == strings.ToUpper(strings.Trim(spec.Name, ".")) {
-		utils.ReportInvalidRequest("Entries cannot be created for the root domain.", r)
-		return
-	}
-	if spec.Name == "" {
-		utils.ReportInvalidRequest("Entries cannot be created for the root domain.", r)
+	spec, err := NormalizeDomainRecord(params["domain"], spec)
+	if err != nil {
+		utils.ReportInvalidRequest(err.Error(), r)
 		return
 	}
 
@@ -478,39 +613,58 @@ func HttpCreateDomainRecords(params martini.Params, spec DomainRecord, berr bind
 	}
 
 	for _, domain := range domains {
-		if err = dns.CreateDomainRecord(domain, spec.Type, spec.Name, spec.Values); err != nil {
+		if err = dns.ChangeDomainRecords(domain, []DomainRecordChange{DomainRecordChange{Action: "upsert", Record: spec}}); err != nil {
 			utils.ReportError(err, r)
 			return
 		}
-		records = append(records, DomainRecord{
-			Type:   spec.Type,
-			Name:   spec.Name,
-			Values: spec.Values,
-			Domain: &Domain{
-				ProviderId:  domain.ProviderId,
-				Name:        domain.Name,
-				Public:      domain.Public,
-				Metadata:    domain.Metadata,
-				Status:      domain.Status,
-				RecordCount: domain.RecordCount,
-			},
-		})
+		record := spec
+		record.Domain = &Domain{
+			ProviderId:  domain.ProviderId,
+			Name:        domain.Name,
+			Public:      domain.Public,
+			Metadata:    domain.Metadata,
+			Status:      domain.Status,
+			RecordCount: domain.RecordCount,
+		}
+		records = append(records, record)
 	}
 	r.JSON(http.StatusCreated, records)
 }
 
-func HttpRemoveDomainRecords(params martini.Params, r render.Render) {
+func HttpRemoveDomainRecords(params martini.Params, req *http.Request, r render.Render) {
 	dns := GetDnsProvider()
-	if strings.Contains(strings.ToLower(params["domain"]), strings.ToLower(params["name"])) || strings.ToLower(params["name"]) == strings.ToLower(params["domain"]) {
-		r.JSON(http.StatusConflict, map[string]interface{}{"error": "CONFLICT", "error_description": "The name entry to delete was the domain itself."})
+	if params["name"] == "" {
+		utils.ReportInvalidRequest("Entries cannot be removed for the root of the domain.", r)
 		return
 	}
-	if strings.ToUpper(strings.Trim(params["domain"], ".")) == strings.ToUpper(strings.Trim(params["name"], ".")) {
-		utils.ReportInvalidRequest("Entries cannot be removed for the root of the domain.", r)
+	// only the record types that can be created on the root of the domain can be removed from it,
+	// one value at a time.
+	recordType := req.URL.Query().Get("type")
+	value := req.URL.Query().Get("value")
+	root := strings.ToUpper(strings.Trim(params["domain"], ".")) == strings.ToUpper(strings.Trim(params["name"], "."))
+	if root && (recordType == "" || value == "") {
+		utils.ReportInvalidRequest("The type and value of the entry to remove are required for the root of the domain.", r)
 		return
 	}
-	if params["name"] == "" {
-		utils.ReportInvalidRequest("Entries cannot be removed for the root of the domain.", r)
+	if root && !rootDomainRecordTypes[strings.ToUpper(recordType)] {
+		utils.ReportInvalidRequest("Only MX, TXT and CAA entries can be removed for the root of the domain.", r)
+		return
+	}
+	if value != "" && recordType == "" {
+		utils.ReportInvalidRequest("The type of the entry is required to remove a value.", r)
+		return
+	}
+	if value != "" {
+		// values are compared in the form they are stored, e.g., with txt values quoted.
+		normalized, err := NormalizeDomainRecord(params["domain"], DomainRecord{Type: recordType, Name: params["name"], Values: []string{value}})
+		if err != nil {
+			utils.ReportInvalidRequest(err.Error(), r)
+			return
+		}
+		value = normalized.Values[0]
+	}
+	if !root && strings.Contains(strings.ToLower(params["domain"]), strings.ToLower(params["name"])) {
+		r.JSON(http.StatusConflict, map[string]interface{}{"error": "CONFLICT", "error_description": "The name entry to delete was the domain itself."})
 		return
 	}
 
@@ -525,6 +679,7 @@ func HttpRemoveDomainRecords(params martini.Params, r render.Render) {
 	}
 
 	toRemoveRecords := make([]DomainRecord, 0)
+	changes := make([]DomainRecordChange, 0)
 	for _, domain := range domains {
 		records, err := dns.DomainRecords(domain)
 		if err != nil {
@@ -532,18 +687,30 @@ func HttpRemoveDomainRecords(params martini.Params, r render.Render) {
 			return
 		}
 		for _, record := range records {
-			// we only allow removal of A or CNAME records
-			if record.Name == params["name"] && (strings.ToUpper(record.Type) == "A" || strings.ToUpper(record.Type) == "AAAA" || strings.ToUpper(record.Type) == "CNAME") {
-				record.Domain = &Domain{
-					ProviderId:  domain.ProviderId,
-					Name:        domain.Name,
-					Public:      domain.Public,
-					Metadata:    domain.Metadata,
-					Status:      domain.Status,
-					RecordCount: domain.RecordCount,
+			// we only allow removal of the record types we manage, optionally only of one type
+			if record.Name != params["name"] || !IsRemovableDomainRecord(record.Type, root, recordType) {
+				continue
+			}
+			// remove the record exactly as it is, its ttl, weight or alias must match.
+			change := DomainRecordChange{Action: "delete", Record: record}
+			if value != "" {
+				var ok bool
+				if change, ok = RemoveDomainRecordValue(record, value); !ok {
+					continue
 				}
-				toRemoveRecords = append(toRemoveRecords, record)
+				record.Values = []string{value}
+			}
+			record.Domain = &Domain{
+				ProviderId:  domain.ProviderId,
+				Name:        domain.Name,
+				Public:      domain.Public,
+				Metadata:    domain.Metadata,
+				Status:      domain.Status,
+				RecordCount: domain.RecordCount,
 			}
+			change.Record.Domain = nil
+			toRemoveRecords = append(toRemoveRecords, record)
+			changes = append(changes, change)
 		}
 	}
 
@@ -552,8 +719,8 @@ func HttpRemoveDomainRecords(params martini.Params, r render.Render) {
 		return
 	}
 
-	for _, rrec := range toRemoveRecords {
-		if err = dns.RemoveDomainRecord(*rrec.Domain, rrec.Type, rrec.Name, rrec.Values); err != nil {
+	for i, rrec := range toRemoveRecords {
+		if err = dns.ChangeDomainRecords(*rrec.Domain, []DomainRecordChange{changes[i]}); err != nil {
 			utils.ReportError(err, r)
 			return
 		}
@@ -591,11 +758,27 @@ func AddToMartini(m *martini.ClassicMartini) {
 	m.Post("/v1/router/:router/path", binding.Json(Route{}), HttpAddPath)
 	m.Delete("/v1/router/:router/path", binding.Json(Route{}), HttpDeletePath)
 	m.Put("/v1/router/:router/path", binding.Json(Route{}), HttpUpdatePath)
+	m.Put("/v1/router/:router/paths", binding.Json([]Route{}), HttpReplacePaths)
+	m.Post("/v1/router/:router/clone", binding.Json(RouterClone{}), HttpCloneRouter)
+	m.Patch("/v1/router/:router/hsts", binding.Json(HSTSUpdate{}), HttpUpdateRouterHSTS)
+	m.Delete("/v1/router/:router/hsts", HttpDeleteRouterHSTS)
+	m.Get("/v1/space/:space/app/:app/domains", HttpGetAppDomains)
+	m.Post("/v1/space/:space/app/:app/domains", binding.Json(AppDomain{}), HttpAddAppDomain)
+	m.Delete("/v1/space/:space/app/:app/domains/:domain", HttpRemoveAppDomain)
 	m.Get("/v1/sites/:site", HttpGetSite)
+	m.Get("/v1/sites/:site/diagnostics", HttpGetSiteDiagnostics)
+	m.Post("/v1/sites/:site/repair", HttpRepairSite)
 	m.Get("/v1/domains", HttpGetDomains)
+	m.Get("/v1/domains/orphaned-records", HttpGetOrphanedDomainRecords)
 	m.Get("/v1/domains/:domain", HttpGetDomain)
 	m.Get("/v1/domains/:domain/records", HttpGetDomainRecords)
 	m.Post("/v1/domains/:domain/records", binding.Json(DomainRecord{}), HttpCreateDomainRecords)
 	m.Delete("/v1/domains/:domain/records/:name", HttpRemoveDomainRecords)
+	m.Post("/v1/domains/:domain/changes", binding.Json(DomainRecordChanges{}), HttpChangeDomainRecords)
+	m.Post("/v1/certificates", binding.Json(CertificateUpload{}), HttpUploadCertificate)
+	m.Get("/v1/certificates/expiring", HttpGetExpiringCertificates)
 	m.Get("/v1/certificates/:domain", HttpGetInstalledCertificates)
+	m.Put("/v1/certificates/:domain", binding.Json(CertificateUpload{}), HttpReplaceCertificate)
+	m.Delete("/v1/certificates/:domain", HttpDeleteCertificate)
+	m.Get("/metrics/certificates", HttpGetCertificateMetrics)
 }
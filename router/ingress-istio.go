@@ -1,8 +1,10 @@
 package router
 
 import (
+	"crypto/rand"
 	"crypto/x509"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
@@ -12,6 +14,7 @@ import (
 	"os"
 	"region-api/runtime"
 	"region-api/structs"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -28,6 +31,7 @@ const VS_RETRY_COUNT = 20
 
 const IstioNetworkingAPIVersion = "networking.istio.io/v1beta1"
 const IstioSecurityAPIVersion = "security.istio.io/v1beta1"
+const IstioNetworkingAPIVersionAlpha = "networking.istio.io/v1alpha3"
 
 // Policy types for istio (https://istio.io/docs/reference/config/security/istio.authentication.v1alpha1/#Policy)
 type StringMatch struct {
@@ -62,10 +66,12 @@ type From struct {
 		NotPrincipals        []string `json:"notPrincipals,omitempty"`
 		RequestPrincipals    []string `json:"requestPrincipals,omitempty"`
 		NotRequestPrincipals []string `json:"notRequestPrincipals,omitempty"`
-		Namespaces           []string `json:"namespaces"`
-		NotNamespaces        []string `json:"notNamespaces"`
-		IpBlocks             []string `json:"ipBlocks"`
-		NotIpBlocks          []string `json:"notIpBlocks"`
+		Namespaces           []string `json:"namespaces,omitempty"`
+		NotNamespaces        []string `json:"notNamespaces,omitempty"`
+		IpBlocks             []string `json:"ipBlocks,omitempty"`
+		NotIpBlocks          []string `json:"notIpBlocks,omitempty"`
+		RemoteIpBlocks       []string `json:"remoteIpBlocks,omitempty"`
+		NotRemoteIpBlocks    []string `json:"notRemoteIpBlocks,omitempty"`
 	} `json:"source"`
 }
 
@@ -93,11 +99,17 @@ type AuthorizationPolicy struct {
 	kubemetav1.TypeMeta   `json:",inline"`
 	kubemetav1.ObjectMeta `json:"metadata"`
 	Spec                  struct {
-		Selector WorkloadSelector `json:"selector"`
-		Rules    []Rule           `json:"rules"`
+		Selector WorkloadSelector   `json:"selector"`
+		Action   string             `json:"action,omitempty"`
+		Provider *ExtensionProvider `json:"provider,omitempty"`
+		Rules    []Rule             `json:"rules"`
 	} `json:"spec"`
 }
 
+type ExtensionProvider struct {
+	Name string `json:"name"`
+}
+
 // Gateway types for istio (https://istio.io/docs/reference/config/networking/gateway/)
 type TLSOptions struct {
 	HttpsRedirect           bool     `json:"httpsRedirect,omitempty"`
@@ -176,12 +188,44 @@ type Routes struct {
 	Destination Destination `json:"destination"`
 }
 
+type Percent struct {
+	Value float64 `json:"value"`
+}
+
+type HTTPRetry struct {
+	Attempts      int32  `json:"attempts"`
+	PerTryTimeout string `json:"perTryTimeout,omitempty"`
+	RetryOn       string `json:"retryOn,omitempty"`
+}
+
+type FaultDelay struct {
+	FixedDelay string   `json:"fixedDelay"`
+	Percentage *Percent `json:"percentage,omitempty"`
+}
+
+type FaultAbort struct {
+	HttpStatus int32    `json:"httpStatus"`
+	Percentage *Percent `json:"percentage,omitempty"`
+}
+
+type HTTPFaultInjection struct {
+	Delay *FaultDelay `json:"delay,omitempty"`
+	Abort *FaultAbort `json:"abort,omitempty"`
+}
+
 type HTTP struct {
-	Match      []Match     `json:"match,omitempty"`
-	Route      []Routes    `json:"route"`
-	Rewrite    *Rewrite    `json:"rewrite,omitempty"`
-	Headers    *Headers    `json:"headers,omitempty"`
-	CorsPolicy *CorsPolicy `json:"corsPolicy,omitempty"`
+	Name       string              `json:"name,omitempty"`
+	Match      []Match             `json:"match,omitempty"`
+	Route      []Routes            `json:"route"`
+	Rewrite    *Rewrite            `json:"rewrite,omitempty"`
+	Headers    *Headers            `json:"headers,omitempty"`
+	CorsPolicy *CorsPolicy         `json:"corsPolicy,omitempty"`
+	Timeout    string              `json:"timeout,omitempty"`
+	Retries    *HTTPRetry          `json:"retries,omitempty"`
+	Fault      *HTTPFaultInjection `json:"fault,omitempty"`
+	// Rate limits are not part of the virtual service, they're rendered into an envoy filter
+	// for the gateway that references this route by name.
+	RateLimit *RateLimit `json:"-"`
 }
 
 type VirtualService struct {
@@ -194,6 +238,25 @@ type VirtualService struct {
 	} `json:"spec"`
 }
 
+// Envoy Filter types for istio (https://istio.io/latest/docs/reference/config/networking/envoy-filter/)
+type EnvoyConfigPatch struct {
+	ApplyTo string                 `json:"applyTo"`
+	Match   map[string]interface{} `json:"match"`
+	Patch   struct {
+		Operation string                 `json:"operation"`
+		Value     map[string]interface{} `json:"value"`
+	} `json:"patch"`
+}
+
+type EnvoyFilter struct {
+	kubemetav1.TypeMeta   `json:",inline"`
+	kubemetav1.ObjectMeta `json:"metadata"`
+	Spec                  struct {
+		WorkloadSelector WorkloadSelector   `json:"workloadSelector"`
+		ConfigPatches    []EnvoyConfigPatch `json:"configPatches"`
+	} `json:"spec"`
+}
+
 func removeSlashSlash(input string) string {
 	toreturn := strings.Replace(input, "//", "/", -1)
 	if toreturn == "" {
@@ -369,18 +432,48 @@ func (ingress *IstioIngress) UpdateAppVirtualService(vs *VirtualService, space s
 	return ingress.UpdateVirtualService(vs, app+"-"+space)
 }
 
-func (ingress *IstioIngress) InstallOrUpdateVirtualService(domain string, vs *VirtualService, exists bool) error {
-	if os.Getenv("INGRESS_DEBUG") == "true" {
-		fmt.Printf("[ingress] Istio - starting install or update virtual service for %s\n", domain)
+// Adds the host to the virtual service and references the gateway it arrives through.
+func AddHostToVirtualService(vs *VirtualService, host string, gateway string) (dirty bool) {
+	hostExists := false
+	for _, h := range vs.Spec.Hosts {
+		if h == host {
+			hostExists = true
+		}
+	}
+	if !hostExists {
+		vs.Spec.Hosts = append(vs.Spec.Hosts, host)
+		dirty = true
+	}
+	gatewayExists := false
+	for _, g := range vs.Spec.Gateways {
+		if g == gateway {
+			gatewayExists = true
+		}
+	}
+	if !gatewayExists {
+		vs.Spec.Gateways = append(vs.Spec.Gateways, gateway)
+		dirty = true
 	}
-	// Force good security practices
-	for i, _ := range vs.Spec.HTTP {
-		if vs.Spec.HTTP[i].Headers.Response.Set == nil {
-			vs.Spec.HTTP[i].Headers.Response.Set = make(map[string]string)
+	return dirty
+}
+
+func RemoveHostFromVirtualService(vs *VirtualService, host string) (dirty bool) {
+	hosts := make([]string, 0)
+	for _, h := range vs.Spec.Hosts {
+		if h == host {
+			dirty = true
+		} else {
+			hosts = append(hosts, h)
 		}
-		vs.Spec.HTTP[i].Headers.Response.Set["Strict-Transport-Security"] = "max-age=31536000; includeSubDomains"
 	}
+	vs.Spec.Hosts = hosts
+	return dirty
+}
 
+func (ingress *IstioIngress) InstallOrUpdateVirtualService(domain string, vs *VirtualService, exists bool) error {
+	if os.Getenv("INGRESS_DEBUG") == "true" {
+		fmt.Printf("[ingress] Istio - starting install or update virtual service for %s\n", domain)
+	}
 	if !exists {
 		body, code, err := ingress.runtime.GenericRequest("post", "/apis/"+IstioNetworkingAPIVersion+"/namespaces/sites-system/virtualservices", vs)
 		if err != nil {
@@ -802,7 +895,8 @@ func (ingress *IstioIngress) GetCertificateFromDomain(domain string) (error, str
 	//
 	// 1. See if a direct certificate exists for the domain name.
 	// 2. See if there's a wildcard certificate installed.
-	// 3. Default to the star certificate and hope it works.
+	// 3. See if another certificate has the domain as an alternative name.
+	// 4. Default to the star certificate and hope it works.
 	//
 	certs, err := ingress.GetInstalledCertificates(domain)
 	if err != nil {
@@ -820,6 +914,13 @@ func (ingress *IstioIngress) GetCertificateFromDomain(domain string) (error, str
 			return nil, strings.Replace(strings.Replace(starCert, ".", "-", -1), "*", "star", -1) + "-tls"
 		}
 	}
+	certs, err = ingress.GetInstalledCertificates("*")
+	if err != nil {
+		return err, ""
+	}
+	if name := alternativeCertificateName(certs, domain); name != "" {
+		return nil, name
+	}
 	return nil, "star-certificate"
 }
 
@@ -938,6 +1039,37 @@ func createHTTPSpecForVS(app string, space string, domain string, maintenance bo
 				}
 				http.Headers.Response.Set["Content-Security-Policy"] = policy
 			}
+		} else if IsTrafficPolicyFilter(filter.Type) {
+			if os.Getenv("INGRESS_DEBUG") == "true" {
+				fmt.Printf("[ingress] Adding %s filter %#+v\n", filter.Type, filter)
+			}
+			if _, err := ApplyTrafficPolicyFilter(&http, filter); err != nil {
+				fmt.Printf("WARNING: Unable to apply %s filter to site %s: %s\n", filter.Type, domain, err.Error())
+			}
+		} else if filter.Type == "ratelimit" {
+			if os.Getenv("INGRESS_DEBUG") == "true" {
+				fmt.Printf("[ingress] Adding rate limit filter %#+v\n", filter)
+			}
+			limit, err := RateLimitFromFilter(filter)
+			if err != nil {
+				fmt.Printf("WARNING: Unable to apply rate limit filter to site %s: %s\n", domain, err.Error())
+			} else {
+				http.Name = domain + forwardedPath
+				http.RateLimit = limit
+			}
+		} else if filter.Type == "headers" {
+			if os.Getenv("INGRESS_DEBUG") == "true" {
+				fmt.Printf("[ingress] Adding headers filter %#+v\n", filter)
+			}
+			headers, err := HeadersFromFilter(filter)
+			if err != nil {
+				fmt.Printf("WARNING: Unable to apply headers filter to site %s: %s\n", domain, err.Error())
+			} else {
+				ApplyHeadersFilter(&http, headers)
+			}
+		} else if filter.Type == "basic_auth" {
+			// The credentials are applied to the named route by an envoy filter on the gateway
+			http.Name = domain + forwardedPath
 		}
 	}
 
@@ -979,161 +1111,1102 @@ func PrepareVirtualServiceForCreateorUpdate(domain string, internal bool, paths
 	return &vs, nil
 }
 
-func CertificateToSecret(server_name string, pem_cert []byte, pem_key []byte, namespace string) (*string, *kube.Secret, error) {
-	block, _ := pem.Decode(pem_cert)
-	if block == nil {
-		fmt.Println("failed to parse PEM block containing the public certificate")
-		return nil, nil, errors.New("Invalid certificate: Failed to decode PEM block")
+func rateLimitEnvoyFilterName(domain string) string {
+	return strings.Replace(domain, ".", "-", -1) + "-ratelimit"
+}
+
+// The rate limit service counts requests for each descriptor it's sent, descriptors without a
+// value in its config (the client ip address or header value) get a bucket for each value seen.
+type RateLimitServiceConfig struct {
+	Domain      string                `json:"domain"`
+	Descriptors []RateLimitDescriptor `json:"descriptors"`
+}
+
+type RateLimitDescriptor struct {
+	Key         string                `json:"key"`
+	Value       string                `json:"value,omitempty"`
+	RateLimit   *RateLimitPolicy      `json:"rate_limit,omitempty"`
+	Descriptors []RateLimitDescriptor `json:"descriptors,omitempty"`
+}
+
+type RateLimitPolicy struct {
+	Unit            string `json:"unit"`
+	RequestsPerUnit int64  `json:"requests_per_unit"`
+}
+
+func getRateLimitServiceCluster() string {
+	if os.Getenv("RATE_LIMIT_SERVICE_CLUSTER") != "" {
+		return os.Getenv("RATE_LIMIT_SERVICE_CLUSTER")
 	}
-	x509_decoded_cert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		fmt.Println("invalid certificate provided")
-		fmt.Println(err)
-		return nil, nil, err
+	return "outbound|8081||ratelimit.istio-system.svc.cluster.local"
+}
+
+func getRateLimitServiceNamespace() string {
+	if os.Getenv("RATE_LIMIT_SERVICE_NAMESPACE") != "" {
+		return os.Getenv("RATE_LIMIT_SERVICE_NAMESPACE")
 	}
-	block, _ = pem.Decode([]byte(pem_key))
-	if block == nil {
-		fmt.Println("failed to parse PEM block containing the private key")
-		return nil, nil, errors.New("Invalid key: Failed to decode PEM block")
+	return "istio-system"
+}
+
+func getRateLimitConfigMap() string {
+	if os.Getenv("RATE_LIMIT_CONFIGMAP") != "" {
+		return os.Getenv("RATE_LIMIT_CONFIGMAP")
 	}
-	main_server_name := strings.Replace(x509_decoded_cert.Subject.CommonName, "*.", "star.", -1)
-	name := strings.Replace(main_server_name, ".", "-", -1) + "-tls"
-	secret := kube.Secret{}
-	secret.Kind = "Secret"
-	secret.APIVersion = "v1"
-	secret.Type = kube.SecretTypeTLS
-	secret.SetName(name)
-	secret.SetNamespace(namespace)
-	secret.SetAnnotations(map[string]string{
-		"akkeris.k8s.io/alt-names":   main_server_name,
-		"akkeris.k8s.io/common-name": main_server_name,
-	})
-	secret.SetLabels(map[string]string{
-		"akkeris.k8s.io/certificate-name": main_server_name,
-	})
-	secret.Data = make(map[string][]byte, 0)
-	secret.Data["tls.key"] = []byte(pem_key)
-	secret.Data["tls.crt"] = []byte(pem_cert)
-	return &name, &secret, nil
+	return "ratelimit-config"
 }
 
-func getDownPage() string {
-	if os.Getenv("ISTIO_DOWNPAGE") != "" {
-		return os.Getenv("ISTIO_DOWNPAGE")
+func rateLimitConfigKey(domain string) string {
+	return strings.Replace(domain, ".", "-", -1) + ".yaml"
+}
+
+// The descriptor key a rate limit counts requests by, the route is always sent first so each
+// route's limit is counted separately.
+func rateLimitDescriptorKey(limit *RateLimit) string {
+	if limit.Key == "header" {
+		return "header-" + limit.Header
 	}
-	return "downpage.akkeris-system.svc.cluster.local"
+	return "remote_address"
 }
 
-func (ingress *IstioIngress) CreateOrUpdateRouter(domain string, internal bool, paths []Route) error {
+// Renders an envoy filter for the gateway which sends the route and client ip address (or header
+// value) of requests on each rate limited route in the virtual service to the rate limit service.
+// Returns nil if no routes have a rate limit.
+func PrepareRateLimitEnvoyFilter(domain string, namespace string, gateway string, vs *VirtualService) *EnvoyFilter {
+	var filter EnvoyFilter
+	filter.APIVersion = IstioNetworkingAPIVersionAlpha
+	filter.Kind = "EnvoyFilter"
+	filter.SetName(rateLimitEnvoyFilterName(domain))
+	filter.SetNamespace(namespace)
+	filter.Spec.WorkloadSelector = WorkloadSelector{
+		Labels: map[string]string{
+			"istio": gateway,
+		},
+	}
+	filter.Spec.ConfigPatches = make([]EnvoyConfigPatch, 0)
+
+	var insertRateLimit EnvoyConfigPatch
+	insertRateLimit.ApplyTo = "HTTP_FILTER"
+	insertRateLimit.Match = map[string]interface{}{
+		"context": "GATEWAY",
+		"listener": map[string]interface{}{
+			"filterChain": map[string]interface{}{
+				"filter": map[string]interface{}{
+					"name":      "envoy.filters.network.http_connection_manager",
+					"subFilter": map[string]interface{}{"name": "envoy.filters.http.router"},
+				},
+			},
+		},
+	}
+	insertRateLimit.Patch.Operation = "INSERT_BEFORE"
+	insertRateLimit.Patch.Value = map[string]interface{}{
+		"name": "envoy.filters.http.ratelimit",
+		"typed_config": map[string]interface{}{
+			"@type":             "type.googleapis.com/envoy.extensions.filters.http.ratelimit.v3.RateLimit",
+			"domain":            domain,
+			"failure_mode_deny": false,
+			"timeout":           "0.25s",
+			"rate_limit_service": map[string]interface{}{
+				"grpc_service": map[string]interface{}{
+					"envoy_grpc": map[string]interface{}{"cluster_name": getRateLimitServiceCluster()},
+				},
+				"transport_api_version": "V3",
+			},
+		},
+	}
+	filter.Spec.ConfigPatches = append(filter.Spec.ConfigPatches, insertRateLimit)
 
-	// Ensure a certificate exists and a hosts entry is registered with the gateway
-	if os.Getenv("INGRESS_DEBUG") == "true" {
-		fmt.Printf("[ingress] Istio - create or update router firing for %s\n", domain)
+	for _, http := range vs.Spec.HTTP {
+		if http.RateLimit == nil || http.Name == "" {
+			continue
+		}
+		limit := http.RateLimit
+		var action map[string]interface{}
+		if limit.Key == "header" {
+			action = map[string]interface{}{
+				"request_headers": map[string]interface{}{
+					"header_name":    limit.Header,
+					"descriptor_key": rateLimitDescriptorKey(limit),
+				},
+			}
+		} else {
+			action = map[string]interface{}{
+				"remote_address": map[string]interface{}{},
+			}
+		}
+
+		var routeRateLimit EnvoyConfigPatch
+		routeRateLimit.ApplyTo = "HTTP_ROUTE"
+		routeRateLimit.Match = map[string]interface{}{
+			"context": "GATEWAY",
+			"routeConfiguration": map[string]interface{}{
+				"vhost": map[string]interface{}{
+					"name":  domain + ":443",
+					"route": map[string]interface{}{"name": http.Name},
+				},
+			},
+		}
+		routeRateLimit.Patch.Operation = "MERGE"
+		routeRateLimit.Patch.Value = map[string]interface{}{
+			"route": map[string]interface{}{
+				"rate_limits": []interface{}{
+					map[string]interface{}{
+						"actions": []interface{}{
+							map[string]interface{}{
+								"generic_key": map[string]interface{}{"descriptor_key": "route", "descriptor_value": http.Name},
+							},
+							action,
+						},
+					},
+				},
+			},
+		}
+		filter.Spec.ConfigPatches = append(filter.Spec.ConfigPatches, routeRateLimit)
 	}
-	err, cert_secret_name := ingress.GetCertificateFromDomain(domain)
+	if len(filter.Spec.ConfigPatches) == 1 {
+		return nil
+	}
+	return &filter
+}
+
+// Renders the rate limit service's config for the routes in the virtual service with a rate limit,
+// returns nil if no routes have a rate limit.
+func PrepareRateLimitServiceConfig(domain string, vs *VirtualService) *RateLimitServiceConfig {
+	config := RateLimitServiceConfig{Domain: domain, Descriptors: make([]RateLimitDescriptor, 0)}
+	for _, http := range vs.Spec.HTTP {
+		if http.RateLimit == nil || http.Name == "" {
+			continue
+		}
+		limit := http.RateLimit
+		config.Descriptors = append(config.Descriptors, RateLimitDescriptor{
+			Key:   "route",
+			Value: http.Name,
+			Descriptors: []RateLimitDescriptor{
+				RateLimitDescriptor{
+					Key:       rateLimitDescriptorKey(limit),
+					RateLimit: &RateLimitPolicy{Unit: limit.Unit, RequestsPerUnit: limit.Requests},
+				},
+			},
+		})
+	}
+	if len(config.Descriptors) == 0 {
+		return nil
+	}
+	return &config
+}
+
+// Each site's rate limits are a key in the rate limit service's config map, a nil config removes them.
+func (ingress *IstioIngress) writeRateLimitServiceConfig(domain string, config *RateLimitServiceConfig) error {
+	path := "/api/v1/namespaces/" + getRateLimitServiceNamespace() + "/configmaps"
+	body, code, err := ingress.runtime.GenericRequest("get", path+"/"+getRateLimitConfigMap(), nil)
 	if err != nil {
-		if os.Getenv("INGRESS_DEBUG") == "true" {
-			fmt.Printf("[ingress] Cannot obtain cert secret name (on push) for site %s because %s\n", domain, err.Error())
-		}
 		return err
 	}
-	if cert_secret_name == "" {
-		panic("We should never have a cert_secret_name thats blank.")
+	var configMap kube.ConfigMap
+	if code == http.StatusOK {
+		if err = json.Unmarshal(body, &configMap); err != nil {
+			return err
+		}
+	} else if code == http.StatusNotFound {
+		if config == nil {
+			return nil
+		}
+		configMap.APIVersion = "v1"
+		configMap.Kind = "ConfigMap"
+		configMap.SetName(getRateLimitConfigMap())
+		configMap.SetNamespace(getRateLimitServiceNamespace())
+	} else {
+		return errors.New("Unable to get the rate limit config " + getRateLimitConfigMap() + ": " + strconv.Itoa(code) + " " + string(body))
 	}
-	if err = ingress.InstallOrUpdateUberSiteGateway(domain, cert_secret_name, internal, 0); err != nil {
-		if os.Getenv("INGRESS_DEBUG") == "true" {
-			fmt.Printf("[ingress] Cannot install or update uber site gateway for site %s using cert %s because %s\n", domain, cert_secret_name, err.Error())
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	if config == nil {
+		if _, ok := configMap.Data[rateLimitConfigKey(domain)]; !ok {
+			return nil
 		}
-		return err
+		delete(configMap.Data, rateLimitConfigKey(domain))
+	} else {
+		// json is valid yaml, which the rate limit service reads.
+		data, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		configMap.Data[rateLimitConfigKey(domain)] = string(data)
+	}
+	if code == http.StatusOK {
+		body, code, err = ingress.runtime.GenericRequest("put", path+"/"+getRateLimitConfigMap(), configMap)
+	} else {
+		body, code, err = ingress.runtime.GenericRequest("post", path, configMap)
 	}
-
-	// Ensure a virtual services exists
-	exists, version, err := ingress.VirtualServiceExists(domain)
 	if err != nil {
-		fmt.Printf("[ingress] Istio - an error received from virtual service exists during create/update router: %s: %s\n", err.Error(), domain)
 		return err
 	}
-	vs, err := PrepareVirtualServiceForCreateorUpdate(domain, internal, paths)
+	if code != http.StatusOK && code != http.StatusCreated {
+		return errors.New("Unable to write the rate limit config " + getRateLimitConfigMap() + ": " + strconv.Itoa(code) + " " + string(body))
+	}
+	return nil
+}
+
+func (ingress *IstioIngress) installOrUpdateEnvoyFilter(filter *EnvoyFilter) error {
+	path := "/apis/" + IstioNetworkingAPIVersionAlpha + "/namespaces/" + ingress.config.Environment + "/envoyfilters"
+	body, code, err := ingress.runtime.GenericRequest("get", path+"/"+filter.GetName(), nil)
 	if err != nil {
-		fmt.Printf("[ingress] Istio - unable to prepare virtual service for create or update: %s: %s\n", err.Error(), domain)
 		return err
 	}
-	if exists && version != "" {
-		vs.SetResourceVersion(version)
-	}
-	if err = ingress.InstallOrUpdateVirtualService(domain, vs, exists); err != nil {
-		if os.Getenv("INGRESS_DEBUG") == "true" {
-			fmt.Printf("[ingress] Cannot install or update virtualservice for site %s using cert %s using because %s, virtual service is %#+v\n", domain, cert_secret_name, err.Error(), vs)
+	if code == http.StatusOK {
+		var existing EnvoyFilter
+		if err = json.Unmarshal(body, &existing); err != nil {
+			return err
 		}
+		filter.SetResourceVersion(existing.GetResourceVersion())
+		body, code, err = ingress.runtime.GenericRequest("put", path+"/"+filter.GetName(), filter)
+	} else {
+		body, code, err = ingress.runtime.GenericRequest("post", path, filter)
+	}
+	if err != nil {
 		return err
 	}
+	if code != http.StatusOK && code != http.StatusCreated {
+		return errors.New("Unable to install envoy filter " + filter.GetName() + " due to error: " + strconv.Itoa(code) + " " + string(body))
+	}
 	return nil
 }
 
-func (ingress *IstioIngress) InstallOrUpdateCORSAuthFilter(vsname string, path string, allowOrigin []string, allowMethods []string, allowHeaders []string, exposeHeaders []string, maxAge time.Duration, allowCredentials bool) error {
-	virtualService, err := ingress.GetVirtualService(vsname)
+func (ingress *IstioIngress) deleteEnvoyFilter(name string) error {
+	body, code, err := ingress.runtime.GenericRequest("delete", "/apis/"+IstioNetworkingAPIVersionAlpha+"/namespaces/"+ingress.config.Environment+"/envoyfilters/"+name, nil)
 	if err != nil {
-		// not yet deployed
-		return nil
+		return err
 	}
-	var dirty = false
-	allowOrigins := make([]StringMatch, 0)
-	for _, origin := range allowOrigin {
-		allowOrigins = append(allowOrigins, StringMatch{Exact: origin})
+	if code != http.StatusOK && code != http.StatusAccepted && code != http.StatusNotFound {
+		return errors.New("Unable to delete envoy filter " + name + ": " + string(body))
 	}
-	for i, http := range virtualService.Spec.HTTP {
-		if http.Match == nil || len(http.Match) == 0 {
-			virtualService.Spec.HTTP[0].CorsPolicy = &CorsPolicy{
-				AllowOrigins:     allowOrigins,
-				AllowMethods:     allowMethods,
-				AllowHeaders:     allowHeaders,
-				ExposeHeaders:    exposeHeaders,
-				MaxAge:           maxAge.String(),
-				AllowCredentials: allowCredentials,
-			}
-			dirty = true
-		} else {
-			for _, match := range http.Match {
-				if os.Getenv("INGRESS_DEBUG") == "true" {
-					fmt.Printf("[ingress] Looking to add CORS policy, comparing path: %s with match prefix %s and match exact %s\n", path, match.URI.Prefix, match.URI.Exact)
-				}
-				if strings.HasPrefix(match.URI.Prefix, path) || match.URI.Exact == path || match.URI.Prefix == path {
-					virtualService.Spec.HTTP[i].CorsPolicy = &CorsPolicy{
-						AllowOrigins:     allowOrigins,
-						AllowMethods:     allowMethods,
-						AllowHeaders:     allowHeaders,
-						ExposeHeaders:    exposeHeaders,
-						MaxAge:           maxAge.String(),
-						AllowCredentials: allowCredentials,
-					}
-					dirty = true
-				}
-			}
-		}
+	return nil
+}
+
+func (ingress *IstioIngress) InstallOrUpdateRateLimitFilter(domain string, vs *VirtualService) error {
+	filter := PrepareRateLimitEnvoyFilter(domain, ingress.config.Environment, ingress.config.Name, vs)
+	if filter == nil {
+		return ingress.DeleteRateLimitFilter(domain)
 	}
-	if dirty == true {
-		if os.Getenv("INGRESS_DEBUG") == "true" {
-			fmt.Printf("[ingress] Istio - Installing or updating CORS auth filter for %s at path %s: %#+v\n", vsname, path, virtualService)
-		}
-		if err = ingress.UpdateVirtualService(virtualService, vsname); err != nil {
-			return err
-		}
+	if os.Getenv("INGRESS_DEBUG") == "true" {
+		fmt.Printf("[ingress] Istio - installing or updating rate limit envoy filter for %s\n", domain)
 	}
-	return nil
+	// the limits must be known to the rate limit service before the gateway sends it requests.
+	if err := ingress.writeRateLimitServiceConfig(domain, PrepareRateLimitServiceConfig(domain, vs)); err != nil {
+		return err
+	}
+	return ingress.installOrUpdateEnvoyFilter(filter)
 }
 
-func (ingress *IstioIngress) DeleteCORSAuthFilter(vsname string, path string) error {
-	virtualService, err := ingress.GetVirtualService(vsname)
-	if err != nil {
-		if err.Error() == "virtual service was not found" {
-			// Go ahead and ignore setting this.  We can't as there's no deployment yet.
-			return nil
-		}
+func (ingress *IstioIngress) DeleteRateLimitFilter(domain string) error {
+	if err := ingress.deleteEnvoyFilter(rateLimitEnvoyFilterName(domain)); err != nil {
 		return err
 	}
-	var dirty = false
-	for i, http := range virtualService.Spec.HTTP {
-		if http.Match == nil || len(http.Match) == 0 {
+	return ingress.writeRateLimitServiceConfig(domain, nil)
+}
+
+func ipFilterPolicyName(vsname string) string {
+	return strings.Replace(vsname, ".", "-", -1) + "-ipfilter"
+}
+
+func ipFilterPaths(path string) []string {
+	path = strings.TrimSuffix(path, "/")
+	if path == "" {
+		return nil
+	}
+	return []string{path, path + "/*"}
+}
+
+func isIPFilterRuleForPath(rule Rule, path string) bool {
+	paths := ipFilterPaths(path)
+	for _, to := range rule.To {
+		if strings.Join(to.Operation.Paths, ",") == strings.Join(paths, ",") {
+			return true
+		}
+	}
+	return false
+}
+
+// The ip filter is enforced at the ingress gateway as a DENY policy, clients outside of
+// the allow list or inside the deny list are rejected for the hosts and path. The remote ip
+// is used so the original client address (from X-Forwarded-For) is checked, not the load balancer.
+func IPFilterRules(hosts []string, path string, ipfilter *IPFilter) []Rule {
+	rules := make([]Rule, 0)
+	matchHosts := make([]string, 0)
+	for _, host := range hosts {
+		matchHosts = append(matchHosts, host, host+":*")
+	}
+	to := []To{To{Operation: Operation{Hosts: matchHosts, Paths: ipFilterPaths(path)}}}
+	if len(ipfilter.Allow) > 0 {
+		var from From
+		from.Source.NotRemoteIpBlocks = ipfilter.Allow
+		rules = append(rules, Rule{From: []From{from}, To: to})
+	}
+	if len(ipfilter.Deny) > 0 {
+		var from From
+		from.Source.RemoteIpBlocks = ipfilter.Deny
+		rules = append(rules, Rule{From: []From{from}, To: to})
+	}
+	return rules
+}
+
+// Renders the ip filter authorization policy for a site from the ipfilter filters on its paths,
+// returns nil if no paths have an ip filter.
+func PrepareIPFilterAuthorizationPolicy(domain string, namespace string, gateway string, paths []Route) *AuthorizationPolicy {
+	rules := make([]Rule, 0)
+	for _, route := range paths {
+		for _, filter := range route.Filters {
+			if filter.Type != "ipfilter" {
+				continue
+			}
+			ipfilter, err := IPFilterFromFilter(filter)
+			if err != nil {
+				fmt.Printf("WARNING: Unable to apply ip filter to site %s: %s\n", domain, err.Error())
+				continue
+			}
+			rules = append(rules, IPFilterRules([]string{domain}, route.Path, ipfilter)...)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	var authPolicy AuthorizationPolicy
+	authPolicy.Kind = "AuthorizationPolicy"
+	authPolicy.APIVersion = IstioSecurityAPIVersion
+	authPolicy.SetName(ipFilterPolicyName(domain))
+	authPolicy.SetNamespace(namespace)
+	authPolicy.Spec.Selector = WorkloadSelector{
+		Labels: map[string]string{
+			"istio": gateway,
+		},
+	}
+	authPolicy.Spec.Action = "DENY"
+	authPolicy.Spec.Rules = rules
+	return &authPolicy
+}
+
+func (ingress *IstioIngress) getIPFilterPolicy(vsname string) (*AuthorizationPolicy, bool, error) {
+	body, code, err := ingress.runtime.GenericRequest("get", "/apis/"+IstioSecurityAPIVersion+"/namespaces/"+ingress.config.Environment+"/authorizationpolicies/"+ipFilterPolicyName(vsname), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if code == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if code != http.StatusOK {
+		return nil, false, errors.New("The response for getting an ip filter policy failed: " + strconv.Itoa(code) + " " + string(body))
+	}
+	var authPolicy AuthorizationPolicy
+	if err = json.Unmarshal(body, &authPolicy); err != nil {
+		return nil, false, err
+	}
+	return &authPolicy, true, nil
+}
+
+func (ingress *IstioIngress) writeIPFilterPolicy(vsname string, authPolicy *AuthorizationPolicy) error {
+	existing, exists, err := ingress.getIPFilterPolicy(vsname)
+	if err != nil {
+		return err
+	}
+	if authPolicy == nil || len(authPolicy.Spec.Rules) == 0 {
+		if !exists {
+			return nil
+		}
+		body, code, err := ingress.runtime.GenericRequest("delete", "/apis/"+IstioSecurityAPIVersion+"/namespaces/"+ingress.config.Environment+"/authorizationpolicies/"+ipFilterPolicyName(vsname), nil)
+		if err != nil {
+			return err
+		}
+		if code != http.StatusOK && code != http.StatusAccepted && code != http.StatusNotFound {
+			return errors.New("The response for deleting an ip filter policy failed: " + strconv.Itoa(code) + " " + string(body))
+		}
+		return nil
+	}
+	var body []byte
+	var code int
+	if exists {
+		authPolicy.SetResourceVersion(existing.GetResourceVersion())
+		body, code, err = ingress.runtime.GenericRequest("put", "/apis/"+IstioSecurityAPIVersion+"/namespaces/"+ingress.config.Environment+"/authorizationpolicies/"+ipFilterPolicyName(vsname), authPolicy)
+	} else {
+		body, code, err = ingress.runtime.GenericRequest("post", "/apis/"+IstioSecurityAPIVersion+"/namespaces/"+ingress.config.Environment+"/authorizationpolicies", authPolicy)
+	}
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK && code != http.StatusCreated {
+		return errors.New("The response for installing an ip filter policy failed: " + strconv.Itoa(code) + " " + string(body))
+	}
+	return nil
+}
+
+func basicAuthKey(path string) string {
+	return strings.TrimSuffix(path, "/")
+}
+
+func BasicAuthSecretName(vsname string) string {
+	return strings.Replace(vsname, ".", "-", -1) + "-basic-auth"
+}
+
+func basicAuthEnvoyFilterName(vsname string) string {
+	return strings.Replace(vsname, ".", "-", -1) + "-basic-auth"
+}
+
+// A htpasswd entry nobody knows the password to, used when a route requires basic auth
+// but its credentials cannot be found so the route fails closed rather than open.
+func lockedHtpasswd() string {
+	random := make([]byte, 32)
+	rand.Read(random)
+	auth := BasicAuth{Username: "locked", Password: base64.StdEncoding.EncodeToString(random)}
+	return auth.Htpasswd()
+}
+
+// Finds the routes in the virtual service for each protected path (both the prefix and the exact
+// match for the path), names them if they have not been named yet so envoy can match them, and
+// returns a map of the envoy route name to the htpasswd entry for it.
+func basicAuthRoutes(vsname string, vs *VirtualService, users map[string]string) (map[string]string, bool) {
+	routes := make(map[string]string)
+	dirty := false
+	for i, http := range vs.Spec.HTTP {
+		for _, match := range http.Match {
+			uri := match.URI.Prefix
+			if uri == "" {
+				uri = match.URI.Exact
+			}
+			htpasswd, ok := users[basicAuthKey(uri)]
+			if !ok {
+				continue
+			}
+			if http.Name == "" {
+				vs.Spec.HTTP[i].Name = vsname + uri
+				dirty = true
+			}
+			routes[vs.Spec.HTTP[i].Name] = htpasswd
+		}
+	}
+	return routes, dirty
+}
+
+// Renders an envoy filter that adds envoy's basic auth filter (disabled by default) to the gateway
+// and enables it on each protected route with the credentials for that route. Returns nil if there
+// are no protected routes.
+func PrepareBasicAuthEnvoyFilter(vsname string, namespace string, gateway string, routes map[string]string) *EnvoyFilter {
+	if len(routes) == 0 {
+		return nil
+	}
+	var filter EnvoyFilter
+	filter.APIVersion = IstioNetworkingAPIVersionAlpha
+	filter.Kind = "EnvoyFilter"
+	filter.SetName(basicAuthEnvoyFilterName(vsname))
+	filter.SetNamespace(namespace)
+	filter.Spec.WorkloadSelector = WorkloadSelector{
+		Labels: map[string]string{
+			"istio": gateway,
+		},
+	}
+	filter.Spec.ConfigPatches = make([]EnvoyConfigPatch, 0)
+
+	var insertBasicAuth EnvoyConfigPatch
+	insertBasicAuth.ApplyTo = "HTTP_FILTER"
+	insertBasicAuth.Match = map[string]interface{}{
+		"context": "GATEWAY",
+		"listener": map[string]interface{}{
+			"filterChain": map[string]interface{}{
+				"filter": map[string]interface{}{
+					"name":      "envoy.filters.network.http_connection_manager",
+					"subFilter": map[string]interface{}{"name": "envoy.filters.http.router"},
+				},
+			},
+		},
+	}
+	insertBasicAuth.Patch.Operation = "INSERT_BEFORE"
+	insertBasicAuth.Patch.Value = map[string]interface{}{
+		"name":     "envoy.filters.http.basic_auth",
+		"disabled": true,
+		"typed_config": map[string]interface{}{
+			"@type": "type.googleapis.com/envoy.extensions.filters.http.basic_auth.v3.BasicAuth",
+			"users": map[string]interface{}{"inline_string": lockedHtpasswd()},
+		},
+	}
+	filter.Spec.ConfigPatches = append(filter.Spec.ConfigPatches, insertBasicAuth)
+
+	names := make([]string, 0)
+	for name := range routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var routeBasicAuth EnvoyConfigPatch
+		routeBasicAuth.ApplyTo = "HTTP_ROUTE"
+		routeBasicAuth.Match = map[string]interface{}{
+			"context": "GATEWAY",
+			"routeConfiguration": map[string]interface{}{
+				"vhost": map[string]interface{}{
+					"route": map[string]interface{}{"name": name},
+				},
+			},
+		}
+		routeBasicAuth.Patch.Operation = "MERGE"
+		routeBasicAuth.Patch.Value = map[string]interface{}{
+			"typed_per_filter_config": map[string]interface{}{
+				"envoy.filters.http.basic_auth": map[string]interface{}{
+					"@type": "type.googleapis.com/envoy.config.route.v3.FilterConfig",
+					"config": map[string]interface{}{
+						"@type": "type.googleapis.com/envoy.extensions.filters.http.basic_auth.v3.BasicAuthPerRoute",
+						"users": map[string]interface{}{"inline_string": routes[name]},
+					},
+				},
+			},
+		}
+		filter.Spec.ConfigPatches = append(filter.Spec.ConfigPatches, routeBasicAuth)
+	}
+	return &filter
+}
+
+// The hashed credentials for each path are kept in a secret as a json map of path to htpasswd entry.
+func (ingress *IstioIngress) getBasicAuthUsers(vsname string) (map[string]string, error) {
+	users := make(map[string]string)
+	body, code, err := ingress.runtime.GenericRequest("get", "/api/v1/namespaces/"+ingress.config.Environment+"/secrets/"+BasicAuthSecretName(vsname), nil)
+	if err != nil {
+		return nil, err
+	}
+	if code == http.StatusNotFound {
+		return users, nil
+	}
+	if code != http.StatusOK {
+		return nil, errors.New("Unable to get basic auth secret: " + strconv.Itoa(code) + " " + string(body))
+	}
+	var secret kube.Secret
+	if err = json.Unmarshal(body, &secret); err != nil {
+		return nil, err
+	}
+	if data, ok := secret.Data["users"]; ok && len(data) > 0 {
+		if err = json.Unmarshal(data, &users); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+func (ingress *IstioIngress) writeBasicAuthUsers(vsname string, users map[string]string) error {
+	path := "/api/v1/namespaces/" + ingress.config.Environment + "/secrets"
+	name := BasicAuthSecretName(vsname)
+	if len(users) == 0 {
+		body, code, err := ingress.runtime.GenericRequest("delete", path+"/"+name, nil)
+		if err != nil {
+			return err
+		}
+		if code != http.StatusOK && code != http.StatusAccepted && code != http.StatusNotFound {
+			return errors.New("Unable to delete basic auth secret: " + strconv.Itoa(code) + " " + string(body))
+		}
+		return nil
+	}
+	data, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+	secret := kube.Secret{}
+	secret.Kind = "Secret"
+	secret.APIVersion = "v1"
+	secret.Type = kube.SecretTypeOpaque
+	secret.SetName(name)
+	secret.SetNamespace(ingress.config.Environment)
+	secret.SetLabels(map[string]string{
+		"akkeris.k8s.io/basic-auth": strings.Replace(vsname, ".", "-", -1),
+	})
+	secret.Data = map[string][]byte{"users": data}
+	_, code, err := ingress.runtime.GenericRequest("get", path+"/"+name, nil)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if code == http.StatusOK {
+		body, code, err = ingress.runtime.GenericRequest("put", path+"/"+name, secret)
+	} else {
+		body, code, err = ingress.runtime.GenericRequest("post", path, secret)
+	}
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK && code != http.StatusCreated {
+		return errors.New("Unable to write basic auth secret: " + strconv.Itoa(code) + " " + string(body))
+	}
+	return nil
+}
+
+func (ingress *IstioIngress) syncBasicAuthFilter(vsname string, vs *VirtualService, users map[string]string) error {
+	routes, dirty := basicAuthRoutes(vsname, vs, users)
+	if dirty {
+		if err := ingress.UpdateVirtualService(vs, vsname); err != nil {
+			return err
+		}
+	}
+	filter := PrepareBasicAuthEnvoyFilter(vsname, ingress.config.Environment, ingress.config.Name, routes)
+	if filter == nil {
+		return ingress.deleteEnvoyFilter(basicAuthEnvoyFilterName(vsname))
+	}
+	return ingress.installOrUpdateEnvoyFilter(filter)
+}
+
+// Stores the hashed credentials for the path and protects the routes for it, if the password
+// is blank the previously stored credentials for the path are kept.
+func (ingress *IstioIngress) InstallOrUpdateBasicAuthFilter(vsname string, path string, username string, password string) error {
+	if os.Getenv("INGRESS_DEBUG") == "true" {
+		fmt.Printf("[ingress] Istio - installing or updating basic auth filter for %s%s\n", vsname, path)
+	}
+	users, err := ingress.getBasicAuthUsers(vsname)
+	if err != nil {
+		return err
+	}
+	if password != "" {
+		auth := BasicAuth{Username: username, Password: password}
+		users[basicAuthKey(path)] = auth.Htpasswd()
+	} else if _, ok := users[basicAuthKey(path)]; !ok {
+		users[basicAuthKey(path)] = lockedHtpasswd()
+	}
+	if err = ingress.writeBasicAuthUsers(vsname, users); err != nil {
+		return err
+	}
+	vs, err := ingress.GetVirtualService(vsname)
+	if err != nil {
+		// not yet deployed
+		return nil
+	}
+	return ingress.syncBasicAuthFilter(vsname, vs, users)
+}
+
+func (ingress *IstioIngress) DeleteBasicAuthFilter(vsname string, path string) error {
+	users, err := ingress.getBasicAuthUsers(vsname)
+	if err != nil {
+		return err
+	}
+	if _, ok := users[basicAuthKey(path)]; !ok {
+		return nil
+	}
+	if os.Getenv("INGRESS_DEBUG") == "true" {
+		fmt.Printf("[ingress] Istio - removing basic auth filter for %s%s\n", vsname, path)
+	}
+	delete(users, basicAuthKey(path))
+	if err = ingress.writeBasicAuthUsers(vsname, users); err != nil {
+		return err
+	}
+	vs, err := ingress.GetVirtualService(vsname)
+	if err != nil {
+		return ingress.deleteEnvoyFilter(basicAuthEnvoyFilterName(vsname))
+	}
+	return ingress.syncBasicAuthFilter(vsname, vs, users)
+}
+
+// Copies the hashed basic auth credentials for the given paths of one site to another, used
+// when a site is cloned.
+func (ingress *IstioIngress) CopyBasicAuthFilters(fromvsname string, tovsname string, paths []string) error {
+	stored, err := ingress.getBasicAuthUsers(fromvsname)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]string)
+	for _, path := range paths {
+		if htpasswd, ok := stored[basicAuthKey(path)]; ok {
+			users[basicAuthKey(path)] = htpasswd
+		}
+	}
+	if len(users) == 0 {
+		return nil
+	}
+	return ingress.writeBasicAuthUsers(tovsname, users)
+}
+
+// Keeps only the credentials for paths on the site that still have a basic_auth filter, paths
+// with a filter but without stored credentials are locked.
+func (ingress *IstioIngress) installOrUpdateSiteBasicAuth(domain string, vs *VirtualService, paths []Route) error {
+	stored, err := ingress.getBasicAuthUsers(domain)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]string)
+	for _, route := range paths {
+		for _, filter := range route.Filters {
+			if filter.Type != "basic_auth" {
+				continue
+			}
+			if htpasswd, ok := stored[basicAuthKey(route.Path)]; ok {
+				users[basicAuthKey(route.Path)] = htpasswd
+			} else {
+				fmt.Printf("WARNING: No basic auth credentials were found for %s%s, the path will be locked.\n", domain, route.Path)
+				users[basicAuthKey(route.Path)] = lockedHtpasswd()
+			}
+		}
+	}
+	if len(users) != len(stored) {
+		if err = ingress.writeBasicAuthUsers(domain, users); err != nil {
+			return err
+		}
+	}
+	routes, _ := basicAuthRoutes(domain, vs, users)
+	filter := PrepareBasicAuthEnvoyFilter(domain, ingress.config.Environment, ingress.config.Name, routes)
+	if filter == nil {
+		return ingress.deleteEnvoyFilter(basicAuthEnvoyFilterName(domain))
+	}
+	return ingress.installOrUpdateEnvoyFilter(filter)
+}
+
+func oauth2PolicyName(vsname string, path string) string {
+	slug := strings.ToLower(strings.Trim(path, "/"))
+	if slug == "" {
+		slug = "root"
+	}
+	slug = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, slug)
+	return strings.Replace(vsname, ".", "-", -1) + "-" + slug + "-oauth2"
+}
+
+// The oauth2 filter is enforced at the ingress gateway by a CUSTOM authorization policy which asks
+// the external authorization provider to check each request to the hosts and path, except for any
+// excluded paths.
+func PrepareOAuth2AuthorizationPolicy(vsname string, namespace string, gateway string, hosts []string, path string, oauth2 *OAuth2) *AuthorizationPolicy {
+	var authPolicy AuthorizationPolicy
+	authPolicy.Kind = "AuthorizationPolicy"
+	authPolicy.APIVersion = IstioSecurityAPIVersion
+	authPolicy.SetName(oauth2PolicyName(vsname, path))
+	authPolicy.SetNamespace(namespace)
+	authPolicy.SetLabels(map[string]string{
+		"akkeris.k8s.io/oauth2": strings.Replace(vsname, ".", "-", -1),
+	})
+	authPolicy.Spec.Selector = WorkloadSelector{
+		Labels: map[string]string{
+			"istio": gateway,
+		},
+	}
+	authPolicy.Spec.Action = "CUSTOM"
+	authPolicy.Spec.Provider = &ExtensionProvider{Name: oauth2.Provider}
+	matchHosts := make([]string, 0)
+	for _, host := range hosts {
+		matchHosts = append(matchHosts, host, host+":*")
+	}
+	notPaths := make([]string, 0)
+	for _, exclude := range oauth2.Excludes {
+		notPaths = append(notPaths, ipFilterPaths(exclude)...)
+	}
+	authPolicy.Spec.Rules = []Rule{Rule{
+		To: []To{To{Operation: Operation{Hosts: matchHosts, Paths: ipFilterPaths(path), NotPaths: notPaths}}},
+	}}
+	return &authPolicy
+}
+
+// Renders the oauth2 policies for a site, paths beneath a protected path which do not have their
+// own oauth2 filter are excluded from the protected path's policy.
+func PrepareOAuth2AuthorizationPolicies(domain string, namespace string, gateway string, paths []Route) []AuthorizationPolicy {
+	policies := make([]AuthorizationPolicy, 0)
+	protected := make(map[string]bool)
+	for _, route := range paths {
+		for _, filter := range route.Filters {
+			if filter.Type == "oauth2" {
+				protected[basicAuthKey(route.Path)] = true
+			}
+		}
+	}
+	for _, route := range paths {
+		for _, filter := range route.Filters {
+			if filter.Type != "oauth2" {
+				continue
+			}
+			oauth2, err := OAuth2FromFilter(filter)
+			if err != nil {
+				fmt.Printf("WARNING: Unable to apply oauth2 filter to site %s: %s\n", domain, err.Error())
+				continue
+			}
+			for _, other := range paths {
+				key := basicAuthKey(other.Path)
+				if !protected[key] && strings.HasPrefix(key, basicAuthKey(route.Path)+"/") {
+					oauth2.Excludes = append(oauth2.Excludes, key)
+				}
+			}
+			policies = append(policies, *PrepareOAuth2AuthorizationPolicy(domain, namespace, gateway, []string{domain}, route.Path, oauth2))
+		}
+	}
+	return policies
+}
+
+func (ingress *IstioIngress) writeOAuth2Policy(authPolicy *AuthorizationPolicy) error {
+	path := "/apis/" + IstioSecurityAPIVersion + "/namespaces/" + ingress.config.Environment + "/authorizationpolicies"
+	body, code, err := ingress.runtime.GenericRequest("get", path+"/"+authPolicy.GetName(), nil)
+	if err != nil {
+		return err
+	}
+	if code == http.StatusOK {
+		var existing AuthorizationPolicy
+		if err = json.Unmarshal(body, &existing); err != nil {
+			return err
+		}
+		authPolicy.SetResourceVersion(existing.GetResourceVersion())
+		body, code, err = ingress.runtime.GenericRequest("put", path+"/"+authPolicy.GetName(), authPolicy)
+	} else {
+		body, code, err = ingress.runtime.GenericRequest("post", path, authPolicy)
+	}
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK && code != http.StatusCreated {
+		return errors.New("The response for installing an oauth2 policy failed: " + strconv.Itoa(code) + " " + string(body))
+	}
+	return nil
+}
+
+func (ingress *IstioIngress) deleteOAuth2Policy(name string) error {
+	body, code, err := ingress.runtime.GenericRequest("delete", "/apis/"+IstioSecurityAPIVersion+"/namespaces/"+ingress.config.Environment+"/authorizationpolicies/"+name, nil)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK && code != http.StatusAccepted && code != http.StatusNotFound {
+		return errors.New("The response for deleting an oauth2 policy failed: " + strconv.Itoa(code) + " " + string(body))
+	}
+	return nil
+}
+
+// Installs the desired oauth2 policies for the site and removes any that are no longer needed.
+func (ingress *IstioIngress) installOrUpdateSiteOAuth2(domain string, policies []AuthorizationPolicy) error {
+	body, code, err := ingress.runtime.GenericRequest("get", "/apis/"+IstioSecurityAPIVersion+"/namespaces/"+ingress.config.Environment+"/authorizationpolicies?labelSelector=akkeris.k8s.io%2Foauth2%3D"+strings.Replace(domain, ".", "-", -1), nil)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return errors.New("Unable to list oauth2 policies: " + strconv.Itoa(code) + " " + string(body))
+	}
+	var existing struct {
+		Items []AuthorizationPolicy `json:"items"`
+	}
+	if err = json.Unmarshal(body, &existing); err != nil {
+		return err
+	}
+	desired := make(map[string]bool)
+	for i := range policies {
+		desired[policies[i].GetName()] = true
+		if err = ingress.writeOAuth2Policy(&policies[i]); err != nil {
+			return err
+		}
+	}
+	for _, policy := range existing.Items {
+		if !desired[policy.GetName()] {
+			if err = ingress.deleteOAuth2Policy(policy.GetName()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ingress *IstioIngress) InstallOrUpdateOAuth2Filter(vsname string, path string, provider string, excludes []string) error {
+	virtualService, err := ingress.GetVirtualService(vsname)
+	if err != nil {
+		// not yet deployed
+		return nil
+	}
+	if os.Getenv("INGRESS_DEBUG") == "true" {
+		fmt.Printf("[ingress] Istio - installing or updating oauth2 filter for %s%s with provider %s\n", vsname, path, provider)
+	}
+	return ingress.writeOAuth2Policy(PrepareOAuth2AuthorizationPolicy(vsname, ingress.config.Environment, ingress.config.Name, virtualService.Spec.Hosts, path, &OAuth2{Provider: provider, Excludes: excludes}))
+}
+
+func (ingress *IstioIngress) DeleteOAuth2Filter(vsname string, path string) error {
+	return ingress.deleteOAuth2Policy(oauth2PolicyName(vsname, path))
+}
+
+func CertificateToSecret(server_name string, pem_cert []byte, pem_key []byte, namespace string) (*string, *kube.Secret, error) {
+	block, _ := pem.Decode(pem_cert)
+	if block == nil {
+		fmt.Println("failed to parse PEM block containing the public certificate")
+		return nil, nil, errors.New("Invalid certificate: Failed to decode PEM block")
+	}
+	x509_decoded_cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		fmt.Println("invalid certificate provided")
+		fmt.Println(err)
+		return nil, nil, err
+	}
+	block, _ = pem.Decode([]byte(pem_key))
+	if block == nil {
+		fmt.Println("failed to parse PEM block containing the private key")
+		return nil, nil, errors.New("Invalid key: Failed to decode PEM block")
+	}
+	main_server_name := strings.Replace(x509_decoded_cert.Subject.CommonName, "*.", "star.", -1)
+	name := strings.Replace(main_server_name, ".", "-", -1) + "-tls"
+	secret := kube.Secret{}
+	secret.Kind = "Secret"
+	secret.APIVersion = "v1"
+	secret.Type = kube.SecretTypeTLS
+	secret.SetName(name)
+	secret.SetNamespace(namespace)
+	secret.SetAnnotations(map[string]string{
+		"akkeris.k8s.io/alt-names":   main_server_name,
+		"akkeris.k8s.io/common-name": main_server_name,
+	})
+	secret.SetLabels(map[string]string{
+		"akkeris.k8s.io/certificate-name": main_server_name,
+	})
+	secret.Data = make(map[string][]byte, 0)
+	secret.Data["tls.key"] = []byte(pem_key)
+	secret.Data["tls.crt"] = []byte(pem_cert)
+	return &name, &secret, nil
+}
+
+func getDownPage() string {
+	if os.Getenv("ISTIO_DOWNPAGE") != "" {
+		return os.Getenv("ISTIO_DOWNPAGE")
+	}
+	return "downpage.akkeris-system.svc.cluster.local"
+}
+
+func (ingress *IstioIngress) CreateOrUpdateRouter(domain string, internal bool, paths []Route) error {
+
+	// Ensure a certificate exists and a hosts entry is registered with the gateway
+	if os.Getenv("INGRESS_DEBUG") == "true" {
+		fmt.Printf("[ingress] Istio - create or update router firing for %s\n", domain)
+	}
+	// Routers with auto_tls are held until their certificate is issued, rather than installed with the default certificate
+	held, err := holdForCertificate(ingress.db, domain, internal)
+	if err != nil {
+		return err
+	}
+	if held {
+		return ErrRouterPendingCertificate
+	}
+	err, cert_secret_name := ingress.GetCertificateFromDomain(domain)
+	if err != nil {
+		if os.Getenv("INGRESS_DEBUG") == "true" {
+			fmt.Printf("[ingress] Cannot obtain cert secret name (on push) for site %s because %s\n", domain, err.Error())
+		}
+		return err
+	}
+	if cert_secret_name == "" {
+		return errors.New("No certificate could be found for " + domain + ".")
+	}
+	if err = ingress.InstallOrUpdateUberSiteGateway(domain, cert_secret_name, internal, 0); err != nil {
+		if os.Getenv("INGRESS_DEBUG") == "true" {
+			fmt.Printf("[ingress] Cannot install or update uber site gateway for site %s using cert %s because %s\n", domain, cert_secret_name, err.Error())
+		}
+		return err
+	}
+
+	// Ensure a virtual services exists
+	exists, version, err := ingress.VirtualServiceExists(domain)
+	if err != nil {
+		fmt.Printf("[ingress] Istio - an error received from virtual service exists during create/update router: %s: %s\n", err.Error(), domain)
+		return err
+	}
+	vs, err := PrepareVirtualServiceForCreateorUpdate(domain, internal, paths)
+	if err != nil {
+		fmt.Printf("[ingress] Istio - unable to prepare virtual service for create or update: %s: %s\n", err.Error(), domain)
+		return err
+	}
+	if exists && version != "" {
+		vs.SetResourceVersion(version)
+	}
+	// Force good security practices, unless the site has tuned or turned off HSTS
+	hsts, err := GetRouterHSTS(ingress.db, domain)
+	if err != nil {
+		fmt.Printf("[ingress] Istio - unable to get the HSTS policy for %s: %s\n", domain, err.Error())
+		return err
+	}
+	ApplyHSTS(vs, hsts)
+	if err = ingress.InstallOrUpdateVirtualService(domain, vs, exists); err != nil {
+		if os.Getenv("INGRESS_DEBUG") == "true" {
+			fmt.Printf("[ingress] Cannot install or update virtualservice for site %s using cert %s using because %s, virtual service is %#+v\n", domain, cert_secret_name, err.Error(), vs)
+		}
+		return err
+	}
+	if err = ingress.InstallOrUpdateRateLimitFilter(domain, vs); err != nil {
+		if os.Getenv("INGRESS_DEBUG") == "true" {
+			fmt.Printf("[ingress] Cannot install or update rate limits for site %s because %s\n", domain, err.Error())
+		}
+		return err
+	}
+	if err = ingress.writeIPFilterPolicy(domain, PrepareIPFilterAuthorizationPolicy(domain, ingress.config.Environment, ingress.config.Name, paths)); err != nil {
+		if os.Getenv("INGRESS_DEBUG") == "true" {
+			fmt.Printf("[ingress] Cannot install or update ip filters for site %s because %s\n", domain, err.Error())
+		}
+		return err
+	}
+	if err = ingress.installOrUpdateSiteBasicAuth(domain, vs, paths); err != nil {
+		if os.Getenv("INGRESS_DEBUG") == "true" {
+			fmt.Printf("[ingress] Cannot install or update basic auth for site %s because %s\n", domain, err.Error())
+		}
+		return err
+	}
+	if err = ingress.installOrUpdateSiteOAuth2(domain, PrepareOAuth2AuthorizationPolicies(domain, ingress.config.Environment, ingress.config.Name, paths)); err != nil {
+		if os.Getenv("INGRESS_DEBUG") == "true" {
+			fmt.Printf("[ingress] Cannot install or update oauth2 for site %s because %s\n", domain, err.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+func (ingress *IstioIngress) InstallOrUpdateCORSAuthFilter(vsname string, path string, allowOrigin []string, allowMethods []string, allowHeaders []string, exposeHeaders []string, maxAge time.Duration, allowCredentials bool) error {
+	virtualService, err := ingress.GetVirtualService(vsname)
+	if err != nil {
+		// not yet deployed
+		return nil
+	}
+	var dirty = false
+	allowOrigins := make([]StringMatch, 0)
+	for _, origin := range allowOrigin {
+		allowOrigins = append(allowOrigins, StringMatch{Exact: origin})
+	}
+	for i, http := range virtualService.Spec.HTTP {
+		if http.Match == nil || len(http.Match) == 0 {
+			virtualService.Spec.HTTP[0].CorsPolicy = &CorsPolicy{
+				AllowOrigins:     allowOrigins,
+				AllowMethods:     allowMethods,
+				AllowHeaders:     allowHeaders,
+				ExposeHeaders:    exposeHeaders,
+				MaxAge:           maxAge.String(),
+				AllowCredentials: allowCredentials,
+			}
+			dirty = true
+		} else {
+			for _, match := range http.Match {
+				if os.Getenv("INGRESS_DEBUG") == "true" {
+					fmt.Printf("[ingress] Looking to add CORS policy, comparing path: %s with match prefix %s and match exact %s\n", path, match.URI.Prefix, match.URI.Exact)
+				}
+				if strings.HasPrefix(match.URI.Prefix, path) || match.URI.Exact == path || match.URI.Prefix == path {
+					virtualService.Spec.HTTP[i].CorsPolicy = &CorsPolicy{
+						AllowOrigins:     allowOrigins,
+						AllowMethods:     allowMethods,
+						AllowHeaders:     allowHeaders,
+						ExposeHeaders:    exposeHeaders,
+						MaxAge:           maxAge.String(),
+						AllowCredentials: allowCredentials,
+					}
+					dirty = true
+				}
+			}
+		}
+	}
+	if dirty == true {
+		if os.Getenv("INGRESS_DEBUG") == "true" {
+			fmt.Printf("[ingress] Istio - Installing or updating CORS auth filter for %s at path %s: %#+v\n", vsname, path, virtualService)
+		}
+		if err = ingress.UpdateVirtualService(virtualService, vsname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ingress *IstioIngress) DeleteCORSAuthFilter(vsname string, path string) error {
+	virtualService, err := ingress.GetVirtualService(vsname)
+	if err != nil {
+		if err.Error() == "virtual service was not found" {
+			// Go ahead and ignore setting this.  We can't as there's no deployment yet.
+			return nil
+		}
+		return err
+	}
+	var dirty = false
+	for i, http := range virtualService.Spec.HTTP {
+		if http.Match == nil || len(http.Match) == 0 {
 			virtualService.Spec.HTTP[i].CorsPolicy = nil
 			dirty = true
 		} else {
@@ -1246,6 +2319,152 @@ func (ingress *IstioIngress) DeleteCSPFilter(vsname string, path string) error {
 	return nil
 }
 
+func (ingress *IstioIngress) InstallOrUpdateTrafficPolicyFilter(vsname string, path string, filters []structs.HttpFilters) error {
+	virtualService, err := ingress.GetVirtualService(vsname)
+	if err != nil {
+		if err.Error() == "virtual service was not found" {
+			// not yet deployed
+			return nil
+		}
+		return err
+	}
+	var dirty = false
+	for i, http := range virtualService.Spec.HTTP {
+		var matched = false
+		if http.Match == nil || len(http.Match) == 0 {
+			matched = true
+		} else {
+			for _, match := range http.Match {
+				if os.Getenv("INGRESS_DEBUG") == "true" {
+					fmt.Printf("[ingress] Looking to add traffic policy, comparing path: %s with match prefix %s and match exact %s\n", path, match.URI.Prefix, match.URI.Exact)
+				}
+				if strings.HasPrefix(match.URI.Prefix, path) || match.URI.Exact == path || match.URI.Prefix == path {
+					matched = true
+				}
+			}
+		}
+		if matched {
+			virtualService.Spec.HTTP[i].Timeout = ""
+			virtualService.Spec.HTTP[i].Retries = nil
+			virtualService.Spec.HTTP[i].Fault = nil
+			for _, filter := range filters {
+				if _, err := ApplyTrafficPolicyFilter(&virtualService.Spec.HTTP[i], filter); err != nil {
+					return err
+				}
+			}
+			dirty = true
+		}
+	}
+	if dirty == true {
+		if os.Getenv("INGRESS_DEBUG") == "true" {
+			fmt.Printf("[ingress] Istio - Installing or updating traffic policy for %s at path %s: %#+v\n", vsname, path, virtualService)
+		}
+		if err = ingress.UpdateVirtualService(virtualService, vsname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ingress *IstioIngress) DeleteTrafficPolicyFilter(vsname string, path string) error {
+	virtualService, err := ingress.GetVirtualService(vsname)
+	if err != nil {
+		if err.Error() == "virtual service was not found" {
+			// Go ahead and ignore setting this.  We can't as there's no deployment yet.
+			return nil
+		}
+		return err
+	}
+	var dirty = false
+	for i, http := range virtualService.Spec.HTTP {
+		if http.Timeout == "" && http.Retries == nil && http.Fault == nil {
+			continue
+		}
+		if http.Match == nil || len(http.Match) == 0 {
+			virtualService.Spec.HTTP[i].Timeout = ""
+			virtualService.Spec.HTTP[i].Retries = nil
+			virtualService.Spec.HTTP[i].Fault = nil
+			dirty = true
+		} else {
+			for _, match := range http.Match {
+				if strings.HasPrefix(match.URI.Prefix, path) || match.URI.Exact == path || match.URI.Prefix == path {
+					virtualService.Spec.HTTP[i].Timeout = ""
+					virtualService.Spec.HTTP[i].Retries = nil
+					virtualService.Spec.HTTP[i].Fault = nil
+					dirty = true
+				}
+			}
+		}
+	}
+	if dirty == true {
+		if os.Getenv("INGRESS_DEBUG") == "true" {
+			fmt.Printf("[ingress] Removing traffic policy for %s at path %s\n", vsname, path)
+		}
+		if err = ingress.UpdateVirtualService(virtualService, vsname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The hosts to restrict come from the virtual service, so an ip filter cannot be applied (and
+// an error is returned) until the virtual service exists.
+func (ingress *IstioIngress) InstallOrUpdateIPFilter(vsname string, path string, allow []string, deny []string) error {
+	virtualService, err := ingress.GetVirtualService(vsname)
+	if err != nil {
+		return err
+	}
+	if os.Getenv("INGRESS_DEBUG") == "true" {
+		fmt.Printf("[ingress] Istio - installing or updating ip filter for %s%s\n", vsname, path)
+	}
+	authPolicy, exists, err := ingress.getIPFilterPolicy(vsname)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		authPolicy = &AuthorizationPolicy{}
+		authPolicy.Kind = "AuthorizationPolicy"
+		authPolicy.APIVersion = IstioSecurityAPIVersion
+		authPolicy.SetName(ipFilterPolicyName(vsname))
+		authPolicy.SetNamespace(ingress.config.Environment)
+	}
+	authPolicy.Spec.Selector = WorkloadSelector{
+		Labels: map[string]string{
+			"istio": ingress.config.Name,
+		},
+	}
+	authPolicy.Spec.Action = "DENY"
+	rules := make([]Rule, 0)
+	for _, rule := range authPolicy.Spec.Rules {
+		if !isIPFilterRuleForPath(rule, path) {
+			rules = append(rules, rule)
+		}
+	}
+	authPolicy.Spec.Rules = append(rules, IPFilterRules(virtualService.Spec.Hosts, path, &IPFilter{Allow: allow, Deny: deny})...)
+	return ingress.writeIPFilterPolicy(vsname, authPolicy)
+}
+
+func (ingress *IstioIngress) DeleteIPFilter(vsname string, path string) error {
+	authPolicy, exists, err := ingress.getIPFilterPolicy(vsname)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	if os.Getenv("INGRESS_DEBUG") == "true" {
+		fmt.Printf("[ingress] Istio - removing ip filter for %s%s\n", vsname, path)
+	}
+	rules := make([]Rule, 0)
+	for _, rule := range authPolicy.Spec.Rules {
+		if !isIPFilterRuleForPath(rule, path) {
+			rules = append(rules, rule)
+		}
+	}
+	authPolicy.Spec.Rules = rules
+	return ingress.writeIPFilterPolicy(vsname, authPolicy)
+}
+
 func setMaintenancePage(ingress *IstioIngress, vsname string, app string, space string, path string, value bool) error {
 	virtualService, err := ingress.GetVirtualService(vsname)
 	if err != nil {
@@ -1351,6 +2570,21 @@ func (ingress *IstioIngress) GetMaintenancePageStatus(app string, space string)
 }
 
 func (ingress *IstioIngress) DeleteRouter(domain string, internal bool) error {
+	if err := ingress.DeleteRateLimitFilter(domain); err != nil {
+		return err
+	}
+	if err := ingress.writeIPFilterPolicy(domain, nil); err != nil {
+		return err
+	}
+	if err := ingress.deleteEnvoyFilter(basicAuthEnvoyFilterName(domain)); err != nil {
+		return err
+	}
+	if err := ingress.writeBasicAuthUsers(domain, nil); err != nil {
+		return err
+	}
+	if err := ingress.installOrUpdateSiteOAuth2(domain, nil); err != nil {
+		return err
+	}
 	if err := ingress.DeleteVirtualService(domain); err != nil {
 		if err.Error() == "virtual service was not found" {
 			// if we do not have a virtual service bail out without
@@ -1367,7 +2601,7 @@ func (ingress *IstioIngress) DeleteRouter(domain string, internal bool) error {
 		return err
 	}
 	if cert_secret_name == "" {
-		panic("We should never have a cert_secret_name thats blank.")
+		return errors.New("No certificate could be found for " + domain + ".")
 	}
 	return ingress.DeleteUberSiteGateway(domain, cert_secret_name, internal, 0)
 }
@@ -1390,6 +2624,202 @@ func (ingress *IstioIngress) InstallCertificate(server_name string, pem_cert []b
 	}
 }
 
+func (ingress *IstioIngress) DeleteCertificate(server_name string) error {
+	name := certificateSecretName(server_name)
+	body, code, err := ingress.runtime.GenericRequest("delete", "/api/v1/namespaces/"+ingress.certificateNamespace+"/secrets/"+name, nil)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK && code != http.StatusAccepted && code != http.StatusNotFound {
+		return errors.New("Unable to delete certificate " + name + ": " + strconv.Itoa(code) + " " + string(body))
+	}
+	return nil
+}
+
+func acmeChallengeVirtualServiceName(domain string) string {
+	return "acme-challenge-" + strings.Replace(strings.Replace(domain, "*", "star", -1), ".", "-", -1)
+}
+
+// Routes ACME http-01 challenges for the domain to the solver (region-api), this is a separate
+// virtual service from the site's so pushing the site does not remove a pending challenge.
+func PrepareAcmeChallengeVirtualService(domain string, internal bool, solverHost string, solverPort int32) *VirtualService {
+	vs := VirtualService{}
+	vs.APIVersion = IstioNetworkingAPIVersion
+	vs.Kind = "VirtualService"
+	vs.SetName(acmeChallengeVirtualServiceName(domain))
+	vs.SetNamespace("sites-system")
+	if internal {
+		vs.Spec.Gateways = []string{"sites-private"}
+	} else {
+		vs.Spec.Gateways = []string{"sites-public"}
+	}
+	vs.Spec.Hosts = []string{domain}
+	vs.Spec.HTTP = []HTTP{HTTP{
+		Match: []Match{Match{URI: StringMatch{Prefix: "/.well-known/acme-challenge/"}}},
+		Route: []Routes{Routes{Destination: Destination{Host: solverHost, Port: Port{Number: solverPort}}}},
+	}}
+	return &vs
+}
+
+func (ingress *IstioIngress) InstallAcmeChallengeRoute(domain string, internal bool, solverHost string, solverPort int32) error {
+	name := acmeChallengeVirtualServiceName(domain)
+	exists, version, err := ingress.VirtualServiceExists(name)
+	if err != nil {
+		return err
+	}
+	vs := PrepareAcmeChallengeVirtualService(domain, internal, solverHost, solverPort)
+	if exists && version != "" {
+		vs.SetResourceVersion(version)
+	}
+	return ingress.InstallOrUpdateVirtualService(name, vs, exists)
+}
+
+func (ingress *IstioIngress) DeleteAcmeChallengeRoute(domain string) error {
+	name := acmeChallengeVirtualServiceName(domain)
+	exists, _, err := ingress.VirtualServiceExists(name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	return ingress.DeleteVirtualService(name)
+}
+
+// Whether the gateway has a https server with the certificate and a http server for the domain.
+func GatewayRegistration(gateway *Gateway, domain string, certificate string) (httpsRegistered bool, httpRegistered bool) {
+	for _, server := range gateway.Spec.Servers {
+		for _, host := range server.Hosts {
+			if host != domain {
+				continue
+			}
+			if server.Port.Number == 443 && server.TLS.CredentialName == certificate {
+				httpsRegistered = true
+			} else if server.Port.Number == 80 {
+				httpRegistered = true
+			}
+		}
+	}
+	return httpsRegistered, httpRegistered
+}
+
+// Returns the paths whose routes are not in the virtual service.
+func MissingVirtualServicePaths(vs *VirtualService, domain string, internal bool, paths []Route) []string {
+	prefixes := make(map[string]bool)
+	for _, http := range vs.Spec.HTTP {
+		for _, match := range http.Match {
+			prefixes[match.URI.Prefix] = true
+		}
+	}
+	missing := make([]string, 0)
+	for _, path := range paths {
+		expected, _ := PrepareVirtualServiceForCreateorUpdate(domain, internal, []Route{path})
+		for _, http := range expected.Spec.HTTP {
+			if !prefixes[http.Match[0].URI.Prefix] {
+				missing = append(missing, path.Path)
+				break
+			}
+		}
+	}
+	return missing
+}
+
+// Custom domains for apps are registered with the sites gateway (using the domain's certificate)
+// and added as hosts to the app's own virtual service.
+func (ingress *IstioIngress) InstallAppDomain(app string, space string, domain string, internal bool) error {
+	vs, err := ingress.AppVirtualService(space, app)
+	if err != nil {
+		return err
+	}
+	err, cert_secret_name := ingress.GetCertificateFromDomain(domain)
+	if err != nil {
+		return err
+	}
+	if err = ingress.InstallOrUpdateUberSiteGateway(domain, cert_secret_name, internal, 0); err != nil {
+		return err
+	}
+	gateway := "sites-public"
+	if internal {
+		gateway = "sites-private"
+	}
+	if AddHostToVirtualService(vs, domain, gateway) {
+		return ingress.UpdateAppVirtualService(vs, space, app)
+	}
+	return nil
+}
+
+func (ingress *IstioIngress) DeleteAppDomain(app string, space string, domain string, internal bool) error {
+	vs, err := ingress.AppVirtualService(space, app)
+	if err != nil && err.Error() != "virtual service was not found" {
+		return err
+	}
+	if vs != nil && RemoveHostFromVirtualService(vs, domain) {
+		if err = ingress.UpdateAppVirtualService(vs, space, app); err != nil {
+			return err
+		}
+	}
+	err, cert_secret_name := ingress.GetCertificateFromDomain(domain)
+	if err != nil {
+		return err
+	}
+	return ingress.DeleteUberSiteGateway(domain, cert_secret_name, internal, 0)
+}
+
+func (ingress *IstioIngress) GetSiteStatus(domain string, internal bool, paths []Route) (*SiteIngressStatus, error) {
+	err, certificate := ingress.GetCertificateFromDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	status := SiteIngressStatus{Certificate: certificate, Routes: make([]SiteRouteStatus, 0)}
+
+	gatewayType := "public"
+	if internal {
+		gatewayType = "private"
+	}
+	body, code, err := ingress.runtime.GenericRequest("get", "/apis/"+IstioNetworkingAPIVersion+"/namespaces/sites-system/gateways/sites-"+gatewayType, nil)
+	if err != nil {
+		return nil, err
+	}
+	if code == http.StatusOK {
+		var gateway Gateway
+		if err = json.Unmarshal(body, &gateway); err != nil {
+			return nil, err
+		}
+		status.GatewayHttpsRegistered, status.GatewayHttpRegistered = GatewayRegistration(&gateway, domain, certificate)
+	} else if code != http.StatusNotFound {
+		return nil, errors.New("Response from request for sites gateway did not make sense: " + strconv.Itoa(code) + " " + string(body))
+	}
+
+	missing := make(map[string]bool)
+	exists, _, err := ingress.VirtualServiceExists(domain)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		vs, err := ingress.GetVirtualService(domain)
+		if err != nil {
+			return nil, err
+		}
+		status.VirtualServiceExists = true
+		for _, path := range MissingVirtualServicePaths(vs, domain, internal, paths) {
+			missing[path] = true
+		}
+	}
+
+	for _, path := range paths {
+		route := SiteRouteStatus{Path: path.Path, Space: path.Space, App: path.App, Maintenance: path.Maintenance}
+		route.InVirtualService = exists && !missing[path.Path]
+		if path.Maintenance {
+			// maintenance routes go to the down page rather than the app
+			route.BackendExists = true
+		} else if route.BackendExists, err = ingress.runtime.ServiceExists(path.Space, path.App); err != nil {
+			return nil, err
+		}
+		status.Routes = append(status.Routes, route)
+	}
+	return &status, nil
+}
+
 func (ingress *IstioIngress) GetInstalledCertificates(site string) ([]Certificate, error) {
 	var certList kube.SecretList
 	if site != "*" {
@@ -19,6 +19,7 @@ type Route struct {
 	Port        string `json:"port"`
 	Filters  	[]structs.HttpFilters `json:"filters,omitempty"`
 	Maintenance bool   `json:"maintenance"`
+	RateLimit   *RateLimit `json:"ratelimit,omitempty"`
 }
 
 type Router struct {
@@ -27,6 +28,9 @@ type Router struct {
 	VSNamespace     string           `json:"vsnamespace"`
 	ResourceVersion string           `json:"resourceVersion"`
 	Paths           []Route 		 `json:"paths"`
+	HSTS            *HSTS            `json:"hsts,omitempty"`
+	AutoTLS         bool             `json:"auto_tls,omitempty"`
+	CertificateStatus string         `json:"certificate_status,omitempty"`
 }
 
 type Ingress interface {
@@ -36,12 +40,28 @@ type Ingress interface {
 	DeleteCORSAuthFilter(vsname string, path string) (error)
 	DeleteCSPFilter(vsname string, path string) (error)
 	DeleteJWTAuthFilter(appname string, space string, fqdn string, port int64) (error)
+	InstallOrUpdateTrafficPolicyFilter(vsname string, path string, filters []structs.HttpFilters) (error)
+	DeleteTrafficPolicyFilter(vsname string, path string) (error)
+	InstallOrUpdateIPFilter(vsname string, path string, allow []string, deny []string) (error)
+	DeleteIPFilter(vsname string, path string) (error)
+	InstallOrUpdateBasicAuthFilter(vsname string, path string, username string, password string) (error)
+	DeleteBasicAuthFilter(vsname string, path string) (error)
+	CopyBasicAuthFilters(fromvsname string, tovsname string, paths []string) (error)
+	InstallOrUpdateOAuth2Filter(vsname string, path string, provider string, excludes []string) (error)
+	DeleteOAuth2Filter(vsname string, path string) (error)
 	SetMaintenancePage(vsname string, app string, space string, path string, value bool) error
 	GetMaintenancePageStatus(app string, space string) (bool, error)
 	DeleteRouter(domain string, internal bool) error
 	CreateOrUpdateRouter(domain string, internal bool, paths []Route) (error)
 	InstallCertificate(server_name string, pem_cert []byte, pem_key []byte) error
+	DeleteCertificate(server_name string) error
+	DeleteUberSiteGateway(domain string, certificate string, internal bool, retryNumber int) error
+	InstallAcmeChallengeRoute(domain string, internal bool, solverHost string, solverPort int32) error
+	DeleteAcmeChallengeRoute(domain string) error
 	GetInstalledCertificates(site string) ([]Certificate, error)
+	GetSiteStatus(domain string, internal bool, paths []Route) (*SiteIngressStatus, error)
+	InstallAppDomain(app string, space string, domain string, internal bool) error
+	DeleteAppDomain(app string, space string, domain string, internal bool) error
 	Config() *IngressConfig
 	Name() string
 }
@@ -236,7 +256,7 @@ func getIngressType(configs []*IngressConfig, ingress string) (*IngressConfig, e
 	}
 }
 
-func TransitionAppToIngress(db *sql.DB, ingress string, internal bool, appFQDN string) (error) {
+func TransitionAppToIngress(db *sql.DB, ingress string, internal bool, appFQDN string, app string, space string) (error) {
 	publicInternals, err := getAppsIngressPublicInternal()
 	if err != nil {
 		return err
@@ -268,7 +288,7 @@ func TransitionAppToIngress(db *sql.DB, ingress string, internal bool, appFQDN s
 		PrivateInternal: *privateInternal,
 	}
 
-	if err := SetDomainName(&configs, appFQDN, internal); err != nil {
+	if err := SetDomainName(db, &configs, appFQDN, internal, AppDNSRecordOwner(app, space)); err != nil {
 		return err
 	}
 	return nil
@@ -306,7 +326,7 @@ func TransitionSiteToIngress(db *sql.DB, ingress string, internal bool, siteFQDN
 		PrivateInternal: *privateInternal,
 	}
 
-	if err := SetDomainName(&configs, siteFQDN, internal); err != nil {
+	if err := SetDomainName(db, &configs, siteFQDN, internal, SiteDNSRecordOwner(siteFQDN)); err != nil {
 		return err
 	}
 	return nil
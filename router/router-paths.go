@@ -0,0 +1,343 @@
+package router
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	structs "region-api/structs"
+	utils "region-api/utils"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+)
+
+type RouterClone struct {
+	Domain string `json:"domain"`
+}
+
+// Checks a full set of paths for a router, the paths are returned with the domain set and the
+// space removed from the app name.
+func ValidateRoutes(domain string, routes []Route) ([]Route, error) {
+	validated := make([]Route, 0)
+	seen := make(map[string]bool)
+	for _, route := range routes {
+		if route.Path == "" {
+			return nil, errors.New("Path Cannot be blank")
+		}
+		if route.Space == "" {
+			return nil, errors.New("Space Cannot be blank for " + route.Path)
+		}
+		if route.App == "" {
+			return nil, errors.New("App Cannot be blank for " + route.Path)
+		}
+		if route.ReplacePath == "" {
+			return nil, errors.New("Replace Path Cannot be blank for " + route.Path)
+		}
+		key := strings.TrimSuffix(route.Path, "/")
+		if seen[key] {
+			return nil, errors.New("The path " + route.Path + " was specified more than once.")
+		}
+		seen[key] = true
+		if err := ValidateFilters(route.Filters); err != nil {
+			return nil, err
+		}
+		route.Domain = domain
+		route.App = strings.Replace(route.App, "-"+route.Space, "", -1)
+		validated = append(validated, route)
+	}
+	return validated, nil
+}
+
+// Copies the paths of a router to another domain, basic auth filters are pointed at the
+// credentials of the new domain.
+func CloneRoutes(routes []Route, domain string) []Route {
+	cloned := make([]Route, 0)
+	for _, route := range routes {
+		route.Domain = domain
+		filters := make([]structs.HttpFilters, 0)
+		for _, filter := range route.Filters {
+			if filter.Type == "basic_auth" {
+				filter = structs.HttpFilters{Type: filter.Type, Data: map[string]string{"username": filter.Data["username"], "secret": BasicAuthSecretName(domain)}}
+			}
+			filters = append(filters, filter)
+		}
+		route.Filters = filters
+		cloned = append(cloned, route)
+	}
+	return cloned
+}
+
+// Replaces all of the paths of a router in a single transaction. Basic auth passwords are
+// stripped from the filters and only stored once the paths are replaced, and the credentials
+// of paths that no longer have a basic_auth filter are removed.
+func ReplaceRouterPaths(db *sql.DB, domain string, routes []Route) error {
+	secured := make([]Route, 0)
+	credentials := make(map[string]*BasicAuth)
+	for _, route := range routes {
+		filters, auth, err := SecureFilters(domain, route.Filters)
+		if err != nil {
+			return err
+		}
+		route.Filters = filters
+		credentials[route.Path] = auth
+		secured = append(secured, route)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	existing, err := lockRouterPaths(tx, domain)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("DELETE from routerpaths where domain=$1", domain); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = insertRouterPaths(tx, domain, secured); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	for _, route := range secured {
+		if err = StoreBasicAuth(db, domain, route.Path, credentials[route.Path], false); err != nil {
+			return err
+		}
+	}
+	removed := removedBasicAuthPaths(existing, secured)
+	if len(removed) == 0 {
+		return nil
+	}
+	internal, err := IsInternalRouter(db, domain)
+	if err != nil {
+		return err
+	}
+	ingress, err := GetSiteIngress(db, internal)
+	if err != nil {
+		return err
+	}
+	return removeBasicAuthFilters(ingress, domain, removed)
+}
+
+// Reads the paths of a router and locks them until the transaction ends, so concurrent
+// replacements see each other's paths.
+func lockRouterPaths(tx *sql.Tx, domain string) ([]Route, error) {
+	rows, err := tx.Query("select path, filters from routerpaths where domain=$1 for update", domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	routes := make([]Route, 0)
+	for rows.Next() {
+		route := Route{Domain: domain}
+		filters := make([]structs.HttpFilters, 0)
+		var filtersJson sql.NullString
+		if err := rows.Scan(&route.Path, &filtersJson); err != nil {
+			return nil, err
+		}
+		if filtersJson.Valid && filtersJson.String != "" {
+			if err := json.Unmarshal([]byte(filtersJson.String), &filters); err != nil {
+				return nil, err
+			}
+		}
+		route.Filters = filters
+		routes = append(routes, route)
+	}
+	return routes, rows.Err()
+}
+
+func insertRouterPaths(tx *sql.Tx, domain string, routes []Route) error {
+	for _, route := range routes {
+		filtersJson := make([]byte, 0)
+		if route.Filters != nil {
+			var err error
+			if filtersJson, err = json.Marshal(route.Filters); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("INSERT INTO routerpaths(domain, path, space, app, replacepath, filters, maintenance) VALUES($1,$2,$3,$4,$5,$6,$7)", domain, route.Path, route.Space, route.App, route.ReplacePath, string(filtersJson), route.Maintenance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the paths with a basic_auth filter.
+func basicAuthPaths(routes []Route) []string {
+	paths := make([]string, 0)
+	for _, route := range routes {
+		for _, filter := range route.Filters {
+			if filter.Type == "basic_auth" {
+				paths = append(paths, route.Path)
+				break
+			}
+		}
+	}
+	return paths
+}
+
+// Returns the paths that had a basic_auth filter and no longer do, either because the path was
+// removed or because its filters no longer include basic_auth.
+func removedBasicAuthPaths(existing []Route, routes []Route) []string {
+	kept := make(map[string]bool)
+	for _, path := range basicAuthPaths(routes) {
+		kept[basicAuthKey(path)] = true
+	}
+	removed := make([]string, 0)
+	for _, path := range basicAuthPaths(existing) {
+		if !kept[basicAuthKey(path)] {
+			removed = append(removed, path)
+		}
+	}
+	return removed
+}
+
+func removeBasicAuthFilters(ingress Ingress, domain string, paths []string) error {
+	for _, path := range paths {
+		if err := ingress.DeleteBasicAuthFilter(domain, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func HttpReplacePaths(db *sql.DB, params martini.Params, spec []Route, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	domain := params["router"]
+	internalrouter, err := IsInternalRouter(db, domain)
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	routes, err := ValidateRoutes(domain, spec)
+	if err != nil {
+		utils.ReportInvalidRequest(err.Error(), r)
+		return
+	}
+	spaces := make(map[string]bool)
+	for _, route := range routes {
+		if _, checked := spaces[route.Space]; checked {
+			continue
+		}
+		internalspace, err := utils.IsInternalSpace(db, route.Space)
+		if err != nil {
+			utils.ReportInvalidRequest("Invalid Space "+route.Space, r)
+			return
+		}
+		if internalrouter != internalspace {
+			utils.ReportInvalidRequest("Cannot Mix internal and external", r)
+			return
+		}
+		spaces[route.Space] = internalspace
+	}
+	if err = ReplaceRouterPaths(db, domain, routes); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	pathspecs, err := GetPaths(db, domain)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	pushed, err := pushRouter(db, Router{Domain: domain, Internal: internalrouter, Paths: pathspecs})
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if !pushed {
+		r.JSON(http.StatusAccepted, structs.Messagespec{Status: http.StatusAccepted, Message: "Paths replaced, the router will be pushed once its certificate is issued"})
+		return
+	}
+	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Paths Replaced"})
+}
+
+func HttpCloneRouter(db *sql.DB, params martini.Params, spec RouterClone, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	source := params["router"]
+	internal, err := IsInternalRouter(db, source)
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	domain := strings.ToLower(strings.Trim(strings.TrimSpace(spec.Domain), "."))
+	if !isHostname(domain) || !strings.Contains(domain, ".") {
+		utils.ReportInvalidRequest("The domain must be a fully qualified hostname.", r)
+		return
+	}
+	inUse, err := appDomainInUse(db, domain)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if inUse != "" {
+		r.JSON(http.StatusConflict, structs.Messagespec{Status: http.StatusConflict, Message: inUse})
+		return
+	}
+	pathspecs, err := GetPaths(db, source)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	hsts, err := GetRouterHSTS(db, source)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	autoTLS, _, err := GetRouterAutoTLS(db, source)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	ingress, err := GetSiteIngress(db, internal)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	routes := CloneRoutes(pathspecs, domain)
+	copied := basicAuthPaths(routes)
+	if err = ingress.CopyBasicAuthFilters(source, domain, copied); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	routerid, status, err := createRouter(db, Router{Domain: domain, Internal: internal, HSTS: hsts, AutoTLS: autoTLS && certificateProvisioner != nil}, routes)
+	if err != nil {
+		// the copied credentials are only removed if the router was never added.
+		if _, e := IsInternalRouter(db, domain); e == sql.ErrNoRows {
+			if e = removeBasicAuthFilters(ingress, domain, copied); e != nil {
+				fmt.Printf("WARNING: Unable to remove the basic auth credentials copied to %s: %s\n", domain, e.Error())
+			}
+		}
+		utils.ReportError(err, r)
+		return
+	}
+	if status == CertificatePending {
+		r.JSON(http.StatusCreated, structs.Messagespec{Status: http.StatusCreated, Message: "Router " + source + " cloned to " + domain + " with ID " + routerid + ", it will be pushed once its certificate is issued"})
+		return
+	}
+	if len(routes) != 0 {
+		if _, err = pushRouter(db, Router{Domain: domain, Internal: internal, Paths: routes}); err != nil {
+			utils.ReportError(err, r)
+			return
+		}
+	}
+	r.JSON(http.StatusCreated, structs.Messagespec{Status: http.StatusCreated, Message: "Router " + source + " cloned to " + domain + " with ID " + routerid})
+}
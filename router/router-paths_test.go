@@ -0,0 +1,68 @@
+package router
+
+import (
+	structs "region-api/structs"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRouterPaths(t *testing.T) {
+	Convey("Test replacing and cloning router paths", t, func() {
+		Convey("A full set of paths should be validated", func() {
+			routes, err := ValidateRoutes("www.example.com", []Route{
+				Route{Path: "/", Space: "default", App: "web-default", ReplacePath: "/"},
+				Route{Path: "/api", Space: "default", App: "api", ReplacePath: "/"},
+			})
+			So(err, ShouldBeNil)
+			So(len(routes), ShouldEqual, 2)
+			So(routes[0].App, ShouldEqual, "web")
+			So(routes[0].Domain, ShouldEqual, "www.example.com")
+
+			_, err = ValidateRoutes("www.example.com", []Route{
+				Route{Path: "/api", Space: "default", App: "api", ReplacePath: "/"},
+				Route{Path: "/api/", Space: "default", App: "web", ReplacePath: "/"},
+			})
+			So(err, ShouldNotBeNil)
+			_, err = ValidateRoutes("www.example.com", []Route{Route{Path: "/api", Space: "default", App: "api"}})
+			So(err, ShouldNotBeNil)
+			_, err = ValidateRoutes("www.example.com", []Route{Route{Path: "/api", Space: "default", App: "api", ReplacePath: "/", Filters: []structs.HttpFilters{structs.HttpFilters{}}}})
+			So(err, ShouldNotBeNil)
+			routes, err = ValidateRoutes("www.example.com", []Route{})
+			So(err, ShouldBeNil)
+			So(len(routes), ShouldEqual, 0)
+		})
+
+		Convey("Cloned paths should use the new domain and its basic auth credentials", func() {
+			routes := CloneRoutes([]Route{
+				Route{Domain: "www.example.com", Path: "/admin", Space: "default", App: "admin", ReplacePath: "/", Filters: []structs.HttpFilters{
+					structs.HttpFilters{Type: "basic_auth", Data: map[string]string{"username": "admin", "secret": BasicAuthSecretName("www.example.com")}},
+					structs.HttpFilters{Type: "csp", Data: map[string]string{"policy": "default-src 'self'"}},
+				}},
+			}, "beta.example.com")
+			So(routes[0].Domain, ShouldEqual, "beta.example.com")
+			So(routes[0].Filters[0].Data["secret"], ShouldEqual, BasicAuthSecretName("beta.example.com"))
+			So(routes[0].Filters[0].Data["username"], ShouldEqual, "admin")
+			So(routes[0].Filters[1].Data["policy"], ShouldEqual, "default-src 'self'")
+		})
+
+		Convey("Credentials should be removed for paths that no longer have a basic auth filter", func() {
+			auth := structs.HttpFilters{Type: "basic_auth", Data: map[string]string{"username": "admin", "secret": BasicAuthSecretName("www.example.com")}}
+			csp := structs.HttpFilters{Type: "csp", Data: map[string]string{"policy": "default-src 'self'"}}
+			existing := []Route{
+				Route{Path: "/admin", Filters: []structs.HttpFilters{auth, csp}},
+				Route{Path: "/internal", Filters: []structs.HttpFilters{auth}},
+				Route{Path: "/reports", Filters: []structs.HttpFilters{auth}},
+				Route{Path: "/", Filters: []structs.HttpFilters{csp}},
+			}
+			So(basicAuthPaths(existing), ShouldResemble, []string{"/admin", "/internal", "/reports"})
+			routes := []Route{
+				Route{Path: "/admin/", Filters: []structs.HttpFilters{auth}},
+				Route{Path: "/internal", Filters: []structs.HttpFilters{csp}},
+				Route{Path: "/", Filters: []structs.HttpFilters{auth}},
+			}
+			So(removedBasicAuthPaths(existing, routes), ShouldResemble, []string{"/internal", "/reports"})
+			So(removedBasicAuthPaths(nil, routes), ShouldBeEmpty)
+		})
+	})
+}
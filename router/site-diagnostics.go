@@ -0,0 +1,433 @@
+package router
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	utils "region-api/utils"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+const (
+	SiteCheckDNSRecord           = "dns_record"
+	SiteCheckDNSResolution       = "dns_resolution"
+	SiteCheckCertificateCoverage = "certificate_coverage"
+	SiteCheckCertificateExpiry   = "certificate_expiry"
+	SiteCheckGateway             = "gateway"
+	SiteCheckVirtualService      = "virtual_service"
+	SiteCheckBackend             = "backend"
+)
+
+// What the ingress has installed for a site, see Ingress.GetSiteStatus
+type SiteRouteStatus struct {
+	Path             string `json:"path"`
+	Space            string `json:"space"`
+	App              string `json:"app"`
+	Maintenance      bool   `json:"maintenance"`
+	InVirtualService bool   `json:"in_virtual_service"`
+	BackendExists    bool   `json:"backend_exists"`
+}
+
+type SiteIngressStatus struct {
+	Certificate            string            `json:"certificate"`
+	GatewayHttpsRegistered bool              `json:"gateway_https_registered"`
+	GatewayHttpRegistered  bool              `json:"gateway_http_registered"`
+	VirtualServiceExists   bool              `json:"virtual_service_exists"`
+	Routes                 []SiteRouteStatus `json:"routes"`
+}
+
+type SiteCheck struct {
+	Name       string `json:"name"`
+	Path       string `json:"path,omitempty"`
+	Ok         bool   `json:"ok"`
+	Message    string `json:"message"`
+	Repairable bool   `json:"repairable"`
+}
+
+type SiteDiagnostics struct {
+	Site     string      `json:"site"`
+	Internal bool        `json:"internal"`
+	Address  string      `json:"address"`
+	Healthy  bool        `json:"healthy"`
+	Checks   []SiteCheck `json:"checks"`
+}
+
+type SiteRepair struct {
+	Repaired    []string         `json:"repaired"`
+	Unrepaired  []string         `json:"unrepaired"`
+	Diagnostics *SiteDiagnostics `json:"diagnostics"`
+}
+
+// A dns record the site should have in a zone, and whether it does.
+type siteDomainRecord struct {
+	Zone    Domain
+	Address string
+	Exists  bool
+	// Another record (such as a CNAME to a CDN) already has the site's name in the zone.
+	Existing *DomainRecord
+}
+
+// Public sites have a record in the public zone to the external ingress and in the private zone
+// to the internal address of the public ingress, internal sites only have a private record.
+func getSiteDomainRecords(dns DNSProvider, site string, internal bool, config *FullIngressConfig) ([]siteDomainRecord, error) {
+	zones, err := FindZones(dns, site)
+	if err != nil {
+		return nil, err
+	}
+	expected := make([]siteDomainRecord, 0)
+	for _, zone := range zones {
+		if zone.Public && !internal {
+			expected = append(expected, siteDomainRecord{Zone: zone, Address: config.PublicExternal.Address})
+		} else if !zone.Public && !internal {
+			expected = append(expected, siteDomainRecord{Zone: zone, Address: config.PublicInternal.Address})
+		} else if !zone.Public && internal {
+			expected = append(expected, siteDomainRecord{Zone: zone, Address: config.PrivateInternal.Address})
+		}
+	}
+	for i, record := range expected {
+		records, err := dns.DomainRecords(record.Zone)
+		if err != nil {
+			return nil, err
+		}
+		for j, r := range records {
+			if strings.TrimSuffix(r.Name, ".") != site {
+				continue
+			}
+			expected[i].Existing = &records[j]
+			for _, value := range r.Values {
+				if strings.TrimSuffix(value, ".") == record.Address {
+					expected[i].Exists = true
+				}
+			}
+		}
+		if expected[i].Exists {
+			expected[i].Existing = nil
+		}
+	}
+	return expected, nil
+}
+
+// Whether the certificate's subject alternative names cover the site, a wildcard only covers one label.
+func CertificateCovers(certificate Certificate, site string) bool {
+	return certificateCoversDomain(certificate.Alternatives, site)
+}
+
+func checkDomainRecords(site string, internal bool, config *FullIngressConfig) SiteCheck {
+	check := SiteCheck{Name: SiteCheckDNSRecord}
+	records, err := getSiteDomainRecords(GetDnsProvider(), site, internal, config)
+	if err != nil {
+		check.Message = "Unable to get the dns records for " + site + ": " + err.Error()
+		return check
+	}
+	return domainRecordsCheck(site, records)
+}
+
+// Missing records are only repairable if nothing else has the site's name, creating the record
+// would otherwise replace a record the site's owner set up (e.g., a CNAME to a CDN).
+func domainRecordsCheck(site string, records []siteDomainRecord) SiteCheck {
+	check := SiteCheck{Name: SiteCheckDNSRecord}
+	if len(records) == 0 {
+		check.Message = "No dns zone was found for " + site + "."
+		return check
+	}
+	missing := make([]string, 0)
+	existing := make([]string, 0)
+	for _, record := range records {
+		if record.Exists {
+			continue
+		}
+		missing = append(missing, record.Zone.Name+" ("+record.Address+")")
+		if record.Existing != nil {
+			values := record.Existing.Values
+			if record.Existing.Alias != nil {
+				values = []string{record.Existing.Alias.Target}
+			}
+			existing = append(existing, record.Zone.Name+" ("+record.Existing.Type+" "+strings.Join(values, ", ")+")")
+		}
+	}
+	if len(existing) > 0 {
+		check.Message = "The site has no record pointing to its ingress in the zone(s) " + strings.Join(missing, ", ") + ", another record for " + site + " exists in " + strings.Join(existing, ", ") + "."
+		return check
+	}
+	if len(missing) > 0 {
+		check.Message = "The site has no record pointing to its ingress in the zone(s) " + strings.Join(missing, ", ") + "."
+		check.Repairable = true
+		return check
+	}
+	check.Ok = true
+	check.Message = "The site has records pointing to its ingress."
+	return check
+}
+
+func checkResolution(site string, internal bool, config *FullIngressConfig) SiteCheck {
+	check := SiteCheck{Name: SiteCheckDNSResolution}
+	address := config.PublicExternal.Address
+	if internal {
+		address = config.PrivateInternal.Address
+	}
+	resolved, err := ResolveDNS(site, internal)
+	if err != nil {
+		check.Message = "Unable to resolve " + site + ": " + err.Error()
+		return check
+	}
+	// the ingress address may be a hostname, compare against what it resolves to as well.
+	expected := map[string]bool{address: true}
+	if addresses, err := ResolveDNS(address, internal); err == nil {
+		for _, a := range addresses {
+			expected[strings.TrimSuffix(a, ".")] = true
+		}
+	}
+	for _, a := range resolved {
+		if expected[strings.TrimSuffix(a, ".")] {
+			check.Ok = true
+			check.Message = site + " resolves to the ingress " + address + "."
+			return check
+		}
+	}
+	check.Message = site + " resolves to " + strings.Join(resolved, ", ") + " rather than the ingress " + address + "."
+	return check
+}
+
+// Every installed certificate is checked for an exact or alternative name match rather than using the
+// certificate the gateway chose, which falls back to the default certificate when none is found by name.
+func checkCertificates(ingress Ingress, site string, certificate string, autoTLS bool) []SiteCheck {
+	certificates, err := ingress.GetInstalledCertificates("*")
+	if err != nil {
+		return []SiteCheck{SiteCheck{Name: SiteCheckCertificateCoverage, Message: "Unable to get the installed certificates for " + site + ": " + err.Error()}}
+	}
+	return certificateChecks(certificates, site, certificate, autoTLS)
+}
+
+// The certificate checked is the one the gateway uses for the site, a certificate that covers the site
+// but isn't picked by the gateway doesn't help. Only sites with auto_tls have a certificate ordered for
+// them, others must have one uploaded or ordered.
+func certificateChecks(certificates []Certificate, site string, certificate string, autoTLS bool) []SiteCheck {
+	coverage := SiteCheck{Name: SiteCheckCertificateCoverage}
+	var covering *Certificate
+	for i, c := range certificates {
+		if c.Name == certificate && CertificateCovers(c, site) {
+			covering = &certificates[i]
+		}
+	}
+	if covering == nil {
+		coverage.Message = "No installed certificate covers " + site + ", the gateway uses " + certificate + "."
+		coverage.Repairable = autoTLS && certificateProvisioner != nil
+		if !coverage.Repairable {
+			coverage.Message += " Upload or order a certificate for it."
+		}
+		return []SiteCheck{coverage}
+	}
+	coverage.Ok = true
+	coverage.Message = "The certificate " + covering.Name + " covers " + site + "."
+
+	expiry := SiteCheck{Name: SiteCheckCertificateExpiry}
+	days := daysRemaining(covering.Expires, time.Now())
+	if covering.Expired {
+		expiry.Message = fmt.Sprintf("The certificate %s expired %d day(s) ago.", covering.Name, -days)
+	} else {
+		expiry.Ok = true
+		expiry.Message = fmt.Sprintf("The certificate %s expires in %d day(s).", covering.Name, days)
+	}
+	return []SiteCheck{coverage, expiry}
+}
+
+func checkIngressStatus(status *SiteIngressStatus, site string, paths []Route) []SiteCheck {
+	gateway := SiteCheck{Name: SiteCheckGateway}
+	vs := SiteCheck{Name: SiteCheckVirtualService}
+	if len(paths) == 0 {
+		gateway.Ok = true
+		gateway.Message = "The router has no paths, it is not registered with the gateway until one is added."
+		vs.Ok = true
+		vs.Message = gateway.Message
+		return []SiteCheck{gateway, vs}
+	}
+	if status.GatewayHttpsRegistered && status.GatewayHttpRegistered {
+		gateway.Ok = true
+		gateway.Message = site + " is registered with the gateway using " + status.Certificate + "."
+	} else {
+		gateway.Repairable = true
+		if !status.GatewayHttpsRegistered {
+			gateway.Message = site + " is not registered with the gateway's https server for " + status.Certificate + "."
+		} else {
+			gateway.Message = site + " is not registered with the gateway's http server."
+		}
+	}
+
+	missing := make([]string, 0)
+	for _, route := range status.Routes {
+		if !route.InVirtualService {
+			missing = append(missing, route.Path)
+		}
+	}
+	if !status.VirtualServiceExists {
+		vs.Repairable = true
+		vs.Message = "The virtual service for " + site + " does not exist."
+	} else if len(missing) > 0 {
+		vs.Repairable = true
+		vs.Message = "The virtual service for " + site + " is missing the path(s) " + strings.Join(missing, ", ") + "."
+	} else {
+		vs.Ok = true
+		vs.Message = "The virtual service for " + site + " has all of its paths."
+	}
+
+	checks := []SiteCheck{gateway, vs}
+	for _, route := range status.Routes {
+		backend := SiteCheck{Name: SiteCheckBackend, Path: route.Path}
+		if route.Maintenance {
+			backend.Ok = true
+			backend.Message = "The path is in maintenance mode."
+		} else if route.BackendExists {
+			backend.Ok = true
+			backend.Message = "The service " + route.App + " exists in " + route.Space + "."
+		} else {
+			backend.Message = "The service " + route.App + " was not found in " + route.Space + "."
+		}
+		checks = append(checks, backend)
+	}
+	return checks
+}
+
+func DiagnoseSite(db *sql.DB, site string) (*SiteDiagnostics, error) {
+	internal, err := IsInternalRouter(db, site)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := GetPaths(db, site)
+	if err != nil {
+		return nil, err
+	}
+	config, err := GetDefaultIngressSiteAddresses()
+	if err != nil {
+		return nil, err
+	}
+	ingress, err := GetSiteIngress(db, internal)
+	if err != nil {
+		return nil, err
+	}
+	status, err := ingress.GetSiteStatus(site, internal, paths)
+	if err != nil {
+		return nil, err
+	}
+	autoTLS, _, err := GetRouterAutoTLS(db, site)
+	if err != nil {
+		return nil, err
+	}
+	diagnostics := SiteDiagnostics{Site: site, Internal: internal, Address: ingress.Config().Address, Healthy: true}
+	diagnostics.Checks = append(diagnostics.Checks, checkDomainRecords(site, internal, config), checkResolution(site, internal, config))
+	diagnostics.Checks = append(diagnostics.Checks, checkCertificates(ingress, site, status.Certificate, autoTLS)...)
+	diagnostics.Checks = append(diagnostics.Checks, checkIngressStatus(status, site, paths)...)
+	for _, check := range diagnostics.Checks {
+		if !check.Ok {
+			diagnostics.Healthy = false
+		}
+	}
+	return &diagnostics, nil
+}
+
+// Fixes what can safely be fixed, missing dns records are created, a certificate is ordered if none
+// covers a site with auto_tls and the router is pushed if the gateway or virtual service is out of date.
+// Failed checks that cannot be repaired (such as a missing certificate without auto_tls) are reported.
+func RepairSite(db *sql.DB, site string) (*SiteRepair, error) {
+	diagnostics, err := DiagnoseSite(db, site)
+	if err != nil {
+		return nil, err
+	}
+	failed := make(map[string]bool)
+	unrepaired := make([]string, 0)
+	for _, check := range diagnostics.Checks {
+		if !check.Ok && check.Repairable {
+			failed[check.Name] = true
+		} else if !check.Ok {
+			unrepaired = append(unrepaired, check.Message)
+		}
+	}
+	repaired := make([]string, 0)
+	if failed[SiteCheckDNSRecord] {
+		config, err := GetDefaultIngressSiteAddresses()
+		if err != nil {
+			return nil, err
+		}
+		dns := GetDnsProvider()
+		records, err := getSiteDomainRecords(dns, site, diagnostics.Internal, config)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			// never replace (and take ownership of) a record the site's owner created.
+			if !record.Exists && record.Existing == nil {
+				if err = dns.CreateDomainRecord(record.Zone, GetDNSRecordType(record.Address), site, []string{record.Address}); err != nil {
+					return nil, err
+				}
+				if err = TrackDomainRecord(db, record.Zone, GetDNSRecordType(record.Address), site, record.Address, SiteDNSRecordOwner(site)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		repaired = append(repaired, SiteCheckDNSRecord)
+	}
+	pending := false
+	if failed[SiteCheckCertificateCoverage] {
+		status, err := OrderRouterCertificate(db, site, diagnostics.Internal)
+		if err != nil {
+			return nil, err
+		}
+		// the router is pushed once the certificate is issued
+		pending = status == CertificatePending
+		repaired = append(repaired, SiteCheckCertificateCoverage)
+	}
+	if (failed[SiteCheckGateway] || failed[SiteCheckVirtualService]) && !pending {
+		paths, err := GetPaths(db, site)
+		if err != nil {
+			return nil, err
+		}
+		ingress, err := GetSiteIngress(db, diagnostics.Internal)
+		if err != nil {
+			return nil, err
+		}
+		err = ingress.CreateOrUpdateRouter(site, diagnostics.Internal, paths)
+		if err == ErrRouterPendingCertificate {
+			unrepaired = append(unrepaired, err.Error())
+		} else if err != nil {
+			return nil, err
+		} else {
+			if failed[SiteCheckGateway] {
+				repaired = append(repaired, SiteCheckGateway)
+			}
+			if failed[SiteCheckVirtualService] {
+				repaired = append(repaired, SiteCheckVirtualService)
+			}
+		}
+	}
+	if diagnostics, err = DiagnoseSite(db, site); err != nil {
+		return nil, err
+	}
+	return &SiteRepair{Repaired: repaired, Unrepaired: unrepaired, Diagnostics: diagnostics}, nil
+}
+
+func HttpGetSiteDiagnostics(db *sql.DB, params martini.Params, r render.Render) {
+	diagnostics, err := DiagnoseSite(db, strings.Trim(strings.ToLower(params["site"]), " "))
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, diagnostics)
+}
+
+func HttpRepairSite(db *sql.DB, params martini.Params, r render.Render) {
+	repair, err := RepairSite(db, strings.Trim(strings.ToLower(params["site"]), " "))
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, repair)
+}
@@ -0,0 +1,127 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSiteDiagnostics(t *testing.T) {
+	Convey("Test site diagnostics", t, func() {
+		Convey("The most specific public and private zones should be found", func() {
+			domains := []Domain{
+				Domain{ProviderId: "1", Name: "example.com", Public: true},
+				Domain{ProviderId: "2", Name: "dev.example.com", Public: true},
+				Domain{ProviderId: "3", Name: "example.com", Public: false},
+				Domain{ProviderId: "4", Name: "ample.com", Public: false},
+			}
+			zones := MostSpecificZones(domains, "www.dev.example.com")
+			So(len(zones), ShouldEqual, 2)
+			So(zones[0].ProviderId, ShouldEqual, "2")
+			So(zones[1].ProviderId, ShouldEqual, "3")
+			So(len(MostSpecificZones(domains, "www.other.com")), ShouldEqual, 0)
+			So(len(MostSpecificZones(domains, "example.com")), ShouldEqual, 2)
+		})
+
+		Convey("A missing record should only be repairable when no other record has the site's name", func() {
+			zone := Domain{ProviderId: "1", Name: "example.com", Public: true}
+			check := domainRecordsCheck("www.example.com", []siteDomainRecord{siteDomainRecord{Zone: zone, Address: "10.0.0.1"}})
+			So(check.Ok, ShouldBeFalse)
+			So(check.Repairable, ShouldBeTrue)
+			cdn := DomainRecord{Type: "CNAME", Name: "www.example.com", Values: []string{"example.cdn.net"}}
+			check = domainRecordsCheck("www.example.com", []siteDomainRecord{siteDomainRecord{Zone: zone, Address: "10.0.0.1", Existing: &cdn}})
+			So(check.Ok, ShouldBeFalse)
+			So(check.Repairable, ShouldBeFalse)
+			So(check.Message, ShouldContainSubstring, "example.cdn.net")
+			check = domainRecordsCheck("www.example.com", []siteDomainRecord{siteDomainRecord{Zone: zone, Address: "10.0.0.1", Exists: true}})
+			So(check.Ok, ShouldBeTrue)
+			So(domainRecordsCheck("www.example.com", []siteDomainRecord{}).Ok, ShouldBeFalse)
+		})
+
+		Convey("Wildcard certificates should only cover one label", func() {
+			cert := Certificate{Name: "star-example-com-tls", Alternatives: []string{"*.example.com", "example.com"}}
+			So(CertificateCovers(cert, "www.example.com"), ShouldBeTrue)
+			So(CertificateCovers(cert, "example.com"), ShouldBeTrue)
+			So(CertificateCovers(cert, "a.www.example.com"), ShouldBeFalse)
+			So(CertificateCovers(cert, "www.other.com"), ShouldBeFalse)
+		})
+
+		Convey("Only the certificate the gateway uses should cover the site", func() {
+			provisioner := certificateProvisioner
+			defer func() { certificateProvisioner = provisioner }()
+			certificateProvisioner = nil
+			certificates := []Certificate{
+				Certificate{Name: "www-example-com-tls", Alternatives: []string{"www.example.com", "example.com"}, Expires: time.Now().Add(time.Hour * 24 * 30).Unix()},
+			}
+			checks := certificateChecks(certificates, "example.com", "www-example-com-tls", false)
+			So(len(checks), ShouldEqual, 2)
+			So(checks[0].Ok, ShouldBeTrue)
+			So(checks[0].Message, ShouldContainSubstring, "www-example-com-tls")
+			So(checks[1].Ok, ShouldBeTrue)
+
+			checks = certificateChecks(certificates, "example.com", "star-certificate", false)
+			So(len(checks), ShouldEqual, 1)
+			So(checks[0].Ok, ShouldBeFalse)
+
+			checks = certificateChecks(certificates, "api.example.com", "star-certificate", true)
+			So(len(checks), ShouldEqual, 1)
+			So(checks[0].Ok, ShouldBeFalse)
+			So(checks[0].Repairable, ShouldBeFalse)
+		})
+
+		Convey("Gateway registration should require the certificate on the https server", func() {
+			var gateway Gateway
+			_, _, updated := AddHostsAndServers("www.example.com", "www-example-com-tls", &gateway)
+			https, http := GatewayRegistration(updated, "www.example.com", "www-example-com-tls")
+			So(https, ShouldBeTrue)
+			So(http, ShouldBeTrue)
+			https, http = GatewayRegistration(updated, "www.example.com", "star-certificate")
+			So(https, ShouldBeFalse)
+			So(http, ShouldBeTrue)
+			https, http = GatewayRegistration(updated, "api.example.com", "www-example-com-tls")
+			So(https, ShouldBeFalse)
+			So(http, ShouldBeFalse)
+		})
+
+		Convey("Paths missing from the virtual service should be reported", func() {
+			paths := []Route{
+				Route{Domain: "www.example.com", Path: "/", Space: "default", App: "web", ReplacePath: "/"},
+				Route{Domain: "www.example.com", Path: "/api", Space: "default", App: "api", ReplacePath: "/"},
+			}
+			vs, err := PrepareVirtualServiceForCreateorUpdate("www.example.com", false, paths[:1])
+			So(err, ShouldBeNil)
+			So(MissingVirtualServicePaths(vs, "www.example.com", false, paths), ShouldResemble, []string{"/api"})
+			vs, err = PrepareVirtualServiceForCreateorUpdate("www.example.com", false, paths)
+			So(err, ShouldBeNil)
+			So(len(MissingVirtualServicePaths(vs, "www.example.com", false, paths)), ShouldEqual, 0)
+		})
+
+		Convey("Ingress status should be turned into checks", func() {
+			paths := []Route{Route{Path: "/", Space: "default", App: "web"}, Route{Path: "/api", Space: "default", App: "api"}}
+			status := &SiteIngressStatus{
+				Certificate:            "star-certificate",
+				GatewayHttpsRegistered: true,
+				GatewayHttpRegistered:  true,
+				VirtualServiceExists:   true,
+				Routes: []SiteRouteStatus{
+					SiteRouteStatus{Path: "/", Space: "default", App: "web", InVirtualService: true, BackendExists: true},
+					SiteRouteStatus{Path: "/api", Space: "default", App: "api", InVirtualService: false, BackendExists: false},
+				},
+			}
+			checks := checkIngressStatus(status, "www.example.com", paths)
+			So(len(checks), ShouldEqual, 4)
+			So(checks[0].Ok, ShouldBeTrue)
+			So(checks[1].Ok, ShouldBeFalse)
+			So(checks[1].Repairable, ShouldBeTrue)
+			So(checks[1].Message, ShouldContainSubstring, "/api")
+			So(checks[2].Ok, ShouldBeTrue)
+			So(checks[3].Ok, ShouldBeFalse)
+			So(checks[3].Repairable, ShouldBeFalse)
+
+			checks = checkIngressStatus(&SiteIngressStatus{}, "www.example.com", []Route{})
+			So(len(checks), ShouldEqual, 2)
+			So(checks[0].Ok && checks[1].Ok, ShouldBeTrue)
+		})
+	})
+}
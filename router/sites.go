@@ -119,7 +119,6 @@ func WildCardMatch(wildcard string, domain string) bool {
 
 func HttpGetSite(db *sql.DB, params martini.Params, r render.Render) {
 	var site = strings.Trim(strings.ToLower(params["site"]), " ")
-	var domain = strings.Split(site, ".")
 
 	internalIngress, err := GetSiteIngress(db, false)
 	if err != nil {
@@ -161,10 +160,7 @@ func HttpGetSite(db *sql.DB, params martini.Params, r render.Render) {
 
 	dns := GetDnsProvider()
 	domainRecords := make([]DomainRecord, 0)
-	if len(domain) > 2 {
-		domain = domain[len(domain)-2:]
-	}
-	dzones, err := dns.Domain(strings.Join(domain, "."))
+	dzones, err := FindZones(dns, site)
 	if err != nil {
 		utils.ReportError(err, r)
 		return
@@ -221,9 +221,10 @@ type Tolerations struct {
 
 type Deploymentspec struct {
 	Metadata struct {
-		Name      string            `json:"name"`
-		Namespace string            `json:"namespace"`
-		Labels    map[string]string `json:"labels,omitempty"`
+		Name       string            `json:"name"`
+		Namespace  string            `json:"namespace"`
+		Labels     map[string]string `json:"labels,omitempty"`
+		Generation int               `json:"generation,omitempty"`
 	} `json:"metadata"`
 	Spec struct {
 		RevisionHistoryLimit int `json:"revisionHistoryLimit"`
@@ -269,6 +270,12 @@ type Deploymentspec struct {
 			} `json:"spec"`
 		} `json:"template"`
 	} `json:"spec"`
+	Status struct {
+		ObservedGeneration int `json:"observedGeneration,omitempty"`
+		Replicas           int `json:"replicas,omitempty"`
+		UpdatedReplicas    int `json:"updatedReplicas,omitempty"`
+		AvailableReplicas  int `json:"availableReplicas,omitempty"`
+	} `json:"status,omitempty"`
 }
 
 type DeploymentCollectionspec struct {
@@ -910,6 +917,58 @@ func (rt Kubernetes) RestartDeployment(space string, app string) (e error) {
 	return e
 }
 
+// Sets and removes config vars on the app's container without changing the rest of the deployment,
+// the change rolls out the same way a deploy would.
+func (rt Kubernetes) UpdateConfigVars(space string, app string, set []structs.EnvVar, remove []string) (e error) {
+	deployment, e := rt.getDeployment(space, app)
+	if e != nil {
+		return e
+	}
+	for i, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name != app && len(deployment.Spec.Template.Spec.Containers) > 1 {
+			continue
+		}
+		env := make([]structs.EnvVar, 0)
+		for _, v := range container.Env {
+			removed := false
+			for _, name := range remove {
+				if v.Name == name {
+					removed = true
+				}
+			}
+			for _, n := range set {
+				if v.Name == n.Name {
+					removed = true
+				}
+			}
+			if !removed {
+				env = append(env, v)
+			}
+		}
+		deployment.Spec.Template.Spec.Containers[i].Env = append(env, set...)
+	}
+	resp, e := rt.k8sRequest("put", "/apis/apps/v1/namespaces/"+space+"/deployments/"+app, deployment)
+	if e != nil {
+		return e
+	}
+	if resp.StatusCode > 399 || resp.StatusCode < 200 {
+		return errors.New("Cannot update config vars for " + app + "-" + space + " received: " + resp.Status + " " + string(resp.Body))
+	}
+	return nil
+}
+
+// True once every replica of the latest revision of the deployment is available.
+func (rt Kubernetes) DeploymentRolledOut(space string, app string) (bool, error) {
+	deployment, e := rt.getDeployment(space, app)
+	if e != nil {
+		return false, e
+	}
+	return deployment.Status.ObservedGeneration >= deployment.Metadata.Generation &&
+		deployment.Status.UpdatedReplicas == deployment.Spec.Replicas &&
+		deployment.Status.AvailableReplicas == deployment.Spec.Replicas &&
+		deployment.Status.Replicas == deployment.Spec.Replicas, nil
+}
+
 func (rt Kubernetes) GetDeploymentHistory(space string, app string) (dslist []structs.DeploymentsSpec, e error) {
 	resp, err := rt.k8sRequest("get", "/apis/apps/v1/namespaces/"+space+"/replicasets?labelSelector=name="+app, nil)
 	if err != nil {
@@ -36,6 +36,8 @@ type Runtime interface {
 	AddImagePullSecretToSpace(space string) (e error)
 	UpdateSpaceTags(space string, compliance string) (e error)
 	RestartDeployment(space string, app string) (e error)
+	UpdateConfigVars(space string, app string, set []structs.EnvVar, remove []string) (e error)
+	DeploymentRolledOut(space string, app string) (bool, error)
 	GetCurrentImage(space string, app string) (i string, e error)
 	GetPodDetails(space string, app string) []structs.Instance
 	GetPodLogs(app string, space string, pod string) (log string, err error)
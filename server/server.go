@@ -144,6 +144,8 @@ func InitOldServiceEndpoints(m *martini.ClassicMartini) {
 	m.Post("/v1/service/kafka/cluster/:cluster/topic", binding.Json(structs.KafkaTopic{}), service.ProvisionTopicV1)
 	m.Get("/v1/service/kafka/topics", service.GetTopicsV1)
 	m.Delete("/v1/service/kafka/cluster/:cluster/topics/:topic", service.DeleteTopicV1)
+	m.Patch("/v1/service/kafka/cluster/:cluster/topics/:topic", binding.Json(structs.KafkaTopicUpdate{}), service.UpdateTopicV1)
+	m.Get("/v1/service/kafka/cluster/:cluster/topics/:topic/changes", service.GetTopicChangesV1)
 	m.Get("/v1/service/kafka/topics/:topic", service.GetTopicV1)
 	m.Get("/v1/service/kafka/cluster/:cluster/configs", service.GetConfigsV1)
 	m.Get("/v1/service/kafka/cluster/:cluster/configs/:name", service.GetConfigV1)
@@ -184,6 +186,20 @@ func InitOpenServiceBrokerEndpoints(db *sql.DB, m *martini.ClassicMartini) {
 	}
 	service.SetGlobalClientService(catalogOSBProvider)
 	m.Get("/v2/catalog", catalogOSBProvider.HttpGetCatalog)
+	m.Get("/v1/brokers", catalogOSBProvider.HttpGetBrokers)
+	m.Post("/v1/brokers", binding.Json(service.BrokerRequest{}), catalogOSBProvider.HttpCreateBroker)
+	m.Get("/v1/brokers/:broker", catalogOSBProvider.HttpGetBroker)
+	m.Delete("/v1/brokers/:broker", catalogOSBProvider.HttpDeleteBroker)
+	m.Post("/v1/brokers/:broker/refresh", catalogOSBProvider.HttpRefreshBroker)
+	m.Get("/v1/service/osb/credentials", catalogOSBProvider.HttpGetCachedBindingCredentials)
+	m.Post("/v1/service/osb/credentials/:instance_id/:binding_id/refresh", catalogOSBProvider.HttpRefreshBindingCredentials)
+	m.Get("/v1/service/osb/instances/:instance_id/access", catalogOSBProvider.HttpGetInstanceAccess)
+	m.Put("/v1/service/osb/instances/:instance_id/owner", binding.Json(service.InstanceOwner{}), catalogOSBProvider.HttpSetInstanceOwner)
+	m.Put("/v1/service/osb/instances/:instance_id/shares/:space", binding.Json(service.InstanceShareRequest{}), catalogOSBProvider.HttpShareInstance)
+	m.Delete("/v1/service/osb/instances/:instance_id/shares/:space", catalogOSBProvider.HttpUnshareInstance)
+	m.Get("/v1/services/instances", catalogOSBProvider.HttpGetServiceInstances)
+	m.Get("/v1/services/orphans", catalogOSBProvider.HttpGetOrphans)
+	m.Post("/v1/services/orphans/cleanup", binding.Json(service.OrphanCleanupRequest{}), catalogOSBProvider.HttpCleanupOrphans)
 	m.Get("/v2/service_instances/:instance_id/last_operation", catalogOSBProvider.HttpGetLastOperation)
 	m.Put("/v2/service_instances/:instance_id", binding.Json(service.ProvisionRequestBody{}), catalogOSBProvider.HttpGetCreateOrUpdateInstance)
 	m.Delete("/v2/service_instances/:instance_id", catalogOSBProvider.HttpDeleteInstance)
@@ -213,6 +229,8 @@ func Server(db *sql.DB) *martini.ClassicMartini {
 	go router.GetDnsProvider()
 	// cause runtime to cache itself.
 	go runtime.GetAllRuntimes(db)
+	// routers with auto_tls order their certificates through the certs package.
+	router.SetCertificateProvisioner(certs.AutoTLS{})
 
 	m.Get("/v2/config", GetInfo)
 
@@ -248,6 +266,11 @@ func Server(db *sql.DB) *martini.ClassicMartini {
 	m.Post("/v1/space/:space/app/:appname/bindmap/:bindtype/:bindname", binding.Json(structs.Bindmapspec{}), app.Createbindmap)
 	m.Get("/v1/space/:space/app/:appname/bindmap/:bindtype/:bindname", app.Getbindmaps)
 	m.Delete("/v1/space/:space/app/:appname/bindmap/:bindtype/:bindname/:mapid", app.Deletebindmap)
+	m.Post("/v1/space/:space/app/:appname/bindrotation/:bindtype/:bindname", app.RotateBinding)
+	m.Get("/v1/space/:space/app/:appname/bindrotation/:bindtype/:bindname", app.GetBindingRotations)
+	m.Get("/v1/space/:space/app/:appname/bindrotation/:bindtype/:bindname/schedule", app.GetBindingRotationSchedule)
+	m.Put("/v1/space/:space/app/:appname/bindrotation/:bindtype/:bindname/schedule", binding.Json(structs.BindingRotationSchedule{}), app.SetBindingRotationSchedule)
+	m.Delete("/v1/space/:space/app/:appname/bindrotation/:bindtype/:bindname/schedule", app.DeleteBindingRotationSchedule)
 	m.Get("/v1/space/:space/apps", app.Describespace)
 	m.Get("/v1/space/:space/app/:appname", app.DescribeappInSpace)
 	m.Get("/v1/space/:space/app/:appname/configvars", app.GetAllConfigVars)
@@ -317,6 +340,16 @@ func Server(db *sql.DB) *martini.ClassicMartini {
 	vault.GetVaultListPeriodic()
 	c := cron.New()
 	c.AddFunc("@every 10m", func() { go vault.GetVaultListPeriodic() })
+	c.AddFunc("@every 1m", func() { go router.PushPendingRouters(db) })
+	c.AddFunc("@every 10s", func() { go catalogOSBProvider.PollOperations() })
+	c.AddFunc("@every 1m", func() { go app.RotateScheduledBindings(db) })
+	certificateScanInterval := os.Getenv("CERTIFICATE_EXPIRY_SCAN_INTERVAL")
+	if certificateScanInterval == "" {
+		certificateScanInterval = "@every 1h"
+	}
+	if err := c.AddFunc(certificateScanInterval, func() { go router.CheckCertificateExpiry(db) }); err != nil {
+		log.Println("Invalid CERTIFICATE_EXPIRY_SCAN_INTERVAL " + certificateScanInterval + ", certificate expiry monitoring was disabled: " + err.Error())
+	}
 	c.Start()
 
 	// proxy to log shuttle
@@ -364,7 +397,14 @@ func Server(db *sql.DB) *martini.ClassicMartini {
 	}
 
 	if os.Getenv("ENABLE_AUTH") == "true" {
-		m.Use(auth.Basic(utils.AuthUser, utils.AuthPassword))
+		basicAuth := auth.Basic(utils.AuthUser, utils.AuthPassword)
+		m.Use(func(res http.ResponseWriter, req *http.Request, c martini.Context) {
+			// acme servers validating http-01 challenges cannot authenticate.
+			if strings.HasPrefix(req.URL.Path, "/.well-known/acme-challenge/") {
+				return
+			}
+			c.Invoke(basicAuth)
+		})
 	}
 
 	return m
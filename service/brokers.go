@@ -0,0 +1,406 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	structs "region-api/structs"
+	utils "region-api/utils"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/lib/pq"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+const (
+	BrokerStatusUnknown     = "unknown"
+	BrokerStatusAvailable   = "available"
+	BrokerStatusUnavailable = "unavailable"
+)
+
+var brokerNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,127}$`)
+
+type BrokerCredentials struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// An open service broker registered at runtime, the credentials are stored encrypted and never returned.
+type Broker struct {
+	Name          string     `json:"name"`
+	Url           string     `json:"url"`
+	Status        string     `json:"status"`
+	StatusMessage string     `json:"status_message,omitempty"`
+	Services      []string   `json:"services"`
+	Checked       *time.Time `json:"checked,omitempty"`
+	Created       *time.Time `json:"created,omitempty"`
+	credentials   string
+}
+
+type BrokerRequest struct {
+	Name     string `json:"name"`
+	Url      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// Separates the credentials from a broker url, credentials in the url are used the same way as the
+// SERVICES environment variable (user:pass@ for basic auth, :token@ for a bearer token).
+func SplitBrokerUrl(rawUrl string) (string, BrokerCredentials, error) {
+	credentials := BrokerCredentials{}
+	sUrl, err := url.Parse(rawUrl)
+	if err != nil || (sUrl.Scheme != "http" && sUrl.Scheme != "https") || sUrl.Host == "" {
+		return "", credentials, errors.New("The broker url must be an http or https url.")
+	}
+	if sUrl.User != nil {
+		pwd, _ := sUrl.User.Password()
+		if sUrl.User.Username() != "" {
+			credentials.Username = sUrl.User.Username()
+			credentials.Password = pwd
+		} else {
+			credentials.Token = pwd
+		}
+		sUrl.User = nil
+	}
+	return sUrl.String(), credentials, nil
+}
+
+func (credentials BrokerCredentials) AuthConfig() *osb.AuthConfig {
+	if credentials.Username != "" {
+		return &osb.AuthConfig{BasicAuthConfig: &osb.BasicAuthConfig{Username: credentials.Username, Password: credentials.Password}}
+	} else if credentials.Token != "" {
+		return &osb.AuthConfig{BearerConfig: &osb.BearerConfig{Token: credentials.Token}}
+	}
+	return nil
+}
+
+func encryptBrokerCredentials(credentials BrokerCredentials) (sql.NullString, error) {
+	if credentials.Username == "" && credentials.Token == "" {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(credentials)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	encrypted, err := utils.Encrypt(string(data))
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: encrypted, Valid: true}, nil
+}
+
+func decryptBrokerCredentials(encrypted string) (BrokerCredentials, error) {
+	var credentials BrokerCredentials
+	if encrypted == "" {
+		return credentials, nil
+	}
+	data, err := utils.Decrypt(encrypted)
+	if err != nil {
+		return credentials, err
+	}
+	err = json.Unmarshal([]byte(data), &credentials)
+	return credentials, err
+}
+
+func scanBroker(rows interface{ Scan(...interface{}) error }) (Broker, error) {
+	var broker Broker
+	var credentials, message sql.NullString
+	var checked *time.Time
+	var created time.Time
+	if err := rows.Scan(&broker.Name, &broker.Url, &credentials, &broker.Status, &message, &checked, &created); err != nil {
+		return broker, err
+	}
+	broker.credentials = credentials.String
+	broker.StatusMessage = message.String
+	broker.Checked = checked
+	broker.Created = &created
+	broker.Services = make([]string, 0)
+	return broker, nil
+}
+
+func GetBrokers(db *sql.DB) ([]Broker, error) {
+	rows, err := db.Query("select name, url, credentials, status, status_message, checked, created from brokers order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	brokers := make([]Broker, 0)
+	for rows.Next() {
+		broker, err := scanBroker(rows)
+		if err != nil {
+			return nil, err
+		}
+		brokers = append(brokers, broker)
+	}
+	return brokers, nil
+}
+
+func GetBroker(db *sql.DB, name string) (*Broker, error) {
+	broker, err := scanBroker(db.QueryRow("select name, url, credentials, status, status_message, checked, created from brokers where name=$1", name))
+	if err != nil {
+		return nil, err
+	}
+	return &broker, nil
+}
+
+func setBrokerStatus(db *sql.DB, name string, status string, message string) error {
+	_, err := db.Exec("update brokers set status=$2, status_message=$3, checked=now() where name=$1", name, status, message)
+	return err
+}
+
+// Records the services a broker offers so its instances can be found when the broker is unreachable.
+func setBrokerServices(db *sql.DB, name string, provider *providerInfo) error {
+	_, err := db.Exec("update brokers set service_ids=$2 where name=$1", name, pq.Array(providerServiceIds(provider)))
+	return err
+}
+
+func providerServiceIds(provider *providerInfo) []string {
+	ids := make([]string, 0)
+	for _, s := range provider.services {
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+func connectBroker(broker Broker) (*providerInfo, error) {
+	credentials, err := decryptBrokerCredentials(broker.credentials)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := newProvider(broker.Url, credentials.AuthConfig())
+	if err != nil {
+		return nil, err
+	}
+	provider.broker = broker.Name
+	return provider, nil
+}
+
+// Gets the catalog of a registered broker and records whether it was reachable.
+func (cserv *OSBClientServices) refreshBroker(broker Broker) (*providerInfo, error) {
+	provider, err := connectBroker(broker)
+	if err != nil {
+		if serr := setBrokerStatus(cserv.db, broker.Name, BrokerStatusUnavailable, err.Error()); serr != nil {
+			return nil, serr
+		}
+		return nil, err
+	}
+	if err = setBrokerStatus(cserv.db, broker.Name, BrokerStatusAvailable, ""); err != nil {
+		return nil, err
+	}
+	if err = setBrokerServices(cserv.db, broker.Name, provider); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// Replaces (or removes if provider is nil) a broker in the cached providers.
+func (cserv *OSBClientServices) cacheBroker(name string, provider *providerInfo) {
+	cserv.providersLock.Lock()
+	defer cserv.providersLock.Unlock()
+	if cserv.providersCache == nil {
+		return
+	}
+	providers := make([]providerInfo, 0)
+	for _, p := range cserv.providersCache {
+		if p.broker != name {
+			providers = append(providers, p)
+		}
+	}
+	if provider != nil {
+		providers = append(providers, *provider)
+	}
+	cserv.providersCache = providers
+}
+
+// Returns the names of the services a broker offers which are already offered by another broker.
+func conflictingServices(providers []providerInfo, provider *providerInfo) []string {
+	conflicts := make([]string, 0)
+	for _, p := range providers {
+		if p.broker != "" && p.broker == provider.broker {
+			continue
+		}
+		for _, existing := range p.services {
+			for _, s := range provider.services {
+				if s.ID == existing.ID || s.Name == existing.Name {
+					conflicts = append(conflicts, s.Name)
+				}
+			}
+		}
+	}
+	return conflicts
+}
+
+func (cserv *OSBClientServices) withServices(broker Broker) Broker {
+	for _, p := range cserv.cachedProviders() {
+		if p.broker == broker.Name {
+			for _, s := range p.services {
+				broker.Services = append(broker.Services, s.Name)
+			}
+		}
+	}
+	return broker
+}
+
+func (cserv *OSBClientServices) HttpGetBrokers(r render.Render) {
+	brokers, err := GetBrokers(cserv.db)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	for i, broker := range brokers {
+		brokers[i] = cserv.withServices(broker)
+	}
+	r.JSON(http.StatusOK, brokers)
+}
+
+func (cserv *OSBClientServices) HttpGetBroker(params martini.Params, r render.Render) {
+	broker, err := GetBroker(cserv.db, params["broker"])
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, cserv.withServices(*broker))
+}
+
+func (cserv *OSBClientServices) HttpCreateBroker(spec BrokerRequest, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	if !brokerNameRegex.MatchString(spec.Name) {
+		utils.ReportInvalidRequest("The broker name must be lowercase letters, numbers and dashes.", r)
+		return
+	}
+	brokerUrl, credentials, err := SplitBrokerUrl(spec.Url)
+	if err != nil {
+		utils.ReportInvalidRequest(err.Error(), r)
+		return
+	}
+	if spec.Username != "" || spec.Token != "" {
+		credentials = BrokerCredentials{Username: spec.Username, Password: spec.Password, Token: spec.Token}
+	}
+	if credentials.Username != "" && credentials.Token != "" {
+		utils.ReportInvalidRequest("Either a username and password or a token may be specified, not both.", r)
+		return
+	}
+	if _, err = GetBroker(cserv.db, spec.Name); err == nil {
+		r.JSON(http.StatusConflict, structs.Messagespec{Status: http.StatusConflict, Message: "The broker " + spec.Name + " already exists."})
+		return
+	} else if err != sql.ErrNoRows {
+		utils.ReportError(err, r)
+		return
+	}
+	encrypted, err := encryptBrokerCredentials(credentials)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	broker := Broker{Name: spec.Name, Url: brokerUrl, Status: BrokerStatusUnavailable, Services: make([]string, 0), credentials: encrypted.String}
+
+	// A broker that cannot be reached is still registered, its catalog is fetched once it's available.
+	provider, err := connectBroker(broker)
+	if err == nil {
+		providers, perr := cserv.GetProviders()
+		if perr != nil {
+			utils.ReportError(perr, r)
+			return
+		}
+		if conflicts := conflictingServices(providers, provider); len(conflicts) > 0 {
+			r.JSON(http.StatusConflict, structs.Messagespec{Status: http.StatusConflict, Message: "The broker offers services already offered by another broker: " + conflicts[0]})
+			return
+		}
+		broker.Status = BrokerStatusAvailable
+	} else {
+		broker.StatusMessage = err.Error()
+	}
+	serviceIds := make([]string, 0)
+	if provider != nil {
+		serviceIds = providerServiceIds(provider)
+	}
+	var created time.Time
+	if err = cserv.db.QueryRow("insert into brokers (name, url, credentials, status, status_message, checked, service_ids) values ($1, $2, $3, $4, $5, now(), $6) returning created",
+		broker.Name, broker.Url, encrypted, broker.Status, broker.StatusMessage, pq.Array(serviceIds)).Scan(&created); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	broker.Created = &created
+	broker.Checked = &created
+	if provider != nil {
+		cserv.cacheBroker(broker.Name, provider)
+	}
+	r.JSON(http.StatusCreated, cserv.withServices(broker))
+}
+
+func (cserv *OSBClientServices) HttpRefreshBroker(params martini.Params, r render.Render) {
+	broker, err := GetBroker(cserv.db, params["broker"])
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if cserv.cachedProviders() == nil {
+		// Loading the providers refreshes every registered broker, including this one.
+		if _, err = cserv.GetProviders(); err != nil {
+			utils.ReportError(err, r)
+			return
+		}
+	} else if provider, err := cserv.refreshBroker(*broker); err != nil {
+		cserv.cacheBroker(broker.Name, nil)
+	} else {
+		cserv.cacheBroker(broker.Name, provider)
+	}
+	if broker, err = GetBroker(cserv.db, params["broker"]); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, cserv.withServices(*broker))
+}
+
+func (cserv *OSBClientServices) HttpDeleteBroker(params martini.Params, r render.Render) {
+	broker, err := GetBroker(cserv.db, params["broker"])
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	// The cache may be empty or missing the broker while it's unreachable, so the service ids
+	// recorded the last time its catalog was fetched are checked as well.
+	serviceIds := make([]string, 0)
+	for _, p := range cserv.cachedProviders() {
+		if p.broker == broker.Name {
+			serviceIds = append(serviceIds, providerServiceIds(&p)...)
+		}
+	}
+	var count int
+	if err = cserv.db.QueryRow("select count(*) from service_instances where service_id = any($2) or service_id in (select unnest(service_ids) from brokers where name=$1)",
+		broker.Name, pq.Array(serviceIds)).Scan(&count); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if count > 0 {
+		r.JSON(http.StatusConflict, structs.Messagespec{Status: http.StatusConflict, Message: "The broker " + broker.Name + " cannot be removed while it has " + strconv.Itoa(count) + " instances."})
+		return
+	}
+	if _, err = cserv.db.Exec("delete from brokers where name=$1", broker.Name); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	cserv.cacheBroker(broker.Name, nil)
+	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: "Broker " + broker.Name + " removed"})
+}
@@ -14,15 +14,7 @@ func GetServiceConfigVars(db *sql.DB, appname string, space string, appbindings
 		servicename := element.Bindname
 		servicevars := []structs.EnvVar{}
 
-		if servicetype == "rabbitmq" {
-			err, vars := Getrabbitmqvars(servicename)
-			if err != nil {
-				return err, elist
-			}
-			for key, value := range vars {
-				servicevars = append(servicevars, structs.EnvVar{Name: key, Value: value.(string)})
-			}
-		} else if servicetype == "kafka" {
+		if servicetype == "kafka" {
 			err, vars := Getkafkavars(db, appname, space)
 			if err != nil {
 				return err, elist
@@ -36,8 +28,8 @@ func GetServiceConfigVars(db *sql.DB, appname string, space string, appbindings
 			for _, value := range vars {
 				servicevars = append(servicevars, structs.EnvVar{Name: value.Key, Value: value.Value})
 			}
-		} else if servicetype == "influxdb" {
-			vars, err := GetInfluxdbVars(servicename)
+		} else if servicetype == "rabbitmq" || servicetype == "influxdb" {
+			vars, err := legacyBindingCredentials(db, appname, space, servicetype, servicename)
 			if err != nil {
 				return err, elist
 			}
@@ -47,7 +39,7 @@ func GetServiceConfigVars(db *sql.DB, appname string, space string, appbindings
 			// if nothing else matches see if we match an
 			// open service broker that dynamically registered.
 		} else if IsOSBService(servicetype) {
-			vars, err := GetOSBBindingCredentials(servicetype, servicename, appname+"-"+space)
+			vars, err := GetOSBBindingCredentials(servicetype, servicename, osbBindingId(db, appname, space, servicename))
 			if err != nil {
 				return err, elist
 			}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	structs "region-api/structs"
+	"strings"
+	"time"
+
+	uuid "github.com/nu7hatch/gouuid"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+var ErrRotationNotSupported = errors.New("The credentials of this service cannot be rotated.")
+var ErrRotationShared = errors.New("The credentials of this instance are shared with other apps, they cannot be rotated for one app.")
+
+// New credentials issued for an app's binding. Open service broker bindings are rotated by creating a second
+// binding, the old binding stays usable until Finish removes it (or Abandon removes the new one). The kafka,
+// rabbitmq and influxdb brokers replace the credentials in place and retire the old credentials themselves.
+type CredentialRotation struct {
+	bind         structs.Bindspec
+	serviceId    string
+	planId       string
+	oldBindingId string
+	newBindingId string
+	inPlace      bool
+}
+
+// The binding id used for an app's binding to an open service broker instance, bindings that were never
+// rotated use the app and space name.
+func osbBindingId(db *sql.DB, appname string, space string, instanceId string) string {
+	var bindingId string
+	if err := db.QueryRow("select coalesce(binding_id, appname || '-' || space) from appbindings where appname=$1 and space=$2 and bindname=$3", appname, space, instanceId).Scan(&bindingId); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("WARNING: Unable to get the binding id of %s-%s to %s: %s\n", appname, space, instanceId, err.Error())
+		}
+		return appname + "-" + space
+	}
+	return bindingId
+}
+
+// The kafka, rabbitmq and influxdb brokers give every binding of an instance the same credentials, a second
+// binding can't be rolled out alongside the old one so the broker replaces the instance's credentials instead.
+func rotatesInPlace(bindtype string) bool {
+	return bindtype == "kafka" || bindtype == "rabbitmq" || bindtype == "influxdb"
+}
+
+func CanRotateCredentials(bindtype string) bool {
+	return rotatesInPlace(bindtype) || IsOSBService(bindtype)
+}
+
+func StartCredentialRotation(db *sql.DB, bind structs.Bindspec) (*CredentialRotation, error) {
+	if !CanRotateCredentials(bind.Bindtype) {
+		return nil, ErrRotationNotSupported
+	}
+	rotation := &CredentialRotation{bind: bind}
+	if rotatesInPlace(bind.Bindtype) {
+		if err := rotateInPlace(db, bind); err != nil {
+			return nil, err
+		}
+		rotation.inPlace = true
+		return rotation, nil
+	}
+	if err := globalClientService.startBindingRotation(rotation); err != nil {
+		return nil, err
+	}
+	return rotation, nil
+}
+
+// Whether the app can be returned to its old credentials, credentials replaced in place by the broker are gone.
+func (rotation *CredentialRotation) Reversible() bool {
+	return !rotation.inPlace
+}
+
+// Credentials replaced in place would break the other apps bound to the instance, so the instance must only
+// be bound to the app being rotated.
+func rotateInPlace(db *sql.DB, bind structs.Bindspec) error {
+	var others int
+	if err := db.QueryRow("select count(*) from appbindings where bindtype=$1 and bindname=$2 and not (appname=$3 and space=$4)",
+		bind.Bindtype, bind.Bindname, bind.App, bind.Space).Scan(&others); err != nil {
+		return err
+	}
+	if others > 0 {
+		return ErrRotationShared
+	}
+	if bind.Bindtype == "kafka" {
+		_, err := kafkaBrokerRequest("POST", "/v1/kafka/credentials/"+bind.Bindname+"/rotate", nil, nil)
+		return err
+	}
+	broker := newLegacyBroker(bind.Bindtype, db)
+	name, err := broker.instanceName(bind.Bindname)
+	if err != nil {
+		return err
+	}
+	if _, err = broker.rotateCredentials(name); err != nil {
+		return err
+	}
+	// the credentials are read through the binding cache, which would otherwise still hold the old ones.
+	removeCachedBindingCredentials(db, bind.Bindname, "")
+	return nil
+}
+
+// Removes the old binding once the app uses the new credentials.
+func (rotation *CredentialRotation) Finish() error {
+	if rotation.newBindingId == "" {
+		return nil
+	}
+	_, err := globalClientService.RemoveBinding(rotation.oldBindingId, rotation.bind.Bindname, rotation.serviceId, rotation.planId)
+	return err
+}
+
+// Returns the app to its old binding and removes the new one.
+func (rotation *CredentialRotation) Abandon() error {
+	if rotation.newBindingId == "" {
+		return nil
+	}
+	if err := globalClientService.setAppBindingId(rotation.bind, rotation.oldBindingId); err != nil {
+		return err
+	}
+	_, err := globalClientService.RemoveBinding(rotation.newBindingId, rotation.bind.Bindname, rotation.serviceId, rotation.planId)
+	return err
+}
+
+func (cserv *OSBClientServices) setAppBindingId(bind structs.Bindspec, bindingId string) error {
+	_, err := cserv.db.Exec("update appbindings set binding_id=$5 where appname=$1 and space=$2 and bindtype=$3 and bindname=$4",
+		bind.App, bind.Space, bind.Bindtype, bind.Bindname, sql.NullString{String: bindingId, Valid: bindingId != bind.App+"-"+bind.Space})
+	return err
+}
+
+// Waits for an asynchronous binding to be completed by the operation poller.
+func (cserv *OSBClientServices) waitForBinding(instanceId string, bindingId string) error {
+	deadline := time.Now().Add(osbOperationTimeout())
+	for time.Now().Before(deadline) {
+		var status string
+		var description sql.NullString
+		if err := cserv.db.QueryRow("select status, status_description from service_bindings where instance_id=$1 and binding_id=$2", instanceId, bindingId).Scan(&status, &description); err != nil {
+			return err
+		}
+		if status == string(osb.StateSucceeded) {
+			return nil
+		} else if status == string(osb.StateFailed) {
+			return errors.New("The new binding failed: " + description.String)
+		}
+		time.Sleep(minOperationPollInterval)
+	}
+	return errors.New("Timed out waiting for the new binding.")
+}
+
+func (cserv *OSBClientServices) startBindingRotation(rotation *CredentialRotation) error {
+	bind := rotation.bind
+	serviceId, planId, _, status, err := cserv.GetInstanceInfoByID(bind.Bindname)
+	if err != nil {
+		return err
+	}
+	if status != string(osb.StateSucceeded) {
+		return errors.New("The service instance is not ready, its status is " + status)
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	rotation.serviceId = serviceId
+	rotation.planId = planId
+	rotation.oldBindingId = osbBindingId(cserv.db, bind.App, bind.Space, bind.Bindname)
+	newBindingId := bind.App + "-" + bind.Space + "-" + strings.Split(id.String(), "-")[0]
+
+	context := map[string]interface{}{"platform": "akkeris", "space": bind.Space, "app": bind.App}
+	role, err := authorizeBrokerBinding(cserv.db, bind.Bindname, rotation.oldBindingId, context)
+	if err != nil {
+		return err
+	}
+	if role != "" {
+		context["role"] = role
+	}
+	resp, err := cserv.CreateBinding(newBindingId, bind.Bindname, serviceId, planId, nil, nil, context)
+	if err != nil {
+		return err
+	}
+	rotation.newBindingId = newBindingId
+	if resp.Async {
+		err = cserv.waitForBinding(bind.Bindname, newBindingId)
+	}
+	if err == nil {
+		_, err = cserv.fetchBindingCredentials(serviceId, bind.Bindname, newBindingId)
+	}
+	if err == nil {
+		err = cserv.setAppBindingId(bind, newBindingId)
+	}
+	if err != nil {
+		if _, rerr := cserv.RemoveBinding(newBindingId, bind.Bindname, serviceId, planId); rerr != nil {
+			log.Printf("WARNING: Unable to remove the binding %s after a failed rotation: %s\n", newBindingId, rerr.Error())
+		}
+		rotation.newBindingId = ""
+		return err
+	}
+	return nil
+}
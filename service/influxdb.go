@@ -1,165 +1,75 @@
 package service
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"github.com/bitly/go-simplejson"
+	"database/sql"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/render"
-	"io/ioutil"
-	"net/http"
-	"os"
+	"log"
 	structs "region-api/structs"
 	utils "region-api/utils"
 )
 
 func GetInfluxdbPlans(params martini.Params, r render.Render) {
 	var plans []structs.Planspec
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "http://"+os.Getenv("INFLUXDB_BROKER_URL")+"/v1/influxdb/plans", nil)
-	resp, err := client.Do(req)
+	sizes, err := newLegacyBroker("influxdb", nil).plans()
 	if err != nil {
-		utils.ReportError(err, r)
+		ProcessErrors(err, r)
 		return
 	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode > 299 || resp.StatusCode < 200 {
-		utils.ReportError(errors.New(resp.Status), r)
-		return
-	}
-
-	bodyj, _ := simplejson.NewFromReader(resp.Body)
-
-	bodymap, maperr := bodyj.Map()
-	if maperr != nil {
-		utils.ReportError(maperr, r)
-		return
-	}
-	for k, v := range bodymap {
+	for k, v := range sizes {
 		var plan structs.Planspec
 		plan.Size = k
-		plan.Description = v.(string)
+		plan.Description = v
 		plans = append(plans, plan)
 	}
 	r.JSON(200, plans)
 }
 
-func GetInfluxdbURL(params martini.Params, r render.Render) {
-	servicename := params["servicename"]
+func influxdbFrom(credentials map[string]interface{}) structs.Influxdbspec {
 	var influxdb structs.Influxdbspec
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "http://"+os.Getenv("INFLUXDB_BROKER_URL")+"/v1/influxdb/url/"+servicename, nil)
-	resp, err := client.Do(req)
-	if err != nil {
-		utils.ReportError(err, r)
-		return
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode > 299 || resp.StatusCode < 200 {
-		utils.ReportError(errors.New(resp.Status), r)
-		return
-	}
-	bodybytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		utils.ReportError(err, r)
-		return
-	}
+	influxdb.Name, _ = credentials["INFLUX_DB"].(string)
+	influxdb.Url, _ = credentials["INFLUX_URL"].(string)
+	influxdb.Username, _ = credentials["INFLUX_USERNAME"].(string)
+	influxdb.Password, _ = credentials["INFLUX_PASSWORD"].(string)
+	influxdb.Spec = "influxdb:" + influxdb.Name
+	return influxdb
+}
 
-	err = json.Unmarshal(bodybytes, &influxdb)
+func GetInfluxdbURL(params martini.Params, r render.Render) {
+	credentials, err := newLegacyBroker("influxdb", nil).credentials(params["servicename"])
 	if err != nil {
-		utils.ReportError(err, r)
+		ProcessErrors(err, r)
 		return
 	}
-	influxdb.Spec = "influxdb:" + influxdb.Name
-	r.JSON(200, influxdb)
+	r.JSON(200, influxdbFrom(credentials))
 }
 
-func ProvisionInfluxdb(spec structs.Provisionspec, berr binding.Errors, r render.Render) {
+func ProvisionInfluxdb(db *sql.DB, spec structs.Provisionspec, berr binding.Errors, r render.Render) {
 	if berr != nil {
 		utils.ReportInvalidRequest(berr[0].Message, r)
 		return
 	}
-	client := &http.Client{}
-	str, err := json.Marshal(spec)
+	credentials, err := newLegacyBroker("influxdb", nil).provision(spec)
 	if err != nil {
-		utils.ReportError(err, r)
+		ProcessErrors(err, r)
 		return
 	}
-	jsonStr := []byte(string(str))
-	req, err := http.NewRequest("POST", "http://"+os.Getenv("INFLUXDB_BROKER_URL")+"/v1/influxdb/instance", bytes.NewBuffer(jsonStr))
-	resp, err := client.Do(req)
-	if err != nil {
-		utils.ReportError(err, r)
-		return
+	influxdb := influxdbFrom(credentials)
+	if err = recordLegacyInstance(db, influxdb.Name, "influxdb", influxdb.Name, spec); err != nil {
+		log.Printf("WARNING: Unable to record the influxdb instance %s: %s\n", influxdb.Name, err.Error())
 	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode > 299 || resp.StatusCode < 200 {
-		utils.ReportError(errors.New(resp.Status), r)
-		return
-	}
-
-	var influxdb structs.Influxdbspec
-	bodybytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		utils.ReportError(err, r)
-		return
-	}
-
-	err = json.Unmarshal(bodybytes, &influxdb)
-	if err != nil {
-		utils.ReportError(err, r)
-		return
-	}
-	influxdb.Spec = "influxdb:" + influxdb.Name
 	r.JSON(201, influxdb)
 }
 
-func DeleteInfluxdb(params martini.Params, r render.Render) {
-	servicename := params["servicename"]
-	client := &http.Client{}
-	req, err := http.NewRequest("DELETE", "http://"+os.Getenv("INFLUXDB_BROKER_URL")+"/v1/influxdb/instance/"+servicename, nil)
-	resp, err := client.Do(req)
+func DeleteInfluxdb(db *sql.DB, params martini.Params, r render.Render) {
+	result, err := newLegacyBroker("influxdb", nil).deprovision(params["servicename"])
 	if err != nil {
-		utils.ReportError(err, r)
+		ProcessErrors(err, r)
 		return
 	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode > 299 || resp.StatusCode < 200 {
-		utils.ReportError(errors.New(resp.Status), r)
-		return
-	}
-
-	bodyj, _ := simplejson.NewFromReader(resp.Body)
-	r.JSON(200, bodyj)
-}
-
-func GetInfluxdbVars(servicename string) (map[string]interface{}, error) {
-	config := make(map[string]interface{})
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "http://"+os.Getenv("INFLUXDB_BROKER_URL")+"/v1/influxdb/url/"+servicename, nil)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println(err)
+	if err = removeLegacyInstance(db, params["servicename"], "influxdb"); err != nil {
+		log.Printf("WARNING: Unable to remove the influxdb instance %s: %s\n", params["servicename"], err.Error())
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode > 299 || resp.StatusCode < 200 {
-		return nil, errors.New(resp.Status)
-	}
-
-	bodyj, _ := simplejson.NewFromReader(resp.Body)
-	config, _ = bodyj.Map()
-	return config, nil
+	r.JSON(200, result)
 }
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"io"
+	"log"
+	"net/http"
+	utils "region-api/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/martini-contrib/render"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+type InstanceUsageApp struct {
+	App   string `json:"app"`
+	Space string `json:"space"`
+	Role  string `json:"role,omitempty"`
+}
+
+// A service instance with what it costs, who pays for it and which apps use it. Instances created before the
+// inventory was recorded are only known through their bindings, their plan, billing code and state are empty.
+type InstanceUsage struct {
+	Service     string             `json:"service"`
+	InstanceId  string             `json:"instance_id"`
+	Plan        string             `json:"plan"`
+	Price       *float64           `json:"price"`
+	PriceUnit   string             `json:"price_unit,omitempty"`
+	BillingCode string             `json:"billing_code"`
+	State       string             `json:"state"`
+	Owner       *InstanceOwner     `json:"owner"`
+	Apps        []InstanceUsageApp `json:"apps"`
+	Created     *time.Time         `json:"created,omitempty"`
+}
+
+// Services whose instances are only tracked through the apps bound to them.
+var boundOnlyServices = []string{"kafka", "rabbitmq", "influxdb", "vault"}
+
+// The price of a plan from its catalog metadata, brokers describe it as costs: [{amount: {usd: 10}, unit: "MONTHLY"}].
+func planPrice(plan *osb.Plan) (*float64, string) {
+	if plan == nil || plan.Metadata == nil {
+		return nil, ""
+	}
+	costs, _ := plan.Metadata["costs"].([]interface{})
+	if len(costs) == 0 {
+		return nil, ""
+	}
+	cost, _ := costs[0].(map[string]interface{})
+	amount, _ := cost["amount"].(map[string]interface{})
+	usd, ok := amount["usd"].(float64)
+	if !ok {
+		return nil, ""
+	}
+	unit, _ := cost["unit"].(string)
+	return &usd, unit
+}
+
+// The apps bound to each instance, by the instance id (or name) they're bound with.
+func boundApps(db *sql.DB) (map[string][]InstanceUsageApp, map[string]string, error) {
+	rows, err := db.Query("select appname, space, bindtype, bindname, role from appbindings order by bindname, space, appname")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	apps := make(map[string][]InstanceUsageApp)
+	bindtypes := make(map[string]string)
+	for rows.Next() {
+		var app InstanceUsageApp
+		var bindtype, bindname string
+		var role sql.NullString
+		if err := rows.Scan(&app.App, &app.Space, &bindtype, &bindname, &role); err != nil {
+			return nil, nil, err
+		}
+		app.Role = role.String
+		apps[bindname] = append(apps[bindname], app)
+		bindtypes[bindname] = bindtype
+	}
+	return apps, bindtypes, rows.Err()
+}
+
+func (cserv *OSBClientServices) GetServiceInstanceUsage() ([]InstanceUsage, error) {
+	apps, bindtypes, err := boundApps(cserv.db)
+	if err != nil {
+		return nil, err
+	}
+	usage := make([]InstanceUsage, 0)
+	listed := make(map[string]bool)
+
+	rows, err := cserv.db.Query(`select instance_id, service_id, plan_id, status, billing_code, owner_space, owner_app, created from service_instances`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var serviceId, planId string
+		var billingCode, ownerSpace, ownerApp sql.NullString
+		var created *time.Time
+		instance := InstanceUsage{}
+		if err := rows.Scan(&instance.InstanceId, &serviceId, &planId, &instance.State, &billingCode, &ownerSpace, &ownerApp, &created); err != nil {
+			return nil, err
+		}
+		instance.Service = serviceId
+		instance.Plan = planId
+		if service, err := cserv.GetServiceByID(serviceId); err == nil {
+			instance.Service = service.Name
+		} else {
+			log.Printf("WARNING: Unable to find the service %s of instance %s: %s\n", serviceId, instance.InstanceId, err.Error())
+		}
+		if plan, err := cserv.GetPlanByID(serviceId, planId); err == nil {
+			instance.Plan = plan.Name
+			instance.Price, instance.PriceUnit = planPrice(plan)
+		}
+		instance.BillingCode = billingCode.String
+		if ownerSpace.Valid {
+			instance.Owner = &InstanceOwner{Space: ownerSpace.String, App: ownerApp.String}
+		}
+		instance.Created = created
+		usage = append(usage, instance)
+		listed[instance.InstanceId] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	legacy, err := cserv.db.Query(`select instance_id, service, plan, billing_code, created from legacy_service_instances`)
+	if err != nil {
+		return nil, err
+	}
+	defer legacy.Close()
+	for legacy.Next() {
+		var plan, billingCode sql.NullString
+		var created *time.Time
+		instance := InstanceUsage{State: string(osb.StateSucceeded)}
+		if err := legacy.Scan(&instance.InstanceId, &instance.Service, &plan, &billingCode, &created); err != nil {
+			return nil, err
+		}
+		// instances provisioned through the open service broker api are already listed.
+		if listed[instance.InstanceId] {
+			continue
+		}
+		instance.Plan = plan.String
+		instance.BillingCode = billingCode.String
+		instance.Created = created
+		usage = append(usage, instance)
+		listed[instance.InstanceId] = true
+	}
+	if err := legacy.Err(); err != nil {
+		return nil, err
+	}
+
+	for bindname, bindtype := range bindtypes {
+		if listed[bindname] || !boundOnlyService(bindtype) {
+			continue
+		}
+		usage = append(usage, InstanceUsage{Service: bindtype, InstanceId: bindname})
+		listed[bindname] = true
+	}
+
+	for i := range usage {
+		usage[i].Apps = apps[usage[i].InstanceId]
+		if usage[i].Apps == nil {
+			usage[i].Apps = []InstanceUsageApp{}
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Service != usage[j].Service {
+			return usage[i].Service < usage[j].Service
+		}
+		return usage[i].InstanceId < usage[j].InstanceId
+	})
+	return usage, nil
+}
+
+func boundOnlyService(bindtype string) bool {
+	for _, service := range boundOnlyServices {
+		if service == bindtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Instances owned by the space or bound to an app in it.
+func filterUsageBySpace(usage []InstanceUsage, space string) []InstanceUsage {
+	filtered := make([]InstanceUsage, 0)
+	for _, instance := range usage {
+		if instance.Owner != nil && instance.Owner.Space == space {
+			filtered = append(filtered, instance)
+			continue
+		}
+		for _, app := range instance.Apps {
+			if app.Space == space {
+				filtered = append(filtered, instance)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+func writeUsageCSV(w io.Writer, usage []InstanceUsage) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"service", "instance_id", "plan", "price", "price_unit", "billing_code", "state", "owner_space", "owner_app", "apps", "created"}); err != nil {
+		return err
+	}
+	for _, instance := range usage {
+		var price, ownerSpace, ownerApp, created string
+		if instance.Price != nil {
+			price = strconv.FormatFloat(*instance.Price, 'f', -1, 64)
+		}
+		if instance.Owner != nil {
+			ownerSpace = instance.Owner.Space
+			ownerApp = instance.Owner.App
+		}
+		if instance.Created != nil {
+			created = instance.Created.UTC().Format(time.RFC3339)
+		}
+		apps := make([]string, 0)
+		for _, app := range instance.Apps {
+			apps = append(apps, app.App+"-"+app.Space)
+		}
+		if err := writer.Write([]string{instance.Service, instance.InstanceId, instance.Plan, price, instance.PriceUnit, instance.BillingCode,
+			instance.State, ownerSpace, ownerApp, strings.Join(apps, " "), created}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func wantsCSV(req *http.Request) bool {
+	return req.URL.Query().Get("format") == "csv" || strings.Contains(req.Header.Get("Accept"), "text/csv")
+}
+
+func (cserv *OSBClientServices) HttpGetServiceInstances(req *http.Request, r render.Render) {
+	usage, err := cserv.GetServiceInstanceUsage()
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if space := req.URL.Query().Get("space"); space != "" {
+		usage = filterUsageBySpace(usage, space)
+	}
+	if !wantsCSV(req) {
+		r.JSON(http.StatusOK, usage)
+		return
+	}
+	var data bytes.Buffer
+	if err := writeUsageCSV(&data, usage); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.Header().Set("Content-Type", "text/csv")
+	r.Data(http.StatusOK, data.Bytes())
+}
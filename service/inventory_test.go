@@ -0,0 +1,67 @@
+package service
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServiceInventory(t *testing.T) {
+	Convey("Test reporting the usage of service instances", t, func() {
+		Convey("The price should come from the plan's cost metadata", func() {
+			plan := &osb.Plan{Metadata: map[string]interface{}{
+				"costs": []interface{}{map[string]interface{}{"amount": map[string]interface{}{"usd": 12.5}, "unit": "MONTHLY"}},
+			}}
+			price, unit := planPrice(plan)
+			So(price, ShouldNotBeNil)
+			So(*price, ShouldEqual, 12.5)
+			So(unit, ShouldEqual, "MONTHLY")
+			price, unit = planPrice(&osb.Plan{Metadata: map[string]interface{}{"costs": []interface{}{}}})
+			So(price, ShouldBeNil)
+			So(unit, ShouldEqual, "")
+			price, _ = planPrice(&osb.Plan{})
+			So(price, ShouldBeNil)
+			price, _ = planPrice(nil)
+			So(price, ShouldBeNil)
+		})
+
+		usage := []InstanceUsage{
+			{Service: "postgresql", InstanceId: "abc", Plan: "standard-0", BillingCode: "eng", State: "succeeded", Owner: &InstanceOwner{Space: "default", App: "api"}},
+			{Service: "kafka", InstanceId: "user1", Apps: []InstanceUsageApp{{App: "worker", Space: "prod"}, {App: "web", Space: "prod"}}},
+			{Service: "vault", InstanceId: "secret/path", Apps: []InstanceUsageApp{{App: "api", Space: "default"}}},
+		}
+
+		Convey("Instances should be filtered by their owner or the apps bound to them", func() {
+			filtered := filterUsageBySpace(usage, "default")
+			So(len(filtered), ShouldEqual, 2)
+			So(filtered[0].InstanceId, ShouldEqual, "abc")
+			So(filtered[1].InstanceId, ShouldEqual, "secret/path")
+			So(len(filterUsageBySpace(usage, "prod")), ShouldEqual, 1)
+			So(filterUsageBySpace(usage, "none"), ShouldBeEmpty)
+		})
+
+		Convey("Instances should be exported as csv", func() {
+			price := 20.0
+			usage[0].Price = &price
+			usage[0].PriceUnit = "MONTHLY"
+			var data bytes.Buffer
+			So(writeUsageCSV(&data, usage), ShouldBeNil)
+			So(data.String(), ShouldEqual, "service,instance_id,plan,price,price_unit,billing_code,state,owner_space,owner_app,apps,created\n"+
+				"postgresql,abc,standard-0,20,MONTHLY,eng,succeeded,default,api,,\n"+
+				"kafka,user1,,,,,,,,worker-prod web-prod,\n"+
+				"vault,secret/path,,,,,,,,api-default,\n")
+		})
+
+		Convey("Csv should be requested through the format or the accept header", func() {
+			req, _ := http.NewRequest("GET", "/v1/services/instances?format=csv", nil)
+			So(wantsCSV(req), ShouldBeTrue)
+			req, _ = http.NewRequest("GET", "/v1/services/instances", nil)
+			So(wantsCSV(req), ShouldBeFalse)
+			req.Header.Set("Accept", "text/csv")
+			So(wantsCSV(req), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,327 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	structs "region-api/structs"
+	utils "region-api/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/lib/pq"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+const (
+	defaultKafkaMaxPartitions  = 256
+	defaultKafkaMaxRetentionMs = 30 * 24 * 60 * 60 * 1000
+)
+
+var ErrPartitionsDecreased = errors.New("The partitions of a topic can only be increased.")
+var ErrPartitionsUnknown = errors.New("The current partitions of the topic could not be read, they cannot be changed.")
+
+// Changes are recorded as pending before they're sent to the broker, so a change is never made without a record.
+const (
+	TopicChangePending = "pending"
+	TopicChangeApplied = "applied"
+	TopicChangeFailed  = "failed"
+)
+
+// The topic configs that may be changed and the smallest value each allows, cleanup.policy is validated separately.
+var kafkaTopicConfigMinimums = map[string]int64{
+	"retention.ms":          1,
+	"retention.bytes":       -1,
+	"segment.ms":            1,
+	"segment.bytes":         1,
+	"delete.retention.ms":   0,
+	"min.compaction.lag.ms": 0,
+	"max.message.bytes":     1,
+}
+
+var kafkaCleanupPolicies = []string{"delete", "compact", "compact,delete", "delete,compact"}
+
+type KafkaTopicChange struct {
+	Id       string     `json:"id"`
+	Cluster  string     `json:"cluster"`
+	Topic    string     `json:"topic"`
+	Setting  string     `json:"setting"`
+	OldValue string     `json:"old_value"`
+	NewValue string     `json:"new_value"`
+	Status   string     `json:"status,omitempty"`
+	Created  *time.Time `json:"created,omitempty"`
+}
+
+type kafkaTopicLimits struct {
+	maxPartitions  int64
+	maxRetentionMs int64
+}
+
+type kafkaTopicResponse struct {
+	Topic struct {
+		Name   string                 `json:"name"`
+		Config map[string]interface{} `json:"config"`
+	} `json:"topic"`
+}
+
+func kafkaLimit(cluster string, name string, fallback int64) int64 {
+	for _, key := range []string{"KAFKA_" + strings.ToUpper(strings.Replace(cluster, "-", "_", -1)) + "_" + name, "KAFKA_" + name} {
+		if val := os.Getenv(key); val != "" {
+			limit, err := strconv.ParseInt(val, 10, 64)
+			if err == nil && limit > 0 {
+				return limit
+			}
+			log.Printf("WARNING: Invalid kafka limit %s=%s, it will be ignored.\n", key, val)
+		}
+	}
+	return fallback
+}
+
+type kafkaClusterConfigsResponse struct {
+	Configs []struct {
+		Name   string                 `json:"name"`
+		Config map[string]interface{} `json:"config"`
+	} `json:"configs"`
+}
+
+// Returns the largest value of a setting across the cluster's topic configurations, or zero if none set it.
+func (configs kafkaClusterConfigsResponse) largest(name string) int64 {
+	var largest int64
+	for _, config := range configs.Configs {
+		value, err := strconv.ParseInt(topicConfigValue(config.Config[name]), 10, 64)
+		if err == nil && value > largest {
+			largest = value
+		}
+	}
+	return largest
+}
+
+// Limits are the most partitions and longest retention.ms of the topic configurations on the cluster. If the broker
+// can't return them, they are set for all clusters with KAFKA_MAX_PARTITIONS and KAFKA_MAX_RETENTION_MS, or for one
+// cluster by adding its name, e.g. KAFKA_MAESTRO_MAX_PARTITIONS.
+func kafkaTopicLimitsFor(cluster string) kafkaTopicLimits {
+	var configs kafkaClusterConfigsResponse
+	if _, err := kafkaBrokerRequest("GET", "/v1/kafka/cluster/"+cluster+"/configs", nil, &configs); err != nil {
+		log.Printf("WARNING: Unable to get the configs of the kafka cluster %s, using the configured limits: %s\n", cluster, err.Error())
+		return kafkaTopicLimits{
+			maxPartitions:  kafkaLimit(cluster, "MAX_PARTITIONS", defaultKafkaMaxPartitions),
+			maxRetentionMs: kafkaLimit(cluster, "MAX_RETENTION_MS", defaultKafkaMaxRetentionMs),
+		}
+	}
+	limits := kafkaTopicLimits{maxPartitions: configs.largest("partitions"), maxRetentionMs: configs.largest("retention.ms")}
+	if limits.maxPartitions == 0 {
+		limits.maxPartitions = kafkaLimit(cluster, "MAX_PARTITIONS", defaultKafkaMaxPartitions)
+	}
+	if limits.maxRetentionMs == 0 {
+		limits.maxRetentionMs = kafkaLimit(cluster, "MAX_RETENTION_MS", defaultKafkaMaxRetentionMs)
+	}
+	return limits
+}
+
+func topicSettings(spec structs.KafkaTopicUpdate) map[string]string {
+	settings := make(map[string]string)
+	for name, value := range spec.Configs {
+		settings[name] = strings.TrimSpace(value)
+	}
+	if spec.Partitions != nil {
+		settings["partitions"] = strconv.Itoa(*spec.Partitions)
+	}
+	if spec.Retentionms != nil {
+		settings["retention.ms"] = strconv.Itoa(*spec.Retentionms)
+	}
+	if spec.Cleanuppolicy != "" {
+		settings["cleanup.policy"] = spec.Cleanuppolicy
+	}
+	return settings
+}
+
+func topicConfigValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func validateTopicSetting(name string, value string, current string, limits kafkaTopicLimits) error {
+	if name == "cleanup.policy" {
+		for _, policy := range kafkaCleanupPolicies {
+			if value == policy {
+				return nil
+			}
+		}
+		return errors.New("The cleanup.policy must be one of " + strings.Join(kafkaCleanupPolicies, ", ") + ".")
+	}
+	min, allowed := kafkaTopicConfigMinimums[name]
+	if name == "partitions" {
+		min, allowed = 1, true
+	}
+	if !allowed {
+		return errors.New("The topic config " + name + " cannot be changed.")
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < min {
+		return fmt.Errorf("The topic config %s must be a number of at least %d.", name, min)
+	}
+	if name == "partitions" {
+		previous, err := strconv.ParseInt(current, 10, 64)
+		if err != nil {
+			return ErrPartitionsUnknown
+		}
+		if number < previous {
+			return ErrPartitionsDecreased
+		}
+		if number > limits.maxPartitions {
+			return fmt.Errorf("The cluster allows at most %d partitions per topic.", limits.maxPartitions)
+		}
+	}
+	if name == "retention.ms" && number > limits.maxRetentionMs {
+		return fmt.Errorf("The cluster allows a retention.ms of at most %d.", limits.maxRetentionMs)
+	}
+	return nil
+}
+
+// The settings that differ from the topic's current config, sorted by name.
+func topicChanges(cluster string, topic string, settings map[string]string, current map[string]string, limits kafkaTopicLimits) ([]KafkaTopicChange, error) {
+	names := make([]string, 0)
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	changes := make([]KafkaTopicChange, 0)
+	for _, name := range names {
+		if err := validateTopicSetting(name, settings[name], current[name], limits); err != nil {
+			return nil, err
+		}
+		if settings[name] == current[name] {
+			continue
+		}
+		changes = append(changes, KafkaTopicChange{Cluster: cluster, Topic: topic, Setting: name, OldValue: current[name], NewValue: settings[name]})
+	}
+	return changes, nil
+}
+
+func recordTopicChanges(db *sql.DB, changes []KafkaTopicChange) error {
+	for i, change := range changes {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		changes[i].Id = id.String()
+		changes[i].Status = TopicChangePending
+		if _, err = db.Exec("insert into kafka_topic_changes (change_id, cluster, topic, setting, old_value, new_value, status) values ($1, $2, $3, $4, $5, $6, $7)",
+			changes[i].Id, change.Cluster, change.Topic, change.Setting, sql.NullString{String: change.OldValue, Valid: change.OldValue != ""}, change.NewValue, changes[i].Status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setTopicChangesStatus(db *sql.DB, changes []KafkaTopicChange, status string) error {
+	ids := make([]string, 0)
+	for i := range changes {
+		changes[i].Status = status
+		ids = append(ids, changes[i].Id)
+	}
+	_, err := db.Exec("update kafka_topic_changes set status=$2 where change_id = any($1::uuid[])", pq.Array(ids), status)
+	return err
+}
+
+func UpdateTopicV1(db *sql.DB, spec structs.KafkaTopicUpdate, params martini.Params, berr binding.Errors, r render.Render) {
+	cluster := params["cluster"]
+	topic := params["topic"]
+
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	settings := topicSettings(spec)
+	if len(settings) == 0 {
+		utils.ReportInvalidRequest("No topic settings were given to change.", r)
+		return
+	}
+
+	var existing kafkaTopicResponse
+	if _, err := kafkaBrokerRequest("GET", "/v1/kafka/cluster/"+cluster+"/topics/"+topic, nil, &existing); err != nil {
+		ProcessErrors(err, r)
+		return
+	}
+	current := make(map[string]string)
+	for name, value := range existing.Topic.Config {
+		current[name] = topicConfigValue(value)
+	}
+	changes, err := topicChanges(cluster, topic, settings, current, kafkaTopicLimitsFor(cluster))
+	if err != nil {
+		utils.ReportInvalidRequest(err.Error(), r)
+		return
+	}
+	if len(changes) == 0 {
+		r.JSON(http.StatusOK, changes)
+		return
+	}
+
+	config := make(map[string]interface{})
+	for _, change := range changes {
+		if number, err := strconv.ParseInt(change.NewValue, 10, 64); err == nil {
+			config[change.Setting] = number
+		} else {
+			config[change.Setting] = change.NewValue
+		}
+	}
+	if err = recordTopicChanges(db, changes); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	update := map[string]interface{}{"topic": map[string]interface{}{"name": topic, "config": config}}
+	if _, err = kafkaBrokerRequest("PATCH", "/v1/kafka/cluster/"+cluster+"/topics/"+topic, update, nil); err != nil {
+		if serr := setTopicChangesStatus(db, changes, TopicChangeFailed); serr != nil {
+			log.Printf("WARNING: Unable to record the failed changes to the topic %s on %s: %s\n", topic, cluster, serr.Error())
+		}
+		ProcessErrors(err, r)
+		return
+	}
+	// the topic has changed, the changes stay pending if this fails and are reported as applied.
+	if err = setTopicChangesStatus(db, changes, TopicChangeApplied); err != nil {
+		log.Printf("WARNING: Unable to record the changes to the topic %s on %s as applied: %s\n", topic, cluster, err.Error())
+	}
+	r.JSON(http.StatusOK, changes)
+}
+
+func GetTopicChangesV1(db *sql.DB, params martini.Params, r render.Render) {
+	rows, err := db.Query("select change_id, cluster, topic, setting, old_value, new_value, status, created from kafka_topic_changes where cluster=$1 and topic=$2 order by created desc",
+		params["cluster"], params["topic"])
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	defer rows.Close()
+	changes := make([]KafkaTopicChange, 0)
+	for rows.Next() {
+		var change KafkaTopicChange
+		var oldValue sql.NullString
+		if err = rows.Scan(&change.Id, &change.Cluster, &change.Topic, &change.Setting, &oldValue, &change.NewValue, &change.Status, &change.Created); err != nil {
+			utils.ReportError(err, r)
+			return
+		}
+		change.OldValue = oldValue.String
+		changes = append(changes, change)
+	}
+	if err = rows.Err(); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, changes)
+}
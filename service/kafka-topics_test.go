@@ -0,0 +1,140 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	structs "region-api/structs"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKafkaTopics(t *testing.T) {
+	Convey("Test changing the settings of kafka topics", t, func() {
+		limits := kafkaTopicLimits{maxPartitions: 32, maxRetentionMs: 604800000}
+
+		Convey("Requested settings should be collected by their topic config name", func() {
+			partitions := 8
+			retention := 3600000
+			settings := topicSettings(structs.KafkaTopicUpdate{Partitions: &partitions, Retentionms: &retention, Cleanuppolicy: "compact", Configs: map[string]string{"segment.ms": " 60000 "}})
+			So(settings, ShouldResemble, map[string]string{"partitions": "8", "retention.ms": "3600000", "cleanup.policy": "compact", "segment.ms": "60000"})
+			So(topicSettings(structs.KafkaTopicUpdate{}), ShouldBeEmpty)
+		})
+
+		Convey("Partitions should only increase within the cluster limit", func() {
+			So(validateTopicSetting("partitions", "8", "4", limits), ShouldBeNil)
+			So(validateTopicSetting("partitions", "2", "4", limits), ShouldEqual, ErrPartitionsDecreased)
+			So(validateTopicSetting("partitions", "64", "4", limits), ShouldNotBeNil)
+			So(validateTopicSetting("partitions", "0", "", limits), ShouldNotBeNil)
+			So(validateTopicSetting("partitions", "4", "", limits), ShouldEqual, ErrPartitionsUnknown)
+			So(validateTopicSetting("partitions", "4", "four", limits), ShouldEqual, ErrPartitionsUnknown)
+		})
+
+		Convey("Only allowed configs with valid values should be accepted", func() {
+			So(validateTopicSetting("retention.ms", "86400000", "", limits), ShouldBeNil)
+			So(validateTopicSetting("retention.ms", "-1", "", limits), ShouldNotBeNil)
+			So(validateTopicSetting("retention.ms", "704800000", "", limits), ShouldNotBeNil)
+			So(validateTopicSetting("retention.bytes", "-1", "", limits), ShouldBeNil)
+			So(validateTopicSetting("cleanup.policy", "compact,delete", "", limits), ShouldBeNil)
+			So(validateTopicSetting("cleanup.policy", "archive", "", limits), ShouldNotBeNil)
+			So(validateTopicSetting("segment.ms", "soon", "", limits), ShouldNotBeNil)
+			So(validateTopicSetting("unclean.leader.election.enable", "true", "", limits), ShouldNotBeNil)
+		})
+
+		Convey("Only settings that differ from the topic should be changes", func() {
+			current := map[string]string{"partitions": "4", "retention.ms": "86400000", "cleanup.policy": "delete"}
+			changes, err := topicChanges("maestro", "events", map[string]string{"partitions": "4", "retention.ms": "3600000", "cleanup.policy": "compact"}, current, limits)
+			So(err, ShouldBeNil)
+			So(len(changes), ShouldEqual, 2)
+			So(changes[0], ShouldResemble, KafkaTopicChange{Cluster: "maestro", Topic: "events", Setting: "cleanup.policy", OldValue: "delete", NewValue: "compact"})
+			So(changes[1].Setting, ShouldEqual, "retention.ms")
+			So(changes[1].OldValue, ShouldEqual, "86400000")
+			_, err = topicChanges("maestro", "events", map[string]string{"partitions": "2"}, current, limits)
+			So(err, ShouldEqual, ErrPartitionsDecreased)
+			_, err = topicChanges("maestro", "events", map[string]string{"partitions": "8"}, map[string]string{"retention.ms": "86400000"}, limits)
+			So(err, ShouldEqual, ErrPartitionsUnknown)
+		})
+
+		Convey("Limits should be read for the cluster before all clusters when the broker is unavailable", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+			url := os.Getenv("KAFKA_BROKER_URL")
+			defer os.Setenv("KAFKA_BROKER_URL", url)
+			os.Setenv("KAFKA_BROKER_URL", server.URL)
+			defer os.Unsetenv("KAFKA_MAX_PARTITIONS")
+			defer os.Unsetenv("KAFKA_NON_PROD_MAX_PARTITIONS")
+			So(kafkaTopicLimitsFor("maestro").maxPartitions, ShouldEqual, defaultKafkaMaxPartitions)
+			So(kafkaTopicLimitsFor("maestro").maxRetentionMs, ShouldEqual, defaultKafkaMaxRetentionMs)
+			os.Setenv("KAFKA_MAX_PARTITIONS", "64")
+			os.Setenv("KAFKA_NON_PROD_MAX_PARTITIONS", "16")
+			So(kafkaTopicLimitsFor("maestro").maxPartitions, ShouldEqual, 64)
+			So(kafkaTopicLimitsFor("non-prod").maxPartitions, ShouldEqual, 16)
+			os.Setenv("KAFKA_MAX_PARTITIONS", "lots")
+			So(kafkaTopicLimitsFor("maestro").maxPartitions, ShouldEqual, defaultKafkaMaxPartitions)
+		})
+
+		Convey("Limits should be read from the cluster's topic configurations", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/v1/kafka/cluster/maestro/configs" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Write([]byte(`{"configs":[{"name":"ledger","config":{"partitions":48,"retention.ms":2592000000}},{"name":"state","config":{"partitions":72,"cleanup.policy":"compact"}},{"name":"event","config":{"partitions":"16","retention.ms":"604800000"}}]}`))
+			}))
+			defer server.Close()
+			url := os.Getenv("KAFKA_BROKER_URL")
+			defer os.Setenv("KAFKA_BROKER_URL", url)
+			os.Setenv("KAFKA_BROKER_URL", server.URL)
+			defer os.Unsetenv("KAFKA_MAX_PARTITIONS")
+			os.Setenv("KAFKA_MAX_PARTITIONS", "8")
+			limits := kafkaTopicLimitsFor("maestro")
+			So(limits.maxPartitions, ShouldEqual, 72)
+			So(limits.maxRetentionMs, ShouldEqual, 2592000000)
+			So(kafkaTopicLimitsFor("non-prod").maxPartitions, ShouldEqual, 8)
+		})
+
+		Convey("Topic configs should be read and sent through the broker", func() {
+			var patched map[string]interface{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch req.Method + " " + req.URL.Path {
+				case "GET /v1/kafka/cluster/maestro/topics/events":
+					w.Write([]byte(`{"topic":{"name":"events","config":{"partitions":4,"retention.ms":604800000,"cleanup.policy":"delete"}}}`))
+				case "PATCH /v1/kafka/cluster/maestro/topics/events":
+					body, _ := ioutil.ReadAll(req.Body)
+					json.Unmarshal(body, &patched)
+					w.Write([]byte(`{}`))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+					w.Write([]byte("no such topic"))
+				}
+			}))
+			defer server.Close()
+			url := os.Getenv("KAFKA_BROKER_URL")
+			defer os.Setenv("KAFKA_BROKER_URL", url)
+			os.Setenv("KAFKA_BROKER_URL", server.URL)
+
+			var existing kafkaTopicResponse
+			_, err := kafkaBrokerRequest("GET", "/v1/kafka/cluster/maestro/topics/events", nil, &existing)
+			So(err, ShouldBeNil)
+			So(topicConfigValue(existing.Topic.Config["retention.ms"]), ShouldEqual, "604800000")
+			So(topicConfigValue(existing.Topic.Config["cleanup.policy"]), ShouldEqual, "delete")
+			So(topicConfigValue(existing.Topic.Config["segment.ms"]), ShouldEqual, "")
+
+			update := map[string]interface{}{"topic": map[string]interface{}{"name": "events", "config": map[string]interface{}{"partitions": 8}}}
+			_, err = kafkaBrokerRequest("PATCH", "/v1/kafka/cluster/maestro/topics/events", update, nil)
+			So(err, ShouldBeNil)
+			So(patched["topic"].(map[string]interface{})["config"].(map[string]interface{})["partitions"], ShouldEqual, 8)
+
+			_, err = kafkaBrokerRequest("GET", "/v1/kafka/cluster/maestro/topics/missing", nil, &existing)
+			herr, isHttp := osb.IsHTTPError(err)
+			So(isHttp, ShouldBeTrue)
+			So(herr.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/render"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 	structs "region-api/structs"
@@ -32,7 +33,40 @@ type AclsResponse struct {
 	Acls []Acl `json:"acls"`
 }
 
-func ProvisionKafkaV1(spec structs.Provisionspec, berr binding.Errors, r render.Render) {
+// Errors from the broker are returned as http errors so they can be reported with ProcessErrors.
+func kafkaBrokerRequest(method string, path string, payload interface{}, result interface{}) (*http.Response, error) {
+	body := bytes.NewBuffer(nil)
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewBuffer(data)
+	}
+	req, err := http.NewRequest(method, os.Getenv("KAFKA_BROKER_URL")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 || resp.StatusCode < 200 {
+		return resp, legacyBrokerError(resp)
+	}
+	if result != nil {
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return resp, err
+		}
+		return resp, json.Unmarshal(data, result)
+	}
+	return resp, nil
+}
+
+func ProvisionKafkaV1(db *sql.DB, spec structs.Provisionspec, berr binding.Errors, r render.Render) {
 	if berr != nil {
 		utils.ReportInvalidRequest(berr[0].Message, r)
 		return
@@ -61,6 +95,9 @@ func ProvisionKafkaV1(spec structs.Provisionspec, berr binding.Errors, r render.
 		utils.ReportError(err, r)
 		return
 	}
+	if err = recordLegacyInstance(db, creds.AclCredentials.Username, "kafka", creds.AclCredentials.Username, spec); err != nil {
+		log.Printf("WARNING: Unable to record the kafka user %s: %s\n", creds.AclCredentials.Username, err.Error())
+	}
 	kafka.Spec = "kafka:" + creds.AclCredentials.Username
 	r.JSON(201, kafka)
 }
@@ -439,7 +476,7 @@ func DeleteTopicV1(params martini.Params, r render.Render) {
 	r.JSON(resp.StatusCode, bodyj)
 }
 
-func DeleteKafkaV1(params martini.Params, r render.Render) {
+func DeleteKafkaV1(db *sql.DB, params martini.Params, r render.Render) {
 	servicename := params["servicename"]
 	client := &http.Client{}
 	req, err := http.NewRequest("DELETE", os.Getenv("KAFKA_BROKER_URL")+"/v1/kafka/user/"+servicename, nil)
@@ -450,6 +487,11 @@ func DeleteKafkaV1(params martini.Params, r render.Render) {
 	}
 
 	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		if err = removeLegacyInstance(db, servicename, "kafka"); err != nil {
+			log.Printf("WARNING: Unable to remove the kafka user %s: %s\n", servicename, err.Error())
+		}
+	}
 	bodyj, _ := simplejson.NewFromReader(resp.Body)
 	r.JSON(resp.StatusCode, bodyj)
 }
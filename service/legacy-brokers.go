@@ -0,0 +1,290 @@
+package service
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	structs "region-api/structs"
+	"sort"
+	"strings"
+
+	uuid "github.com/nu7hatch/gouuid"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// The rabbitmq and influxdb brokers predate the open service broker api, legacyBroker implements osb.Client
+// over their api so they're offered, provisioned and bound through the same providers as open service brokers.
+// Instances provisioned through the old endpoints are named by the broker, those names are used as instance ids.
+type legacyBroker struct {
+	name string
+	url  string
+	db   *sql.DB
+}
+
+var legacyBrokerNames = []string{"rabbitmq", "influxdb"}
+
+func newLegacyBroker(name string, db *sql.DB) *legacyBroker {
+	return &legacyBroker{name: name, url: "http://" + os.Getenv(strings.ToUpper(name)+"_BROKER_URL"), db: db}
+}
+
+// Ids must stay the same across restarts as they're recorded with each instance.
+func legacyId(parts ...string) string {
+	id, err := uuid.NewV5(uuid.NamespaceURL, []byte("akkeris:"+strings.Join(parts, ":")))
+	if err != nil {
+		return strings.Join(parts, "-")
+	}
+	return id.String()
+}
+
+func legacyBrokerError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	message := resp.Status
+	description := strings.TrimSpace(string(body))
+	return osb.HTTPStatusCodeError{StatusCode: resp.StatusCode, ErrorMessage: &message, Description: &description}
+}
+
+func (broker *legacyBroker) request(method string, path string, payload interface{}) (map[string]interface{}, error) {
+	var body *bytes.Buffer = bytes.NewBuffer(nil)
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewBuffer(data)
+	}
+	req, err := http.NewRequest(method, broker.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 || resp.StatusCode < 200 {
+		return nil, legacyBrokerError(resp)
+	}
+	result := make(map[string]interface{})
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err = json.Unmarshal(data, &result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// The broker's plans by size with their description.
+func (broker *legacyBroker) plans() (map[string]string, error) {
+	result, err := broker.request("GET", "/v1/"+broker.name+"/plans", nil)
+	if err != nil {
+		return nil, err
+	}
+	plans := make(map[string]string)
+	for size, description := range result {
+		plans[size], _ = description.(string)
+	}
+	return plans, nil
+}
+
+func (broker *legacyBroker) provision(spec structs.Provisionspec) (map[string]interface{}, error) {
+	return broker.request("POST", "/v1/"+broker.name+"/instance", spec)
+}
+
+func (broker *legacyBroker) credentials(name string) (map[string]interface{}, error) {
+	return broker.request("GET", "/v1/"+broker.name+"/url/"+name, nil)
+}
+
+// Replaces the instance's credentials, the old credentials stop working.
+func (broker *legacyBroker) rotateCredentials(name string) (map[string]interface{}, error) {
+	return broker.request("POST", "/v1/"+broker.name+"/url/"+name+"/rotate", nil)
+}
+
+func (broker *legacyBroker) deprovision(name string) (map[string]interface{}, error) {
+	return broker.request("DELETE", "/v1/"+broker.name+"/instance/"+name, nil)
+}
+
+// The name the broker gave an instance, from the credentials returned when it was provisioned.
+func (broker *legacyBroker) instanceNameFrom(credentials map[string]interface{}) string {
+	if broker.name == "influxdb" {
+		name, _ := credentials["INFLUX_DB"].(string)
+		return name
+	}
+	url, _ := credentials[strings.ToUpper(broker.name)+"_URL"].(string)
+	parts := strings.Split(url, "/")
+	return parts[len(parts)-1]
+}
+
+// Instances provisioned through the old endpoints use the broker's name for the instance as their id.
+func recordLegacyInstance(db *sql.DB, instanceId string, service string, name string, spec structs.Provisionspec) error {
+	_, err := db.Exec(`insert into legacy_service_instances (instance_id, service, name, plan, billing_code) values ($1, $2, $3, $4, $5)
+		on conflict (instance_id) do update set service=$2, name=$3, plan=$4, billing_code=$5`, instanceId, service, name, spec.Plan, spec.Billingcode)
+	return err
+}
+
+func removeLegacyInstance(db *sql.DB, instanceId string, service string) error {
+	_, err := db.Exec("delete from legacy_service_instances where instance_id=$1 and service=$2", instanceId, service)
+	return err
+}
+
+func (broker *legacyBroker) instanceName(instanceId string) (string, error) {
+	if broker.db == nil {
+		return instanceId, nil
+	}
+	var name string
+	err := broker.db.QueryRow("select name from legacy_service_instances where instance_id=$1 and service=$2", instanceId, broker.name).Scan(&name)
+	if err == sql.ErrNoRows {
+		return instanceId, nil
+	}
+	return name, err
+}
+
+func (broker *legacyBroker) GetCatalog() (*osb.CatalogResponse, error) {
+	plans, err := broker.plans()
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]string, 0)
+	for size := range plans {
+		sizes = append(sizes, size)
+	}
+	sort.Strings(sizes)
+	service := osb.Service{ID: legacyId(broker.name), Name: broker.name, Description: broker.name + " provided by the " + broker.name + " broker", Bindable: true, PlanUpdatable: new(bool)}
+	for _, size := range sizes {
+		service.Plans = append(service.Plans, osb.Plan{ID: legacyId(broker.name, size), Name: size, Description: plans[size]})
+	}
+	return &osb.CatalogResponse{Services: []osb.Service{service}}, nil
+}
+
+func (broker *legacyBroker) ProvisionInstance(r *osb.ProvisionRequest) (*osb.ProvisionResponse, error) {
+	catalog, err := broker.GetCatalog()
+	if err != nil {
+		return nil, err
+	}
+	spec := structs.Provisionspec{}
+	for _, plan := range catalog.Services[0].Plans {
+		if plan.ID == r.PlanID {
+			spec.Plan = plan.Name
+		}
+	}
+	if spec.Plan == "" {
+		return nil, errors.New("Unable to find plan")
+	}
+	spec.Billingcode, _ = r.Parameters["billingcode"].(string)
+	credentials, err := broker.provision(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err = recordLegacyInstance(broker.db, r.InstanceID, broker.name, broker.instanceNameFrom(credentials), spec); err != nil {
+		return nil, err
+	}
+	return &osb.ProvisionResponse{}, nil
+}
+
+func (broker *legacyBroker) UpdateInstance(r *osb.UpdateInstanceRequest) (*osb.UpdateInstanceResponse, error) {
+	message := "NotSupported"
+	description := "The plan of a " + broker.name + " instance cannot be changed."
+	return nil, osb.HTTPStatusCodeError{StatusCode: http.StatusUnprocessableEntity, ErrorMessage: &message, Description: &description}
+}
+
+func (broker *legacyBroker) DeprovisionInstance(r *osb.DeprovisionRequest) (*osb.DeprovisionResponse, error) {
+	name, err := broker.instanceName(r.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = broker.deprovision(name); err != nil {
+		return nil, err
+	}
+	if err = removeLegacyInstance(broker.db, r.InstanceID, broker.name); err != nil {
+		return nil, err
+	}
+	return &osb.DeprovisionResponse{}, nil
+}
+
+// Operations on the legacy brokers are synchronous, they're always complete.
+func (broker *legacyBroker) PollLastOperation(r *osb.LastOperationRequest) (*osb.LastOperationResponse, error) {
+	return &osb.LastOperationResponse{State: osb.StateSucceeded}, nil
+}
+
+func (broker *legacyBroker) PollBindingLastOperation(r *osb.BindingLastOperationRequest) (*osb.LastOperationResponse, error) {
+	return &osb.LastOperationResponse{State: osb.StateSucceeded}, nil
+}
+
+// Every binding of an instance receives the instance's credentials.
+func (broker *legacyBroker) Bind(r *osb.BindRequest) (*osb.BindResponse, error) {
+	name, err := broker.instanceName(r.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := broker.credentials(name)
+	if err != nil {
+		return nil, err
+	}
+	return &osb.BindResponse{Credentials: credentials}, nil
+}
+
+func (broker *legacyBroker) Unbind(r *osb.UnbindRequest) (*osb.UnbindResponse, error) {
+	return &osb.UnbindResponse{}, nil
+}
+
+func (broker *legacyBroker) GetBinding(r *osb.GetBindingRequest) (*osb.GetBindingResponse, error) {
+	name, err := broker.instanceName(r.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := broker.credentials(name)
+	if err != nil {
+		return nil, err
+	}
+	return &osb.GetBindingResponse{Credentials: credentials}, nil
+}
+
+// The credentials of a rabbitmq or influxdb binding, these are always bound so unlike other brokers an
+// unavailable broker is an error rather than a binding without config vars. The broker is asked directly
+// when its provider can't be used, e.g., it was unavailable when the providers were cached.
+func legacyBindingCredentials(db *sql.DB, appname string, space string, servicetype string, instanceId string) (map[string]interface{}, error) {
+	if globalClientService != nil {
+		credentials, err := GetOSBBindingCredentials(servicetype, instanceId, osbBindingId(db, appname, space, instanceId))
+		if err == nil {
+			return credentials, nil
+		}
+		log.Printf("WARNING: Unable to get the %s credentials for %s from its provider, asking the broker: %s\n", servicetype, instanceId, err.Error())
+	}
+	broker := newLegacyBroker(servicetype, db)
+	name, err := broker.instanceName(instanceId)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := broker.credentials(name)
+	if err != nil {
+		return nil, errors.New("Unable to get the " + servicetype + " credentials for " + instanceId + ": " + err.Error())
+	}
+	return credentials, nil
+}
+
+// Providers for the legacy brokers that are configured.
+func (cserv *OSBClientServices) legacyProviders() []providerInfo {
+	providers := make([]providerInfo, 0)
+	for _, name := range legacyBrokerNames {
+		if os.Getenv(strings.ToUpper(name)+"_BROKER_URL") == "" {
+			continue
+		}
+		broker := newLegacyBroker(name, cserv.db)
+		catalog, err := broker.GetCatalog()
+		if err != nil {
+			log.Printf("ERROR: Unable to get the plans of the %s broker: %s\n", name, err.Error())
+			continue
+		}
+		providers = append(providers, providerInfo{serviceUrl: broker.url, client: broker, services: catalog.Services})
+	}
+	return providers
+}
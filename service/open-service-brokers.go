@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	utils "region-api/utils"
+	"sync"
 	"time"
 
 	"github.com/go-martini/martini"
@@ -19,13 +20,18 @@ import (
 )
 
 type providerInfo struct {
+	broker     string
 	serviceUrl string
+	auth       *osb.AuthConfig
 	client     osb.Client
 	services   []osb.Service
 }
 
 type OSBClientServices struct {
+	// the cache is read and replaced from requests, the operation poller and the refresh ticker,
+	// it's only accessed through cachedProviders and setCachedProviders (or with providersLock held).
 	providersCache []providerInfo
+	providersLock  sync.RWMutex
 	serviceUrls    []string
 	db             *sql.DB
 }
@@ -100,67 +106,88 @@ func (cserv *OSBClientServices) init() {
 	go (func() {
 		t := time.NewTicker(time.Minute * 30)
 		for {
-			cserv.providersCache = nil
+			cserv.setCachedProviders(nil)
 			<-t.C
 		}
 	})()
 }
 
+// The cached slice is never modified in place, it's replaced, so it's safe to read once returned.
+func (cserv *OSBClientServices) cachedProviders() []providerInfo {
+	cserv.providersLock.RLock()
+	defer cserv.providersLock.RUnlock()
+	return cserv.providersCache
+}
+
+func (cserv *OSBClientServices) setCachedProviders(providers []providerInfo) {
+	cserv.providersLock.Lock()
+	defer cserv.providersLock.Unlock()
+	cserv.providersCache = providers
+}
+
 func getProvider(serviceUrl string) (*providerInfo, error) {
-	config := osb.DefaultClientConfiguration()
 	sUrl, err := url.Parse(serviceUrl)
-	if err == nil {
-		config.URL = serviceUrl
-		if sUrl.User != nil && sUrl.User.Username() != "" {
-			pwd, _ := sUrl.User.Password()
-			config.AuthConfig = &osb.AuthConfig{BasicAuthConfig: &osb.BasicAuthConfig{Username: sUrl.User.Username(), Password: pwd}}
-		} else if sUrl.User != nil && sUrl.User.Username() == "" {
-			pwd, _ := sUrl.User.Password()
-			config.AuthConfig = &osb.AuthConfig{BearerConfig: &osb.BearerConfig{Token: pwd}}
-		}
-		config.EnableAlphaFeatures = true // necessary for GetBinding
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("ERROR: Unable to parse service url %s\n", serviceUrl))
+	}
+	var auth *osb.AuthConfig = nil
+	if sUrl.User != nil && sUrl.User.Username() != "" {
+		pwd, _ := sUrl.User.Password()
+		auth = &osb.AuthConfig{BasicAuthConfig: &osb.BasicAuthConfig{Username: sUrl.User.Username(), Password: pwd}}
+	} else if sUrl.User != nil && sUrl.User.Username() == "" {
+		pwd, _ := sUrl.User.Password()
+		auth = &osb.AuthConfig{BearerConfig: &osb.BearerConfig{Token: pwd}}
+	}
+	return newProvider(serviceUrl, auth)
+}
 
-		if os.Getenv("DEBUG_OSB") == "true" {
-			log.Printf("[osb] Connecting to OSB provider at %s...\n", config.URL)
-		}
+func newProvider(serviceUrl string, auth *osb.AuthConfig) (*providerInfo, error) {
+	config := osb.DefaultClientConfiguration()
+	config.URL = serviceUrl
+	config.AuthConfig = auth
+	config.EnableAlphaFeatures = true // necessary for GetBinding
 
-		client, err := osb.NewClient(config)
-		if err != nil {
-			if os.Getenv("DEBUG_OSB") == "true" {
-				log.Printf("[osb] Error creating OSB client!\n[osb]    %v\n", err)
-			}
-			return nil, err
-		}
-		s, err := client.GetCatalog()
-		if err != nil {
-			if os.Getenv("DEBUG_OSB") == "true" {
-				log.Printf("[osb] Error getting OSB catalog!\n[osb]    %v\n", err)
-			}
-			return nil, err
-		}
-		service := providerInfo{serviceUrl: serviceUrl, client: client, services: s.Services}
+	if os.Getenv("DEBUG_OSB") == "true" {
+		log.Printf("[osb] Connecting to OSB provider at %s...\n", config.URL)
+	}
 
+	client, err := osb.NewClient(config)
+	if err != nil {
 		if os.Getenv("DEBUG_OSB") == "true" {
-			log.Printf("[osb] Found services:\n")
-			for _, svc := range s.Services {
-				log.Printf("[osb]    %s (%v plans) - %v\n", svc.Name, len(svc.Plans), svc.Description)
-			}
+			log.Printf("[osb] Error creating OSB client!\n[osb]    %v\n", err)
+		}
+		return nil, err
+	}
+	s, err := client.GetCatalog()
+	if err != nil {
+		if os.Getenv("DEBUG_OSB") == "true" {
+			log.Printf("[osb] Error getting OSB catalog!\n[osb]    %v\n", err)
 		}
+		return nil, err
+	}
+	service := providerInfo{serviceUrl: serviceUrl, auth: auth, client: client, services: s.Services}
 
-		return &service, nil
-	} else {
-		return nil, errors.New(fmt.Sprintf("ERROR: Unable to parse service url %s\n", serviceUrl))
+	if os.Getenv("DEBUG_OSB") == "true" {
+		log.Printf("[osb] Found services:\n")
+		for _, svc := range s.Services {
+			log.Printf("[osb]    %s (%v plans) - %v\n", svc.Name, len(svc.Plans), svc.Description)
+		}
 	}
+
+	return &service, nil
 }
 
 func (cserv *OSBClientServices) GetProviders() ([]providerInfo, error) {
-	if cserv.providersCache != nil {
-		return cserv.providersCache, nil
+	if providers := cserv.cachedProviders(); providers != nil {
+		return providers, nil
 	}
 	services := make([]providerInfo, 0)
 
 	// Don't cache a problematic service, but allow working ones to be cached
 	for _, serviceUrl := range cserv.serviceUrls {
+		if serviceUrl == "" {
+			continue
+		}
 		service, err := getProvider(serviceUrl)
 		if err != nil {
 			log.Println(err.Error())
@@ -168,16 +195,27 @@ func (cserv *OSBClientServices) GetProviders() ([]providerInfo, error) {
 			services = append(services, *service)
 		}
 	}
-	cserv.providersCache = services
-	return cserv.providersCache, nil
+	brokers, err := GetBrokers(cserv.db)
+	if err != nil {
+		log.Printf("ERROR: Unable to get the registered brokers: %s\n", err.Error())
+	}
+	for _, broker := range brokers {
+		service, err := cserv.refreshBroker(broker)
+		if err != nil {
+			log.Printf("ERROR: Unable to get the catalog of the broker %s: %s\n", broker.Name, err.Error())
+		} else {
+			services = append(services, *service)
+		}
+	}
+	services = append(services, cserv.legacyProviders()...)
+	cserv.setCachedProviders(services)
+	return services, nil
 }
 
 func (cserv *OSBClientServices) GetOSBServices() (*osb.CatalogResponse, error) {
-	if cserv.providersCache == nil {
-		cserv.GetProviders()
-	}
+	providers, _ := cserv.GetProviders()
 	var catalog osb.CatalogResponse
-	for _, provider := range cserv.providersCache {
+	for _, provider := range providers {
 		catalog.Services = append(catalog.Services, provider.services...)
 	}
 	return &catalog, nil
@@ -278,7 +316,7 @@ func (cserv *OSBClientServices) GetInstanceInfoByID(instanceId string) (serviceI
 }
 
 func (cserv *OSBClientServices) InsertInstanceInfo(instanceId string, serviceId string, planId string, operationKey *string, status osb.LastOperationState) (err error) {
-	_, err = cserv.db.Exec("insert into service_instances (instance_id, service_id, plan_id, operation_key, status) values ($1, $2, $3, $4, $5)", instanceId, serviceId, planId, operationKey, status)
+	_, err = cserv.db.Exec("insert into service_instances (instance_id, service_id, plan_id, operation_key, status, created) values ($1, $2, $3, $4, $5, now())", instanceId, serviceId, planId, operationKey, status)
 	return err
 }
 
@@ -289,17 +327,24 @@ func (cserv *OSBClientServices) UpdateInstanceInfo(instanceId string, serviceId
 
 func (cserv *OSBClientServices) RemoveInstanceInfo(instanceId string) (err error) {
 	_, err = cserv.db.Exec("delete from service_instances where instance_id = $1", instanceId)
+	if err == nil {
+		removeInstanceShares(cserv.db, instanceId)
+	}
 	return err
 }
 
-func (cserv *OSBClientServices) Provision(instanceId string, service *osb.Service, plan *osb.Plan, orgGuid string, spaceGuid string) (*osb.ProvisionResponse, error) {
+func (cserv *OSBClientServices) Provision(instanceId string, service *osb.Service, plan *osb.Plan, orgGuid string, spaceGuid string, parameters map[string]interface{}, context map[string]interface{}) (*osb.ProvisionResponse, error) {
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
 	request := &osb.ProvisionRequest{
 		InstanceID:        instanceId,
 		ServiceID:         service.ID,
 		PlanID:            plan.ID,
 		OrganizationGUID:  orgGuid,
 		SpaceGUID:         spaceGuid,
-		Parameters:        map[string]interface{}{},
+		Parameters:        parameters,
+		Context:           context,
 		AcceptsIncomplete: true,
 	}
 
@@ -321,24 +366,41 @@ func (cserv *OSBClientServices) Provision(instanceId string, service *osb.Servic
 		}
 		if err = cserv.InsertInstanceInfo(instanceId, service.ID, plan.ID, opkey, osb.StateInProgress); err != nil {
 			log.Printf("ERROR: Cannot record instance %s %s %s because %s\n", instanceId, service.ID, plan.ID, err.Error())
+		} else if err = cserv.startOperation(instanceId, OperationProvision, opkey); err != nil {
+			log.Printf("ERROR: Cannot record the operation on instance %s because %s\n", instanceId, err.Error())
 		}
 	} else {
-		if err = cserv.InsertInstanceInfo(instanceId, service.ID, plan.ID, nil, osb.StateInProgress); err != nil {
+		if err = cserv.InsertInstanceInfo(instanceId, service.ID, plan.ID, nil, osb.StateSucceeded); err != nil {
 			log.Printf("ERROR: Cannot record instance %s %s %s because %s\n", instanceId, service.ID, plan.ID, err.Error())
 		}
 	}
+	if owner := ownerFromContext(context); owner != nil {
+		if err = setInstanceOwner(cserv.db, instanceId, *owner); err != nil {
+			log.Printf("ERROR: Cannot record the owner of instance %s because %s\n", instanceId, err.Error())
+		}
+	}
+	if billingcode, ok := parameters["billingcode"].(string); ok && billingcode != "" {
+		if _, err = cserv.db.Exec("update service_instances set billing_code=$2 where instance_id=$1", instanceId, billingcode); err != nil {
+			log.Printf("ERROR: Cannot record the billing code of instance %s because %s\n", instanceId, err.Error())
+		}
+	}
 
 	return resp, nil
 }
 
-func (cserv *OSBClientServices) Update(instanceId string, service *osb.Service, plan *osb.Plan) (*osb.UpdateInstanceResponse, error) {
+// Parameters are only sent when given, an update without parameters leaves the instance's parameters as they are.
+func (cserv *OSBClientServices) Update(instanceId string, service *osb.Service, plan *osb.Plan, parameters map[string]interface{}, context map[string]interface{}, previous *PreviousValues) (*osb.UpdateInstanceResponse, error) {
 	request := &osb.UpdateInstanceRequest{
 		InstanceID:        instanceId,
 		ServiceID:         service.ID,
 		PlanID:            &plan.ID,
-		Parameters:        map[string]interface{}{},
+		Parameters:        parameters,
+		Context:           context,
 		AcceptsIncomplete: true,
 	}
+	if previous != nil {
+		request.PreviousValues = &osb.PreviousValues{PlanID: previous.PlanID, ServiceID: previous.ServiceID, OrgID: previous.OrgID, SpaceID: previous.SpaceID}
+	}
 
 	svc, err := cserv.GetProviderByID(service.ID)
 	if err != nil {
@@ -356,6 +418,9 @@ func (cserv *OSBClientServices) Update(instanceId string, service *osb.Service,
 			opkey = &tmpkey
 		}
 		cserv.UpdateInstanceInfo(instanceId, service.ID, plan.ID, opkey, osb.StateInProgress)
+		if err = cserv.startOperation(instanceId, OperationUpdate, opkey); err != nil {
+			log.Printf("ERROR: Cannot record the operation on instance %s because %s\n", instanceId, err.Error())
+		}
 	} else {
 		cserv.UpdateInstanceInfo(instanceId, service.ID, plan.ID, nil, osb.StateSucceeded)
 	}
@@ -379,23 +444,41 @@ func (cserv *OSBClientServices) Deprovision(instanceId string, service *osb.Serv
 	if err != nil {
 		return nil, err
 	}
+	if resp.Async {
+		// the instance is removed once the poller sees the deprovision succeed
+		var opkey *string = nil
+		if resp.OperationKey != nil {
+			tmpkey := string(*resp.OperationKey)
+			opkey = &tmpkey
+		}
+		if err = cserv.startOperation(instanceId, OperationDeprovision, opkey); err != nil {
+			log.Printf("ERROR: Cannot record the operation on instance %s because %s\n", instanceId, err.Error())
+		}
+		return resp, nil
+	}
 	if err = cserv.RemoveInstanceInfo(instanceId); err != nil {
 		log.Printf("ERROR: Cannot record instance %s because %s\n", instanceId, err.Error())
 	}
+	removeCachedBindingCredentials(cserv.db, instanceId, "")
 	return resp, nil
 }
 
-func (cserv *OSBClientServices) CreateBinding(bindingId string, instanceId string, serviceId string, planId string, appGuid *string) (*osb.BindResponse, error) {
+func (cserv *OSBClientServices) CreateBinding(bindingId string, instanceId string, serviceId string, planId string, appGuid *string, parameters map[string]interface{}, context map[string]interface{}) (*osb.BindResponse, error) {
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
 	resource := &osb.BindResource{
 		AppGUID: appGuid,
 	}
 	request := &osb.BindRequest{
-		BindingID:    bindingId,
-		InstanceID:   instanceId,
-		ServiceID:    serviceId,
-		PlanID:       planId,
-		BindResource: resource,
-		Parameters:   map[string]interface{}{},
+		BindingID:         bindingId,
+		InstanceID:        instanceId,
+		ServiceID:         serviceId,
+		PlanID:            planId,
+		BindResource:      resource,
+		Parameters:        parameters,
+		Context:           context,
+		AcceptsIncomplete: true,
 	}
 
 	svc, err := cserv.GetProviderByID(serviceId)
@@ -407,6 +490,11 @@ func (cserv *OSBClientServices) CreateBinding(bindingId string, instanceId strin
 	if err != nil {
 		return nil, err
 	}
+	if response.Async {
+		if err = cserv.startBindingOperation(bindingId, instanceId, serviceId, planId, response.OperationKey); err != nil {
+			log.Printf("ERROR: Cannot record the operation on binding %s because %s\n", bindingId, err.Error())
+		}
+	}
 
 	return response, nil
 }
@@ -438,11 +526,19 @@ func (cserv *OSBClientServices) RemoveBinding(bindingId string, instanceId strin
 		return nil, err
 	}
 
-	return svc.client.Unbind(request)
+	resp, err := svc.client.Unbind(request)
+	if err != nil {
+		return nil, err
+	}
+	removeCachedBindingCredentials(cserv.db, instanceId, bindingId)
+	if _, err = cserv.db.Exec("delete from service_bindings where instance_id=$1 and binding_id=$2", instanceId, bindingId); err != nil {
+		log.Printf("ERROR: Cannot remove binding %s because %s\n", bindingId, err.Error())
+	}
+	return resp, nil
 }
 
 func (cserv *OSBClientServices) GetInstanceStatus(instanceId string) (*osb.LastOperationResponse, error) {
-	serviceId, planId, operationKey, _, err := cserv.GetInstanceInfoByID(instanceId)
+	serviceId, planId, operationKey, status, err := cserv.GetInstanceInfoByID(instanceId)
 	if err != nil {
 		return nil, err
 	}
@@ -469,8 +565,14 @@ func (cserv *OSBClientServices) GetInstanceStatus(instanceId string) (*osb.LastO
 		return nil, err
 	}
 
-	if err = cserv.UpdateInstanceInfo(instanceId, serviceId, planId, operationKey, response.State); err != nil {
-		return nil, err
+	if status == string(osb.StateInProgress) && response.State != osb.StateInProgress {
+		description := ""
+		if response.Description != nil {
+			description = *response.Description
+		}
+		if err = cserv.completeOperation(instanceId, response.State, description); err != nil {
+			return nil, err
+		}
 	}
 
 	return response, nil
@@ -523,13 +625,22 @@ func (cserv *OSBClientServices) HttpPartialUpdateInstance(params martini.Params,
 		return
 	}
 
+	if err = ValidateContext(spec.Context); err != nil {
+		reportInvalidContext(err, r)
+		return
+	}
+	if problems := ValidateParameters(plan, OperationUpdate, spec.Parameters); len(problems) > 0 {
+		reportInvalidParameters(problems, r)
+		return
+	}
+
 	_, _, _, status, err := cserv.GetInstanceInfoByID(instanceId)
 
 	if err != nil {
 		ProcessErrors(err, r)
 		return
 	} else if status != string(osb.StateInProgress) {
-		resp, err := cserv.Update(instanceId, service, plan)
+		resp, err := cserv.Update(instanceId, service, plan, spec.Parameters, spec.Context, spec.PreviousValues)
 		if err != nil {
 			ProcessErrors(err, r)
 			return
@@ -574,11 +685,20 @@ func (cserv *OSBClientServices) HttpGetCreateOrUpdateInstance(params martini.Par
 		return
 	}
 
+	if err = ValidateContext(spec.Context); err != nil {
+		reportInvalidContext(err, r)
+		return
+	}
+
 	_, _, _, status, err := cserv.GetInstanceInfoByID(instanceId)
 
 	if err != nil {
 		// The instance does not exist
-		resp, err := cserv.Provision(instanceId, service, plan, spec.OrganizationGUID, spec.SpaceGUID)
+		if problems := ValidateParameters(plan, OperationProvision, spec.Parameters); len(problems) > 0 {
+			reportInvalidParameters(problems, r)
+			return
+		}
+		resp, err := cserv.Provision(instanceId, service, plan, spec.OrganizationGUID, spec.SpaceGUID, spec.Parameters, spec.Context)
 		if err != nil {
 			ProcessErrors(err, r)
 			return
@@ -590,7 +710,11 @@ func (cserv *OSBClientServices) HttpGetCreateOrUpdateInstance(params martini.Par
 			r.JSON(http.StatusCreated, provisionSuccessResponseBody{DashboardURL: nil, Operation: resp.OperationKey})
 		}
 	} else if status != string(osb.StateInProgress) {
-		resp, err := cserv.Update(instanceId, service, plan)
+		if problems := ValidateParameters(plan, OperationUpdate, spec.Parameters); len(problems) > 0 {
+			reportInvalidParameters(problems, r)
+			return
+		}
+		resp, err := cserv.Update(instanceId, service, plan, spec.Parameters, spec.Context, nil)
 		if err != nil {
 			ProcessErrors(err, r)
 			return
@@ -634,11 +758,48 @@ func (cserv *OSBClientServices) HttpCreateOrUpdateBinding(params martini.Params,
 		utils.ReportInvalidRequest(berr[0].Message, r)
 		return
 	}
+	plan, err := cserv.GetPlanByID(spec.ServiceID, spec.PlanID)
+	if err != nil && err.Error() == "Unable to find service" {
+		r.JSON(http.StatusNotFound, map[string]interface{}{"error": "ServiceNotFound", "description": "The specified service was not found."})
+		return
+	} else if err != nil && err.Error() == "Unable to find plan" {
+		r.JSON(http.StatusNotFound, map[string]interface{}{"error": "PlanNotFound", "description": "The specified plan was not found."})
+		return
+	} else if err != nil {
+		ProcessErrors(err, r)
+		return
+	}
+	if err = ValidateContext(spec.Context); err != nil {
+		reportInvalidContext(err, r)
+		return
+	}
+	if problems := ValidateParameters(plan, OperationBind, spec.Parameters); len(problems) > 0 {
+		reportInvalidParameters(problems, r)
+		return
+	}
+	// brokers can issue restricted credentials to apps bound through a read-only share.
+	role, err := authorizeBrokerBinding(cserv.db, params["instance_id"], params["binding_id"], spec.Context)
+	if err == ErrInvalidRole {
+		r.JSON(http.StatusBadRequest, map[string]interface{}{"error": "InvalidRole", "description": err.Error()})
+		return
+	} else if err == ErrInstanceNotShared || err == ErrReadOnlyShare {
+		r.JSON(http.StatusForbidden, map[string]interface{}{"error": "Forbidden", "description": err.Error()})
+		return
+	} else if err != nil {
+		ProcessErrors(err, r)
+		return
+	}
+	if role != "" {
+		if spec.Context == nil {
+			spec.Context = map[string]interface{}{"platform": "akkeris"}
+		}
+		spec.Context["role"] = role
+	}
 	var appGuid *string = nil
 	if spec.BindResource != nil {
 		appGuid = spec.BindResource.AppGUID
 	}
-	resp, err := cserv.CreateBinding(params["binding_id"], params["instance_id"], spec.ServiceID, spec.PlanID, appGuid)
+	resp, err := cserv.CreateBinding(params["binding_id"], params["instance_id"], spec.ServiceID, spec.PlanID, appGuid, spec.Parameters, spec.Context)
 	if err != nil {
 		ProcessErrors(err, r)
 		return
@@ -668,8 +829,18 @@ func (cserv *OSBClientServices) HttpGetBinding(params martini.Params, r render.R
 }
 
 func (cserv *OSBClientServices) HttpGetBindingLastOperation(params martini.Params, r render.Render) {
-	r.JSON(http.StatusOK,
-		map[string]interface{}{"status": "succeeded", "description": ""}) // TOOD ? Does this interface really exist
+	var status string
+	var description sql.NullString
+	err := cserv.db.QueryRow("select status, status_description from service_bindings where instance_id=$1 and binding_id=$2", params["instance_id"], params["binding_id"]).Scan(&status, &description)
+	if err == sql.ErrNoRows {
+		// only asynchronous bindings are tracked, others were complete when created
+		r.JSON(http.StatusOK, map[string]interface{}{"state": osb.StateSucceeded, "description": ""})
+		return
+	} else if err != nil {
+		ProcessErrors(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, map[string]interface{}{"state": status, "description": description.String})
 }
 
 func (cserv *OSBClientServices) HttpRemoveBinding(params martini.Params, r render.Render) {
@@ -723,31 +894,34 @@ func SetGlobalClientService(cserv *OSBClientServices) {
 	globalClientService = cserv
 }
 
-// The servicetype can either be an id or service name.
+// The servicetype can either be an id or service name. Credentials are cached, if the broker cannot
+// be reached the last credentials retrieved for the binding are used.
 func GetOSBBindingCredentials(servicetype string, instanceId string, bindingId string) (map[string]interface{}, error) {
 	if globalClientService == nil {
 		return nil, errors.New("Open service brokers are not configured.")
 	}
-	provider, err := globalClientService.GetProviderByID(servicetype)
+	cached, err := getCachedBindingCredentials(globalClientService.db, instanceId, bindingId)
 	if err != nil {
-		provider, err = globalClientService.GetProviderByName(servicetype)
-		if err != nil {
-			return nil, errors.New("No such servicetype")
-		}
+		log.Printf("WARNING: Unable to get the cached credentials for %s/%s: %s\n", instanceId, bindingId, err.Error())
 	}
-
-	request := &osb.GetBindingRequest{
-		BindingID:  bindingId,
-		InstanceID: instanceId,
+	if cached != nil && !cached.Stale {
+		if credentials, err := cached.Credentials(); err == nil {
+			return credentials, nil
+		}
 	}
-
-	resp, err := provider.client.GetBinding(request)
+	credentials, err := globalClientService.fetchBindingCredentials(servicetype, instanceId, bindingId)
 	if err != nil {
 		log.Printf("ERROR: Unable to get bind credentials for service: %s because: %s\n", servicetype, err.Error())
+		if cached != nil {
+			if credentials, cerr := cached.Credentials(); cerr == nil {
+				log.Printf("WARNING: Using the credentials for %s/%s retrieved %s ago\n", instanceId, bindingId, time.Duration(cached.Age)*time.Second)
+				recordBindingCredentialsError(globalClientService.db, instanceId, bindingId, err)
+				return credentials, nil
+			}
+		}
 		return nil, err
 	}
-
-	return resp.Credentials, nil
+	return credentials, nil
 }
 
 func IsOSBService(servicetype string) bool {
@@ -756,7 +930,8 @@ func IsOSBService(servicetype string) bool {
 	}
 	if _, err := globalClientService.GetProviderByID(servicetype); err != nil {
 		if _, err = globalClientService.GetProviderByName(servicetype); err != nil {
-			return false
+			// the broker may be unavailable, bindings with cached credentials can still be used
+			return hasCachedBindingCredentials(globalClientService.db, servicetype)
 		}
 	}
 	return true
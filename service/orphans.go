@@ -0,0 +1,361 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	structs "region-api/structs"
+	utils "region-api/utils"
+	"time"
+
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+const (
+	OrphanReasonAppMissing      = "The app no longer exists."
+	OrphanReasonInstanceMissing = "The service instance no longer exists."
+	OrphanReasonUnbound         = "No app is bound to the service instance and its owner no longer exists."
+)
+
+// Instances that were just provisioned are often not bound yet, they aren't reported until they're this old.
+const orphanGracePeriod = time.Hour
+
+type OrphanedBinding struct {
+	App      string `json:"app"`
+	Space    string `json:"space"`
+	Bindtype string `json:"bindtype"`
+	Bindname string `json:"bindname"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type OrphanedInstance struct {
+	Service    string         `json:"service"`
+	InstanceId string         `json:"instance_id"`
+	Owner      *InstanceOwner `json:"owner"`
+	Reason     string         `json:"reason,omitempty"`
+}
+
+type OrphanReport struct {
+	Bindings  []OrphanedBinding  `json:"bindings"`
+	Instances []OrphanedInstance `json:"instances"`
+}
+
+// Only bindings and instances listed in the request that are still orphaned when the cleanup runs are removed,
+// a dry run reports what would be removed.
+type OrphanCleanupRequest struct {
+	Bindings  []OrphanedBinding `json:"bindings"`
+	Instances []string          `json:"instances"`
+	DryRun    bool              `json:"dry_run"`
+}
+
+type OrphanCleanupResult struct {
+	DryRun    bool               `json:"dry_run"`
+	Bindings  []OrphanedBinding  `json:"bindings"`
+	Instances []OrphanedInstance `json:"instances"`
+	Skipped   []string           `json:"skipped"`
+	Errors    []string           `json:"errors"`
+}
+
+type appKey struct {
+	app   string
+	space string
+}
+
+func (binding OrphanedBinding) key() string {
+	return binding.Bindtype + ":" + binding.Bindname + " bound to " + binding.App + "-" + binding.Space
+}
+
+// Brokers answer with not found or gone for instances they no longer have.
+func isGoneError(err error) bool {
+	herr, isHttp := osb.IsHTTPError(err)
+	return isHttp && (herr.StatusCode == http.StatusNotFound || herr.StatusCode == http.StatusGone)
+}
+
+func liveApps(db *sql.DB) (map[appKey]bool, error) {
+	rows, err := db.Query("select appname, space from spacesapps")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	live := make(map[appKey]bool)
+	for rows.Next() {
+		var key appKey
+		if err := rows.Scan(&key.app, &key.space); err != nil {
+			return nil, err
+		}
+		live[key] = true
+	}
+	return live, rows.Err()
+}
+
+func allAppBindings(db *sql.DB) ([]structs.Bindspec, error) {
+	rows, err := db.Query("select appname, space, bindtype, bindname from appbindings order by space, appname, bindtype, bindname")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bindings := make([]structs.Bindspec, 0)
+	for rows.Next() {
+		var bind structs.Bindspec
+		if err := rows.Scan(&bind.App, &bind.Space, &bind.Bindtype, &bind.Bindname); err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, bind)
+	}
+	return bindings, rows.Err()
+}
+
+// The ids of instances recorded by provisioning, only instances from the old endpoints that were provisioned
+// before they were recorded are looked up at their broker.
+func (cserv *OSBClientServices) instanceExists(bind structs.Bindspec, recorded map[string]bool) (bool, error) {
+	if recorded[bind.Bindname] {
+		return true, nil
+	}
+	var err error
+	switch bind.Bindtype {
+	case "kafka":
+		_, err = kafkaBrokerRequest("GET", "/v1/kafka/credentials/"+bind.Bindname, nil, nil)
+	case "rabbitmq", "influxdb":
+		_, err = newLegacyBroker(bind.Bindtype, cserv.db).credentials(bind.Bindname)
+	default:
+		// open service broker instances are always recorded, other bindings (vault, config) can't be checked.
+		return !IsOSBService(bind.Bindtype), nil
+	}
+	if isGoneError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func classifyOrphans(live map[appKey]bool, bindings []structs.Bindspec, usage []InstanceUsage, exists func(structs.Bindspec) (bool, error), now time.Time) (*OrphanReport, error) {
+	report := &OrphanReport{Bindings: []OrphanedBinding{}, Instances: []OrphanedInstance{}}
+	for _, bind := range bindings {
+		orphan := OrphanedBinding{App: bind.App, Space: bind.Space, Bindtype: bind.Bindtype, Bindname: bind.Bindname}
+		if !live[appKey{bind.App, bind.Space}] {
+			orphan.Reason = OrphanReasonAppMissing
+		} else if ok, err := exists(bind); err != nil {
+			return nil, err
+		} else if !ok {
+			orphan.Reason = OrphanReasonInstanceMissing
+		} else {
+			continue
+		}
+		report.Bindings = append(report.Bindings, orphan)
+	}
+	for _, instance := range usage {
+		// instances only known through their bindings can't be deprovisioned.
+		if instance.State == "" || instance.State == string(osb.StateInProgress) {
+			continue
+		}
+		if instance.Created != nil && now.Sub(*instance.Created) < orphanGracePeriod {
+			continue
+		}
+		bound := false
+		for _, app := range instance.Apps {
+			bound = bound || live[appKey{app.App, app.Space}]
+		}
+		if bound || (instance.Owner != nil && (instance.Owner.App == "" || live[appKey{instance.Owner.App, instance.Owner.Space}])) {
+			continue
+		}
+		report.Instances = append(report.Instances, OrphanedInstance{Service: instance.Service, InstanceId: instance.InstanceId, Owner: instance.Owner, Reason: OrphanReasonUnbound})
+	}
+	return report, nil
+}
+
+// Bindings of apps that no longer exist or to instances that no longer exist, and instances no app uses.
+func (cserv *OSBClientServices) FindOrphans() (*OrphanReport, error) {
+	live, err := liveApps(cserv.db)
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := allAppBindings(cserv.db)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := cserv.GetServiceInstanceUsage()
+	if err != nil {
+		return nil, err
+	}
+	recorded := make(map[string]bool)
+	for _, instance := range usage {
+		if instance.State != "" {
+			recorded[instance.InstanceId] = true
+		}
+	}
+	return classifyOrphans(live, bindings, usage, func(bind structs.Bindspec) (bool, error) {
+		return cserv.instanceExists(bind, recorded)
+	}, time.Now())
+}
+
+// Kafka users belong to the cluster they were provisioned on, which is recorded as their plan.
+func removeKafkaAcls(db *sql.DB, username string) error {
+	var cluster sql.NullString
+	err := db.QueryRow("select plan from legacy_service_instances where instance_id=$1 and service='kafka'", username).Scan(&cluster)
+	if err == sql.ErrNoRows || (err == nil && cluster.String == "") {
+		return errors.New("Unable to find the cluster of the kafka user " + username + ", its acls must be removed from the broker.")
+	} else if err != nil {
+		return err
+	}
+	var acls AclsResponse
+	if _, err = kafkaBrokerRequest("GET", "/v1/kafka/cluster/"+cluster.String+"/acls?topic=", nil, &acls); err != nil {
+		return err
+	}
+	for _, acl := range acls.Acls {
+		if acl.User != username {
+			continue
+		}
+		if _, err = kafkaBrokerRequest("DELETE", "/v1/kafka/acls/"+acl.Id, nil, nil); err != nil && !isGoneError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cserv *OSBClientServices) removeOrphanedBinding(orphan OrphanedBinding) error {
+	bindingId := osbBindingId(cserv.db, orphan.App, orphan.Space, orphan.Bindname)
+	if orphan.Reason == OrphanReasonAppMissing {
+		if orphan.Bindtype == "kafka" {
+			// other apps may use the same kafka user, its acls are theirs as well.
+			var others int
+			if err := cserv.db.QueryRow(`select count(*) from appbindings ab join spacesapps sa on ab.appname=sa.appname and ab.space=sa.space
+				where ab.bindtype='kafka' and ab.bindname=$1`, orphan.Bindname).Scan(&others); err != nil {
+				return err
+			}
+			if others == 0 {
+				if err := removeKafkaAcls(cserv.db, orphan.Bindname); err != nil {
+					return err
+				}
+			}
+		} else if serviceId, planId, _, _, err := cserv.GetInstanceInfoByID(orphan.Bindname); err == nil {
+			if _, err = cserv.RemoveBinding(bindingId, orphan.Bindname, serviceId, planId); err != nil && !isGoneError(err) {
+				return err
+			}
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+	}
+	if _, err := cserv.db.Exec("delete from appbindings where appname=$1 and bindtype=$2 and bindname=$3 and space=$4", orphan.App, orphan.Bindtype, orphan.Bindname, orphan.Space); err != nil {
+		return err
+	}
+	if _, err := cserv.db.Exec("delete from configvarsmap where appname=$1 and bindtype=$2 and bindname=$3 and space=$4", orphan.App, orphan.Bindtype, orphan.Bindname, orphan.Space); err != nil {
+		return err
+	}
+	removeCachedBindingCredentials(cserv.db, orphan.Bindname, bindingId)
+	return nil
+}
+
+func (cserv *OSBClientServices) removeOrphanedInstance(orphan OrphanedInstance) error {
+	serviceId, planId, _, _, err := cserv.GetInstanceInfoByID(orphan.InstanceId)
+	if err == nil {
+		service, err := cserv.GetServiceByID(serviceId)
+		if err != nil {
+			return err
+		}
+		plan, err := cserv.GetPlanByID(serviceId, planId)
+		if err != nil {
+			return err
+		}
+		_, err = cserv.Deprovision(orphan.InstanceId, service, plan)
+		return err
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	// instances provisioned through the old endpoints, dropping a rabbitmq instance removes its vhost.
+	switch orphan.Service {
+	case "kafka":
+		_, err = kafkaBrokerRequest("DELETE", "/v1/kafka/user/"+orphan.InstanceId, nil, nil)
+	case "rabbitmq", "influxdb":
+		_, err = newLegacyBroker(orphan.Service, cserv.db).deprovision(orphan.InstanceId)
+	default:
+		return errors.New("Unable to remove instances of " + orphan.Service)
+	}
+	if err != nil && !isGoneError(err) {
+		return err
+	}
+	return removeLegacyInstance(cserv.db, orphan.InstanceId, orphan.Service)
+}
+
+// The requested bindings and instances that are orphaned according to the report, the rest are skipped.
+func selectOrphans(report *OrphanReport, spec OrphanCleanupRequest) ([]OrphanedBinding, []OrphanedInstance, []string) {
+	bindings := make([]OrphanedBinding, 0)
+	instances := make([]OrphanedInstance, 0)
+	skipped := make([]string, 0)
+	for _, requested := range spec.Bindings {
+		found := false
+		for _, orphan := range report.Bindings {
+			if orphan.App == requested.App && orphan.Space == requested.Space && orphan.Bindtype == requested.Bindtype && orphan.Bindname == requested.Bindname {
+				bindings = append(bindings, orphan)
+				found = true
+				break
+			}
+		}
+		if !found {
+			skipped = append(skipped, requested.key())
+		}
+	}
+	for _, requested := range spec.Instances {
+		found := false
+		for _, orphan := range report.Instances {
+			if orphan.InstanceId == requested {
+				instances = append(instances, orphan)
+				found = true
+				break
+			}
+		}
+		if !found {
+			skipped = append(skipped, requested)
+		}
+	}
+	return bindings, instances, skipped
+}
+
+func (cserv *OSBClientServices) HttpGetOrphans(r render.Render) {
+	report, err := cserv.FindOrphans()
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, report)
+}
+
+func (cserv *OSBClientServices) HttpCleanupOrphans(spec OrphanCleanupRequest, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	if len(spec.Bindings) == 0 && len(spec.Instances) == 0 {
+		utils.ReportInvalidRequest("The bindings or instances to remove must be listed.", r)
+		return
+	}
+	report, err := cserv.FindOrphans()
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	bindings, instances, skipped := selectOrphans(report, spec)
+	result := OrphanCleanupResult{DryRun: spec.DryRun, Bindings: []OrphanedBinding{}, Instances: []OrphanedInstance{}, Skipped: skipped, Errors: []string{}}
+	if spec.DryRun {
+		result.Bindings = bindings
+		result.Instances = instances
+		r.JSON(http.StatusOK, result)
+		return
+	}
+	for _, orphan := range bindings {
+		if err := cserv.removeOrphanedBinding(orphan); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", orphan.key(), err.Error()))
+			continue
+		}
+		result.Bindings = append(result.Bindings, orphan)
+	}
+	for _, orphan := range instances {
+		if err := cserv.removeOrphanedInstance(orphan); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", orphan.InstanceId, err.Error()))
+			continue
+		}
+		result.Instances = append(result.Instances, orphan)
+	}
+	r.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	structs "region-api/structs"
+	"testing"
+	"time"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOrphans(t *testing.T) {
+	Convey("Test finding orphaned bindings and instances", t, func() {
+		now := time.Now()
+		old := now.Add(-2 * orphanGracePeriod)
+		recent := now.Add(-time.Minute)
+		live := map[appKey]bool{{"api", "default"}: true, {"worker", "default"}: true}
+		bindings := []structs.Bindspec{
+			{App: "api", Space: "default", Bindtype: "postgresql", Bindname: "abc"},
+			{App: "deleted", Space: "default", Bindtype: "kafka", Bindname: "user1"},
+			{App: "worker", Space: "default", Bindtype: "rabbitmq", Bindname: "gone"},
+		}
+		usage := []InstanceUsage{
+			{Service: "postgresql", InstanceId: "abc", State: "succeeded", Created: &old, Apps: []InstanceUsageApp{{App: "api", Space: "default"}}},
+			{Service: "kafka", InstanceId: "user1", State: "succeeded", Created: &old, Apps: []InstanceUsageApp{{App: "deleted", Space: "default"}}},
+			{Service: "redis", InstanceId: "owned", State: "succeeded", Created: &old, Owner: &InstanceOwner{Space: "default"}, Apps: []InstanceUsageApp{}},
+			{Service: "redis", InstanceId: "new", State: "succeeded", Created: &recent, Apps: []InstanceUsageApp{}},
+			{Service: "redis", InstanceId: "pending", State: string(osb.StateInProgress), Created: &old, Apps: []InstanceUsageApp{}},
+			{Service: "redis", InstanceId: "abandoned", State: "succeeded", Created: &old, Owner: &InstanceOwner{Space: "default", App: "deleted"}, Apps: []InstanceUsageApp{}},
+			{Service: "vault", InstanceId: "secret/path", Apps: []InstanceUsageApp{{App: "deleted", Space: "default"}}},
+		}
+		exists := func(bind structs.Bindspec) (bool, error) {
+			return bind.Bindname != "gone", nil
+		}
+
+		Convey("Bindings of deleted apps or to removed instances should be reported", func() {
+			report, err := classifyOrphans(live, bindings, usage, exists, now)
+			So(err, ShouldBeNil)
+			So(len(report.Bindings), ShouldEqual, 2)
+			So(report.Bindings[0].Bindname, ShouldEqual, "user1")
+			So(report.Bindings[0].Reason, ShouldEqual, OrphanReasonAppMissing)
+			So(report.Bindings[1].Bindname, ShouldEqual, "gone")
+			So(report.Bindings[1].Reason, ShouldEqual, OrphanReasonInstanceMissing)
+		})
+
+		Convey("Only settled instances without live apps or owners should be reported", func() {
+			report, err := classifyOrphans(live, bindings, usage, exists, now)
+			So(err, ShouldBeNil)
+			So(len(report.Instances), ShouldEqual, 2)
+			So(report.Instances[0].InstanceId, ShouldEqual, "user1")
+			So(report.Instances[1].InstanceId, ShouldEqual, "abandoned")
+			So(report.Instances[1].Owner.App, ShouldEqual, "deleted")
+		})
+
+		Convey("Errors checking for an instance should stop the check", func() {
+			_, err := classifyOrphans(live, bindings, usage, func(bind structs.Bindspec) (bool, error) {
+				return false, errors.New("broker unavailable")
+			}, now)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Cleanup should only select requested bindings and instances that are still orphaned", func() {
+			report, _ := classifyOrphans(live, bindings, usage, exists, now)
+			selected, instances, skipped := selectOrphans(report, OrphanCleanupRequest{
+				Bindings:  []OrphanedBinding{{App: "deleted", Space: "default", Bindtype: "kafka", Bindname: "user1"}, {App: "api", Space: "default", Bindtype: "postgresql", Bindname: "abc"}},
+				Instances: []string{"abandoned", "owned"},
+			})
+			So(len(selected), ShouldEqual, 1)
+			So(selected[0].Reason, ShouldEqual, OrphanReasonAppMissing)
+			So(len(instances), ShouldEqual, 1)
+			So(instances[0].InstanceId, ShouldEqual, "abandoned")
+			So(skipped, ShouldResemble, []string{"postgresql:abc bound to api-default", "owned"})
+		})
+
+		Convey("Instances the broker no longer has should be recognized", func() {
+			So(isGoneError(osb.HTTPStatusCodeError{StatusCode: http.StatusNotFound}), ShouldBeTrue)
+			So(isGoneError(osb.HTTPStatusCodeError{StatusCode: http.StatusGone}), ShouldBeTrue)
+			So(isGoneError(osb.HTTPStatusCodeError{StatusCode: http.StatusInternalServerError}), ShouldBeFalse)
+			So(isGoneError(errors.New("connection refused")), ShouldBeFalse)
+			So(isGoneError(nil), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	utils "region-api/utils"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+const defaultOSBCredentialsTTL = 15 * time.Minute
+
+// Binding credentials retrieved from a broker, kept (encrypted) so apps can still deploy when
+// the broker is unavailable. The credentials themselves are never returned by the api.
+type CachedBindingCredentials struct {
+	InstanceId  string     `json:"instance_id"`
+	BindingId   string     `json:"binding_id"`
+	ServiceId   string     `json:"service_id"`
+	ServiceName string     `json:"service_name"`
+	Fetched     *time.Time `json:"fetched"`
+	Age         int64      `json:"age"`
+	Stale       bool       `json:"stale"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	credentials string
+}
+
+// How long binding credentials are used before they're retrieved from the broker again, set
+// with OSB_CREDENTIALS_TTL (e.g., 30m).
+func osbCredentialsTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("OSB_CREDENTIALS_TTL")); err == nil && ttl >= 0 {
+		return ttl
+	}
+	return defaultOSBCredentialsTTL
+}
+
+func (cached *CachedBindingCredentials) setAge(now time.Time, ttl time.Duration) {
+	age := now.Sub(*cached.Fetched)
+	cached.Age = int64(age / time.Second)
+	cached.Stale = age >= ttl
+}
+
+func (cached *CachedBindingCredentials) Credentials() (map[string]interface{}, error) {
+	data, err := utils.Decrypt(cached.credentials)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]interface{})
+	err = json.Unmarshal([]byte(data), &credentials)
+	return credentials, err
+}
+
+func scanCachedBindingCredentials(rows interface{ Scan(...interface{}) error }) (*CachedBindingCredentials, error) {
+	var cached CachedBindingCredentials
+	var fetched time.Time
+	var lastError sql.NullString
+	if err := rows.Scan(&cached.InstanceId, &cached.BindingId, &cached.ServiceId, &cached.ServiceName, &cached.credentials, &fetched, &lastError, &cached.LastErrorAt); err != nil {
+		return nil, err
+	}
+	cached.Fetched = &fetched
+	cached.LastError = lastError.String
+	cached.setAge(time.Now(), osbCredentialsTTL())
+	return &cached, nil
+}
+
+// Returns nil if nothing is cached for the binding.
+func getCachedBindingCredentials(db *sql.DB, instanceId string, bindingId string) (*CachedBindingCredentials, error) {
+	cached, err := scanCachedBindingCredentials(db.QueryRow("select instance_id, binding_id, service_id, service_name, credentials, fetched, last_error, last_error_at from osb_binding_credentials where instance_id=$1 and binding_id=$2", instanceId, bindingId))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return cached, err
+}
+
+func getAllCachedBindingCredentials(db *sql.DB) ([]CachedBindingCredentials, error) {
+	rows, err := db.Query("select instance_id, binding_id, service_id, service_name, credentials, fetched, last_error, last_error_at from osb_binding_credentials order by fetched")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	all := make([]CachedBindingCredentials, 0)
+	for rows.Next() {
+		cached, err := scanCachedBindingCredentials(rows)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, *cached)
+	}
+	return all, nil
+}
+
+func hasCachedBindingCredentials(db *sql.DB, servicetype string) bool {
+	var count int
+	if err := db.QueryRow("select count(*) from osb_binding_credentials where service_id=$1 or service_name=$1", servicetype).Scan(&count); err != nil {
+		log.Printf("WARNING: Unable to check the cached credentials for %s: %s\n", servicetype, err.Error())
+		return false
+	}
+	return count > 0
+}
+
+func cacheBindingCredentials(db *sql.DB, service osb.Service, instanceId string, bindingId string, credentials map[string]interface{}) error {
+	data, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+	encrypted, err := utils.Encrypt(string(data))
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`insert into osb_binding_credentials (instance_id, binding_id, service_id, service_name, credentials, fetched) values ($1, $2, $3, $4, $5, now())
+		on conflict (instance_id, binding_id) do update set service_id=$3, service_name=$4, credentials=$5, fetched=now(), last_error=null, last_error_at=null`,
+		instanceId, bindingId, service.ID, service.Name, encrypted)
+	return err
+}
+
+func recordBindingCredentialsError(db *sql.DB, instanceId string, bindingId string, cause error) {
+	if _, err := db.Exec("update osb_binding_credentials set last_error=$3, last_error_at=now() where instance_id=$1 and binding_id=$2", instanceId, bindingId, cause.Error()); err != nil {
+		log.Printf("WARNING: Unable to record the error for the credentials of %s/%s: %s\n", instanceId, bindingId, err.Error())
+	}
+}
+
+// Removes the cached credentials for a binding, or all of the bindings of the instance if the binding is empty.
+func removeCachedBindingCredentials(db *sql.DB, instanceId string, bindingId string) {
+	var err error
+	if bindingId == "" {
+		_, err = db.Exec("delete from osb_binding_credentials where instance_id=$1", instanceId)
+	} else {
+		_, err = db.Exec("delete from osb_binding_credentials where instance_id=$1 and binding_id=$2", instanceId, bindingId)
+	}
+	if err != nil {
+		log.Printf("WARNING: Unable to remove the cached credentials for %s/%s: %s\n", instanceId, bindingId, err.Error())
+	}
+}
+
+// Retrieves the credentials from the broker and caches them, the servicetype can be an id or service name.
+func (cserv *OSBClientServices) fetchBindingCredentials(servicetype string, instanceId string, bindingId string) (map[string]interface{}, error) {
+	service, err := cserv.GetServiceByID(servicetype)
+	if err != nil {
+		if service, err = cserv.GetServiceByName(servicetype); err != nil {
+			return nil, errors.New("No such servicetype")
+		}
+	}
+	provider, err := cserv.GetProviderByID(service.ID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := provider.client.GetBinding(&osb.GetBindingRequest{BindingID: bindingId, InstanceID: instanceId})
+	if err != nil {
+		return nil, err
+	}
+	if err = cacheBindingCredentials(cserv.db, *service, instanceId, bindingId, resp.Credentials); err != nil {
+		log.Printf("WARNING: Unable to cache the credentials for %s/%s: %s\n", instanceId, bindingId, err.Error())
+	}
+	return resp.Credentials, nil
+}
+
+func (cserv *OSBClientServices) HttpGetCachedBindingCredentials(r render.Render) {
+	all, err := getAllCachedBindingCredentials(cserv.db)
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, all)
+}
+
+func (cserv *OSBClientServices) HttpRefreshBindingCredentials(params martini.Params, r render.Render) {
+	cached, err := getCachedBindingCredentials(cserv.db, params["instance_id"], params["binding_id"])
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if cached == nil {
+		utils.ReportNotFoundError(r)
+		return
+	}
+	if _, err = cserv.fetchBindingCredentials(cached.ServiceId, cached.InstanceId, cached.BindingId); err != nil {
+		recordBindingCredentialsError(cserv.db, cached.InstanceId, cached.BindingId, err)
+		ProcessErrors(err, r)
+		return
+	}
+	if cached, err = getCachedBindingCredentials(cserv.db, params["instance_id"], params["binding_id"]); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, cached)
+}
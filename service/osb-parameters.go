@@ -0,0 +1,241 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/martini-contrib/render"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+const (
+	OperationProvision = "provision"
+	OperationUpdate    = "update"
+	OperationBind      = "bind"
+)
+
+// The json schema a plan declares for the parameters of an operation, nil if it has none.
+func planParametersSchema(plan *osb.Plan, operation string) interface{} {
+	if plan == nil || plan.Schemas == nil {
+		return nil
+	}
+	switch operation {
+	case OperationProvision:
+		if plan.Schemas.ServiceInstance != nil && plan.Schemas.ServiceInstance.Create != nil {
+			return plan.Schemas.ServiceInstance.Create.Parameters
+		}
+	case OperationUpdate:
+		if plan.Schemas.ServiceInstance != nil && plan.Schemas.ServiceInstance.Update != nil {
+			return plan.Schemas.ServiceInstance.Update.Parameters
+		}
+	case OperationBind:
+		if plan.Schemas.ServiceBinding != nil && plan.Schemas.ServiceBinding.Create != nil {
+			return plan.Schemas.ServiceBinding.Create.Parameters
+		}
+	}
+	return nil
+}
+
+// Validates the parameters of an operation against the schema of the plan, returning a description
+// of each problem found. Updates without parameters leave the instance's parameters as they are
+// and are not validated.
+func ValidateParameters(plan *osb.Plan, operation string, parameters map[string]interface{}) []string {
+	problems := make([]string, 0)
+	schema := planParametersSchema(plan, operation)
+	if schema == nil || (operation == OperationUpdate && parameters == nil) {
+		return problems
+	}
+	// Round trip the parameters so numbers and nested values have the types the schema expects.
+	var value interface{} = map[string]interface{}{}
+	if parameters != nil {
+		data, err := json.Marshal(parameters)
+		if err != nil {
+			return append(problems, "parameters: "+err.Error())
+		}
+		if err = json.Unmarshal(data, &value); err != nil {
+			return append(problems, "parameters: "+err.Error())
+		}
+	}
+	return validateSchema(schema, value, "parameters", problems)
+}
+
+// The context is passed to the broker as is, but must identify the platform as the OSB spec requires.
+func ValidateContext(context map[string]interface{}) error {
+	if len(context) == 0 {
+		return nil
+	}
+	if platform, ok := context["platform"].(string); !ok || platform == "" {
+		return errors.New("The context must include the platform.")
+	}
+	return nil
+}
+
+func reportInvalidParameters(problems []string, r render.Render) {
+	r.JSON(http.StatusBadRequest, map[string]interface{}{"error": "InvalidParameters", "description": "The parameters are not valid for the plan: " + strings.Join(problems, "; "), "errors": problems})
+}
+
+func reportInvalidContext(err error, r render.Render) {
+	r.JSON(http.StatusBadRequest, map[string]interface{}{"error": "InvalidContext", "description": err.Error()})
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func matchesType(value interface{}, expected string) bool {
+	actual := jsonType(value)
+	return actual == expected || (expected == "number" && actual == "integer")
+}
+
+func schemaNumber(schema map[string]interface{}, key string) (float64, bool) {
+	n, ok := schema[key].(float64)
+	return n, ok
+}
+
+// Checks a value against the commonly used json schema keywords, keywords that are not supported
+// are ignored.
+func validateSchema(rawSchema interface{}, value interface{}, path string, problems []string) []string {
+	schema, ok := rawSchema.(map[string]interface{})
+	if !ok {
+		return problems
+	}
+	if t, ok := schema["type"]; ok {
+		types := make([]string, 0)
+		switch v := t.(type) {
+		case string:
+			types = append(types, v)
+		case []interface{}:
+			for _, s := range v {
+				if str, ok := s.(string); ok {
+					types = append(types, str)
+				}
+			}
+		}
+		matched := len(types) == 0
+		for _, expected := range types {
+			matched = matched || matchesType(value, expected)
+		}
+		if !matched {
+			return append(problems, fmt.Sprintf("%s must be of type %s", path, strings.Join(types, " or ")))
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		options := make([]string, 0)
+		for _, option := range enum {
+			found = found || fmt.Sprintf("%v", option) == fmt.Sprintf("%v", value) && jsonType(option) == jsonType(value)
+			options = append(options, fmt.Sprintf("%v", option))
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s must be one of %s", path, strings.Join(options, ", ")))
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		if min, ok := schemaNumber(schema, "minLength"); ok && float64(len([]rune(v))) < min {
+			problems = append(problems, fmt.Sprintf("%s must be at least %v characters", path, min))
+		}
+		if max, ok := schemaNumber(schema, "maxLength"); ok && float64(len([]rune(v))) > max {
+			problems = append(problems, fmt.Sprintf("%s must be at most %v characters", path, max))
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(v) {
+				problems = append(problems, fmt.Sprintf("%s must match %s", path, pattern))
+			}
+		}
+	case float64:
+		if min, ok := schemaNumber(schema, "minimum"); ok && v < min {
+			problems = append(problems, fmt.Sprintf("%s must be at least %v", path, min))
+		}
+		if max, ok := schemaNumber(schema, "maximum"); ok && v > max {
+			problems = append(problems, fmt.Sprintf("%s must be at most %v", path, max))
+		}
+		if min, ok := schemaNumber(schema, "exclusiveMinimum"); ok && v <= min {
+			problems = append(problems, fmt.Sprintf("%s must be greater than %v", path, min))
+		}
+		if max, ok := schemaNumber(schema, "exclusiveMaximum"); ok && v >= max {
+			problems = append(problems, fmt.Sprintf("%s must be less than %v", path, max))
+		}
+	case []interface{}:
+		if min, ok := schemaNumber(schema, "minItems"); ok && float64(len(v)) < min {
+			problems = append(problems, fmt.Sprintf("%s must have at least %v items", path, min))
+		}
+		if max, ok := schemaNumber(schema, "maxItems"); ok && float64(len(v)) > max {
+			problems = append(problems, fmt.Sprintf("%s must have at most %v items", path, max))
+		}
+		if items, ok := schema["items"]; ok {
+			for i, item := range v {
+				problems = validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i), problems)
+			}
+		}
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if key, ok := name.(string); ok {
+					if _, present := v[key]; !present {
+						problems = append(problems, fmt.Sprintf("%s.%s is required", path, key))
+					}
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		keys := make([]string, 0)
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if property, ok := properties[key]; ok {
+				problems = validateSchema(property, v[key], path+"."+key, problems)
+			} else if additional, ok := schema["additionalProperties"]; ok {
+				if allowed, isBool := additional.(bool); isBool && !allowed {
+					problems = append(problems, fmt.Sprintf("%s.%s is not a supported parameter", path, key))
+				} else if !isBool {
+					problems = validateSchema(additional, v[key], path+"."+key, problems)
+				}
+			}
+		}
+	}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			problems = validateSchema(sub, value, path, problems)
+		}
+	}
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		if options, ok := schema[keyword].([]interface{}); ok {
+			matches := 0
+			for _, sub := range options {
+				if len(validateSchema(sub, value, path, make([]string, 0))) == 0 {
+					matches++
+				}
+			}
+			if matches == 0 || (keyword == "oneOf" && matches > 1) {
+				problems = append(problems, fmt.Sprintf("%s does not match the %s schemas", path, keyword))
+			}
+		}
+	}
+	return problems
+}
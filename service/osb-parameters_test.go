@@ -0,0 +1,67 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func planWithSchema(schema string) *osb.Plan {
+	var parameters interface{}
+	if err := json.Unmarshal([]byte(schema), &parameters); err != nil {
+		panic(err)
+	}
+	return &osb.Plan{ID: "plan", Schemas: &osb.Schemas{
+		ServiceInstance: &osb.ServiceInstanceSchema{
+			Create: &osb.InputParametersSchema{Parameters: parameters},
+			Update: &osb.InputParametersSchema{Parameters: parameters},
+		},
+		ServiceBinding: &osb.ServiceBindingSchema{Create: &osb.RequestResponseSchema{InputParametersSchema: osb.InputParametersSchema{Parameters: parameters}}},
+	}}
+}
+
+func TestOSBParameters(t *testing.T) {
+	Convey("Test validating open service broker parameters and context", t, func() {
+		plan := planWithSchema(`{
+			"$schema": "http://json-schema.org/draft-04/schema#",
+			"type": "object",
+			"required": ["size"],
+			"additionalProperties": false,
+			"properties": {
+				"size": {"type": "string", "enum": ["small", "large"]},
+				"replicas": {"type": "integer", "minimum": 1, "maximum": 5},
+				"name": {"type": "string", "pattern": "^[a-z]+$", "maxLength": 10},
+				"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}}
+			}
+		}`)
+
+		Convey("Parameters matching the plan's schema should be accepted", func() {
+			So(ValidateParameters(plan, OperationProvision, map[string]interface{}{"size": "small", "replicas": 3, "tags": []string{"a"}}), ShouldBeEmpty)
+			So(ValidateParameters(&osb.Plan{ID: "plan"}, OperationProvision, map[string]interface{}{"anything": true}), ShouldBeEmpty)
+		})
+
+		Convey("Each problem with the parameters should be described", func() {
+			problems := ValidateParameters(plan, OperationProvision, map[string]interface{}{"replicas": 2.5, "name": "Bad-Name", "tags": []interface{}{"a", 1, "c"}, "extra": 1})
+			So(problems, ShouldContain, "parameters.size is required")
+			So(problems, ShouldContain, "parameters.replicas must be of type integer")
+			So(problems, ShouldContain, "parameters.name must match ^[a-z]+$")
+			So(problems, ShouldContain, "parameters.tags must have at most 2 items")
+			So(problems, ShouldContain, "parameters.tags[1] must be of type string")
+			So(problems, ShouldContain, "parameters.extra is not a supported parameter")
+			So(ValidateParameters(plan, OperationBind, map[string]interface{}{"size": "medium"}), ShouldResemble, []string{"parameters.size must be one of small, large"})
+		})
+
+		Convey("Missing parameters should be validated except on updates", func() {
+			So(ValidateParameters(plan, OperationProvision, nil), ShouldResemble, []string{"parameters.size is required"})
+			So(ValidateParameters(plan, OperationUpdate, nil), ShouldBeEmpty)
+		})
+
+		Convey("The context must identify the platform", func() {
+			So(ValidateContext(nil), ShouldBeNil)
+			So(ValidateContext(map[string]interface{}{"platform": "akkeris", "space": "default"}), ShouldBeNil)
+			So(ValidateContext(map[string]interface{}{"space": "default"}), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,350 @@
+package service
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+const (
+	OperationDeprovision = "deprovision"
+
+	minOperationPollInterval     = 10 * time.Second
+	maxOperationPollInterval     = 5 * time.Minute
+	defaultOperationTimeout      = 1 * time.Hour
+	OperationEventInstanceReady  = "instance_ready"
+	OperationEventInstanceFailed = "instance_failed"
+	OperationEventInstanceGone   = "instance_deprovisioned"
+	OperationEventBindingReady   = "binding_ready"
+	OperationEventBindingFailed  = "binding_failed"
+)
+
+// Sent to OSB_EVENTS_WEBHOOK when an asynchronous operation finishes, apps lists the apps (as
+// app-space) bound to the instance so they can be deployed once it's ready.
+type OperationEvent struct {
+	Action      string   `json:"action"`
+	InstanceId  string   `json:"instance_id"`
+	BindingId   string   `json:"binding_id,omitempty"`
+	ServiceId   string   `json:"service_id"`
+	PlanId      string   `json:"plan_id"`
+	Operation   string   `json:"operation,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Apps        []string `json:"apps"`
+}
+
+type operationPoll struct {
+	State       osb.LastOperationState
+	Description string
+	RetryAfter  time.Duration
+	Gone        bool
+}
+
+var pollingOperations int32
+
+// How long an asynchronous operation may be in progress before it's marked as failed, set with OSB_OPERATION_TIMEOUT.
+func osbOperationTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(os.Getenv("OSB_OPERATION_TIMEOUT")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultOperationTimeout
+}
+
+// The delay before an operation is polled again, the broker's Retry-After is used if it sent one
+// otherwise the delay doubles with each poll.
+func pollBackoff(attempts int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if retryAfter < minOperationPollInterval {
+			return minOperationPollInterval
+		}
+		return retryAfter
+	}
+	delay := minOperationPollInterval
+	for i := 0; i < attempts && delay < maxOperationPollInterval; i++ {
+		delay = delay * 2
+	}
+	if delay > maxOperationPollInterval {
+		return maxOperationPollInterval
+	}
+	return delay
+}
+
+// Retry-After may be a number of seconds or an http date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// Polls the last operation endpoint of the broker directly, the osb client does not return
+// the Retry-After header.
+func (provider *providerInfo) pollOperation(path string, serviceId string, planId string, operationKey *string) (*operationPoll, error) {
+	brokerUrl, err := url.Parse(provider.serviceUrl)
+	if err != nil {
+		return nil, err
+	}
+	brokerUrl.User = nil
+	query := url.Values{}
+	query.Set("service_id", serviceId)
+	query.Set("plan_id", planId)
+	if operationKey != nil {
+		query.Set("operation", *operationKey)
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s?%s", strings.TrimRight(brokerUrl.String(), "/"), path, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Broker-API-Version", "2.13")
+	if provider.auth != nil && provider.auth.BasicAuthConfig != nil {
+		req.SetBasicAuth(provider.auth.BasicAuthConfig.Username, provider.auth.BasicAuthConfig.Password)
+	} else if provider.auth != nil && provider.auth.BearerConfig != nil {
+		req.Header.Set("Authorization", "Bearer "+provider.auth.BearerConfig.Token)
+	}
+	client := http.Client{Timeout: time.Second * 30}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	poll := operationPoll{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	if resp.StatusCode == http.StatusGone {
+		poll.Gone = true
+		return &poll, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("The broker responded with %d", resp.StatusCode)
+	}
+	var body osb.LastOperationResponse
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	poll.State = body.State
+	if body.Description != nil {
+		poll.Description = *body.Description
+	}
+	return &poll, nil
+}
+
+func (cserv *OSBClientServices) startOperation(instanceId string, operation string, operationKey *string) error {
+	_, err := cserv.db.Exec("update service_instances set operation=$2, operation_key=$3, status=$4, status_description=null, operation_started=now(), next_poll=now(), poll_attempts=0 where instance_id=$1",
+		instanceId, operation, operationKey, string(osb.StateInProgress))
+	return err
+}
+
+func (cserv *OSBClientServices) startBindingOperation(bindingId string, instanceId string, serviceId string, planId string, operationKey *osb.OperationKey) error {
+	var opkey *string = nil
+	if operationKey != nil {
+		tmpkey := string(*operationKey)
+		opkey = &tmpkey
+	}
+	_, err := cserv.db.Exec(`insert into service_bindings (instance_id, binding_id, service_id, plan_id, operation_key, status) values ($1, $2, $3, $4, $5, $6)
+		on conflict (instance_id, binding_id) do update set service_id=$3, plan_id=$4, operation_key=$5, status=$6, status_description=null, operation_started=now(), next_poll=now(), poll_attempts=0`,
+		instanceId, bindingId, serviceId, planId, opkey, string(osb.StateInProgress))
+	return err
+}
+
+// Records the outcome of an instance's operation, a deprovisioned instance is removed.
+func (cserv *OSBClientServices) completeOperation(instanceId string, state osb.LastOperationState, description string) error {
+	var serviceId, planId string
+	var operation sql.NullString
+	if err := cserv.db.QueryRow("select service_id, plan_id, operation from service_instances where instance_id=$1", instanceId).Scan(&serviceId, &planId, &operation); err != nil {
+		return err
+	}
+	event := OperationEvent{InstanceId: instanceId, ServiceId: serviceId, PlanId: planId, Operation: operation.String, Description: description}
+	if operation.String == OperationDeprovision && state == osb.StateSucceeded {
+		if err := cserv.RemoveInstanceInfo(instanceId); err != nil {
+			return err
+		}
+		removeCachedBindingCredentials(cserv.db, instanceId, "")
+		event.Action = OperationEventInstanceGone
+	} else {
+		if _, err := cserv.db.Exec("update service_instances set status=$2, status_description=$3, next_poll=null where instance_id=$1", instanceId, string(state), description); err != nil {
+			return err
+		}
+		event.Action = OperationEventInstanceReady
+		if state != osb.StateSucceeded {
+			event.Action = OperationEventInstanceFailed
+		}
+	}
+	cserv.sendOperationEvent(event)
+	return nil
+}
+
+func (cserv *OSBClientServices) completeBindingOperation(instanceId string, bindingId string, serviceId string, planId string, state osb.LastOperationState, description string) error {
+	if _, err := cserv.db.Exec("update service_bindings set status=$3, status_description=$4, next_poll=null where instance_id=$1 and binding_id=$2", instanceId, bindingId, string(state), description); err != nil {
+		return err
+	}
+	action := OperationEventBindingReady
+	if state != osb.StateSucceeded {
+		action = OperationEventBindingFailed
+	}
+	cserv.sendOperationEvent(OperationEvent{Action: action, InstanceId: instanceId, BindingId: bindingId, ServiceId: serviceId, PlanId: planId, Operation: "bind", Description: description})
+	return nil
+}
+
+func (cserv *OSBClientServices) boundApps(instanceId string) []string {
+	apps := make([]string, 0)
+	rows, err := cserv.db.Query("select appname, space from appbindings where bindname=$1 order by appname, space", instanceId)
+	if err != nil {
+		log.Printf("WARNING: Unable to get the apps bound to %s: %s\n", instanceId, err.Error())
+		return apps
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var app, space string
+		if err = rows.Scan(&app, &space); err == nil {
+			apps = append(apps, app+"-"+space)
+		}
+	}
+	return apps
+}
+
+func (cserv *OSBClientServices) sendOperationEvent(event OperationEvent) {
+	if os.Getenv("DEBUG_OSB") == "true" {
+		log.Printf("[osb] %s %s %s\n", event.Action, event.InstanceId, event.BindingId)
+	}
+	webhook := os.Getenv("OSB_EVENTS_WEBHOOK")
+	if webhook == "" {
+		return
+	}
+	event.Apps = cserv.boundApps(event.InstanceId)
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("WARNING: Unable to send the %s event for %s: %s\n", event.Action, event.InstanceId, err.Error())
+		return
+	}
+	client := http.Client{Timeout: time.Second * 10}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("WARNING: Unable to send the %s event for %s: %s\n", event.Action, event.InstanceId, err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("WARNING: The webhook %s responded with %d to the %s event for %s\n", webhook, resp.StatusCode, event.Action, event.InstanceId)
+	}
+}
+
+type pendingOperation struct {
+	instanceId   string
+	bindingId    string
+	serviceId    string
+	planId       string
+	operationKey *string
+	operation    string
+	started      *time.Time
+	attempts     int
+}
+
+// Decides what to do with a poll of an operation, returns the state the operation finished in
+// (or in progress if it should be polled again) and its description.
+func operationOutcome(op pendingOperation, poll *operationPoll, err error, now time.Time, timeout time.Duration) (osb.LastOperationState, string) {
+	if op.started != nil && now.Sub(*op.started) > timeout {
+		return osb.StateFailed, fmt.Sprintf("The %s did not complete within %s.", op.operation, timeout)
+	}
+	if err != nil {
+		return osb.StateInProgress, ""
+	}
+	if poll.Gone {
+		if op.operation == OperationDeprovision {
+			return osb.StateSucceeded, ""
+		}
+		return osb.StateFailed, "The broker no longer has the " + op.operation + " operation."
+	}
+	return poll.State, poll.Description
+}
+
+func (cserv *OSBClientServices) getPendingOperations(bindings bool) ([]pendingOperation, error) {
+	query := "select instance_id, '', service_id, plan_id, operation_key, coalesce(operation, ''), operation_started, poll_attempts from service_instances where status=$1 and (next_poll is null or next_poll <= now())"
+	if bindings {
+		query = "select instance_id, binding_id, service_id, plan_id, operation_key, 'bind', operation_started, poll_attempts from service_bindings where status=$1 and (next_poll is null or next_poll <= now())"
+	}
+	rows, err := cserv.db.Query(query, string(osb.StateInProgress))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	operations := make([]pendingOperation, 0)
+	for rows.Next() {
+		var op pendingOperation
+		if err = rows.Scan(&op.instanceId, &op.bindingId, &op.serviceId, &op.planId, &op.operationKey, &op.operation, &op.started, &op.attempts); err != nil {
+			return nil, err
+		}
+		if op.operation == "" {
+			op.operation = OperationProvision
+		}
+		operations = append(operations, op)
+	}
+	return operations, nil
+}
+
+func (cserv *OSBClientServices) pollPendingOperation(op pendingOperation, timeout time.Duration) error {
+	var poll *operationPoll
+	provider, err := cserv.GetProviderByID(op.serviceId)
+	if err == nil {
+		path := "/v2/service_instances/" + url.PathEscape(op.instanceId) + "/last_operation"
+		if op.bindingId != "" {
+			path = "/v2/service_instances/" + url.PathEscape(op.instanceId) + "/service_bindings/" + url.PathEscape(op.bindingId) + "/last_operation"
+		}
+		poll, err = provider.pollOperation(path, op.serviceId, op.planId, op.operationKey)
+	}
+	if err != nil {
+		log.Printf("WARNING: Unable to poll the %s operation of %s %s: %s\n", op.operation, op.instanceId, op.bindingId, err.Error())
+	}
+	state, description := operationOutcome(op, poll, err, time.Now(), timeout)
+	if state == osb.StateInProgress {
+		var retryAfter time.Duration
+		if poll != nil {
+			retryAfter = poll.RetryAfter
+		}
+		next := time.Now().Add(pollBackoff(op.attempts, retryAfter))
+		if op.bindingId != "" {
+			_, err = cserv.db.Exec("update service_bindings set next_poll=$3, poll_attempts=poll_attempts+1 where instance_id=$1 and binding_id=$2", op.instanceId, op.bindingId, next)
+		} else {
+			_, err = cserv.db.Exec("update service_instances set next_poll=$2, poll_attempts=poll_attempts+1, operation_started=coalesce(operation_started, now()) where instance_id=$1", op.instanceId, next)
+		}
+		return err
+	}
+	if op.bindingId != "" {
+		return cserv.completeBindingOperation(op.instanceId, op.bindingId, op.serviceId, op.planId, state, description)
+	}
+	return cserv.completeOperation(op.instanceId, state, description)
+}
+
+// Polls the asynchronous operations on instances and bindings that are due, this is run periodically.
+func (cserv *OSBClientServices) PollOperations() {
+	if !atomic.CompareAndSwapInt32(&pollingOperations, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&pollingOperations, 0)
+	timeout := osbOperationTimeout()
+	for _, bindings := range []bool{false, true} {
+		operations, err := cserv.getPendingOperations(bindings)
+		if err != nil {
+			log.Printf("WARNING: Unable to get the pending open service broker operations: %s\n", err.Error())
+			continue
+		}
+		for _, op := range operations {
+			if err = cserv.pollPendingOperation(op, timeout); err != nil {
+				log.Printf("WARNING: Unable to record the %s operation of %s %s: %s\n", op.operation, op.instanceId, op.bindingId, err.Error())
+			}
+		}
+	}
+}
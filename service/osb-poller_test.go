@@ -0,0 +1,81 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOSBPoller(t *testing.T) {
+	Convey("Test polling asynchronous open service broker operations", t, func() {
+		Convey("Polls should back off unless the broker asks for a delay", func() {
+			So(pollBackoff(0, 0), ShouldEqual, 10*time.Second)
+			So(pollBackoff(2, 0), ShouldEqual, 40*time.Second)
+			So(pollBackoff(20, 0), ShouldEqual, maxOperationPollInterval)
+			So(pollBackoff(20, 2*time.Second), ShouldEqual, minOperationPollInterval)
+			So(pollBackoff(0, 15*time.Minute), ShouldEqual, 15*time.Minute)
+		})
+
+		Convey("Retry-After should be accepted as seconds or a date", func() {
+			now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			So(parseRetryAfter("", now), ShouldEqual, 0)
+			So(parseRetryAfter("120", now), ShouldEqual, 2*time.Minute)
+			So(parseRetryAfter("Wed, 01 Jan 2020 00:05:00 GMT", now), ShouldEqual, 5*time.Minute)
+			So(parseRetryAfter("soon", now), ShouldEqual, 0)
+		})
+
+		Convey("Operations should finish with the broker's state or fail after the deadline", func() {
+			started := time.Now().Add(-2 * time.Hour)
+			state, _ := operationOutcome(pendingOperation{operation: OperationProvision, started: &started}, &operationPoll{State: osb.StateInProgress}, nil, time.Now(), time.Hour)
+			So(state, ShouldEqual, osb.StateFailed)
+			started = time.Now()
+			state, _ = operationOutcome(pendingOperation{operation: OperationProvision, started: &started}, nil, http.ErrHandlerTimeout, time.Now(), time.Hour)
+			So(state, ShouldEqual, osb.StateInProgress)
+			state, description := operationOutcome(pendingOperation{operation: OperationUpdate, started: &started}, &operationPoll{State: osb.StateFailed, Description: "quota exceeded"}, nil, time.Now(), time.Hour)
+			So(state, ShouldEqual, osb.StateFailed)
+			So(description, ShouldEqual, "quota exceeded")
+			state, _ = operationOutcome(pendingOperation{operation: OperationDeprovision, started: &started}, &operationPoll{Gone: true}, nil, time.Now(), time.Hour)
+			So(state, ShouldEqual, osb.StateSucceeded)
+			state, _ = operationOutcome(pendingOperation{operation: OperationProvision, started: &started}, &operationPoll{Gone: true}, nil, time.Now(), time.Hour)
+			So(state, ShouldEqual, osb.StateFailed)
+		})
+
+		Convey("The last operation should be polled with the broker's credentials", func() {
+			broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				username, password, ok := req.BasicAuth()
+				if !ok || username != "user" || password != "pass" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if req.URL.Path == "/v2/service_instances/gone/last_operation" {
+					w.WriteHeader(http.StatusGone)
+					return
+				}
+				if req.URL.Query().Get("operation") != "op-1" || req.URL.Query().Get("plan_id") != "plan" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("Retry-After", "30")
+				w.Write([]byte(`{"state":"in progress","description":"creating"}`))
+			}))
+			defer broker.Close()
+			provider := providerInfo{serviceUrl: broker.URL + "/", auth: &osb.AuthConfig{BasicAuthConfig: &osb.BasicAuthConfig{Username: "user", Password: "pass"}}}
+			operationKey := "op-1"
+			poll, err := provider.pollOperation("/v2/service_instances/abc/last_operation", "service", "plan", &operationKey)
+			So(err, ShouldBeNil)
+			So(poll.State, ShouldEqual, osb.StateInProgress)
+			So(poll.Description, ShouldEqual, "creating")
+			So(poll.RetryAfter, ShouldEqual, 30*time.Second)
+			poll, err = provider.pollOperation("/v2/service_instances/gone/last_operation", "service", "plan", nil)
+			So(err, ShouldBeNil)
+			So(poll.Gone, ShouldBeTrue)
+			provider.auth = nil
+			_, err = provider.pollOperation("/v2/service_instances/abc/last_operation", "service", "plan", &operationKey)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,298 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	structs "region-api/structs"
+	utils "region-api/utils"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+)
+
+const (
+	BindingRoleReadOnly  = "read-only"
+	BindingRoleReadWrite = "read-write"
+)
+
+var (
+	ErrInstanceNotShared = errors.New("The service instance is not shared with this space.")
+	ErrReadOnlyShare     = errors.New("The service instance is only shared read-only with this space.")
+	ErrInvalidRole       = errors.New("The role must be read-only or read-write.")
+)
+
+// The space (and optionally app) that provisioned an instance, other spaces may only bind to it through a share.
+type InstanceOwner struct {
+	Space string `json:"space"`
+	App   string `json:"app,omitempty"`
+}
+
+type InstanceShare struct {
+	InstanceId string     `json:"instance_id"`
+	Space      string     `json:"space"`
+	Role       string     `json:"role"`
+	Created    *time.Time `json:"created,omitempty"`
+}
+
+type InstanceShareRequest struct {
+	Role string `json:"role"`
+}
+
+type InstanceAccess struct {
+	InstanceId string          `json:"instance_id"`
+	Owner      *InstanceOwner  `json:"owner"`
+	Shares     []InstanceShare `json:"shares"`
+}
+
+func validBindingRole(role string) bool {
+	return role == BindingRoleReadOnly || role == BindingRoleReadWrite
+}
+
+// The owner is taken from the space and app in the provision context, if given.
+func ownerFromContext(context map[string]interface{}) *InstanceOwner {
+	space, _ := context["space"].(string)
+	if space == "" {
+		return nil
+	}
+	app, _ := context["app"].(string)
+	return &InstanceOwner{Space: space, App: app}
+}
+
+// Determines the role a binding from an app in a space receives. Owned instances may only be bound from the
+// owning space or a space it was shared with, the requested role cannot exceed what was granted. Instances
+// without an owner (provisioned before ownership was recorded) can be bound from anywhere.
+func bindingRoleFor(owner *InstanceOwner, share *InstanceShare, space string, requested string) (string, error) {
+	if requested != "" && !validBindingRole(requested) {
+		return "", ErrInvalidRole
+	}
+	if owner == nil || owner.Space == space {
+		if requested == "" {
+			return BindingRoleReadWrite, nil
+		}
+		return requested, nil
+	}
+	if share == nil {
+		return "", ErrInstanceNotShared
+	}
+	if requested == "" {
+		return share.Role, nil
+	}
+	if requested == BindingRoleReadWrite && share.Role != BindingRoleReadWrite {
+		return "", ErrReadOnlyShare
+	}
+	return requested, nil
+}
+
+func getInstanceOwner(db *sql.DB, instanceId string) (*InstanceOwner, error) {
+	var space, app sql.NullString
+	if err := db.QueryRow("select owner_space, owner_app from service_instances where instance_id=$1", instanceId).Scan(&space, &app); err != nil {
+		return nil, err
+	}
+	if space.String == "" {
+		return nil, nil
+	}
+	return &InstanceOwner{Space: space.String, App: app.String}, nil
+}
+
+func setInstanceOwner(db *sql.DB, instanceId string, owner InstanceOwner) error {
+	_, err := db.Exec("update service_instances set owner_space=$2, owner_app=$3 where instance_id=$1", instanceId, owner.Space, sql.NullString{String: owner.App, Valid: owner.App != ""})
+	return err
+}
+
+// Returns nil if the instance is not shared with the space.
+func getInstanceShare(db *sql.DB, instanceId string, space string) (*InstanceShare, error) {
+	var share InstanceShare
+	err := db.QueryRow("select instance_id, space, role, created from service_instance_shares where instance_id=$1 and space=$2", instanceId, space).Scan(&share.InstanceId, &share.Space, &share.Role, &share.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &share, err
+}
+
+func getInstanceShares(db *sql.DB, instanceId string) ([]InstanceShare, error) {
+	rows, err := db.Query("select instance_id, space, role, created from service_instance_shares where instance_id=$1 order by space", instanceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shares := make([]InstanceShare, 0)
+	for rows.Next() {
+		var share InstanceShare
+		if err = rows.Scan(&share.InstanceId, &share.Space, &share.Role, &share.Created); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+func removeInstanceShares(db *sql.DB, instanceId string) {
+	if _, err := db.Exec("delete from service_instance_shares where instance_id=$1", instanceId); err != nil {
+		log.Printf("WARNING: Unable to remove the shares of %s: %s\n", instanceId, err.Error())
+	}
+}
+
+// Checks whether an app in a space may bind to a service instance and returns the role the binding receives.
+// Bind names that are not open service broker instances are not checked and receive no role.
+func AuthorizeInstanceBinding(db *sql.DB, instanceId string, space string, requested string) (string, error) {
+	owner, err := getInstanceOwner(db, instanceId)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	var share *InstanceShare
+	if owner != nil && owner.Space != space {
+		if share, err = getInstanceShare(db, instanceId, space); err != nil {
+			return "", err
+		}
+	}
+	return bindingRoleFor(owner, share, space, requested)
+}
+
+// The role recorded when the app was bound, the binding id of an app's binding is its app and space name
+// unless its credentials were rotated.
+func getBindingRole(db *sql.DB, instanceId string, bindingId string) (string, error) {
+	var role sql.NullString
+	err := db.QueryRow("select role from appbindings where bindname=$1 and coalesce(binding_id, appname || '-' || space)=$2", instanceId, bindingId).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role.String, err
+}
+
+// The role a binding asks for, the role recorded when the app was bound takes precedence over one in the context.
+func requestedBindingRole(recorded string, context map[string]interface{}) string {
+	if recorded != "" {
+		return recorded
+	}
+	role, _ := context["role"].(string)
+	return role
+}
+
+// Authorizes a binding made through the broker api, the space comes from the bind context and the role is
+// checked against the instance's owner and shares at bind time, so a removed or reduced share takes effect.
+func authorizeBrokerBinding(db *sql.DB, instanceId string, bindingId string, context map[string]interface{}) (string, error) {
+	recorded, err := getBindingRole(db, instanceId, bindingId)
+	if err != nil {
+		return "", err
+	}
+	space, _ := context["space"].(string)
+	return AuthorizeInstanceBinding(db, instanceId, space, requestedBindingRole(recorded, context))
+}
+
+func (cserv *OSBClientServices) HttpGetInstanceAccess(params martini.Params, r render.Render) {
+	owner, err := getInstanceOwner(cserv.db, params["instance_id"])
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	shares, err := getInstanceShares(cserv.db, params["instance_id"])
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, InstanceAccess{InstanceId: params["instance_id"], Owner: owner, Shares: shares})
+}
+
+func (cserv *OSBClientServices) HttpSetInstanceOwner(params martini.Params, spec InstanceOwner, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	if spec.Space == "" {
+		utils.ReportInvalidRequest("Space Name can not be blank", r)
+		return
+	}
+	if _, err := getInstanceOwner(cserv.db, params["instance_id"]); err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if err := setInstanceOwner(cserv.db, params["instance_id"], spec); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	// the owning space always has full access, a share to it would be misleading.
+	if _, err := cserv.db.Exec("delete from service_instance_shares where instance_id=$1 and space=$2", params["instance_id"], spec.Space); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, spec)
+}
+
+func (cserv *OSBClientServices) HttpShareInstance(params martini.Params, spec InstanceShareRequest, berr binding.Errors, r render.Render) {
+	if berr != nil {
+		utils.ReportInvalidRequest(berr[0].Message, r)
+		return
+	}
+	if spec.Role == "" {
+		spec.Role = BindingRoleReadOnly
+	}
+	if !validBindingRole(spec.Role) {
+		utils.ReportInvalidRequest(ErrInvalidRole.Error(), r)
+		return
+	}
+	owner, err := getInstanceOwner(cserv.db, params["instance_id"])
+	if err == sql.ErrNoRows {
+		utils.ReportNotFoundError(r)
+		return
+	} else if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if owner == nil {
+		utils.ReportInvalidRequest("The service instance has no owner, set its owner before sharing it.", r)
+		return
+	}
+	if owner.Space == params["space"] {
+		utils.ReportInvalidRequest("The service instance is owned by the space "+owner.Space+".", r)
+		return
+	}
+	if _, err = cserv.db.Exec(`insert into service_instance_shares (instance_id, space, role) values ($1, $2, $3)
+		on conflict (instance_id, space) do update set role=$3`, params["instance_id"], params["space"], spec.Role); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	share, err := getInstanceShare(cserv.db, params["instance_id"], params["space"])
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, share)
+}
+
+func (cserv *OSBClientServices) HttpUnshareInstance(params martini.Params, r render.Render) {
+	share, err := getInstanceShare(cserv.db, params["instance_id"], params["space"])
+	if err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if share == nil {
+		utils.ReportNotFoundError(r)
+		return
+	}
+	var count int
+	if err = cserv.db.QueryRow("select count(*) from appbindings where bindname=$1 and space=$2", share.InstanceId, share.Space).Scan(&count); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	if count > 0 {
+		r.JSON(http.StatusConflict, structs.Messagespec{Status: http.StatusConflict, Message: "The service instance cannot be unshared while apps in " + share.Space + " are bound to it."})
+		return
+	}
+	if _, err = cserv.db.Exec("delete from service_instance_shares where instance_id=$1 and space=$2", share.InstanceId, share.Space); err != nil {
+		utils.ReportError(err, r)
+		return
+	}
+	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: share.InstanceId + " is no longer shared with " + share.Space})
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOSBShares(t *testing.T) {
+	Convey("Test sharing open service broker instances across spaces", t, func() {
+		Convey("The owner should come from the provision context", func() {
+			So(ownerFromContext(nil), ShouldBeNil)
+			So(ownerFromContext(map[string]interface{}{"platform": "akkeris"}), ShouldBeNil)
+			owner := ownerFromContext(map[string]interface{}{"platform": "akkeris", "space": "default", "app": "api"})
+			So(owner, ShouldNotBeNil)
+			So(owner.Space, ShouldEqual, "default")
+			So(owner.App, ShouldEqual, "api")
+		})
+
+		Convey("Instances without an owner can be bound from any space", func() {
+			role, err := bindingRoleFor(nil, nil, "other", "")
+			So(err, ShouldBeNil)
+			So(role, ShouldEqual, BindingRoleReadWrite)
+			role, err = bindingRoleFor(nil, nil, "other", BindingRoleReadOnly)
+			So(err, ShouldBeNil)
+			So(role, ShouldEqual, BindingRoleReadOnly)
+		})
+
+		Convey("The owning space should always be allowed to bind", func() {
+			owner := &InstanceOwner{Space: "default", App: "api"}
+			role, err := bindingRoleFor(owner, nil, "default", "")
+			So(err, ShouldBeNil)
+			So(role, ShouldEqual, BindingRoleReadWrite)
+			_, err = bindingRoleFor(owner, nil, "default", "admin")
+			So(err, ShouldEqual, ErrInvalidRole)
+		})
+
+		Convey("Other spaces should only bind through a share and within its role", func() {
+			owner := &InstanceOwner{Space: "default"}
+			_, err := bindingRoleFor(owner, nil, "other", "")
+			So(err, ShouldEqual, ErrInstanceNotShared)
+			share := &InstanceShare{InstanceId: "abc", Space: "other", Role: BindingRoleReadOnly}
+			role, err := bindingRoleFor(owner, share, "other", "")
+			So(err, ShouldBeNil)
+			So(role, ShouldEqual, BindingRoleReadOnly)
+			_, err = bindingRoleFor(owner, share, "other", BindingRoleReadWrite)
+			So(err, ShouldEqual, ErrReadOnlyShare)
+			share.Role = BindingRoleReadWrite
+			role, err = bindingRoleFor(owner, share, "other", BindingRoleReadOnly)
+			So(err, ShouldBeNil)
+			So(role, ShouldEqual, BindingRoleReadOnly)
+		})
+
+		Convey("Bindings through the broker api should use the recorded role before the context", func() {
+			So(requestedBindingRole("", nil), ShouldEqual, "")
+			So(requestedBindingRole("", map[string]interface{}{"platform": "akkeris", "role": BindingRoleReadOnly}), ShouldEqual, BindingRoleReadOnly)
+			So(requestedBindingRole(BindingRoleReadWrite, map[string]interface{}{"platform": "akkeris", "role": BindingRoleReadOnly}), ShouldEqual, BindingRoleReadWrite)
+			_, err := bindingRoleFor(&InstanceOwner{Space: "default"}, nil, "", "")
+			So(err, ShouldEqual, ErrInstanceNotShared)
+		})
+	})
+}
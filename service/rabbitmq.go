@@ -2,18 +2,17 @@ package service
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
-	"errors"
-	"github.com/bitly/go-simplejson"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/render"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 	structs "region-api/structs"
 	utils "region-api/utils"
-	"strings"
 )
 
 //Tagrabbitmq centralized
@@ -48,51 +47,37 @@ func Tagrabbitmq(spec structs.Tagspec, berr binding.Errors, r render.Render) {
 }
 
 //Deleterabbitmq  centralized
-func Deleterabbitmq(params martini.Params, r render.Render) {
-	servicename := params["servicename"]
-	client := &http.Client{}
-	req, err := http.NewRequest("DELETE", "http://"+os.Getenv("RABBITMQ_BROKER_URL")+"/v1/rabbitmq/instance/"+servicename, nil)
-	resp, err := client.Do(req)
+func Deleterabbitmq(db *sql.DB, params martini.Params, r render.Render) {
+	result, err := newLegacyBroker("rabbitmq", nil).deprovision(params["servicename"])
 	if err != nil {
-		utils.ReportError(err, r)
+		ProcessErrors(err, r)
 		return
 	}
-	defer resp.Body.Close()
-	bodyj, _ := simplejson.NewFromReader(resp.Body)
-
-	r.JSON(200, bodyj)
+	if err = removeLegacyInstance(db, params["servicename"], "rabbitmq"); err != nil {
+		log.Printf("WARNING: Unable to remove the rabbitmq instance %s: %s\n", params["servicename"], err.Error())
+	}
+	r.JSON(200, result)
 }
 
 //Provisionrabbitmq  centralized
-func Provisionrabbitmq(spec structs.Provisionspec, berr binding.Errors, r render.Render) {
+func Provisionrabbitmq(db *sql.DB, spec structs.Provisionspec, berr binding.Errors, r render.Render) {
 	if berr != nil {
 		utils.ReportInvalidRequest(berr[0].Message, r)
 		return
 	}
-	client := &http.Client{}
-	str, err := json.Marshal(spec)
+	broker := newLegacyBroker("rabbitmq", nil)
+	credentials, err := broker.provision(spec)
 	if err != nil {
-		utils.ReportError(err, r)
+		ProcessErrors(err, r)
 		return
 	}
-	jsonStr := []byte(string(str))
-	req, err := http.NewRequest("POST", "http://"+os.Getenv("RABBITMQ_BROKER_URL")+"/v1/rabbitmq/instance", bytes.NewBuffer(jsonStr))
-	resp, err := client.Do(req)
-	if err != nil {
-		utils.ReportError(err, r)
-		return
-	}
-	defer resp.Body.Close()
-	bodyj, _ := simplejson.NewFromReader(resp.Body)
-
-	rabbitmqurl, _ := bodyj.Get("RABBITMQ_URL").String()
-	rabbitmquiurl, _ := bodyj.Get("RABBITMQUI_URL").String()
-	location := rabbitmqurl
-	parts := strings.Split(location, "/")
-	name := parts[len(parts)-1]
 	toreturn := make(map[string]interface{})
-	toreturn["RABBITMQ_URL"] = rabbitmqurl
-	toreturn["RABBITMQUI_URL"] = rabbitmquiurl
+	toreturn["RABBITMQ_URL"] = credentials["RABBITMQ_URL"]
+	toreturn["RABBITMQUI_URL"] = credentials["RABBITMQUI_URL"]
+	name := broker.instanceNameFrom(credentials)
+	if err = recordLegacyInstance(db, name, "rabbitmq", name, spec); err != nil {
+		log.Printf("WARNING: Unable to record the rabbitmq instance %s: %s\n", name, err.Error())
+	}
 	toreturn["spec"] = "rabbitmq:" + name
 
 	r.JSON(201, toreturn)
@@ -100,22 +85,15 @@ func Provisionrabbitmq(spec structs.Provisionspec, berr binding.Errors, r render
 
 //Getrabbitmqurl  centralized
 func Getrabbitmqurl(params martini.Params, r render.Render) {
-	var rabbitmq structs.Rabbitmqspec
 	servicename := params["servicename"]
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "http://"+os.Getenv("RABBITMQ_BROKER_URL")+"/v1/rabbitmq/url/"+servicename, nil)
-	resp, err := client.Do(req)
+	credentials, err := newLegacyBroker("rabbitmq", nil).credentials(servicename)
 	if err != nil {
-		utils.ReportError(err, r)
-		return
-	}
-	defer resp.Body.Close()
-	bodybytes, _ := ioutil.ReadAll(resp.Body)
-	uerr := json.Unmarshal(bodybytes, &rabbitmq)
-	if uerr != nil {
-		utils.ReportError(uerr, r)
+		ProcessErrors(err, r)
 		return
 	}
+	var rabbitmq structs.Rabbitmqspec
+	rabbitmq.RabbitmqUrl, _ = credentials["RABBITMQ_URL"].(string)
+	rabbitmq.RabbitmqUiUrl, _ = credentials["RABBITMQUI_URL"].(string)
 	rabbitmq.Spec = "rabbitmq:" + servicename
 	r.JSON(200, rabbitmq)
 }
@@ -123,43 +101,16 @@ func Getrabbitmqurl(params martini.Params, r render.Render) {
 //Getrabbitmqplans  centralized
 func Getrabbitmqplans(params martini.Params, r render.Render) {
 	var plans []structs.Planspec
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "http://"+os.Getenv("RABBITMQ_BROKER_URL")+"/v1/rabbitmq/plans", nil)
-	resp, err := client.Do(req)
+	sizes, err := newLegacyBroker("rabbitmq", nil).plans()
 	if err != nil {
-		utils.ReportError(err, r)
-		return
-	}
-	defer resp.Body.Close()
-	bodyj, _ := simplejson.NewFromReader(resp.Body)
-	bodymap, maperr := bodyj.Map()
-	if maperr != nil {
-		utils.ReportError(maperr, r)
+		ProcessErrors(err, r)
 		return
 	}
-	for k, v := range bodymap {
+	for k, v := range sizes {
 		var plan structs.Planspec
 		plan.Size = k
-		plan.Description = v.(string)
+		plan.Description = v
 		plans = append(plans, plan)
 	}
 	r.JSON(200, plans)
 }
-
-//Getrabbitmqvars  centralized
-func Getrabbitmqvars(servicename string) (error, map[string]interface{}) {
-	config := make(map[string]interface{})
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "http://"+os.Getenv("RABBITMQ_BROKER_URL")+"/v1/rabbitmq/url/"+servicename, nil)
-	resp, err := client.Do(req)
-	if err != nil {
-		return err, config
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode > 299 {
-		return errors.New("Cannot obtain RABBITMQ_BROKER_URL from broker service"), config
-	}
-	bodyj, _ := simplejson.NewFromReader(resp.Body)
-	config, _ = bodyj.Map()
-	return nil, config
-}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	router "region-api/router"
 	runtime "region-api/runtime"
 	structs "region-api/structs"
 	utils "region-api/utils"
@@ -163,6 +164,8 @@ func DeleteApp(db *sql.DB, params martini.Params, r render.Render) {
 		utils.ReportError(err, r)
 		return
 	}
+	router.RemoveAppDomains(db, appname, space)
+	router.RemoveAppDomainRecords(db, appname, space)
 	r.JSON(http.StatusOK, structs.Messagespec{Status: http.StatusOK, Message: appname + " removed"})
 }
 
@@ -110,6 +110,7 @@ type Bindspec struct {
 	Space    string `json:"space"`
 	Bindtype string `json:"bindtype"`
 	Bindname string `json:"bindname"`
+	Role     string `json:"role,omitempty"`
 }
 
 //Bindspec bind spec
@@ -124,6 +125,25 @@ type Bindmapspec struct {
 	Action   string `json:"action"`
 }
 
+//BindingRotation new credentials issued for a binding
+type BindingRotation struct {
+	Id       string     `json:"id"`
+	App      string     `json:"appname"`
+	Space    string     `json:"space"`
+	Bindtype string     `json:"bindtype"`
+	Bindname string     `json:"bindname"`
+	Status   string     `json:"status"`
+	Message  string     `json:"message,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+//BindingRotationSchedule how often a binding's credentials are rotated, e.g. 720h
+type BindingRotationSchedule struct {
+	Every        string     `json:"every"`
+	NextRotation *time.Time `json:"next_rotation,omitempty"`
+}
+
 //Planspec  plans spec
 type Planspec struct {
 	Size        string `json:"size"`
@@ -598,6 +618,14 @@ type KafkaTopic struct {
 	} `json:"topic"`
 }
 
+// Settings left empty are not changed, other topic configs are set through Configs.
+type KafkaTopicUpdate struct {
+	Partitions    *int              `json:"partitions,omitempty"`
+	Retentionms   *int              `json:"retention.ms,omitempty"`
+	Cleanuppolicy string            `json:"cleanup.policy,omitempty"`
+	Configs       map[string]string `json:"configs,omitempty"`
+}
+
 type KafkaAclCredentials struct {
 	AclCredentials struct {
 		Username string `json:"username"`